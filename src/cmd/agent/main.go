@@ -3,26 +3,52 @@ package main
 
 import (
     "fmt"
-    "log"
+    "log/slog"
     "os"
     "strconv"
 
     "github.com/smeetnagda/vmshare/internal/agent"
+    "github.com/smeetnagda/vmshare/internal/logging"
 )
 
+// fatal logs an error that keeps the agent from running and exits.
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
+
 func main() {
+    // QEMU runs us as `<agent> egress-pipe <sock>` to relay a guest's
+    // connection to its egress proxy
+    if len(os.Args) == 3 && os.Args[1] == "egress-pipe" {
+        if err := agent.EgressPipe(os.Args[2]); err != nil {
+            os.Exit(1)
+        }
+        return
+    }
+
     // Expect exactly two args: <agentID> <dbPath>
     if len(os.Args) != 3 {
-        log.Fatalf("Usage: %s <agentID> <dbPath>", os.Args[0])
+        fmt.Fprintf(os.Stderr, "Usage: %s <agentID> <dbPath>\n", os.Args[0])
+        os.Exit(2)
+    }
+    if _, err := logging.Setup("agent"); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
     }
     agentID, err := strconv.Atoi(os.Args[1])
     if err != nil {
-        log.Fatalf("Invalid agentID: %v", err)
+        fatal("invalid agent ID", "value", os.Args[1])
     }
     dbPath := os.Args[2]
 
-    fmt.Printf("🔧 Starting agent daemon (ID=%d) polling %s …\n", agentID, dbPath)
-    if err := agent.Run(dbPath, agentID); err != nil {
-        log.Fatalf("Agent error: %v", err)
+    cfg, err := agent.ConfigFromEnv(dbPath, agentID)
+    if err != nil {
+        fatal("invalid agent config", "err", err)
+    }
+
+    slog.Info("starting agent", "agent_id", agentID, "db", dbPath)
+    if err := agent.Run(cfg); err != nil {
+        fatal("agent stopped", "agent_id", agentID, "err", err)
     }
 }
@@ -1,56 +1,186 @@
 package main
 import (
-    "log"
+    "fmt"
+    "log/slog"
     "net/http"
     "os"
     "path"
+    "path/filepath"
+    "strconv"
+    "time"
     "github.com/gorilla/handlers"
+    "github.com/smeetnagda/vmshare/internal/expiry"
+    "github.com/smeetnagda/vmshare/internal/logging"
     "github.com/smeetnagda/vmshare/internal/server"
 )
 
+// fatal logs an error that keeps the coordinator from starting and exits.
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
+
 func main() {
+    if _, err := logging.Setup("coordinator"); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    if v := os.Getenv("MIGRATIONS_DIR"); v != "" {
+        server.MigrationsDir = v
+    }
+    dir, err := filepath.Abs(server.MigrationsDir)
+    if err != nil {
+        fatal("resolve migrations directory", "path", server.MigrationsDir, "err", err)
+    }
+    server.MigrationsDir = dir
     dbPath := "data/vmrental.db"
     db, err := server.NewDB(dbPath)
     if err != nil {
-        log.Fatalf("Failed to open database %q: %v", dbPath, err)
+        fatal("open database", "path", dbPath, "err", err)
     }
     defer db.Close()
-    log.Printf("✅ Database ready: %s", dbPath)
-    server.StartExpiredRentalCleanup(db)
+    slog.Info("database ready", "path", dbPath)
+    if v := os.Getenv("MAX_RENTAL_MINUTES"); v != "" {
+        minutes, err := strconv.Atoi(v)
+        if err != nil || minutes <= 0 {
+            fatal("invalid MAX_RENTAL_MINUTES", "value", v)
+        }
+        server.MaxRentalLifetime = time.Duration(minutes) * time.Minute
+    }
+    if v := os.Getenv("VOLUME_QUOTA_GB"); v != "" {
+        gb, err := strconv.Atoi(v)
+        if err != nil || gb < 0 {
+            fatal("invalid VOLUME_QUOTA_GB", "value", v)
+        }
+        server.VolumeQuotaGB = gb
+    }
+    server.AdminToken = os.Getenv("ADMIN_TOKEN")
+    if v, ok := os.LookupEnv("EXPIRY_WARNINGS"); ok {
+        offsets, err := expiry.ParseWarnings(v)
+        if err != nil {
+            fatal("invalid EXPIRY_WARNINGS", "err", err)
+        }
+        server.ExpiryWarnings = offsets
+    }
+    sched, err := server.StartExpiryScheduler(db)
+    if err != nil {
+        fatal("start expiry scheduler", "err", err)
+    }
+    hub, err := server.StartWatchHub(db)
+    if err != nil {
+        fatal("start watch hub", "err", err)
+    }
 
     mux := http.NewServeMux()
-    mux.HandleFunc("/rentals", server.RentalsHandler(db))
+    mux.HandleFunc("/rentals", server.RentalsHandler(db, sched))
     mux.HandleFunc("/rentals/", func(w http.ResponseWriter, r *http.Request) {
         switch {
+        case r.Method == http.MethodDelete && path.Base(path.Dir(r.URL.Path)) == "ports":
+            server.HandleDeletePortForward(db)(w, r)
+        case r.Method == http.MethodDelete:
+            server.HandleDeleteRental(db, sched)(w, r)
+        case r.Method == http.MethodPatch && path.Base(r.URL.Path) == "extend":
+            server.HandleExtendRental(db, sched)(w, r)
+        case r.Method == http.MethodPost && path.Base(r.URL.Path) == "snapshots":
+            server.HandleCreateSnapshot(db)(w, r)
+        case r.Method == http.MethodPost && path.Base(r.URL.Path) == "suspend":
+            server.HandleSuspendRental(db)(w, r)
+        case r.Method == http.MethodPost && path.Base(r.URL.Path) == "resume":
+            server.HandleResumeRental(db, sched)(w, r)
+        case r.Method == http.MethodPost && path.Base(r.URL.Path) == "migrate":
+            server.HandleMigrateRental(db, sched)(w, r)
+        case r.Method == http.MethodPost && path.Base(r.URL.Path) == "ports":
+            server.HandleCreatePortForward(db)(w, r)
+        case r.Method == http.MethodGet && path.Base(r.URL.Path) == "metrics":
+            server.HandleGetRentalMetrics(db)(w, r)
+        case r.Method == http.MethodGet && path.Base(r.URL.Path) == "events":
+            server.HandleListRentalEvents(db)(w, r)
+        case r.Method == http.MethodGet && (path.Base(r.URL.Path) == "console" || path.Base(path.Dir(r.URL.Path)) == "console"):
+            server.HandleConsole(db)(w, r)
+        case r.Method == http.MethodGet && path.Base(r.URL.Path) == "terminal":
+            server.HandleTerminal(db)(w, r)
+        case r.Method == http.MethodGet && path.Base(r.URL.Path) == "watch":
+            server.HandleWatchRental(db, hub)(w, r)
+        case r.Method == http.MethodGet && path.Base(r.URL.Path) == "ports":
+            server.HandleListPortForwards(db)(w, r)
+        default:
+            http.NotFound(w, r)
+        }
+    })
+    mux.HandleFunc("/volumes", server.VolumesHandler(db))
+    mux.HandleFunc("/volumes/", server.HandleDeleteVolume(db))
+    mux.HandleFunc("/networks", server.NetworksHandler(db))
+    mux.HandleFunc("/networks/", server.HandleDeleteNetwork(db))
+    mux.HandleFunc("/clusters", server.ClustersHandler(db, sched))
+    mux.HandleFunc("/clusters/", func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case r.Method == http.MethodGet:
+            server.HandleGetCluster(db)(w, r)
         case r.Method == http.MethodDelete:
-            server.HandleDeleteRental(db)(w, r)
+            server.HandleDeleteCluster(db, sched)(w, r)
         case r.Method == http.MethodPatch && path.Base(r.URL.Path) == "extend":
-            server.HandleExtendRental(db)(w, r)
+            server.HandleExtendCluster(db, sched)(w, r)
         default:
             http.NotFound(w, r)
         }
     })
+    mux.HandleFunc("/snapshots", server.HandleListSnapshots(db))
+    mux.HandleFunc("/migrations/", server.HandleGetMigration(db))
     mux.HandleFunc("/signup", server.HandleSignup(db))
     mux.HandleFunc("/login",  server.HandleLogin(db))
     mux.HandleFunc("/me",     server.HandleGetCurrentUser(db))
-    mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-        w.Write([]byte("OK"))
-    })
+    mux.HandleFunc("/notifications", server.HandleListNotifications(db))
+    mux.HandleFunc("/watch", server.HandleWatchUser(db, hub))
+    mux.HandleFunc("/billing", server.HandleGetBilling(db))
+    live, ready := server.HealthChecks(db, sched)
+    mux.Handle("/livez", live.Handler())
+    mux.Handle("/readyz", ready.Handler())
+    server.RegisterDBMetrics(db)
+    mux.Handle("/metrics", server.Metrics.Handler())
     mux.HandleFunc("/logout", server.LogoutHandler())
     // Configure CORS:
     corsHandler := handlers.CORS(
-        handlers.AllowedOrigins([]string{"http://localhost:3000"}),         // your React app
+        handlers.AllowedOrigins(server.AllowedOrigins),         // your React app
         handlers.AllowedMethods([]string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"}),
         handlers.AllowedHeaders([]string{"Content-Type", "Authorization","Cookie"}),
         handlers.AllowCredentials(),
-    )(mux)
+    )(server.RequestLogger(server.InstrumentHandler(mux)))
+
+    // SSH gateway and agent tunnels, each off unless its address is set
+    gatewayAddr := os.Getenv("SSH_GATEWAY_ADDR")
+    tunnelAddr := os.Getenv("AGENT_TUNNEL_ADDR")
+    if gatewayAddr != "" || tunnelAddr != "" {
+        // the tunnels present the gateway's host key too
+        hostKeyPath := os.Getenv("SSH_GATEWAY_HOST_KEY")
+        if hostKeyPath == "" {
+            hostKeyPath = "data/ssh_gateway_host_key"
+        }
+        hostKey, err := server.LoadHostKey(hostKeyPath)
+        if err != nil {
+            fatal("load SSH host key", "path", hostKeyPath, "err", err)
+        }
+        if gatewayAddr != "" {
+            go func() {
+                if err := server.ServeSSHGateway(db, gatewayAddr, hostKey); err != nil {
+                    fatal("SSH gateway", "err", err)
+                }
+            }()
+        }
+        if tunnelAddr != "" {
+            go func() {
+                if err := server.ServeAgentTunnels(db, tunnelAddr, hostKey); err != nil {
+                    fatal("agent tunnels", "err", err)
+                }
+            }()
+        }
+    }
 
     addr := os.Getenv("HTTP_ADDR")
     if addr == "" {
         addr = ":8080"
     }
-    log.Printf("🚀 Coordinator listening on %s …", addr)
+    slog.Info("coordinator listening", "addr", addr)
     if err := http.ListenAndServe(addr, corsHandler); err != nil {
-        log.Fatalf("HTTP server error: %v", err)
+        fatal("HTTP server", "err", err)
     }
 }
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// adoptVMs takes back the VMs a previous run of this agent left running, so
+// restarting the agent neither orphans them nor loses track of rentals.
+// VMs of live rentals placed here are tracked again; warm VMs and VMs the
+// database no longer wants here are stopped; running rentals whose VM is
+// gone are recorded as stopped. VMs of other agents on this host are left
+// alone.
+func adoptVMs(db *sql.DB, cfg Config, sched *expiry.Scheduler, vms *vmTable) {
+	manifests, err := system.RunningManifests()
+	if err != nil {
+		slog.Error("list running VMs", "err", err)
+	}
+	warmPrefix := fmt.Sprintf("warm-%d-", cfg.AgentID)
+	for _, manifest := range manifests {
+		vm, err := system.AdoptVM(manifest)
+		if err != nil {
+			slog.Debug("not adopting VM", "manifest", manifest, "err", err)
+			continue
+		}
+		if strings.HasPrefix(vm.Name, warmPrefix) {
+			slog.Info("stopping warm VM left by a previous run", "vm", vm.Name)
+			vm.Stop(cfg.ShutdownGrace)
+			os.RemoveAll(filepath.Dir(manifest))
+			continue
+		}
+
+		var state string
+		var agentID int
+		var expiresAt time.Time
+		var egressPolicy, egressAllow, egressEffective sql.NullString
+		err = db.QueryRow(
+			`SELECT state, agent_id, expires_at, egress_policy, egress_allow, egress_effective
+			   FROM rentals WHERE vm_name = ?`,
+			vm.Name,
+		).Scan(&state, &agentID, &expiresAt, &egressPolicy, &egressAllow, &egressEffective)
+		if err != nil || agentID != cfg.AgentID {
+			// another agent's, or not a rental at all
+			continue
+		}
+		switch state {
+		case "running", "stopping", "suspending", "migrating":
+			// the sync loop carries on with whatever was in progress
+			trackVM(db, cfg, sched, vms, vm, expiresAt)
+			rule := bootedEgress(cfg, egressPolicy, egressAllow, egressEffective)
+			if err := startEgressProxy(vm, rule); err != nil {
+				slog.Error("start egress proxy", "vm", vm.Name, "err", err)
+			}
+			if egressEffective.String == system.EgressOpen && rule.Policy != system.EgressOpen {
+				// an unrestricted NIC cannot be filtered without a reboot
+				slog.Warn("VM keeps open egress until it restarts", "vm", vm.Name, "policy", rule.Policy)
+			}
+			slog.Info("adopted VM", "vm", vm.Name, "state", state)
+			recordEvent(db, vm.Name, "adopted", "VM taken back after an agent restart", "")
+		default:
+			// e.g. still pending, which the creation loop boots afresh
+			slog.Info("stopping VM left by a previous run", "vm", vm.Name, "state", state)
+			vm.Stop(cfg.ShutdownGrace)
+		}
+	}
+
+	rows, err := db.Query(`SELECT vm_name FROM rentals WHERE agent_id = ? AND state = 'running'`, cfg.AgentID)
+	if err != nil {
+		slog.Error("query running rentals", "err", err)
+		return
+	}
+	var lost []string
+	for rows.Next() {
+		var vmName string
+		if rows.Scan(&vmName) == nil && vms.get(vmName) == nil {
+			lost = append(lost, vmName)
+		}
+	}
+	rows.Close()
+	for _, vmName := range lost {
+		slog.Warn("VM gone after agent restart", "vm", vmName)
+		recordStopped(db, vmName, "lost", "")
+		recordEvent(db, vmName, "stopped", "VM was no longer running when the agent restarted", "")
+	}
+}
@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// Config holds the host-side settings for one agent daemon.
+type Config struct {
+	DBPath  string
+	AgentID int
+
+	// Capacity is how many VMs this host is willing to run at once.
+	Capacity int
+	// MaxLifetime caps how long any rental on this host may live, counted
+	// from creation; extensions beyond it are clamped. Zero means no cap.
+	MaxLifetime time.Duration
+	// WarnBefore lists the offsets before expiry at which renters are
+	// warned inside the guest.
+	WarnBefore []time.Duration
+	// ShutdownGrace is how long a guest gets to halt after an ACPI
+	// power-off before QEMU is signalled.
+	ShutdownGrace time.Duration
+	// WarmPool lists how many idle, pre-booted VMs to keep per image/flavor.
+	WarmPool []PoolSpec
+	// VolumeDir holds the qcow2 files of persistent volumes stored here.
+	VolumeDir string
+	// VolumeQuotaGB is how much volume storage this host offers.
+	VolumeQuotaGB int
+	// SnapshotDir holds the rental snapshots taken on this host.
+	SnapshotDir string
+	// SuspendDir holds the saved state of suspended VMs. It is per agent so
+	// that two agents on one machine can migrate between each other.
+	SuspendDir string
+	// Listen is the address the agent-to-agent HTTP protocol is served on,
+	// and AdvertiseAddr the one other agents are told to use. The protocol
+	// is plain HTTP: its bearer tokens (cfg.Token, migration tokens) and VM
+	// state cross the wire unencrypted, so a non-loopback Listen belongs on
+	// a private network; agents elsewhere should use the coordinator tunnel.
+	Listen        string
+	AdvertiseAddr string
+	// NetworkAddr is the local address private networks send their
+	// multicast from. On loopback they stay on this host; agents sharing
+	// a LAN address range can host networks that span them.
+	NetworkAddr string
+	// EgressPolicy is the least strict egress policy (see system.Egress*)
+	// renter VMs on this host get; EgressAllow is its allow-list when that
+	// policy is allowlist.
+	EgressPolicy string
+	EgressAllow  []string
+	// NetRateMbit caps each VM's average network throughput and NetQuotaGB
+	// its total transfer over the rental. Zero means no limit.
+	NetRateMbit int
+	NetQuotaGB  int
+	// Metrics serves Prometheus metrics on the Listen address.
+	Metrics bool
+	// Token is what the coordinator must present to use this agent's VM
+	// endpoints (see agentHandler). A fresh one is published with each
+	// start.
+	Token string
+	// TunnelAddr is the coordinator's agent tunnel server. When set, the
+	// agent keeps a tunnel open to it so the coordinator can reach this
+	// host's HTTP API from behind NAT; DBPath must still be the
+	// coordinator's database. TunnelHostKey pins the server's host key,
+	// and the agent logs in with TunnelKey, a fresh key whose public half
+	// is published with each start like Token.
+	TunnelAddr    string
+	TunnelHostKey ssh.PublicKey
+	TunnelKey     ssh.Signer
+}
+
+// PoolSpec is the target size of one warm pool.
+type PoolSpec struct {
+	Image  string
+	Flavor string
+	Size   int
+}
+
+// parseWarmPool parses "image/flavor=N,flavor=N,..." (image defaults to
+// system.DefaultImage).
+func parseWarmPool(s string) ([]PoolSpec, error) {
+	var specs []PoolSpec
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		key, size, ok := strings.Cut(f, "=")
+		n, err := strconv.Atoi(size)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid pool entry %q", f)
+		}
+		spec := PoolSpec{Image: system.DefaultImage, Flavor: key, Size: n}
+		if image, flavor, ok := strings.Cut(key, "/"); ok {
+			spec.Image, spec.Flavor = image, flavor
+		}
+		if !system.ValidImageName(spec.Image) {
+			return nil, fmt.Errorf("invalid image in pool entry %q", f)
+		}
+		if _, err := system.LookupFlavor(spec.Flavor); err != nil {
+			return nil, fmt.Errorf("pool entry %q: %v", f, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// ConfigFromEnv builds a Config for agentID/dbPath, reading host settings
+// from VMSHARE_* environment variables.
+func ConfigFromEnv(dbPath string, agentID int) (Config, error) {
+	cfg := Config{
+		DBPath:     dbPath,
+		AgentID:    agentID,
+		Capacity:   2,
+		WarnBefore: expiry.DefaultWarnings,
+
+		ShutdownGrace: system.DefaultShutdownGrace,
+		VolumeDir:     filepath.Join(os.Getenv("HOME"), ".vmshare", "volumes"),
+		VolumeQuotaGB: 20,
+		SnapshotDir:   filepath.Join(os.Getenv("HOME"), ".vmshare", "snapshots"),
+		SuspendDir:    filepath.Join(os.Getenv("HOME"), ".vmshare", "suspended", strconv.Itoa(agentID)),
+		Listen:        fmt.Sprintf("127.0.0.1:%d", 7100+agentID),
+		NetworkAddr:   "127.0.0.1",
+		EgressPolicy:  system.EgressOpen,
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return cfg, fmt.Errorf("generate agent token: %v", err)
+	}
+	cfg.Token = hex.EncodeToString(token)
+	if v := os.Getenv("VMSHARE_CAPACITY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid VMSHARE_CAPACITY %q", v)
+		}
+		cfg.Capacity = n
+	}
+	if v := os.Getenv("VMSHARE_MAX_LIFETIME_MINUTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid VMSHARE_MAX_LIFETIME_MINUTES %q", v)
+		}
+		cfg.MaxLifetime = time.Duration(n) * time.Minute
+	}
+	if v, ok := os.LookupEnv("VMSHARE_WARN_BEFORE"); ok {
+		offsets, err := expiry.ParseWarnings(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid VMSHARE_WARN_BEFORE: %v", err)
+		}
+		cfg.WarnBefore = offsets
+	}
+	if v := os.Getenv("VMSHARE_SHUTDOWN_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("invalid VMSHARE_SHUTDOWN_GRACE %q", v)
+		}
+		cfg.ShutdownGrace = d
+	}
+	if v := os.Getenv("VMSHARE_WARM_POOL"); v != "" {
+		specs, err := parseWarmPool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid VMSHARE_WARM_POOL: %v", err)
+		}
+		cfg.WarmPool = specs
+	}
+	if v := os.Getenv("VMSHARE_VOLUME_DIR"); v != "" {
+		cfg.VolumeDir = v
+	}
+	if v := os.Getenv("VMSHARE_VOLUME_QUOTA_GB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid VMSHARE_VOLUME_QUOTA_GB %q", v)
+		}
+		cfg.VolumeQuotaGB = n
+	}
+	if v := os.Getenv("VMSHARE_SNAPSHOT_DIR"); v != "" {
+		cfg.SnapshotDir = v
+	}
+	if v := os.Getenv("VMSHARE_SUSPEND_DIR"); v != "" {
+		cfg.SuspendDir = v
+	}
+	if v := os.Getenv("VMSHARE_LISTEN"); v != "" {
+		cfg.Listen = v
+	}
+	cfg.AdvertiseAddr = cfg.Listen
+	if v := os.Getenv("VMSHARE_ADVERTISE_ADDR"); v != "" {
+		cfg.AdvertiseAddr = v
+	}
+	if v := os.Getenv("VMSHARE_NETWORK_ADDR"); v != "" {
+		if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+			return cfg, fmt.Errorf("invalid VMSHARE_NETWORK_ADDR %q", v)
+		}
+		cfg.NetworkAddr = v
+	}
+	if v := os.Getenv("VMSHARE_EGRESS_POLICY"); v != "" {
+		if !system.ValidEgressPolicy(v) {
+			return cfg, fmt.Errorf("invalid VMSHARE_EGRESS_POLICY %q", v)
+		}
+		cfg.EgressPolicy = v
+	}
+	if v := os.Getenv("VMSHARE_EGRESS_ALLOW"); v != "" {
+		list, err := parseEgressAllow(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid VMSHARE_EGRESS_ALLOW: %v", err)
+		}
+		cfg.EgressAllow = list
+	}
+	if v := os.Getenv("VMSHARE_NET_RATE_MBIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid VMSHARE_NET_RATE_MBIT %q", v)
+		}
+		cfg.NetRateMbit = n
+	}
+	if v := os.Getenv("VMSHARE_NET_QUOTA_GB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid VMSHARE_NET_QUOTA_GB %q", v)
+		}
+		cfg.NetQuotaGB = n
+	}
+	if v := os.Getenv("VMSHARE_TUNNEL"); v != "" {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			return cfg, fmt.Errorf("invalid VMSHARE_TUNNEL %q", v)
+		}
+		cfg.TunnelAddr = v
+	}
+	if v := os.Getenv("VMSHARE_TUNNEL_HOST_KEY"); v != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(v))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid VMSHARE_TUNNEL_HOST_KEY: %v", err)
+		}
+		cfg.TunnelHostKey = key
+	}
+	if cfg.TunnelAddr != "" {
+		if cfg.TunnelHostKey == nil {
+			return cfg, fmt.Errorf("VMSHARE_TUNNEL needs VMSHARE_TUNNEL_HOST_KEY")
+		}
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return cfg, fmt.Errorf("generate tunnel key: %v", err)
+		}
+		if cfg.TunnelKey, err = ssh.NewSignerFromKey(priv); err != nil {
+			return cfg, fmt.Errorf("generate tunnel key: %v", err)
+		}
+	}
+	if v := os.Getenv("VMSHARE_METRICS"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid VMSHARE_METRICS %q", v)
+		}
+		cfg.Metrics = on
+	}
+	return cfg, nil
+}
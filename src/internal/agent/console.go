@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/smeetnagda/vmshare/internal/websocket"
+)
+
+// consoles tracks which VMs have an interactive console open; QEMU serves
+// one console client at a time.
+var consoles sync.Map
+
+// handleConsole serves a running VM's serial console to the coordinator:
+// GET /vms/{vmName}/console/log returns the output captured since boot
+// (Range requests work, for tailing), and GET /vms/{vmName}/console
+// upgrades to a WebSocket carrying the console both ways.
+func handleConsole(cfg Config, vms *vmTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(cfg, r) {
+			http.Error(w, "bad token", http.StatusForbidden)
+			return
+		}
+		// expect path like "/vms/{vmName}/console[/log]"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 4 || len(parts) > 5 || parts[3] != "console" || (len(parts) == 5 && parts[4] != "log") {
+			http.NotFound(w, r)
+			return
+		}
+		vm := vms.get(parts[2])
+		if vm == nil {
+			http.Error(w, "VM is not running on this agent", http.StatusNotFound)
+			return
+		}
+
+		if len(parts) == 5 {
+			f, err := os.Open(vm.ConsoleLog())
+			if err != nil {
+				http.Error(w, "no console output yet", http.StatusNotFound)
+				return
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.ServeContent(w, r, "", fi.ModTime(), f)
+			return
+		}
+
+		if _, busy := consoles.LoadOrStore(vm.Name, true); busy {
+			http.Error(w, "console is already open", http.StatusConflict)
+			return
+		}
+		defer consoles.Delete(vm.Name)
+		serial, err := vm.DialConsole()
+		if err != nil {
+			slog.Error("open console", "vm", vm.Name, "err", err)
+			http.Error(w, "console unavailable", http.StatusBadGateway)
+			return
+		}
+		defer serial.Close()
+		ws, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		slog.Info("console opened", "vm", vm.Name)
+
+		// guest output to the client, until the VM or the client goes away
+		go func() {
+			io.Copy(ws.Writer(websocket.BinaryMessage), serial)
+			ws.Close()
+		}()
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				break
+			}
+			if _, err := serial.Write(msg); err != nil {
+				break
+			}
+		}
+		slog.Info("console closed", "vm", vm.Name)
+	}
+}
+
+// authorized reports whether r carries this agent's token.
+func authorized(cfg Config, r *http.Request) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return cfg.Token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(cfg.Token)) == 1
+}
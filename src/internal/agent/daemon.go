@@ -3,107 +3,507 @@ package agent
 import (
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/smeetnagda/vmshare/internal/expiry"
 	"github.com/smeetnagda/vmshare/internal/system"
 )
 
+// syncInterval is how often the agent checks for extensions and deletions
+// of the VMs it runs. It is deliberately much shorter than the creation poll
+// so an extension made just before expiry still lands in time.
+const syncInterval = 2 * time.Second
+
 // Run starts the agent daemon loop, polling rentals and managing VMs.
-func Run(dbPath string, agentID int) error {
+func Run(cfg Config) error {
+	agentID := cfg.AgentID
+	// everything this daemon logs is about one agent
+	slog.SetDefault(slog.Default().With("agent_id", agentID))
+
 	// open in WAL mode so our long-running agent can update safely
 	db, err := sql.Open(
 		"sqlite3",
-		fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", dbPath),
+		fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", cfg.DBPath),
 	)
 	if err != nil {
 		return fmt.Errorf("open db: %w", err)
 	}
 	defer db.Close()
 
+	// every VM we launch gets a kill deadline in here; the sync loop keeps
+	// those deadlines in step with the rentals table
+	sched := expiry.New()
+	sched.Start()
+	vms := newVMTable()
+	failInterruptedSnapshots(db, cfg)
+	adoptVMs(db, cfg, sched, vms)
+	if cfg.Metrics {
+		registerHostMetrics(vms)
+	}
+	handler := agentHandler(db, cfg, vms)
+	go serveAgentHTTP(cfg, handler)
+	if cfg.TunnelAddr != "" {
+		go coordinator.run(cfg, handler)
+	}
+	go syncLoop(db, cfg, sched, vms)
+	go meterLoop(db, cfg, vms)
+	go metricsLoop(db, vms)
+	pool := newWarmPool(cfg, vms)
+	go pool.run()
+
 	for {
+		creationBeat.Beat()
 		now := time.Now()
 
-		// ─── Creation pass: launch any rental that has no IP yet ───
+		if err := heartbeat(db, cfg, now); err != nil {
+			slog.Error("agent heartbeat", "err", err)
+		}
+
+		// ─── Creation pass: launch any rental still pending ───
 		rows, err := db.Query(`
-			SELECT vm_name, ssh_key, expires_at
+			SELECT vm_name, ssh_key, image, flavor, from_snapshot, hostname, cluster_id,
+			       egress_policy, egress_allow, expires_at
 			FROM rentals
-			WHERE ip_address IS NULL
+			WHERE state = 'pending'
+			  AND agent_id IN (0, ?)
 			  AND expires_at > ?`,
-			now,
+			agentID, now,
 		)
 		if err != nil {
-			fmt.Printf("query pending rentals: %v\n", err)
+			slog.Error("query pending rentals", "err", err)
 		} else {
+			// read them all first; sqlite does not like writes under an
+			// open cursor
+			type pendingRental struct {
+				spec      system.VMSpec
+				clusterID sql.NullInt64
+				egress    egressRule
+				expiresAt time.Time
+			}
+			var pending []pendingRental
 			for rows.Next() {
-				var vmName, sshKey string
-				var expiresAt time.Time
-				if err := rows.Scan(&vmName, &sshKey, &expiresAt); err != nil {
-                    fmt.Printf("scan row error: %v\n", err)
+				var p pendingRental
+				var fromSnapshot sql.NullInt64
+				var hostname, egressPolicy, egressAllow sql.NullString
+				if err := rows.Scan(&p.spec.Name, &p.spec.SSHKey, &p.spec.Image, &p.spec.Flavor, &fromSnapshot, &hostname, &p.clusterID,
+					&egressPolicy, &egressAllow, &p.expiresAt); err != nil {
+                    slog.Error("scan pending rental", "err", err)
                     continue
                 }
-            
+				if fromSnapshot.Valid {
+					p.spec.Snapshot = system.SnapshotPath(cfg.SnapshotDir, fromSnapshot.Int64)
+				}
+				p.spec.Hostname = hostname.String
+				p.egress = effectiveEgress(cfg, egressPolicy, egressAllow)
+				p.spec.Egress = egressSpec(p.egress)
+				pending = append(pending, p)
+			}
+			rows.Close()
 
-				duration := time.Until(expiresAt)
-				hostPort, err := system.StartVM(vmName, sshKey, duration)
+			for _, p := range pending {
+				creationBeat.Beat()
+				spec, vmName, expiresAt := p.spec, p.spec.Name, p.expiresAt
+				if vms.get(vmName) != nil {
+					continue
+				}
+				if !pool.hasRoom() {
+					// full; leave it for another agent or a later pass
+					continue
+				}
+				// claim it so no other agent boots the same rental
+				res, err := db.Exec(
+					`UPDATE rentals SET agent_id = ?
+					 WHERE vm_name = ? AND state = 'pending' AND agent_id IN (0, ?)`,
+					agentID, vmName, agentID,
+				)
+				if err != nil {
+					slog.Error("claim rental", "vm", vmName, "err", err)
+					continue
+				}
+				if n, _ := res.RowsAffected(); n == 0 {
+					continue
+				}
+				recordEvent(db, vmName, "scheduled", fmt.Sprintf("scheduled to agent %d", agentID), "")
+
+				// hold its slot while it boots so the warm pool does not take it
+				if !vms.claim(vmName) {
+					continue
+				}
+				spec.Volumes, err = attachedVolumes(db, cfg, vmName)
+				if err != nil {
+					slog.Error("load volumes", "vm", vmName, "err", err)
+					vms.release(vmName)
+					continue
+				}
+				spec.Networks, err = attachedNetworks(db, cfg, vmName)
+				if err != nil {
+					slog.Error("load networks", "vm", vmName, "err", err)
+					vms.release(vmName)
+					continue
+				}
+				if p.clusterID.Valid {
+					spec.Hosts, err = clusterHosts(db, p.clusterID.Int64)
+					if err != nil {
+						slog.Error("load cluster hosts", "vm", vmName, "err", err)
+						vms.release(vmName)
+						continue
+					}
+				}
+				spec.Progress = func(stage string) {
+					recordEvent(db, vmName, stage, bootStages[stage], "")
+				}
+				vm, warm, err := launchVM(pool, spec)
                 if err != nil {
-					fmt.Printf("startVM %s error: %v\n", vmName, err)
+					slog.Error("start VM", "vm", vmName, "err", err)
+					startFailures.Inc()
+					recordEvent(db, vmName, "error", "start VM: "+err.Error(), "")
+					vms.release(vmName)
 					continue
 				}
-				// we always forward guest:22 → localhost:2222
-				addr := fmt.Sprintf("127.0.0.1:%d", hostPort)
+				if warm {
+					recordEvent(db, vmName, "warm_handover", "handed a pre-booted VM from the warm pool", "")
+				}
+				trackVM(db, cfg, sched, vms, vm, expiresAt)
+				vms.release(vmName)
+				if err := startEgressProxy(vm, p.egress); err != nil {
+					slog.Error("start egress proxy", "vm", vmName, "err", err)
+				}
+
+				// we always forward guest:22 → localhost:<hostPort>
+				addr := fmt.Sprintf("127.0.0.1:%d", vm.HostPort)
 
 				// wait for SSH socket to become ready
+				sshReady := false
 				for i := 0; i < 15; i++ {
 					conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
 					if err == nil {
 						conn.Close()
+						sshReady = true
 						break
 					}
 					time.Sleep(2 * time.Second)
 				}
-
-				// persist that endpoint into the DB
-				if _, err := db.Exec(
-					`UPDATE rentals SET ip_address = ?, agent_id = ? WHERE vm_name = ?`,
-					addr, agentID, vmName,
-				); err != nil {
-					fmt.Printf("update rental %s error: %v\n", vmName, err)
+				if sshReady {
+					recordEvent(db, vmName, "ssh_ready", "SSH reachable at "+addr, "")
 				} else {
-					fmt.Printf("✅ VM %q ready; SSH at: ssh -p %d ubuntu@127.0.0.1\n", vmName, hostPort)
+					recordEvent(db, vmName, "error", "SSH not reachable at "+addr+" after 60s", vm.StderrTail())
 				}
-			}
-			rows.Close()
-		}
 
-		// ─── Deletion pass: remove any expired rows ───
-		// (the QEMU process itself already self-kills after duration)
-		rows2, err2 := db.Query(`
-			SELECT vm_name
-			FROM rentals
-			WHERE expires_at <= ?`,
-			now,
-		)
-		if err2 != nil {
-			fmt.Printf("query expired rentals: %v\n", err2)
-		} else {
-			for rows2.Next() {
-				var vmName string
-				rows2.Scan(&vmName)
-
-				// just delete the database record
-				if _, err := db.Exec(
-					`DELETE FROM rentals WHERE vm_name = ?`, vmName,
-				); err != nil {
-					fmt.Printf("delete rental %s error: %v\n", vmName, err)
+				// persist that endpoint into the DB, unless the rental was
+				// cancelled while we were booting
+				res, err = db.Exec(
+					`UPDATE rentals SET ip_address = ?, agent_id = ?, state = 'running', egress_effective = ?,
+					                   started_at = ?
+					 WHERE vm_name = ? AND state = 'pending'`,
+					addr, agentID, p.egress.Policy, time.Now(), vmName,
+				)
+				if err != nil {
+					slog.Error("update rental", "vm", vmName, "err", err)
+				} else if n, _ := res.RowsAffected(); n == 0 {
+					go stopVM(db, cfg, vms, vmName, "cancelled while booting")
 				} else {
-					fmt.Printf("🗑️ Cleaned up rental %q\n", vmName)
+					slog.Info("VM ready", "vm", vmName, "ssh_port", vm.HostPort)
+					recordEvent(db, vmName, "running", "running; SSH at "+addr, "")
 				}
 			}
-			rows2.Close()
 		}
 
 		time.Sleep(10 * time.Second)
 	}
 }
+
+// bootStages are the timeline messages for the stages system.StartVM
+// reports through VMSpec.Progress.
+var bootStages = map[string]string{
+	"seed_built":   "cloud-init seed built",
+	"qemu_started": "QEMU started",
+}
+
+// heartbeat registers this agent (or refreshes its row) so the coordinator
+// knows it is alive and which host limits apply to its rentals.
+func heartbeat(db *sql.DB, cfg Config, now time.Time) error {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "agent"
+	}
+	_, err = db.Exec(
+		`INSERT INTO agents (id, name, last_seen, capacity, max_lifetime_minutes, volume_quota_gb, address, network_addr, egress_policy, token, tunnel_key)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(id) DO UPDATE SET
+		   last_seen = excluded.last_seen,
+		   capacity = excluded.capacity,
+		   max_lifetime_minutes = excluded.max_lifetime_minutes,
+		   volume_quota_gb = excluded.volume_quota_gb,
+		   address = excluded.address,
+		   network_addr = excluded.network_addr,
+		   egress_policy = excluded.egress_policy,
+		   token = excluded.token,
+		   tunnel_key = excluded.tunnel_key`,
+		cfg.AgentID, fmt.Sprintf("%s-%d", name, cfg.AgentID), now,
+		cfg.Capacity, int(cfg.MaxLifetime/time.Minute), cfg.VolumeQuotaGB, cfg.AdvertiseAddr, cfg.NetworkAddr, cfg.EgressPolicy, cfg.Token, tunnelPublicKey(cfg),
+	)
+	return err
+}
+
+// syncLoop follows extensions and stop requests for the VMs we run. Expiry
+// itself is handled by sched; the coordinator marks deleted (and expired)
+// rentals as stopping.
+func syncLoop(db *sql.DB, cfg Config, sched *expiry.Scheduler, vms *vmTable) {
+	ports := loadPorts(db, cfg, vms)
+	for {
+		syncBeat.Beat()
+		applyExtensions(db, cfg, sched, vms)
+		syncVolumes(db, cfg)
+		syncSnapshots(db, cfg, vms)
+		syncSuspended(db, cfg, sched, vms)
+		syncPorts(db, cfg, vms, ports)
+
+		for _, vmName := range vms.names() {
+			var state string
+			var reason sql.NullString
+			err := db.QueryRow(
+				`SELECT state, stop_reason FROM rentals WHERE vm_name = ?`, vmName,
+			).Scan(&state, &reason)
+			switch {
+			case err == sql.ErrNoRows:
+				reason.String = "rental removed"
+			case err != nil:
+				slog.Error("query rental", "vm", vmName, "err", err)
+				continue
+			case state == "pending" || state == "running":
+				continue
+			case state == "suspending":
+				go suspendVM(db, cfg, vms, vmName)
+				continue
+			case state == "migrating":
+				go migrateOut(db, cfg, vms, vmName)
+				continue
+			}
+			sched.Cancel(vmName)
+			sched.CancelWarnings(vmName, cfg.WarnBefore)
+			go stopVM(db, cfg, vms, vmName, reason.String)
+		}
+
+		time.Sleep(syncInterval)
+	}
+}
+
+// applyExtensions moves the kill deadline of each of our VMs that has a new
+// rental_extensions row and marks those rows applied.
+func applyExtensions(db *sql.DB, cfg Config, sched *expiry.Scheduler, vms *vmTable) {
+	rows, err := db.Query(`
+		SELECT e.id, e.vm_name, e.expires_at
+		FROM rental_extensions e
+		JOIN rentals r ON r.vm_name = e.vm_name
+		WHERE e.applied_at IS NULL
+		  AND r.agent_id = ?
+		ORDER BY e.id`,
+		cfg.AgentID,
+	)
+	if err != nil {
+		slog.Error("query extensions", "err", err)
+		return
+	}
+	type ext struct {
+		id        int64
+		vmName    string
+		expiresAt time.Time
+	}
+	var pending []ext
+	for rows.Next() {
+		var e ext
+		if err := rows.Scan(&e.id, &e.vmName, &e.expiresAt); err != nil {
+			slog.Error("scan extension", "err", err)
+			continue
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+
+	for _, e := range pending {
+		if vm := vms.get(e.vmName); vm != nil {
+			sched.Reschedule(e.vmName, e.expiresAt)
+			scheduleWarnings(db, cfg, sched, vm, e.expiresAt)
+			slog.Info("VM extended", "vm", e.vmName, "expires_at", e.expiresAt)
+		}
+		if _, err := db.Exec(
+			`UPDATE rental_extensions SET applied_at = ? WHERE id = ?`,
+			time.Now(), e.id,
+		); err != nil {
+			slog.Error("mark extension applied", "vm", e.vmName, "extension_id", e.id, "err", err)
+		}
+	}
+}
+
+// trackVM registers a running VM: it is stopped at expiresAt, its renter is
+// warned beforehand, and an unrequested exit is recorded as a guest shutdown.
+func trackVM(db *sql.DB, cfg Config, sched *expiry.Scheduler, vms *vmTable, vm *system.VM, expiresAt time.Time) {
+	vmName := vm.Name
+	vms.add(vm)
+	sched.Schedule(vmName, expiresAt, func() { stopVM(db, cfg, vms, vmName, "expired") })
+	scheduleWarnings(db, cfg, sched, vm, expiresAt)
+	go func() {
+		<-vm.Done()
+		sched.Cancel(vmName)
+		sched.CancelWarnings(vmName, cfg.WarnBefore)
+		if !vms.remove(vmName) {
+			// nobody asked for this; the guest powered itself off (or
+			// QEMU died, in which case its stderr says why)
+			recordStopped(db, vmName, "guest_shutdown", "")
+			recordEvent(db, vmName, "stopped", "QEMU exited without a stop request", vm.StderrTail())
+		}
+	}()
+}
+
+// scheduleWarnings (re)arms the in-guest expiry notices for vm.
+func scheduleWarnings(db *sql.DB, cfg Config, sched *expiry.Scheduler, vm *system.VM, expiresAt time.Time) {
+	sched.ScheduleWarnings(vm.Name, expiresAt, cfg.WarnBefore, func(time.Duration) {
+		at, ok := sched.Deadline(vm.Name)
+		if !ok {
+			return
+		}
+		msg := fmt.Sprintf("*** VMShare: this VM expires in %s (at %s). Extend the rental or save your work now. ***",
+			expiry.FormatOffset(time.Until(at)), at.UTC().Format(time.RFC1123))
+		if err := vm.Broadcast(msg); err != nil {
+			slog.Error("warn VM", "vm", vm.Name, "err", err)
+			return
+		}
+		slog.Info("VM warned of expiry", "vm", vm.Name, "expires_at", at)
+		recordEvent(db, vm.Name, "guest_warned", "expiry notice broadcast in the guest", "")
+	})
+}
+
+// stopVM runs the graceful stop sequence on a VM we own and records on the
+// rental which stage ended it. Concurrent calls for the same VM are no-ops.
+func stopVM(db *sql.DB, cfg Config, vms *vmTable, vmName, reason string) {
+	vm := vms.beginStop(vmName)
+	if vm == nil {
+		return
+	}
+	slog.Info("stopping VM", "vm", vmName, "reason", reason)
+	stage, err := vm.Stop(cfg.ShutdownGrace)
+	if err != nil {
+		slog.Error("stop VM", "vm", vmName, "err", err)
+		recordEvent(db, vmName, "error", "stop VM: "+err.Error(), vm.StderrTail())
+	}
+	slog.Info("VM stopped", "vm", vmName, "stage", stage)
+	recordStopped(db, vmName, reason, stage)
+	recordEvent(db, vmName, "stopped", fmt.Sprintf("stopped (%s) at stage %s", reason, stage), "")
+}
+
+// recordStopped marks the rental stopped, keeping any stop_reason the
+// coordinator already set, and releases its volumes.
+func recordStopped(db *sql.DB, vmName, reason, stage string) {
+	if _, err := db.Exec(
+		`UPDATE rentals
+		    SET state = 'stopped',
+		        stop_reason = COALESCE(stop_reason, ?),
+		        stop_stage = NULLIF(?, ''),
+		        stopped_at = ?
+		  WHERE vm_name = ?`,
+		reason, stage, time.Now(), vmName,
+	); err != nil {
+		slog.Error("record stop", "vm", vmName, "err", err)
+	}
+	detachVolumes(db, vmName)
+	closePortForwards(db, vmName)
+}
+
+// vmTable tracks the VMs this agent has running, keyed by rental VM name.
+type vmTable struct {
+	mu       sync.Mutex
+	vms      map[string]*system.VM
+	stopping map[string]bool
+	claimed  map[string]bool
+}
+
+func newVMTable() *vmTable {
+	return &vmTable{
+		vms:      make(map[string]*system.VM),
+		stopping: make(map[string]bool),
+		claimed:  make(map[string]bool),
+	}
+}
+
+func (t *vmTable) add(vm *system.VM) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.vms[vm.Name] = vm
+}
+
+func (t *vmTable) get(vmName string) *system.VM {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.vms[vmName]
+}
+
+// beginStop claims the right to stop vmName. It returns nil if the VM is
+// unknown or another goroutine is already stopping it.
+func (t *vmTable) beginStop(vmName string) *system.VM {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	vm := t.vms[vmName]
+	if vm == nil || t.stopping[vmName] {
+		return nil
+	}
+	t.stopping[vmName] = true
+	return vm
+}
+
+// endStop gives up a beginStop claim on a VM that keeps running.
+func (t *vmTable) endStop(vmName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.stopping, vmName)
+}
+
+// claim marks vmName as being worked on outside the table (e.g. while it is
+// restored) and reports whether nobody else had claimed it.
+func (t *vmTable) claim(vmName string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.vms[vmName] != nil || t.claimed[vmName] {
+		return false
+	}
+	t.claimed[vmName] = true
+	return true
+}
+
+func (t *vmTable) release(vmName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.claimed, vmName)
+}
+
+// remove forgets vmName and reports whether it was being stopped on purpose.
+func (t *vmTable) remove(vmName string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stopping := t.stopping[vmName]
+	delete(t.vms, vmName)
+	delete(t.stopping, vmName)
+	return stopping
+}
+
+// count returns how many VMs are running or being restored, which is what
+// counts against the host's capacity.
+func (t *vmTable) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.vms) + len(t.claimed)
+}
+
+func (t *vmTable) names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.vms))
+	for name := range t.vms {
+		names = append(names, name)
+	}
+	return names
+}
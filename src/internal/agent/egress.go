@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// egressRule is what a VM may reach: its effective policy plus what the
+// proxy checks for filtered policies.
+type egressRule struct {
+	Policy string
+	// every list must permit a destination (the host's and the rental's)
+	allow [][]string
+	// denyPrivate blocks RFC1918, loopback, link-local and this host
+	denyPrivate bool
+}
+
+// effectiveEgress combines the host's egress policy with what the renter
+// asked for; the stricter one wins, and allow-lists from both apply.
+func effectiveEgress(cfg Config, policy, allow sql.NullString) egressRule {
+	rule := egressRule{Policy: system.StricterEgress(policy.String, cfg.EgressPolicy)}
+	if cfg.EgressPolicy == system.EgressAllowlist {
+		rule.allow = append(rule.allow, cfg.EgressAllow)
+	}
+	if policy.String == system.EgressAllowlist {
+		var list []string
+		if allow.String != "" {
+			list = strings.Split(allow.String, ",")
+		}
+		rule.allow = append(rule.allow, list)
+	}
+	rule.denyPrivate = cfg.EgressPolicy == system.EgressDenyPrivate || policy.String == system.EgressDenyPrivate
+	return rule
+}
+
+// atLeast tightens rule to be no looser than policy. An allowlist with no
+// list of its own permits nothing.
+func (rule egressRule) atLeast(policy string) egressRule {
+	switch policy {
+	case system.EgressDenyPrivate:
+		rule.denyPrivate = true
+	case system.EgressAllowlist:
+		if len(rule.allow) == 0 {
+			rule.allow = [][]string{nil}
+		}
+	}
+	rule.Policy = system.StricterEgress(rule.Policy, policy)
+	return rule
+}
+
+// bootedEgress is the rule for a running VM whose NIC was set up under
+// policy booted (rentals.egress_effective). The NIC keeps that policy until
+// the VM restarts, so it stays the floor even if this host's is looser now.
+func bootedEgress(cfg Config, policy, allow, booted sql.NullString) egressRule {
+	return effectiveEgress(cfg, policy, allow).atLeast(booted.String)
+}
+
+// egressSpec is how StartVM should set up a VM under rule.
+func egressSpec(rule egressRule) system.Egress {
+	e := system.Egress{Policy: rule.Policy}
+	if system.EgressProxied(rule.Policy) {
+		exe, err := os.Executable()
+		if err != nil {
+			exe = os.Args[0]
+		}
+		e.Pipe = []string{exe, "egress-pipe"}
+	}
+	return e
+}
+
+// startEgressProxy serves vm's egress proxy on its egress socket until the
+// VM exits. QEMU connects a fresh `egress-pipe` to it for every connection
+// the guest makes to the proxy address.
+func startEgressProxy(vm *system.VM, rule egressRule) error {
+	if !system.EgressProxied(rule.Policy) {
+		return nil
+	}
+	sock := vm.EgressSocket()
+	os.Remove(sock)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return fmt.Errorf("egress proxy: %v", err)
+	}
+	go func() {
+		<-vm.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveEgress(conn, vm.Name, rule)
+		}
+	}()
+	return nil
+}
+
+// serveEgress handles one proxied connection: a CONNECT tunnel or a single
+// plain HTTP request.
+func serveEgress(conn net.Conn, vmName string, rule egressRule) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if req.Method == http.MethodConnect {
+		host, port, err = net.SplitHostPort(req.Host)
+		if err != nil {
+			fmt.Fprintf(conn, "HTTP/1.1 400 Bad Request\r\n\r\n")
+			return
+		}
+	} else if port == "" {
+		port = "80"
+	}
+	ip, err := rule.resolve(host)
+	if err != nil {
+		slog.Info("egress denied", "vm", vmName, "host", host, "err", err)
+		fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n%v\n", err)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), 15*time.Second)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n%v\n", err)
+		return
+	}
+	defer upstream.Close()
+
+	if req.Method == http.MethodConnect {
+		fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(upstream, br)
+		io.Copy(conn, upstream)
+		return
+	}
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Connection")
+	req.Close = true
+	if err := req.Write(upstream); err != nil {
+		return
+	}
+	io.Copy(conn, upstream)
+}
+
+// resolve looks host up and returns the first of its addresses rule
+// permits, so the proxy connects to exactly what was checked.
+func (rule egressRule) resolve(host string) (net.IP, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		ips = addrs
+	}
+	for _, ip := range ips {
+		if rule.permits(host, ip) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("egress to %s denied by %s policy", host, rule.Policy)
+}
+
+func (rule egressRule) permits(host string, ip net.IP) bool {
+	if rule.denyPrivate && privateIP(ip) {
+		return false
+	}
+	for _, list := range rule.allow {
+		if !allowListed(list, host, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowListed reports whether host (resolved to ip) matches an entry of
+// list: an IP, a subnet, a hostname or a "*.domain" wildcard.
+func allowListed(list []string, host string, ip net.IP) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		switch {
+		case net.ParseIP(entry) != nil:
+			if net.ParseIP(entry).Equal(ip) {
+				return true
+			}
+		case strings.Contains(entry, "/"):
+			if _, subnet, err := net.ParseCIDR(entry); err == nil && subnet.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(entry, "*."):
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+		case host == entry:
+			return true
+		}
+	}
+	return false
+}
+
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// privateIP reports whether ip is on a private, loopback or link-local
+// network, or is one of this host's own addresses.
+func privateIP(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || cgnat.Contains(ip) {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// EgressPipe relays stdin/stdout to the egress proxy socket sock. QEMU
+// runs it (as `agent egress-pipe <sock>`) for each guest connection to the
+// proxy address.
+func EgressPipe(sock string) error {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
+
+// parseEgressAllow parses a comma-separated allow-list.
+func parseEgressAllow(s string) ([]string, error) {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !system.ValidEgressAllow(e) {
+			return nil, fmt.Errorf("invalid entry %q", e)
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"database/sql"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func TestBootedEgress(t *testing.T) {
+	public := net.ParseIP("93.184.216.34")
+	private := net.ParseIP("192.168.1.10")
+	tests := []struct {
+		name    string
+		host    string
+		policy  string
+		allow   string
+		booted  string
+		want    string
+		proxied bool
+		// what the proxy lets example.com through at, when there is one
+		publicOK  bool
+		privateOK bool
+	}{
+		{name: "host loosened from allowlist", host: system.EgressOpen, booted: system.EgressAllowlist,
+			want: system.EgressAllowlist, proxied: true},
+		{name: "host loosened from deny-private", host: system.EgressOpen, booted: system.EgressDenyPrivate,
+			want: system.EgressDenyPrivate, proxied: true, publicOK: true},
+		{name: "host loosened from isolated", host: system.EgressOpen, booted: system.EgressIsolated,
+			want: system.EgressIsolated},
+		{name: "renter's allowlist under a deny-private NIC", host: system.EgressOpen, policy: system.EgressAllowlist,
+			allow: "example.com", booted: system.EgressDenyPrivate, want: system.EgressAllowlist, proxied: true, publicOK: true},
+		{name: "unchanged", host: system.EgressDenyPrivate, booted: system.EgressDenyPrivate,
+			want: system.EgressDenyPrivate, proxied: true, publicOK: true},
+		{name: "host tightened past an open NIC", host: system.EgressDenyPrivate, booted: system.EgressOpen,
+			want: system.EgressDenyPrivate, proxied: true, publicOK: true},
+		{name: "booted before egress_effective was recorded", host: system.EgressOpen,
+			want: system.EgressOpen},
+	}
+	for _, tt := range tests {
+		cfg := Config{EgressPolicy: tt.host}
+		rule := bootedEgress(cfg, nullString(tt.policy), nullString(tt.allow), nullString(tt.booted))
+		if rule.Policy != tt.want || system.EgressProxied(rule.Policy) != tt.proxied {
+			t.Errorf("%s: policy %q, want %q", tt.name, rule.Policy, tt.want)
+		}
+		if !tt.proxied {
+			continue
+		}
+		if got := rule.permits("example.com", public); got != tt.publicOK {
+			t.Errorf("%s: public permitted = %v, want %v", tt.name, got, tt.publicOK)
+		}
+		if got := rule.permits("example.com", private); got != tt.privateOK {
+			t.Errorf("%s: private permitted = %v, want %v", tt.name, got, tt.privateOK)
+		}
+	}
+}
+
+func TestEffectiveEgress(t *testing.T) {
+	tests := []struct {
+		name      string
+		host      string
+		hostAllow []string
+		policy    string
+		allow     string
+		want      egressRule
+	}{
+		{name: "open host, no preference", host: system.EgressOpen,
+			want: egressRule{Policy: system.EgressOpen}},
+		{name: "renter stricter", host: system.EgressOpen, policy: system.EgressDenyPrivate,
+			want: egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}},
+		{name: "host stricter", host: system.EgressDenyPrivate, policy: system.EgressOpen,
+			want: egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}},
+		{name: "host allowlist", host: system.EgressAllowlist, hostAllow: []string{"a.com"},
+			want: egressRule{Policy: system.EgressAllowlist, allow: [][]string{{"a.com"}}}},
+		{name: "both allowlists apply", host: system.EgressAllowlist, hostAllow: []string{"a.com"},
+			policy: system.EgressAllowlist, allow: "b.com,c.com",
+			want: egressRule{Policy: system.EgressAllowlist, allow: [][]string{{"a.com"}, {"b.com", "c.com"}}}},
+		{name: "renter allowlist on a deny-private host", host: system.EgressDenyPrivate,
+			policy: system.EgressAllowlist, allow: "b.com",
+			want: egressRule{Policy: system.EgressAllowlist, allow: [][]string{{"b.com"}}, denyPrivate: true}},
+		{name: "empty renter allowlist", host: system.EgressOpen, policy: system.EgressAllowlist,
+			want: egressRule{Policy: system.EgressAllowlist, allow: [][]string{nil}}},
+		{name: "empty host allowlist", host: system.EgressAllowlist,
+			want: egressRule{Policy: system.EgressAllowlist, allow: [][]string{nil}}},
+		{name: "isolated host", host: system.EgressIsolated, policy: system.EgressAllowlist, allow: "b.com",
+			want: egressRule{Policy: system.EgressIsolated, allow: [][]string{{"b.com"}}}},
+	}
+	for _, tt := range tests {
+		cfg := Config{EgressPolicy: tt.host, EgressAllow: tt.hostAllow}
+		if got := effectiveEgress(cfg, nullString(tt.policy), nullString(tt.allow)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAtLeast(t *testing.T) {
+	list := [][]string{{"a.com"}}
+	tests := []struct {
+		name   string
+		rule   egressRule
+		policy string
+		want   egressRule
+	}{
+		{"no floor", egressRule{Policy: system.EgressOpen}, "",
+			egressRule{Policy: system.EgressOpen}},
+		{"looser floor", egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}, system.EgressOpen,
+			egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}},
+		{"open to deny-private", egressRule{Policy: system.EgressOpen}, system.EgressDenyPrivate,
+			egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}},
+		{"open to allowlist permits nothing", egressRule{Policy: system.EgressOpen}, system.EgressAllowlist,
+			egressRule{Policy: system.EgressAllowlist, allow: [][]string{nil}}},
+		{"deny-private to allowlist", egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}, system.EgressAllowlist,
+			egressRule{Policy: system.EgressAllowlist, allow: [][]string{nil}, denyPrivate: true}},
+		{"allowlist keeps its list", egressRule{Policy: system.EgressAllowlist, allow: list}, system.EgressAllowlist,
+			egressRule{Policy: system.EgressAllowlist, allow: list}},
+		{"allowlist under deny-private", egressRule{Policy: system.EgressAllowlist, allow: list}, system.EgressDenyPrivate,
+			egressRule{Policy: system.EgressAllowlist, allow: list, denyPrivate: true}},
+		{"isolated", egressRule{Policy: system.EgressAllowlist, allow: list}, system.EgressIsolated,
+			egressRule{Policy: system.EgressIsolated, allow: list}},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.atLeast(tt.policy); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if (egressRule{Policy: system.EgressOpen}).atLeast(system.EgressAllowlist).permits("a.com", net.ParseIP("93.184.216.34")) {
+		t.Error("an allowlist floor with no list permits a.com")
+	}
+}
+
+func TestPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.0.1", true},
+		{"100.64.0.1", true}, // carrier-grade NAT
+		{"127.0.0.1", true},
+		{"169.254.169.254", true}, // cloud metadata
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"::ffff:100.64.0.1", true},
+		{"93.184.216.34", false},
+		{"172.32.0.1", false},
+		{"100.128.0.1", false},
+		{"::ffff:93.184.216.34", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, tt := range tests {
+		if got := privateIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("privateIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAllowListed(t *testing.T) {
+	list := []string{"example.com", "*.example.org", "93.184.216.34", "198.51.100.0/24", "2001:db8::/32"}
+	tests := []struct {
+		host string
+		ip   string
+		want bool
+	}{
+		{"example.com", "203.0.113.1", true},
+		{"EXAMPLE.com.", "203.0.113.1", true},
+		{"evil-example.com", "203.0.113.1", false},
+		{"example.com.evil.net", "203.0.113.1", false},
+		{"www.example.com", "203.0.113.1", false}, // exact entries do not cover subdomains
+		{"www.example.org", "203.0.113.1", true},
+		{"a.b.example.org", "203.0.113.1", true},
+		{"example.org", "203.0.113.1", false}, // nor wildcards the domain itself
+		{"evil-example.org", "203.0.113.1", false},
+		{"anything.test", "93.184.216.34", true},
+		{"anything.test", "::ffff:93.184.216.34", true},
+		{"anything.test", "198.51.100.7", true},
+		{"anything.test", "198.51.101.7", false},
+		{"anything.test", "2001:db8::5", true},
+		{"anything.test", "203.0.113.1", false},
+	}
+	for _, tt := range tests {
+		if got := allowListed(list, tt.host, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allowListed(%s at %s) = %v, want %v", tt.host, tt.ip, got, tt.want)
+		}
+	}
+	if allowListed(nil, "example.com", net.ParseIP("93.184.216.34")) {
+		t.Error("an empty list permits example.com")
+	}
+}
+
+func TestPermits(t *testing.T) {
+	public, private := net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.5")
+	tests := []struct {
+		name string
+		rule egressRule
+		host string
+		ip   net.IP
+		want bool
+	}{
+		{"open", egressRule{Policy: system.EgressOpen}, "intranet", private, true},
+		{"deny-private, public", egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}, "example.com", public, true},
+		{"deny-private, private", egressRule{Policy: system.EgressDenyPrivate, denyPrivate: true}, "intranet", private, false},
+		{"listed private host under deny-private", egressRule{Policy: system.EgressAllowlist,
+			allow: [][]string{{"intranet"}}, denyPrivate: true}, "intranet", private, false},
+		{"on both lists", egressRule{Policy: system.EgressAllowlist,
+			allow: [][]string{{"example.com"}, {"*.com"}}}, "example.com", public, true},
+		{"on one list of two", egressRule{Policy: system.EgressAllowlist,
+			allow: [][]string{{"example.com"}, {"other.com"}}}, "example.com", public, false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.permits(tt.host, tt.ip); got != tt.want {
+			t.Errorf("%s: permits(%s at %s) = %v, want %v", tt.name, tt.host, tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"database/sql"
+	"log/slog"
+)
+
+// recordEvent appends an event to vmName's rental timeline. detail carries
+// anything too long for the message, such as QEMU's stderr. Failures are
+// only logged: the timeline must never hold up the VM itself.
+func recordEvent(db *sql.DB, vmName, kind, message, detail string) {
+	if _, err := db.Exec(
+		`INSERT INTO rental_events (vm_name, kind, message, detail, agent_id)
+		 VALUES (?, ?, ?, NULLIF(?, ''), (SELECT NULLIF(agent_id, 0) FROM rentals WHERE vm_name = ?))`,
+		vmName, kind, message, detail, vmName,
+	); err != nil {
+		slog.Error("record rental event", "vm", vmName, "kind", kind, "err", err)
+	}
+}
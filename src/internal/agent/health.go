@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/health"
+	hostres "github.com/smeetnagda/vmshare/internal/qemu"
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// Heartbeats of the agent's background loops. Each max age is a few times
+// the loop's period; the creation loop beats before each VM it boots, so
+// a backlog of pending rentals booting one after another doesn't trip it.
+var (
+	creationBeat health.Heartbeat
+	syncBeat     health.Heartbeat
+	meterBeat    health.Heartbeat
+	metricsBeat  health.Heartbeat
+)
+
+// healthChecks returns the agent's probes. Liveness fails if a background
+// loop is stuck; readiness also needs the database, the QEMU binaries, the
+// images this host offers, enough free memory and disk for a new VM and,
+// behind NAT, the coordinator tunnel.
+func healthChecks(db *sql.DB, cfg Config) (live, ready *health.Checks) {
+	loops := []struct {
+		name   string
+		beat   *health.Heartbeat
+		maxAge time.Duration
+	}{
+		{"creation_loop", &creationBeat, 5 * time.Minute},
+		{"sync_loop", &syncBeat, time.Minute},
+		{"meter_loop", &meterBeat, 2 * time.Minute},
+		{"metrics_loop", &metricsBeat, 2 * time.Minute},
+	}
+
+	live = &health.Checks{}
+	ready = &health.Checks{}
+	for _, l := range loops {
+		live.Add(l.name, health.Recent(l.beat.Last, l.maxAge))
+		ready.Add(l.name, health.Recent(l.beat.Last, l.maxAge))
+	}
+
+	ready.Add("database", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return db.PingContext(ctx)
+	})
+	ready.Add("qemu", func() error {
+		for _, bin := range []string{"qemu-system-aarch64", "qemu-img"} {
+			if _, err := exec.LookPath(bin); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	ready.Add("images", func() error {
+		images := []string{system.DefaultImage}
+		for _, p := range cfg.WarmPool {
+			images = append(images, p.Image)
+		}
+		for _, image := range images {
+			if _, err := os.Stat(system.ImagePath(image)); err != nil {
+				return fmt.Errorf("image %s: %v", image, err)
+			}
+		}
+		return nil
+	})
+	ready.Add("resources", hostres.CheckResources)
+	if cfg.TunnelAddr != "" {
+		ready.Add("coordinator_tunnel", coordinator.check)
+	}
+	return live, ready
+}
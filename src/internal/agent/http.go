@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"database/sql"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+)
+
+// agentHandler serves the agent-to-agent protocol. Other agents find it
+// through the address this agent publishes in its heartbeat, or through the
+// coordinator tunnel. The coordinator uses /vms/ to reach VMs' consoles and
+// SSH ports, authenticating with cfg.Token. It also serves the /livez and
+// /readyz probes and, with cfg.Metrics, Prometheus metrics on /metrics.
+func agentHandler(db *sql.DB, cfg Config, vms *vmTable) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/migrations/", handleIncomingMigration(db, cfg))
+	mux.HandleFunc("/vms/", func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) == "ssh" {
+			handleSSHTunnel(cfg, vms)(w, r)
+			return
+		}
+		handleConsole(cfg, vms)(w, r)
+	})
+	if cfg.Metrics {
+		mux.Handle("/metrics", agentMetrics.Handler())
+	}
+	live, ready := healthChecks(db, cfg)
+	mux.Handle("/livez", live.Handler())
+	mux.Handle("/readyz", ready.Handler())
+	return mux
+}
+
+// serveAgentHTTP serves handler on cfg.Listen.
+func serveAgentHTTP(cfg Config, handler http.Handler) {
+	slog.Info("agent protocol listening", "addr", cfg.Listen)
+	if host, _, err := net.SplitHostPort(cfg.Listen); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			slog.Warn("agent protocol is plain HTTP; keep VMSHARE_LISTEN on a private network", "addr", cfg.Listen)
+		}
+	}
+	if err := http.ListenAndServe(cfg.Listen, handler); err != nil {
+		slog.Error("agent HTTP server", "err", err)
+	}
+}
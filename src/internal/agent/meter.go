@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// meterInterval is how often each VM's network counters are sampled.
+const meterInterval = 10 * time.Second
+
+// rateBurst is how many seconds of traffic at the rate limit a VM may
+// send in one go before it is throttled.
+const rateBurst = 30
+
+// netMeter is what the meter remembers about one VM process.
+type netMeter struct {
+	vm      *system.VM
+	counted bool   // whether a sample of this relay has been recorded
+	dropped uint64 // the relay's drop counter at the last sample
+}
+
+// meterLoop records each VM's network usage on its rental and enforces the
+// host's rate limit and transfer quota.
+func meterLoop(db *sql.DB, cfg Config, vms *vmTable) {
+	meters := map[string]*netMeter{}
+	for {
+		meterBeat.Beat()
+		sampleNetwork(db, cfg, vms, meters)
+		time.Sleep(meterInterval)
+	}
+}
+
+// sampleNetwork takes one sample of every VM's counters, which the host
+// keeps as it relays the VM's traffic. The rate limit is applied by the
+// relay itself, which holds back and then drops traffic over it; a VM over
+// its quota has all traffic dropped for good.
+func sampleNetwork(db *sql.DB, cfg Config, vms *vmTable, meters map[string]*netMeter) {
+	rate := float64(cfg.NetRateMbit) * 1e6 / 8 // bytes per second
+	quota := int64(cfg.NetQuotaGB) << 30
+
+	names := vms.names()
+	live := map[string]bool{}
+	for _, name := range names {
+		live[name] = true
+	}
+	for name := range meters {
+		if !live[name] {
+			delete(meters, name)
+		}
+	}
+
+	for _, name := range names {
+		vm := vms.get(name)
+		if vm == nil {
+			continue
+		}
+		m := meters[name]
+		if m == nil || m.vm != vm {
+			// a new process or agent run, whose relay starts unlimited
+			// and counting from zero
+			m = &netMeter{vm: vm}
+			meters[name] = m
+			vm.LimitNetwork(rate, rate*rateBurst)
+		}
+
+		var seenRx, seenTx, totalRx, totalTx int64
+		var limited sql.NullString
+		if err := db.QueryRow(
+			`SELECT net_rx_seen, net_tx_seen, net_rx_bytes, net_tx_bytes, net_limited
+			   FROM rentals WHERE vm_name = ?`, name,
+		).Scan(&seenRx, &seenTx, &totalRx, &totalTx, &limited); err != nil {
+			continue
+		}
+		stats, err := vm.NetworkStats()
+		if err != nil {
+			// relay not connected yet, or a VM from before it existed
+			continue
+		}
+		if !m.counted {
+			seenRx, seenTx = 0, 0
+			m.counted = true
+		}
+		rx, tx := counterDelta(stats.RxBytes, seenRx), counterDelta(stats.TxBytes, seenTx)
+		totalRx, totalTx = totalRx+rx, totalTx+tx
+
+		want := ""
+		switch {
+		case limited.String == "quota", quota > 0 && totalRx+totalTx >= quota:
+			want = "quota"
+		case rate > 0 && stats.Dropped > m.dropped:
+			want = "rate"
+		}
+		m.dropped = stats.Dropped
+		vm.BlockNetwork(want == "quota")
+		if want != limited.String {
+			reportLimit(vm, name, want, cfg)
+		}
+
+		if _, err := db.Exec(
+			`UPDATE rentals
+			    SET net_rx_bytes = ?, net_tx_bytes = ?, net_rx_seen = ?, net_tx_seen = ?,
+			        net_limited = NULLIF(?, '')
+			  WHERE vm_name = ?`,
+			totalRx, totalTx, int64(stats.RxBytes), int64(stats.TxBytes), want, name,
+		); err != nil {
+			slog.Error("record network usage", "vm", name, "err", err)
+		}
+	}
+}
+
+// counterDelta is how far a relay counter moved since it read seen. A
+// smaller value means the counter restarted at 0.
+func counterDelta(cur uint64, seen int64) int64 {
+	if int64(cur) < seen {
+		return int64(cur)
+	}
+	return int64(cur) - seen
+}
+
+// reportLimit logs a throttling change and, for the quota, tells the renter
+// why their network went away.
+func reportLimit(vm *system.VM, vmName, limited string, cfg Config) {
+	switch limited {
+	case "":
+		slog.Info("VM network no longer limited", "vm", vmName)
+	case "rate":
+		slog.Warn("VM over network rate limit; traffic throttled", "vm", vmName, "rate_mbit", cfg.NetRateMbit)
+	case "quota":
+		slog.Warn("VM used its transfer quota; network off", "vm", vmName, "quota_gb", cfg.NetQuotaGB)
+		go vm.Broadcast(fmt.Sprintf("This VM has used its %d GB network transfer quota; its network is now off.", cfg.NetQuotaGB))
+	}
+}
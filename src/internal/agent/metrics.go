@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// metricsInterval is how often each VM's resource usage is sampled into
+// vm_metrics, and metricsRetention how long samples are kept.
+const (
+	metricsInterval  = 15 * time.Second
+	metricsRetention = 7 * 24 * time.Hour
+)
+
+// metricsLoop samples every VM this agent runs into vm_metrics, where the
+// coordinator serves them from (see GET /rentals/{vm}/metrics).
+func metricsLoop(db *sql.DB, vms *vmTable) {
+	var pruned time.Time
+	for {
+		metricsBeat.Beat()
+		sampleMetrics(db, vms)
+		if time.Since(pruned) > time.Hour {
+			if _, err := db.Exec(`DELETE FROM vm_metrics WHERE at < ?`,
+				time.Now().Add(-metricsRetention).UTC()); err != nil {
+				slog.Error("prune metrics", "err", err)
+			}
+			pruned = time.Now()
+		}
+		time.Sleep(metricsInterval)
+	}
+}
+
+// sampleMetrics records one sample per VM. Network totals come from the
+// rental, kept up to date by meterLoop.
+func sampleMetrics(db *sql.DB, vms *vmTable) {
+	for _, name := range vms.names() {
+		vm := vms.get(name)
+		if vm == nil {
+			continue
+		}
+		proc, err := vm.ProcessStats()
+		if err != nil {
+			continue
+		}
+		disk, err := vm.BlockStats()
+		if err != nil {
+			// QMP busy or VM going away; try again next round
+			continue
+		}
+		var rx, tx int64
+		if err := db.QueryRow(
+			`SELECT net_rx_bytes, net_tx_bytes FROM rentals WHERE vm_name = ?`, name,
+		).Scan(&rx, &tx); err != nil {
+			continue
+		}
+		if _, err := db.Exec(
+			`INSERT INTO vm_metrics(vm_name, at, cpu_seconds, rss_bytes,
+			                        disk_rd_bytes, disk_wr_bytes, disk_rd_ops, disk_wr_ops,
+			                        net_rx_bytes, net_tx_bytes)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			name, time.Now().UTC(), proc.CPUSeconds, int64(proc.RSSBytes),
+			int64(disk.RdBytes), int64(disk.WrBytes), int64(disk.RdOps), int64(disk.WrOps),
+			rx, tx,
+		); err != nil {
+			slog.Error("record metrics", "vm", name, "err", err)
+		}
+	}
+}
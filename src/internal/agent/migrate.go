@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+	"github.com/smeetnagda/vmshare/internal/tunnel"
+)
+
+// migrateOut moves vmName to the agent named in its pending migration: the
+// VM is suspended (if it is still running), its state and disk are streamed
+// to the destination, and the local copy is dropped once the destination has
+// taken it. On failure the VM resumes here.
+func migrateOut(db *sql.DB, cfg Config, vms *vmTable, vmName string) {
+	var id int64
+	var destID int
+	var token, addr string
+	err := db.QueryRow(
+		`SELECT m.id, m.dest_agent_id, m.token, a.address
+		   FROM migrations m JOIN agents a ON a.id = m.dest_agent_id
+		  WHERE m.vm_name = ? AND m.source_agent_id = ? AND m.state = 'pending'
+		  ORDER BY m.id DESC LIMIT 1`,
+		vmName, cfg.AgentID,
+	).Scan(&id, &destID, &token, &addr)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		slog.Error("query migration", "vm", vmName, "err", err)
+		return
+	}
+	res, err := db.Exec(`UPDATE migrations SET state = 'sending' WHERE id = ? AND state = 'pending'`, id)
+	if err != nil {
+		slog.Error("claim migration", "vm", vmName, "migration_id", id, "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+
+	dir := suspendDir(cfg, vmName)
+	if vm := vms.beginStop(vmName); vm != nil {
+		slog.Info("suspending VM for migration", "vm", vmName, "migration_id", id)
+		if err := vm.Suspend(dir); err != nil {
+			vms.endStop(vmName)
+			failMigration(db, id, err)
+			recordEvent(db, vmName, "error", fmt.Sprintf("migration %d: suspend VM: %v", id, err), vm.StderrTail())
+			if _, err := db.Exec(
+				`UPDATE rentals SET state = 'running' WHERE vm_name = ? AND state = 'migrating'`, vmName,
+			); err != nil {
+				slog.Error("update rental", "vm", vmName, "err", err)
+			}
+			return
+		}
+	} else if _, err := os.Stat(dir); err != nil {
+		failMigration(db, id, fmt.Errorf("VM %s is neither running nor suspended here", vmName))
+		recordStopped(db, vmName, "migration_failed", "")
+		return
+	}
+
+	slog.Info("sending VM", "vm", vmName, "migration_id", id, "to", addr)
+	if err := sendMigration(addr, destID, id, token, dir); err != nil {
+		failMigration(db, id, err)
+		recordEvent(db, vmName, "error", fmt.Sprintf("migration %d: send VM: %v", id, err), "")
+		// pick it up again locally
+		if _, err := db.Exec(
+			`UPDATE rentals SET state = 'resuming' WHERE vm_name = ? AND state = 'migrating'`, vmName,
+		); err != nil {
+			slog.Error("update rental", "vm", vmName, "err", err)
+		}
+		return
+	}
+	if err := system.DiscardSuspended(dir); err != nil {
+		slog.Error("discard migrated VM", "vm", vmName, "migration_id", id, "err", err)
+	}
+	slog.Info("VM handed over", "vm", vmName, "migration_id", id)
+	recordEvent(db, vmName, "migrated_out", fmt.Sprintf("migration %d: handed over to %s", id, addr), "")
+}
+
+// sendMigration streams the VM suspended in dir to agent destID at addr,
+// or through the coordinator when this agent is behind a tunnel. The
+// coordinator only relays to agents with a tunnel of their own, so for
+// any other destination the agent dials addr itself.
+func sendMigration(addr string, destID int, id int64, token, dir string) error {
+	client := http.DefaultClient
+	if coordinator.up() {
+		direct := addr
+		addr = tunnel.User(destID)
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				conn, err := coordinator.dialAgent(destID)
+				if err != nil && direct != "" {
+					var d net.Dialer
+					return d.DialContext(ctx, network, direct)
+				}
+				return conn, err
+			},
+			DisableKeepAlives: true,
+		}}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(system.ExportSuspended(dir, pw))
+	}()
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/migrations/%d", addr, id), pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/x-tar")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("destination: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// failMigration records why migration id failed.
+func failMigration(db *sql.DB, id int64, cause error) {
+	slog.Error("migration failed", "migration_id", id, "err", cause)
+	if _, err := db.Exec(
+		`UPDATE migrations SET state = 'failed', error = ?, completed_at = ? WHERE id = ?`,
+		cause.Error(), time.Now(), id,
+	); err != nil {
+		slog.Error("update migration", "migration_id", id, "err", err)
+	}
+}
+
+// handleIncomingMigration handles POST /migrations/{id} from a source agent:
+// it unpacks the VM and takes the rental over, leaving it resuming so the
+// sync loop restores it here with a new endpoint. Failures are reported to
+// the source, which records them. The migration's token is the only
+// credential and, like the VM state, travels in the clear unless the
+// transfer goes through the coordinator tunnel (see Config.Listen).
+func handleIncomingMigration(db *sql.DB, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/migrations/"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		var vmName, state, token string
+		var destID int
+		err = db.QueryRow(
+			`SELECT vm_name, dest_agent_id, state, token FROM migrations WHERE id = ?`, id,
+		).Scan(&vmName, &destID, &state, &token)
+		if err == sql.ErrNoRows || (err == nil && destID != cfg.AgentID) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "bad token", http.StatusForbidden)
+			return
+		}
+		if state != "sending" {
+			http.Error(w, "migration is "+state, http.StatusConflict)
+			return
+		}
+
+		slog.Info("receiving VM", "vm", vmName, "migration_id", id)
+		dir := suspendDir(cfg, vmName)
+		workDir := filepath.Join(os.TempDir(), "vmrentals", fmt.Sprintf("%s-m%d", vmName, id))
+		if err := system.ImportSuspended(r.Body, dir, workDir); err != nil {
+			os.RemoveAll(dir)
+			os.RemoveAll(workDir)
+			slog.Error("import migrated VM", "vm", vmName, "migration_id", id, "err", err)
+			http.Error(w, "import: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := adoptMigratedRental(db, cfg, id, vmName); err != nil {
+			system.DiscardSuspended(dir)
+			slog.Error("adopt migrated VM", "vm", vmName, "migration_id", id, "err", err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		slog.Info("VM received", "vm", vmName, "migration_id", id)
+		recordEvent(db, vmName, "migrated_in", fmt.Sprintf("migration %d: received from source agent", id), "")
+	}
+}
+
+// adoptMigratedRental moves vmName onto this agent and completes migration
+// id, unless the rental ended while it was in flight.
+func adoptMigratedRental(db *sql.DB, cfg Config, id int64, vmName string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE rentals SET agent_id = ?, state = 'resuming', ip_address = NULL
+		  WHERE vm_name = ? AND state = 'migrating'`,
+		cfg.AgentID, vmName,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("rental %s ended during migration", vmName)
+	}
+	if _, err := tx.Exec(
+		`UPDATE migrations SET state = 'completed', completed_at = ? WHERE id = ?`,
+		time.Now(), id,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// attachedNetworks lists the private networks the coordinator attached to
+// vmName, giving the VM an address on each one it doesn't have one on yet.
+// The rental was pinned here with its networks, which a cluster's network
+// may span beyond this agent.
+func attachedNetworks(db *sql.DB, cfg Config, vmName string) ([]system.NetworkNIC, error) {
+	rows, err := db.Query(
+		`SELECT n.id, n.cidr, n.mcast_port, COALESCE(na.ip_address, '')
+		   FROM network_attachments na
+		   JOIN networks n ON n.id = na.network_id
+		  WHERE na.vm_name = ? AND n.state = 'active'
+		  ORDER BY n.id`,
+		vmName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	type attachment struct {
+		networkID int64
+		cidr, ip  string
+		port      int
+	}
+	var atts []attachment
+	for rows.Next() {
+		var a attachment
+		if err := rows.Scan(&a.networkID, &a.cidr, &a.port, &a.ip); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		atts = append(atts, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var nics []system.NetworkNIC
+	for _, a := range atts {
+		_, subnet, err := net.ParseCIDR(a.cidr)
+		if err != nil {
+			return nil, fmt.Errorf("network %d: bad cidr %q", a.networkID, a.cidr)
+		}
+		if a.ip == "" {
+			if a.ip, err = assignNetworkIP(db, a.networkID, subnet, vmName); err != nil {
+				return nil, fmt.Errorf("network %d: %v", a.networkID, err)
+			}
+		}
+		ones, _ := subnet.Mask.Size()
+		nics = append(nics, system.NetworkNIC{
+			NetworkID: a.networkID,
+			Port:      a.port,
+			Address:   fmt.Sprintf("%s/%d", a.ip, ones),
+			LocalAddr: cfg.NetworkAddr,
+		})
+	}
+	return nics, nil
+}
+
+// assignNetworkIP gives vmName the lowest free host address on a network,
+// skipping .1 and counting only addresses held by live rentals.
+func assignNetworkIP(db *sql.DB, networkID int64, subnet *net.IPNet, vmName string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT na.ip_address FROM network_attachments na
+		   JOIN rentals r ON r.vm_name = na.vm_name
+		  WHERE na.network_id = ? AND na.ip_address IS NOT NULL
+		    AND r.state NOT IN ('stopped', 'expired')`,
+		networkID,
+	)
+	if err != nil {
+		return "", err
+	}
+	used := map[string]bool{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			rows.Close()
+			return "", err
+		}
+		used[ip] = true
+	}
+	rows.Close()
+
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	for off := uint32(2); off < size-1; off++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+off)
+		if used[ip.String()] {
+			continue
+		}
+		if _, err := tx.Exec(
+			`UPDATE network_attachments SET ip_address = ?
+			  WHERE network_id = ? AND vm_name = ?`,
+			ip.String(), networkID, vmName,
+		); err != nil {
+			return "", err
+		}
+		return ip.String(), tx.Commit()
+	}
+	return "", fmt.Errorf("no free addresses in %s", subnet)
+}
+
+// clusterHosts lists the hostnames and private addresses of a cluster's
+// members for their /etc/hosts.
+func clusterHosts(db *sql.DB, clusterID int64) ([]system.HostEntry, error) {
+	rows, err := db.Query(
+		`SELECT na.ip_address, r.hostname
+		   FROM rentals r
+		   JOIN clusters c ON c.id = r.cluster_id
+		   JOIN network_attachments na ON na.vm_name = r.vm_name AND na.network_id = c.network_id
+		  WHERE r.cluster_id = ? AND na.ip_address IS NOT NULL AND r.hostname IS NOT NULL
+		  ORDER BY r.id`,
+		clusterID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hosts []system.HostEntry
+	for rows.Next() {
+		var h system.HostEntry
+		if err := rows.Scan(&h.IP, &h.Name); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, rows.Err()
+}
@@ -0,0 +1,249 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// warmBootTimeout bounds how long a warm VM may take to bring up its guest
+// agent before it is discarded.
+const warmBootTimeout = 10 * time.Minute
+
+// poolKey identifies one warm pool.
+type poolKey struct {
+	image, flavor string
+}
+
+// warmPool keeps pre-booted, keyless VMs per image/flavor so a new rental can
+// be handed a running guest instead of paying for seed ISO, overlay creation
+// and boot. Pools are topped back up in the background after each handover.
+// Warm VMs take up host capacity like rental VMs, and make way for rentals
+// when the host is full.
+type warmPool struct {
+	specs    []PoolSpec
+	agentID  int
+	grace    time.Duration
+	capacity int
+	vms      *vmTable
+
+	mu      sync.Mutex
+	idle    map[poolKey][]*system.VM
+	booting map[poolKey]int
+	seq     int
+	refill  chan struct{}
+}
+
+func newWarmPool(cfg Config, vms *vmTable) *warmPool {
+	specs := cfg.WarmPool
+	if cfg.EgressPolicy != system.EgressOpen && len(specs) > 0 {
+		// warm VMs boot with open egress, which no rental here may have
+		slog.Warn("warm pool disabled: host egress policy is not open", "egress_policy", cfg.EgressPolicy)
+		specs = nil
+	}
+	return &warmPool{
+		specs:    specs,
+		agentID:  cfg.AgentID,
+		grace:    cfg.ShutdownGrace,
+		capacity: cfg.Capacity,
+		vms:      vms,
+		idle:     make(map[poolKey][]*system.VM),
+		booting:  make(map[poolKey]int),
+		refill:   make(chan struct{}, 1),
+	}
+}
+
+// run keeps every configured pool at its target size.
+func (p *warmPool) run() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		p.fill()
+		select {
+		case <-p.refill:
+		case <-ticker.C:
+		}
+	}
+}
+
+// fill starts enough boots to bring each pool back to its target size, as
+// far as the capacity rentals leave free allows.
+func (p *warmPool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	free := p.capacity - p.vms.count() - p.size()
+	for _, spec := range p.specs {
+		key := poolKey{spec.Image, spec.Flavor}
+		for len(p.idle[key])+p.booting[key] < spec.Size && free > 0 {
+			free--
+			p.seq++
+			p.booting[key]++
+			go p.boot(key, fmt.Sprintf("warm-%d-%d-%d", p.agentID, time.Now().Unix(), p.seq))
+		}
+	}
+}
+
+// boot starts one keyless VM and adds it to the idle list once its guest
+// agent answers, since key injection at handover goes through it.
+func (p *warmPool) boot(key poolKey, name string) {
+	vm, err := system.StartVM(system.VMSpec{Name: name, Image: key.image, Flavor: key.flavor})
+	if err == nil {
+		if err = vm.WaitGuestAgent(warmBootTimeout); err != nil {
+			vm.Stop(p.grace)
+		}
+	}
+
+	p.mu.Lock()
+	p.booting[key]--
+	if err == nil {
+		p.idle[key] = append(p.idle[key], vm)
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		slog.Error("boot warm VM", "vm", name, "image", key.image, "flavor", key.flavor, "err", err)
+		// back off so a broken image does not spin
+		time.Sleep(time.Minute)
+		p.poke()
+		return
+	}
+	slog.Info("warm VM ready", "vm", name, "image", key.image, "flavor", key.flavor)
+
+	go func() {
+		<-vm.Done()
+		if p.remove(key, vm) {
+			slog.Warn("warm VM exited while idle", "vm", name)
+			p.poke()
+		}
+	}()
+}
+
+// size returns how many warm VMs are idle or booting. The caller holds p.mu.
+func (p *warmPool) size() int {
+	n := 0
+	for _, list := range p.idle {
+		n += len(list)
+	}
+	for _, b := range p.booting {
+		n += b
+	}
+	return n
+}
+
+// hasRoom reports whether the host can take another rental VM: it has
+// free capacity, or an idle warm VM that the rental can be handed or that
+// can be stopped to make room (see makeRoom).
+func (p *warmPool) hasRoom() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.vms.count()+p.size() < p.capacity {
+		return true
+	}
+	for _, list := range p.idle {
+		if len(list) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// makeRoom stops an idle warm VM if the host is over capacity, before a
+// cold boot. The VM about to boot is already counted (see vmTable.claim).
+func (p *warmPool) makeRoom() {
+	p.mu.Lock()
+	if p.vms.count()+p.size() <= p.capacity {
+		p.mu.Unlock()
+		return
+	}
+	var victim *system.VM
+	for key, list := range p.idle {
+		if len(list) > 0 {
+			victim = list[0]
+			p.idle[key] = list[1:]
+			break
+		}
+	}
+	p.mu.Unlock()
+	if victim != nil {
+		slog.Info("stopping warm VM to make room for a rental", "warm_vm", victim.Name)
+		victim.Stop(p.grace)
+	}
+}
+
+// take hands out an idle VM for image/flavor, or nil if none is ready.
+// The caller owns the VM from then on.
+func (p *warmPool) take(image, flavor string) *system.VM {
+	key := poolKey{image, flavor}
+	p.mu.Lock()
+	var vm *system.VM
+	if list := p.idle[key]; len(list) > 0 {
+		vm = list[0]
+		p.idle[key] = list[1:]
+	}
+	p.mu.Unlock()
+	if vm != nil {
+		p.poke()
+	}
+	return vm
+}
+
+// remove drops vm from the idle list and reports whether it was there.
+func (p *warmPool) remove(key poolKey, vm *system.VM) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := p.idle[key]
+	for i, v := range list {
+		if v == vm {
+			p.idle[key] = append(list[:i:i], list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *warmPool) poke() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// launchVM boots the VM for a rental, preferring a warm one from the pool:
+// the renter's key is injected through the guest agent and the VM is renamed
+// to the rental. It falls back to a cold boot if no warm VM is available or
+// the handover fails. Rentals with volumes, private networks, an egress
+// policy other than open or restored from a snapshot always cold boot, since
+// those are set up on the QEMU command line. warm reports whether the VM
+// came from the pool.
+func launchVM(pool *warmPool, spec system.VMSpec) (vm *system.VM, warm bool, err error) {
+	if !warmEligible(spec) {
+		pool.makeRoom()
+		vm, err = system.StartVM(spec)
+		return vm, false, err
+	}
+	if vm = pool.take(spec.Image, spec.Flavor); vm != nil {
+		warmName := vm.Name
+		err = vm.AuthorizeKey(spec.SSHKey, spec.Name)
+		if err == nil {
+			err = vm.Rename(spec.Name)
+		}
+		if err == nil {
+			slog.Info("handed warm VM to rental", "vm", spec.Name, "warm_vm", warmName)
+			return vm, true, nil
+		}
+		slog.Warn("warm handover failed; cold booting", "vm", spec.Name, "warm_vm", warmName, "err", err)
+		vm.Stop(pool.grace)
+	}
+	pool.makeRoom()
+	vm, err = system.StartVM(spec)
+	return vm, false, err
+}
+
+// warmEligible reports whether spec can be handed a warm VM.
+func warmEligible(spec system.VMSpec) bool {
+	return len(spec.Volumes) == 0 && len(spec.Networks) == 0 && spec.Snapshot == "" &&
+		(spec.Egress.Policy == "" || spec.Egress.Policy == system.EgressOpen)
+}
@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// Extra forwards get host ports from this range, clear of the SSH ports
+// StartVM picks.
+const (
+	forwardPortMin = 30000
+	forwardPortMax = 40000
+)
+
+// portTable remembers which forwards have been applied to which QEMU
+// process. Forwards don't survive the process, so a resumed or migrated VM
+// shows up as a new *system.VM that needs its active forwards again.
+type portTable map[*system.VM]map[int64]bool
+
+// loadPorts rebuilds the table of applied forwards when the agent starts.
+// VMs adopted from a previous run kept their QEMU processes and with them
+// the forwards that run applied; those are recorded as applied so
+// syncPorts neither adds them twice nor moves them to another host port.
+// Forwards the process lacks are left for syncPorts to apply.
+func loadPorts(db *sql.DB, cfg Config, vms *vmTable) portTable {
+	applied := portTable{}
+	rows, err := db.Query(
+		`SELECT pf.id, pf.vm_name, pf.protocol, pf.host_port
+		   FROM port_forwards pf JOIN rentals r ON r.vm_name = pf.vm_name
+		  WHERE r.agent_id = ? AND pf.state IN ('active', 'removing') AND pf.host_port IS NOT NULL`,
+		cfg.AgentID,
+	)
+	if err != nil {
+		slog.Error("query port forwards", "err", err)
+		return applied
+	}
+	type forward struct {
+		id            int64
+		vmName, proto string
+		hostPort      int
+	}
+	var forwards []forward
+	for rows.Next() {
+		var f forward
+		if err := rows.Scan(&f.id, &f.vmName, &f.proto, &f.hostPort); err != nil {
+			slog.Error("scan port forward", "err", err)
+			continue
+		}
+		forwards = append(forwards, f)
+	}
+	rows.Close()
+
+	have := map[*system.VM]map[system.HostFwd]bool{}
+	for _, f := range forwards {
+		vm := vms.get(f.vmName)
+		if vm == nil {
+			continue
+		}
+		if have[vm] == nil {
+			fwds, err := vm.HostFwds()
+			if err != nil {
+				slog.Error("list port forwards", "vm", f.vmName, "err", err)
+			}
+			have[vm] = map[system.HostFwd]bool{}
+			for _, fwd := range fwds {
+				have[vm][fwd] = true
+			}
+		}
+		if !have[vm][system.HostFwd{Proto: f.proto, HostPort: f.hostPort}] {
+			continue
+		}
+		if applied[vm] == nil {
+			applied[vm] = map[int64]bool{}
+		}
+		applied[vm][f.id] = true
+	}
+	return applied
+}
+
+// syncPorts applies the port forwards renters asked for to their running
+// VMs and removes the ones they dropped.
+func syncPorts(db *sql.DB, cfg Config, vms *vmTable, applied portTable) {
+	rows, err := db.Query(
+		`SELECT pf.id, pf.vm_name, pf.protocol, pf.guest_port, COALESCE(pf.host_port, 0), pf.state, r.state
+		   FROM port_forwards pf JOIN rentals r ON r.vm_name = pf.vm_name
+		  WHERE r.agent_id = ? AND pf.state IN ('pending', 'active', 'removing')
+		  ORDER BY pf.id`,
+		cfg.AgentID,
+	)
+	if err != nil {
+		slog.Error("query port forwards", "err", err)
+		return
+	}
+	type forward struct {
+		id                  int64
+		vmName, proto       string
+		guestPort, hostPort int
+		state, rentalState  string
+	}
+	var pending []forward
+	for rows.Next() {
+		var f forward
+		if err := rows.Scan(&f.id, &f.vmName, &f.proto, &f.guestPort, &f.hostPort, &f.state, &f.rentalState); err != nil {
+			slog.Error("scan port forward", "err", err)
+			continue
+		}
+		pending = append(pending, f)
+	}
+	rows.Close()
+
+	live := map[*system.VM]bool{}
+	for _, name := range vms.names() {
+		if vm := vms.get(name); vm != nil {
+			live[vm] = true
+		}
+	}
+	for vm := range applied {
+		if !live[vm] {
+			delete(applied, vm)
+		}
+	}
+
+	for _, f := range pending {
+		vm := vms.get(f.vmName)
+		if f.state == "removing" {
+			if vm != nil && applied[vm][f.id] {
+				if err := vm.HostFwdRemove(f.proto, f.hostPort); err != nil {
+					slog.Error("remove port forward", "vm", f.vmName, "forward_id", f.id, "err", err)
+				}
+				delete(applied[vm], f.id)
+			}
+			setPortForward(db, f.id, "removed", f.hostPort, "")
+			continue
+		}
+		if vm == nil || f.rentalState != "running" || applied[vm][f.id] {
+			continue
+		}
+
+		hostPort := f.hostPort
+		if hostPort == 0 || !portFree(f.proto, hostPort) {
+			if hostPort, err = allocateForwardPort(db, cfg, f.proto); err != nil {
+				slog.Error("apply port forward", "vm", f.vmName, "forward_id", f.id, "err", err)
+				setPortForward(db, f.id, "error", 0, err.Error())
+				continue
+			}
+		}
+		if err := vm.HostFwdAdd(f.proto, hostPort, f.guestPort); err != nil {
+			slog.Error("apply port forward", "vm", f.vmName, "forward_id", f.id, "err", err)
+			setPortForward(db, f.id, "error", 0, err.Error())
+			continue
+		}
+		if applied[vm] == nil {
+			applied[vm] = map[int64]bool{}
+		}
+		// if the renter dropped it meanwhile, the next pass removes it
+		applied[vm][f.id] = true
+		if _, err := db.Exec(
+			`UPDATE port_forwards SET host_port = ?, state = 'active', error = NULL
+			  WHERE id = ? AND state IN ('pending', 'active')`,
+			hostPort, f.id,
+		); err != nil {
+			slog.Error("update port forward", "vm", f.vmName, "forward_id", f.id, "err", err)
+		}
+		slog.Info("port forwarded", "vm", f.vmName, "protocol", f.proto, "host_port", hostPort, "guest_port", f.guestPort)
+	}
+}
+
+func setPortForward(db *sql.DB, id int64, state string, hostPort int, errMsg string) {
+	if _, err := db.Exec(
+		`UPDATE port_forwards SET state = ?, host_port = NULLIF(?, 0), error = NULLIF(?, '') WHERE id = ?`,
+		state, hostPort, errMsg, id,
+	); err != nil {
+		slog.Error("update port forward", "forward_id", id, "err", err)
+	}
+}
+
+// allocateForwardPort picks a free host port no other forward on this
+// agent holds.
+func allocateForwardPort(db *sql.DB, cfg Config, proto string) (int, error) {
+	for i := 0; i < 50; i++ {
+		port := forwardPortMin + rand.Intn(forwardPortMax-forwardPortMin)
+		var taken int
+		if err := db.QueryRow(
+			`SELECT COUNT(*) FROM port_forwards pf JOIN rentals r ON r.vm_name = pf.vm_name
+			  WHERE r.agent_id = ? AND pf.protocol = ? AND pf.host_port = ? AND pf.state = 'active'`,
+			cfg.AgentID, proto, port,
+		).Scan(&taken); err != nil {
+			return 0, err
+		}
+		if taken == 0 && portFree(proto, port) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free host port for %s", proto)
+}
+
+// portFree reports whether proto port can be bound on this host.
+func portFree(proto string, port int) bool {
+	addr := fmt.Sprintf(":%d", port)
+	if proto == "udp" {
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// closePortForwards retires vmName's forwards once its VM is gone.
+func closePortForwards(db *sql.DB, vmName string) {
+	if _, err := db.Exec(
+		`UPDATE port_forwards SET state = 'removed'
+		  WHERE vm_name = ? AND state IN ('pending', 'active', 'removing')`,
+		vmName,
+	); err != nil {
+		slog.Error("close port forwards", "vm", vmName, "err", err)
+	}
+}
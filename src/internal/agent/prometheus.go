@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/mem"
+
+	"github.com/smeetnagda/vmshare/internal/metrics"
+)
+
+// agentMetrics is served on /metrics of the agent protocol listener when
+// Config.Metrics is set.
+var agentMetrics = metrics.NewRegistry()
+
+var startFailures = agentMetrics.NewCounter("vmshare_agent_vm_start_failures_total",
+	"Rental VMs that failed to boot.")
+
+// registerHostMetrics adds the gauges read at scrape time.
+func registerHostMetrics(vms *vmTable) {
+	agentMetrics.NewGaugeFunc("vmshare_agent_vms_running", "Rental VMs running on this host.",
+		func() ([]metrics.Sample, error) {
+			return []metrics.Sample{{Value: float64(len(vms.names()))}}, nil
+		})
+	agentMetrics.NewGaugeFunc("vmshare_agent_host_memory_bytes", "Host memory by kind: total or available.",
+		func() ([]metrics.Sample, error) {
+			v, err := mem.VirtualMemory()
+			if err != nil {
+				return nil, err
+			}
+			return []metrics.Sample{
+				{Values: []string{"total"}, Value: float64(v.Total)},
+				{Values: []string{"available"}, Value: float64(v.Available)},
+			}, nil
+		}, "kind")
+	agentMetrics.NewGaugeFunc("vmshare_agent_host_disk_free_bytes", "Free space on the host's root filesystem.",
+		func() ([]metrics.Sample, error) {
+			d, err := disk.Usage("/")
+			if err != nil {
+				return nil, err
+			}
+			return []metrics.Sample{{Value: float64(d.Free)}}, nil
+		})
+	agentMetrics.NewGaugeFunc("vmshare_agent_host_cpu_percent", "Host CPU use since the previous scrape, across all cores.",
+		func() ([]metrics.Sample, error) {
+			p, err := cpu.Percent(0, false)
+			if err != nil || len(p) == 0 {
+				return nil, err
+			}
+			return []metrics.Sample{{Value: p[0]}}, nil
+		})
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/smeetnagda/vmshare/internal/tunnel"
+)
+
+// Reconnect backoff for the coordinator tunnel. A tunnel that stayed up for
+// tunnelStableAfter starts over from the shortest delay.
+const (
+	tunnelMinBackoff  = time.Second
+	tunnelMaxBackoff  = time.Minute
+	tunnelStableAfter = time.Minute
+)
+
+// errTunnelDown is returned when the coordinator tunnel is not connected.
+var errTunnelDown = errors.New("coordinator tunnel is down")
+
+// reverseTunnel is the connection an agent behind NAT keeps open to the
+// coordinator's tunnel server. The coordinator sends the agent's HTTP API
+// traffic (VM consoles, SSH and incoming migrations) down it, and the agent
+// uses it to reach other agents.
+type reverseTunnel struct {
+	mu      sync.Mutex
+	conn    ssh.Conn
+	lastErr error
+}
+
+// coordinator is this agent's tunnel; it stays down unless cfg.TunnelAddr
+// is set.
+var coordinator reverseTunnel
+
+// run keeps the tunnel up, serving handler on it, reconnecting with
+// exponential backoff and jitter whenever it drops.
+func (t *reverseTunnel) run(cfg Config, handler http.Handler) {
+	backoff := tunnelMinBackoff
+	for {
+		start := time.Now()
+		err := t.connect(cfg, handler)
+		if time.Since(start) >= tunnelStableAfter {
+			backoff = tunnelMinBackoff
+		}
+		t.mu.Lock()
+		t.lastErr = err
+		t.mu.Unlock()
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		slog.Warn("coordinator tunnel down", "addr", cfg.TunnelAddr, "err", err, "retry_in", wait)
+		time.Sleep(wait)
+		backoff = min(2*backoff, tunnelMaxBackoff)
+	}
+}
+
+// connect logs in to the tunnel server and serves handler on the channels
+// the coordinator opens until the connection drops.
+func (t *reverseTunnel) connect(cfg Config, handler http.Handler) error {
+	config := &ssh.ClientConfig{
+		User:            tunnel.User(cfg.AgentID),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(cfg.TunnelKey)},
+		HostKeyCallback: ssh.FixedHostKey(cfg.TunnelHostKey),
+		ClientVersion:   "SSH-2.0-vmshare-agent",
+	}
+	nc, err := net.DialTimeout("tcp", cfg.TunnelAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	nc.SetDeadline(time.Now().Add(30 * time.Second))
+	conn, chans, reqs, err := ssh.NewClientConn(nc, cfg.TunnelAddr, config)
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("ssh: %v", err)
+	}
+	nc.SetDeadline(time.Time{})
+	defer conn.Close()
+
+	t.mu.Lock()
+	t.conn, t.lastErr = conn, nil
+	t.mu.Unlock()
+	slog.Info("coordinator tunnel connected", "addr", cfg.TunnelAddr)
+	defer func() {
+		t.mu.Lock()
+		t.conn = nil
+		t.mu.Unlock()
+	}()
+
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		tick := time.NewTicker(tunnel.KeepaliveInterval)
+		defer tick.Stop()
+		for range tick.C {
+			if _, _, err := conn.SendRequest("keepalive@vmshare", true, nil); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	ln := tunnel.NewListener(conn.LocalAddr())
+	go func() {
+		for nc := range chans {
+			if nc.ChannelType() != tunnel.HTTPChannel {
+				nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+				continue
+			}
+			ch, chReqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(chReqs)
+			ln.Push(tunnel.NewConn(ch, conn))
+		}
+		ln.Close()
+	}()
+	http.Serve(ln, handler)
+	return conn.Wait()
+}
+
+// tunnelPublicKey is the key published for the tunnel server to check
+// this agent's login against, or NULL when it uses no tunnel.
+func tunnelPublicKey(cfg Config) sql.NullString {
+	if cfg.TunnelKey == nil {
+		return sql.NullString{}
+	}
+	key := ssh.MarshalAuthorizedKey(cfg.TunnelKey.PublicKey())
+	return sql.NullString{String: strings.TrimSpace(string(key)), Valid: true}
+}
+
+// dialAgent opens a connection to agentID's HTTP API, relayed by the
+// coordinator.
+func (t *reverseTunnel) dialAgent(agentID int) (net.Conn, error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn == nil {
+		return nil, errTunnelDown
+	}
+	return tunnel.Open(conn, &tunnel.Target{AgentID: uint32(agentID)})
+}
+
+// up reports whether the tunnel is connected.
+func (t *reverseTunnel) up() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn != nil
+}
+
+// check is the tunnel's readiness check.
+func (t *reverseTunnel) check() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return nil
+	}
+	if t.lastErr != nil {
+		return fmt.Errorf("%w: %v", errTunnelDown, t.lastErr)
+	}
+	return errTunnelDown
+}
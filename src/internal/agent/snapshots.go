@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// syncSnapshots picks up snapshot requests for VMs we run and takes each in
+// the background; copying a disk can take a while.
+func syncSnapshots(db *sql.DB, cfg Config, vms *vmTable) {
+	rows, err := db.Query(
+		`SELECT id, vm_name FROM snapshots
+		  WHERE agent_id = ? AND state = 'pending'
+		  ORDER BY id`,
+		cfg.AgentID,
+	)
+	if err != nil {
+		slog.Error("query snapshots", "err", err)
+		return
+	}
+	type request struct {
+		id     int64
+		vmName string
+	}
+	var pending []request
+	for rows.Next() {
+		var r request
+		if err := rows.Scan(&r.id, &r.vmName); err != nil {
+			slog.Error("scan snapshot", "err", err)
+			continue
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+
+	for _, r := range pending {
+		vm := vms.get(r.vmName)
+		if vm == nil {
+			finishSnapshot(db, r.id, 0, fmt.Errorf("VM %s is not running on this agent", r.vmName))
+			continue
+		}
+		res, err := db.Exec(
+			`UPDATE snapshots SET state = 'creating' WHERE id = ? AND state = 'pending'`, r.id,
+		)
+		if err != nil {
+			slog.Error("claim snapshot", "vm", r.vmName, "snapshot_id", r.id, "err", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		go func(id int64, vm *system.VM) {
+			slog.Info("snapshotting VM", "vm", vm.Name, "snapshot_id", id)
+			size, err := vm.Snapshot(system.SnapshotPath(cfg.SnapshotDir, id))
+			finishSnapshot(db, id, size, err)
+		}(r.id, vm)
+	}
+}
+
+// finishSnapshot records the outcome of snapshot id.
+func finishSnapshot(db *sql.DB, id, size int64, snapErr error) {
+	state, errMsg := "available", ""
+	if snapErr != nil {
+		state, errMsg = "error", snapErr.Error()
+		slog.Error("snapshot VM", "snapshot_id", id, "err", snapErr)
+	} else {
+		slog.Info("snapshot ready", "snapshot_id", id, "bytes", size)
+	}
+	if _, err := db.Exec(
+		`UPDATE snapshots
+		    SET state = ?, size_bytes = NULLIF(?, 0), error = NULLIF(?, ''), completed_at = ?
+		  WHERE id = ?`,
+		state, size, errMsg, time.Now(), id,
+	); err != nil {
+		slog.Error("update snapshot", "snapshot_id", id, "err", err)
+	}
+}
+
+// failInterruptedSnapshots marks snapshots this agent was taking when it last
+// went down as failed; their files are incomplete.
+func failInterruptedSnapshots(db *sql.DB, cfg Config) {
+	if _, err := db.Exec(
+		`UPDATE snapshots SET state = 'error', error = 'agent restarted', completed_at = ?
+		  WHERE agent_id = ? AND state = 'creating'`,
+		time.Now(), cfg.AgentID,
+	); err != nil {
+		slog.Error("reset interrupted snapshots", "err", err)
+	}
+}
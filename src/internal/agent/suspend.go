@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// suspendDir is where vmName's state is saved while it is suspended.
+func suspendDir(cfg Config, vmName string) string {
+	return filepath.Join(cfg.SuspendDir, vmName)
+}
+
+// suspendVM saves a running VM to disk and ends its QEMU process, handing
+// the host its memory back. If saving fails the VM keeps running.
+func suspendVM(db *sql.DB, cfg Config, vms *vmTable, vmName string) {
+	vm := vms.beginStop(vmName)
+	if vm == nil {
+		return
+	}
+	slog.Info("suspending VM", "vm", vmName)
+	if err := vm.Suspend(suspendDir(cfg, vmName)); err != nil {
+		slog.Error("suspend VM", "vm", vmName, "err", err)
+		recordEvent(db, vmName, "error", "suspend VM: "+err.Error(), vm.StderrTail())
+		vms.endStop(vmName)
+		if _, err := db.Exec(
+			`UPDATE rentals SET state = 'running', suspended_at = NULL, pause_clock = 0
+			  WHERE vm_name = ? AND state = 'suspending'`,
+			vmName,
+		); err != nil {
+			slog.Error("update rental", "vm", vmName, "err", err)
+		}
+		return
+	}
+	// the VM's exit watcher drops it from vms and cancels its timers
+
+	if _, err := db.Exec(
+		`UPDATE rentals SET state = 'suspended', ip_address = NULL
+		  WHERE vm_name = ? AND state = 'suspending'`,
+		vmName,
+	); err != nil {
+		slog.Error("update rental", "vm", vmName, "err", err)
+		return
+	}
+	slog.Info("VM suspended", "vm", vmName)
+	recordEvent(db, vmName, "suspended", "saved to disk and QEMU ended", "")
+}
+
+// syncSuspended restores suspended VMs the coordinator asked to resume (or
+// that were migrated here), sends off those asked to move to another agent
+// and discards those whose rental ended while they were suspended.
+func syncSuspended(db *sql.DB, cfg Config, sched *expiry.Scheduler, vms *vmTable) {
+	rows, err := db.Query(
+		`SELECT vm_name, state FROM rentals
+		  WHERE agent_id = ? AND state IN ('resuming', 'stopping', 'migrating')`,
+		cfg.AgentID,
+	)
+	if err != nil {
+		slog.Error("query suspended rentals", "err", err)
+		return
+	}
+	type rental struct{ vmName, state string }
+	var pending []rental
+	for rows.Next() {
+		var r rental
+		if err := rows.Scan(&r.vmName, &r.state); err != nil {
+			slog.Error("scan suspended rental", "err", err)
+			continue
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+
+	for _, r := range pending {
+		if vms.get(r.vmName) != nil {
+			continue
+		}
+		if r.state == "migrating" {
+			go migrateOut(db, cfg, vms, r.vmName)
+			continue
+		}
+		dir := suspendDir(cfg, r.vmName)
+		if _, err := os.Stat(dir); err != nil {
+			if r.state == "resuming" {
+				slog.Error("resume VM: no saved state", "vm", r.vmName)
+				recordStopped(db, r.vmName, "resume_failed", "")
+				recordEvent(db, r.vmName, "error", "resume VM: no saved state on this agent", "")
+			}
+			continue
+		}
+		switch r.state {
+		case "resuming":
+			if vms.claim(r.vmName) {
+				go resumeVM(db, cfg, sched, vms, r.vmName)
+			}
+		case "stopping":
+			if err := system.DiscardSuspended(dir); err != nil {
+				slog.Error("discard suspended VM", "vm", r.vmName, "err", err)
+			}
+			slog.Info("discarded suspended VM", "vm", r.vmName)
+			recordStopped(db, r.vmName, "", "")
+			recordEvent(db, r.vmName, "destroyed", "suspended state discarded", "")
+		}
+	}
+}
+
+// resumeVM restores a suspended VM and puts it back under the agent's care
+// with its (possibly moved) deadline.
+func resumeVM(db *sql.DB, cfg Config, sched *expiry.Scheduler, vms *vmTable, vmName string) {
+	defer vms.release(vmName)
+
+	slog.Info("resuming VM", "vm", vmName)
+	vm, err := system.ResumeVM(suspendDir(cfg, vmName))
+	if err != nil {
+		slog.Error("resume VM", "vm", vmName, "err", err)
+		recordEvent(db, vmName, "error", "resume VM: "+err.Error(), "")
+		if _, err := db.Exec(
+			`UPDATE rentals SET state = 'suspended' WHERE vm_name = ? AND state = 'resuming'`,
+			vmName,
+		); err != nil {
+			slog.Error("update rental", "vm", vmName, "err", err)
+		}
+		return
+	}
+
+	var expiresAt time.Time
+	var egressPolicy, egressAllow, egressEffective sql.NullString
+	if err := db.QueryRow(
+		`SELECT expires_at, egress_policy, egress_allow, egress_effective FROM rentals WHERE vm_name = ?`, vmName,
+	).Scan(&expiresAt, &egressPolicy, &egressAllow, &egressEffective); err != nil {
+		slog.Error("load rental", "vm", vmName, "err", err)
+		expiresAt = time.Now()
+	}
+	trackVM(db, cfg, sched, vms, vm, expiresAt)
+	if err := startEgressProxy(vm, bootedEgress(cfg, egressPolicy, egressAllow, egressEffective)); err != nil {
+		slog.Error("start egress proxy", "vm", vmName, "err", err)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", vm.HostPort)
+	res, err := db.Exec(
+		`UPDATE rentals SET state = 'running', ip_address = ?
+		  WHERE vm_name = ? AND state = 'resuming'`,
+		addr, vmName,
+	)
+	if err != nil {
+		slog.Error("update rental", "vm", vmName, "err", err)
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		go stopVM(db, cfg, vms, vmName, "cancelled while resuming")
+	} else {
+		slog.Info("VM resumed", "vm", vmName, "ssh_port", vm.HostPort)
+		recordEvent(db, vmName, "resumed", "restored; SSH at "+addr, "")
+	}
+}
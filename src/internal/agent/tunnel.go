@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tunnelProtocol is the Upgrade token for a raw TCP stream to a VM's SSH
+// port, for coordinators that cannot reach the port themselves.
+const tunnelProtocol = "vmshare-tcp"
+
+// tunnelKeyTTL is how long a key sent with a tunnel request stays usable.
+// It only has to outlive the SSH handshake: sshd checks it at login.
+const tunnelKeyTTL = 2 * time.Minute
+
+// handleSSHTunnel handles GET /vms/{vmName}/ssh upgraded to tunnelProtocol:
+// the connection becomes a byte stream to the guest's SSH server. An
+// X-VMShare-Key header holds a public key to authorize in the guest for
+// the life of the tunnel.
+func handleSSHTunnel(cfg Config, vms *vmTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(cfg, r) {
+			http.Error(w, "bad token", http.StatusForbidden)
+			return
+		}
+		// expect path like "/vms/{vmName}/ssh"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "ssh" {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.EqualFold(r.Header.Get("Upgrade"), tunnelProtocol) {
+			http.Error(w, "upgrade to "+tunnelProtocol+" required", http.StatusUpgradeRequired)
+			return
+		}
+		vm := vms.get(parts[2])
+		if vm == nil {
+			http.Error(w, "VM is not running on this agent", http.StatusNotFound)
+			return
+		}
+
+		if key := r.Header.Get("X-VMShare-Key"); key != "" {
+			tag := newKeyTag()
+			if err := vm.AddTemporaryKey(key, tag, tunnelKeyTTL); err != nil {
+				slog.Error("authorize tunnel key", "vm", vm.Name, "err", err)
+				http.Error(w, "could not authorize key in guest", http.StatusBadGateway)
+				return
+			}
+			defer func() {
+				if err := vm.RemoveKey(tag); err != nil {
+					slog.Error("remove tunnel key", "vm", vm.Name, "err", err)
+				}
+			}()
+		}
+
+		guest, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", vm.HostPort), 5*time.Second)
+		if err != nil {
+			http.Error(w, "guest SSH unreachable", http.StatusBadGateway)
+			return
+		}
+		defer guest.Close()
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Time{})
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", tunnelProtocol)
+		if err := brw.Flush(); err != nil {
+			return
+		}
+		slog.Info("SSH tunnel opened", "vm", vm.Name)
+		pipe(conn, brw.Reader, guest)
+		slog.Info("SSH tunnel closed", "vm", vm.Name)
+	}
+}
+
+// pipe copies between a hijacked client connection (read through br, which
+// may hold bytes already buffered) and guest until either side closes.
+func pipe(conn net.Conn, br io.Reader, guest net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(guest, br)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, guest)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// newKeyTag returns a unique comment for a temporary authorized key.
+func newKeyTag() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "vmshare-tunnel-" + hex.EncodeToString(b)
+}
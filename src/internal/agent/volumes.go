@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"database/sql"
+	"log/slog"
+	"os"
+
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// syncVolumes creates the backing files of new volumes on this host and
+// removes those the coordinator marked for deletion.
+func syncVolumes(db *sql.DB, cfg Config) {
+	rows, err := db.Query(
+		`SELECT id, size_gb, state FROM volumes
+		  WHERE agent_id = ? AND state IN ('creating', 'deleting')`,
+		cfg.AgentID,
+	)
+	if err != nil {
+		slog.Error("query volumes", "err", err)
+		return
+	}
+	type volume struct {
+		id     int64
+		sizeGB int
+		state  string
+	}
+	var pending []volume
+	for rows.Next() {
+		var v volume
+		if err := rows.Scan(&v.id, &v.sizeGB, &v.state); err != nil {
+			slog.Error("scan volume", "err", err)
+			continue
+		}
+		pending = append(pending, v)
+	}
+	rows.Close()
+
+	for _, v := range pending {
+		path := system.VolumePath(cfg.VolumeDir, v.id)
+		switch v.state {
+		case "creating":
+			if err := system.CreateDisk(path, v.sizeGB); err != nil {
+				slog.Error("create volume", "volume_id", v.id, "err", err)
+				setVolumeState(db, v.id, "error", err.Error())
+				continue
+			}
+			slog.Info("volume created", "volume_id", v.id, "size_gb", v.sizeGB)
+			setVolumeState(db, v.id, "available", "")
+		case "deleting":
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				slog.Error("delete volume", "volume_id", v.id, "err", err)
+				setVolumeState(db, v.id, "error", err.Error())
+				continue
+			}
+			slog.Info("volume deleted", "volume_id", v.id)
+			setVolumeState(db, v.id, "deleted", "")
+		}
+	}
+}
+
+func setVolumeState(db *sql.DB, id int64, state, errMsg string) {
+	if _, err := db.Exec(
+		`UPDATE volumes SET state = ?, error = NULLIF(?, '') WHERE id = ?`,
+		state, errMsg, id,
+	); err != nil {
+		slog.Error("update volume", "volume_id", id, "err", err)
+	}
+}
+
+// attachedVolumes lists the volumes the coordinator attached to vmName.
+func attachedVolumes(db *sql.DB, cfg Config, vmName string) ([]system.VolumeDisk, error) {
+	rows, err := db.Query(
+		`SELECT id FROM volumes
+		  WHERE attached_to = ? AND agent_id = ? AND state = 'attached'
+		  ORDER BY id`,
+		vmName, cfg.AgentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vols []system.VolumeDisk
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		vols = append(vols, system.VolumeDisk{ID: id, Path: system.VolumePath(cfg.VolumeDir, id)})
+	}
+	return vols, rows.Err()
+}
+
+// detachVolumes makes vmName's volumes available again once its VM is gone.
+func detachVolumes(db *sql.DB, vmName string) {
+	if _, err := db.Exec(
+		`UPDATE volumes SET state = 'available', attached_to = NULL
+		  WHERE attached_to = ? AND state = 'attached'`,
+		vmName,
+	); err != nil {
+		slog.Error("detach volumes", "vm", vmName, "err", err)
+	}
+}
@@ -0,0 +1,196 @@
+// Package expiry keeps a min-heap of deadlines and fires a callback as each
+// one passes. The coordinator uses it to expire rental rows and the agent uses
+// it to stop the VMs it owns, so both react within a second of expires_at
+// instead of waiting for a polling tick.
+package expiry
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// entry is one pending deadline in the heap.
+type entry struct {
+	key   string
+	at    time.Time
+	fn    func()
+	index int
+}
+
+// deadlineHeap orders entries by deadline, earliest first.
+type deadlineHeap []*entry
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x any) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// Scheduler fires one callback per key when that key's deadline passes.
+// Keys are unique: scheduling an existing key replaces its deadline.
+type Scheduler struct {
+	mu       sync.Mutex
+	h        deadlineHeap
+	byKey    map[string]*entry
+	wake     chan struct{}
+	lastLoop time.Time
+}
+
+// loopInterval is the longest the loop sleeps, even with nothing due, so
+// LastLoop shows that it is still running.
+const loopInterval = 30 * time.Second
+
+// New returns an empty scheduler. Call Start to begin firing callbacks.
+func New() *Scheduler {
+	return &Scheduler{
+		byKey: make(map[string]*entry),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Start runs the scheduler loop in a background goroutine.
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+// Schedule arranges for fn to run once at (or just after) at. If key is
+// already scheduled its deadline and callback are replaced.
+func (s *Scheduler) Schedule(key string, at time.Time, fn func()) {
+	s.mu.Lock()
+	if e, ok := s.byKey[key]; ok {
+		e.at = at
+		e.fn = fn
+		heap.Fix(&s.h, e.index)
+	} else {
+		e := &entry{key: key, at: at, fn: fn}
+		heap.Push(&s.h, e)
+		s.byKey[key] = e
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Reschedule moves an existing key to a new deadline, keeping its callback.
+// It reports false if key is not scheduled.
+func (s *Scheduler) Reschedule(key string, at time.Time) bool {
+	s.mu.Lock()
+	e, ok := s.byKey[key]
+	if ok {
+		e.at = at
+		heap.Fix(&s.h, e.index)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.notify()
+	}
+	return ok
+}
+
+// Cancel removes key without firing it. It reports whether key was pending.
+func (s *Scheduler) Cancel(key string) bool {
+	s.mu.Lock()
+	e, ok := s.byKey[key]
+	if ok {
+		heap.Remove(&s.h, e.index)
+		delete(s.byKey, key)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.notify()
+	}
+	return ok
+}
+
+// Deadline returns the pending deadline for key, if any.
+func (s *Scheduler) Deadline(key string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.byKey[key]; ok {
+		return e.at, true
+	}
+	return time.Time{}, false
+}
+
+// LastLoop returns when the scheduler loop last woke up; it wakes at least
+// every 30 seconds while running.
+func (s *Scheduler) LastLoop() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastLoop
+}
+
+// Len returns the number of pending deadlines.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.h)
+}
+
+// notify wakes the loop so it can re-arm its timer for a new head.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		// Fire everything that is already due.
+		var due []*entry
+		s.mu.Lock()
+		now := time.Now()
+		s.lastLoop = now
+		for len(s.h) > 0 && !s.h[0].at.After(now) {
+			e := heap.Pop(&s.h).(*entry)
+			delete(s.byKey, e.key)
+			due = append(due, e)
+		}
+		wait := loopInterval
+		if len(s.h) > 0 && time.Until(s.h[0].at) < wait {
+			wait = time.Until(s.h[0].at)
+		}
+		s.mu.Unlock()
+
+		for _, e := range due {
+			// callbacks may block (e.g. a VM shutdown), so never run them
+			// on the loop goroutine
+			go e.fn()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
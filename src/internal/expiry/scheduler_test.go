@@ -0,0 +1,144 @@
+package expiry
+
+import (
+	"testing"
+	"time"
+)
+
+// recorder collects the keys a scheduler fires, in order.
+type recorder struct {
+	ch chan string
+}
+
+func newRecorder() *recorder {
+	return &recorder{ch: make(chan string, 16)}
+}
+
+func (r *recorder) fn(key string) func() {
+	return func() { r.ch <- key }
+}
+
+// wait returns the next n keys fired, failing the test if they take too long.
+func (r *recorder) wait(t *testing.T, n int) []string {
+	t.Helper()
+	var keys []string
+	for len(keys) < n {
+		select {
+		case k := <-r.ch:
+			keys = append(keys, k)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("fired %v, want %d keys", keys, n)
+		}
+	}
+	return keys
+}
+
+// quiet fails the test if anything fires within d.
+func (r *recorder) quiet(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case k := <-r.ch:
+		t.Fatalf("unexpected fire of %q", k)
+	case <-time.After(d):
+	}
+}
+
+func TestSchedulerFiresInDeadlineOrder(t *testing.T) {
+	s := New()
+	s.Start()
+	rec := newRecorder()
+	now := time.Now()
+	s.Schedule("c", now.Add(150*time.Millisecond), rec.fn("c"))
+	s.Schedule("a", now.Add(50*time.Millisecond), rec.fn("a"))
+	s.Schedule("b", now.Add(100*time.Millisecond), rec.fn("b"))
+
+	got := rec.wait(t, 3)
+	want := []string{"a", "b", "c"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("fired %v, want %v", got, want)
+		}
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len() = %d after all fired, want 0", n)
+	}
+}
+
+func TestSchedulerPastDeadlineFiresImmediately(t *testing.T) {
+	s := New()
+	s.Start()
+	rec := newRecorder()
+	s.Schedule("late", time.Now().Add(-time.Hour), rec.fn("late"))
+	rec.wait(t, 1)
+}
+
+func TestSchedulerReplaceReschedulesAndCancels(t *testing.T) {
+	s := New()
+	s.Start()
+	rec := newRecorder()
+	now := time.Now()
+
+	// replacing a key keeps one entry with the new deadline and callback
+	s.Schedule("k", now.Add(time.Hour), rec.fn("old"))
+	s.Schedule("k", now.Add(50*time.Millisecond), rec.fn("new"))
+	if n := s.Len(); n != 1 {
+		t.Fatalf("Len() = %d after replacing a key, want 1", n)
+	}
+	if got := rec.wait(t, 1); got[0] != "new" {
+		t.Fatalf("fired %q, want the replacement callback", got[0])
+	}
+
+	// Reschedule moves the deadline but keeps the callback
+	s.Schedule("r", now.Add(time.Hour), rec.fn("r"))
+	if !s.Reschedule("r", time.Now().Add(50*time.Millisecond)) {
+		t.Fatal("Reschedule of a pending key reported false")
+	}
+	rec.wait(t, 1)
+	if s.Reschedule("missing", time.Now()) {
+		t.Error("Reschedule of an unknown key reported true")
+	}
+
+	// Cancel drops the key without firing it
+	s.Schedule("x", time.Now().Add(50*time.Millisecond), rec.fn("x"))
+	if !s.Cancel("x") {
+		t.Fatal("Cancel of a pending key reported false")
+	}
+	if s.Cancel("x") {
+		t.Error("second Cancel reported true")
+	}
+	rec.quiet(t, 150*time.Millisecond)
+}
+
+func TestSchedulerDeadline(t *testing.T) {
+	s := New()
+	at := time.Now().Add(time.Hour)
+	s.Schedule("k", at, func() {})
+	got, ok := s.Deadline("k")
+	if !ok || !got.Equal(at) {
+		t.Errorf("Deadline(k) = %v, %v; want %v, true", got, ok, at)
+	}
+	if _, ok := s.Deadline("missing"); ok {
+		t.Error("Deadline of an unknown key reported true")
+	}
+}
+
+func TestSchedulerHeapOrderAfterRemovals(t *testing.T) {
+	s := New()
+	base := time.Now().Add(time.Hour)
+	keys := []string{"e", "b", "d", "a", "c"}
+	for i, k := range keys {
+		s.Schedule(k, base.Add(time.Duration(len(keys)-i)*time.Minute), func() {})
+	}
+	s.Cancel("d")
+	s.Reschedule("e", base.Add(-time.Minute))
+
+	var prev time.Time
+	for s.h.Len() > 0 {
+		e := s.h[0]
+		if e.at.Before(prev) {
+			t.Fatalf("heap returned %s at %v after %v", e.key, e.at, prev)
+		}
+		prev = e.at
+		s.Cancel(e.key)
+	}
+}
@@ -0,0 +1,73 @@
+package expiry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultWarnings are the offsets before expiry at which renters are warned.
+var DefaultWarnings = []time.Duration{15 * time.Minute, 5 * time.Minute, time.Minute}
+
+// ParseWarnings parses a comma-separated list of durations such as
+// "15m,5m,1m" into offsets sorted longest first. An empty string disables
+// warnings.
+func ParseWarnings(s string) ([]time.Duration, error) {
+	var offsets []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid warning offset %q", f)
+		}
+		offsets = append(offsets, d)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets, nil
+}
+
+// WarningKey is the scheduler key for the warning sent the given offset
+// ahead of key's deadline.
+func WarningKey(key string, before time.Duration) string {
+	return key + "#warn-" + before.String()
+}
+
+// ScheduleWarnings (re)arms one callback per offset at deadline-offset.
+// Offsets that are already in the past are cancelled rather than fired, so a
+// restart or a late extension never replays stale warnings.
+func (s *Scheduler) ScheduleWarnings(key string, deadline time.Time, offsets []time.Duration, fn func(before time.Duration)) {
+	now := time.Now()
+	for _, before := range offsets {
+		wk := WarningKey(key, before)
+		at := deadline.Add(-before)
+		if !at.After(now) {
+			s.Cancel(wk)
+			continue
+		}
+		before := before
+		s.Schedule(wk, at, func() { fn(before) })
+	}
+}
+
+// CancelWarnings drops every pending warning for key.
+func (s *Scheduler) CancelWarnings(key string, offsets []time.Duration) {
+	for _, before := range offsets {
+		s.Cancel(WarningKey(key, before))
+	}
+}
+
+// FormatOffset renders an offset for humans: "15m", "1h30m", "45s".
+func FormatOffset(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package expiry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseWarnings(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: " , ", want: nil},
+		{in: "1m", want: []time.Duration{time.Minute}},
+		{in: "1m,15m,5m", want: []time.Duration{15 * time.Minute, 5 * time.Minute, time.Minute}},
+		{in: " 30s , 1h ", want: []time.Duration{time.Hour, 30 * time.Second}},
+		{in: "1h30m,2h", want: []time.Duration{2 * time.Hour, 90 * time.Minute}},
+		{in: "5", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "0s", wantErr: true},
+		{in: "-5m", wantErr: true},
+		{in: "5m,bogus", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseWarnings(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseWarnings(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseWarnings(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseWarnings(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatOffset(t *testing.T) {
+	tests := []struct {
+		in   time.Duration
+		want string
+	}{
+		{15 * time.Minute, "15m"},
+		{time.Minute, "1m"},
+		{45 * time.Second, "45s"},
+		{90 * time.Minute, "1h30m"},
+		{2 * time.Hour, "2h"},
+		{61 * time.Second, "1m1s"},
+		{1500 * time.Millisecond, "2s"},
+	}
+	for _, tt := range tests {
+		if got := FormatOffset(tt.in); got != tt.want {
+			t.Errorf("FormatOffset(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleWarningsSkipsPastOffsets(t *testing.T) {
+	s := New()
+	deadline := time.Now().Add(10 * time.Minute)
+	offsets := []time.Duration{15 * time.Minute, 5 * time.Minute, time.Minute}
+	s.ScheduleWarnings("vm", deadline, offsets, func(time.Duration) {})
+
+	if _, ok := s.Deadline(WarningKey("vm", 15*time.Minute)); ok {
+		t.Error("warning 15m before a deadline 10m away was scheduled")
+	}
+	for _, before := range offsets[1:] {
+		at, ok := s.Deadline(WarningKey("vm", before))
+		if !ok || !at.Equal(deadline.Add(-before)) {
+			t.Errorf("warning %v: deadline %v, %v; want %v", before, at, ok, deadline.Add(-before))
+		}
+	}
+
+	// moving the deadline closer drops warnings that are now in the past
+	s.ScheduleWarnings("vm", time.Now().Add(2*time.Minute), offsets, func(time.Duration) {})
+	if _, ok := s.Deadline(WarningKey("vm", 5*time.Minute)); ok {
+		t.Error("stale 5m warning kept after the deadline moved closer")
+	}
+
+	s.CancelWarnings("vm", offsets)
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len() = %d after CancelWarnings, want 0", n)
+	}
+}
@@ -0,0 +1,127 @@
+// Package health serves liveness and readiness probes: a set of named
+// checks run on each request and reported as JSON, with 503 if any fails.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkTimeout bounds each check, so one hung dependency cannot hang the
+// probe.
+const checkTimeout = 5 * time.Second
+
+// Result is the outcome of one check.
+type Result struct {
+	Status     string `json:"status"` // ok or fail
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Report is the body of a probe response.
+type Report struct {
+	Status string            `json:"status"` // ok if every check passed
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checks is an ordered set of named checks.
+type Checks struct {
+	names []string
+	fns   []func() error
+}
+
+// Add registers a check; fn returns nil when healthy.
+func (c *Checks) Add(name string, fn func() error) {
+	c.names = append(c.names, name)
+	c.fns = append(c.fns, fn)
+}
+
+// Run runs every check concurrently.
+func (c *Checks) Run() Report {
+	rep := Report{Status: "ok", Checks: make(map[string]Result, len(c.names))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, name := range c.names {
+		wg.Add(1)
+		go func(name string, fn func() error) {
+			defer wg.Done()
+			res := run(fn)
+			mu.Lock()
+			rep.Checks[name] = res
+			if res.Status != "ok" {
+				rep.Status = "fail"
+			}
+			mu.Unlock()
+		}(name, c.fns[i])
+	}
+	wg.Wait()
+	return rep
+}
+
+// run runs fn, giving up on it after checkTimeout.
+func run(fn func() error) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(checkTimeout):
+		err = fmt.Errorf("timed out after %s", checkTimeout)
+	}
+	res := Result{Status: "ok", DurationMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Status, res.Error = "fail", err.Error()
+	}
+	return res
+}
+
+// Handler serves the report, with status 503 if any check failed.
+func (c *Checks) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		rep := c.Run()
+		w.Header().Set("Content-Type", "application/json")
+		if rep.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(rep)
+	})
+}
+
+// Heartbeat records when a background loop last went round.
+type Heartbeat struct {
+	last atomic.Int64 // UnixNano
+}
+
+// Beat marks the loop as alive now.
+func (h *Heartbeat) Beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+// Last is when Beat was last called, or the zero time if never.
+func (h *Heartbeat) Last() time.Time {
+	n := h.last.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Recent returns a check that fails unless last reports a time within max
+// of now, for loops that report their own progress.
+func Recent(last func() time.Time, max time.Duration) func() error {
+	return func() error {
+		t := last()
+		if t.IsZero() {
+			return fmt.Errorf("has not run yet")
+		}
+		if age := time.Since(t); age > max {
+			return fmt.Errorf("last ran %s ago", age.Truncate(time.Second))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+// Package logging sets up the structured (log/slog) logger shared by the
+// coordinator and agent: text or JSON output, secret redaction, and a
+// per-request logger carried in the context.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Setup installs the default logger, tagged with component, and returns
+// it. LOG_FORMAT picks text (default) or json output and LOG_LEVEL the
+// minimum level (debug, info, warn or error; default info). The standard
+// log package is routed through it too.
+func Setup(component string) (*slog.Logger, error) {
+	var level slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q", v)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+
+	var h slog.Handler
+	switch f := os.Getenv("LOG_FORMAT"); f {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q (want text or json)", f)
+	}
+	l := slog.New(h).With("component", component)
+	slog.SetDefault(l)
+	return l, nil
+}
+
+// secretKeys are substrings of attribute keys whose values are never
+// written out.
+var secretKeys = []string{"password", "passwd", "secret", "token", "authorization", "cookie", "private_key"}
+
+// Redacted replaces secret values in the output.
+const Redacted = "[REDACTED]"
+
+// redact blanks out attributes whose key names a secret, at any depth.
+func redact(_ []string, a slog.Attr) slog.Attr {
+	k := strings.ToLower(a.Key)
+	for _, s := range secretKeys {
+		if strings.Contains(k, s) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	return a
+}
+
+// Secret is a string that always logs as [REDACTED], whatever key it is
+// logged under.
+type Secret string
+
+// LogValue implements slog.LogValuer.
+func (Secret) LogValue() slog.Value {
+	return slog.StringValue(Redacted)
+}
+
+type ctxKey struct{}
+
+// WithLogger returns ctx carrying l.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, e.g. one tagged with the
+// request ID, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// NewRequestID returns a random ID for correlating one request's logs.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,353 @@
+// Package metrics is a small Prometheus client: counters and histograms
+// updated in process, gauges and histograms computed at scrape time, and
+// a handler serving them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram bucket bounds, in seconds, suited to HTTP
+// request latency.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds a set of metrics and writes them out on scrape.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is one metric family.
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.metrics {
+		if old.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	list := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range list {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry's metrics. The scrape is rendered in full
+// before anything is sent, so a failing collector fails it with a 500.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var buf bytes.Buffer
+		if err := r.Write(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+// desc is what every metric family has in common.
+type desc struct {
+	fqName, help, kind string
+	labels             []string
+}
+
+func (d desc) name() string { return d.fqName }
+
+func (d desc) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.fqName, escapeHelp(d.help), d.fqName, d.kind)
+	return err
+}
+
+// series formats one sample line; extra is an optional trailing label
+// (the histogram "le").
+func (d desc) series(w io.Writer, suffix string, values []string, extra string, v float64) error {
+	var b strings.Builder
+	b.WriteString(d.fqName + suffix)
+	if len(d.labels) > 0 || extra != "" {
+		b.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=%q", l, values[i])
+		}
+		if extra != "" {
+			if len(d.labels) > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(extra)
+		}
+		b.WriteByte('}')
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", b.String(), formatValue(v))
+	return err
+}
+
+// key joins label values into a map key.
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (d desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.fqName, len(d.labels), len(values)))
+	}
+}
+
+// sortedKeys returns m's keys in a stable order, so scrapes diff cleanly.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// Counter is a monotonically increasing count, one per combination of
+// label values.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	counts map[string]float64
+	values map[string][]string
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name, help, "counter", labels},
+		counts: map[string]float64{},
+		values: map[string][]string{},
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the series for values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the series for values.
+func (c *Counter) Add(v float64, values ...string) {
+	c.check(values)
+	k := key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[k]; !ok {
+		c.values[k] = append([]string(nil), values...)
+	}
+	c.counts[k] += v
+}
+
+func (c *Counter) write(w io.Writer) error {
+	if err := c.header(w); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.counts) == 0 {
+		return c.series(w, "", nil, "", 0)
+	}
+	for _, k := range sortedKeys(c.counts) {
+		if err := c.series(w, "", c.values[k], "", c.counts[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations into cumulative buckets, one set per
+// combination of label values.
+type Histogram struct {
+	desc
+	buckets  []float64
+	mu       sync.Mutex
+	bySeries map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (s *histogramSeries) observe(buckets []float64, v float64) {
+	for i, le := range buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds
+// (ascending; +Inf is implied) and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:     desc{name, help, "histogram", labels},
+		buckets:  buckets,
+		bySeries: map[string]*histogramSeries{},
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records v in the series for values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.check(values)
+	k := key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.bySeries[k]
+	if s == nil {
+		s = &histogramSeries{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.bySeries[k] = s
+	}
+	s.observe(h.buckets, v)
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	if err := h.header(w); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.bySeries) {
+		if err := writeHistogram(w, h.desc, h.buckets, h.bySeries[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHistogram(w io.Writer, d desc, buckets []float64, s *histogramSeries) error {
+	var cum uint64
+	for i, le := range buckets {
+		cum += s.counts[i]
+		if err := d.series(w, "_bucket", s.values, fmt.Sprintf("le=%q", formatValue(le)), float64(cum)); err != nil {
+			return err
+		}
+	}
+	if err := d.series(w, "_bucket", s.values, `le="+Inf"`, float64(s.count)); err != nil {
+		return err
+	}
+	if err := d.series(w, "_sum", s.values, "", s.sum); err != nil {
+		return err
+	}
+	return d.series(w, "_count", s.values, "", float64(s.count))
+}
+
+// Sample is one series of a computed gauge.
+type Sample struct {
+	Values []string // label values, in the order the labels were declared
+	Value  float64
+}
+
+// gaugeFunc is a gauge whose samples are computed on every scrape.
+type gaugeFunc struct {
+	desc
+	fn func() ([]Sample, error)
+}
+
+// NewGaugeFunc registers a gauge computed by fn at scrape time, e.g. from a
+// database query. If fn fails the scrape fails, rather than reporting stale
+// or partial values.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() ([]Sample, error), labels ...string) {
+	r.register(&gaugeFunc{desc{name, help, "gauge", labels}, fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	samples, err := g.fn()
+	if err != nil {
+		return fmt.Errorf("collect %s: %v", g.fqName, err)
+	}
+	if err := g.header(w); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		g.check(s.Values)
+		if err := g.series(w, "", s.Values, "", s.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogramFunc is a histogram rebuilt from all observations on every
+// scrape.
+type histogramFunc struct {
+	desc
+	buckets []float64
+	fn      func() ([]float64, error)
+}
+
+// NewHistogramFunc registers a histogram built at scrape time from the
+// observations fn returns, for values that already live in a database.
+func (r *Registry) NewHistogramFunc(name, help string, buckets []float64, fn func() ([]float64, error)) {
+	r.register(&histogramFunc{desc{name, help, "histogram", nil}, buckets, fn})
+}
+
+func (h *histogramFunc) write(w io.Writer) error {
+	obs, err := h.fn()
+	if err != nil {
+		return fmt.Errorf("collect %s: %v", h.fqName, err)
+	}
+	if err := h.header(w); err != nil {
+		return err
+	}
+	s := &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	for _, v := range obs {
+		s.observe(h.buckets, v)
+	}
+	return writeHistogram(w, h.desc, h.buckets, s)
+}
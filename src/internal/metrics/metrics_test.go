@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.\nBy code.", "method", "code")
+	c.Inc("GET", "200")
+	c.Add(2, "GET", "200")
+	c.Inc("POST", `a"b`)
+	r.NewCounter("plain_total", `A \ count.`)
+
+	want := `# HELP requests_total Requests.\nBy code.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 3
+requests_total{method="POST",code="a\"b"} 1
+# HELP plain_total A \\ count.
+# TYPE plain_total counter
+plain_total 0
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	for _, v := range []float64{0.05, 0.5, 0.5, 3} {
+		h.Observe(v, "/a")
+	}
+
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 3
+latency_seconds_bucket{route="/a",le="+Inf"} 4
+latency_seconds_sum{route="/a"} 4.05
+latency_seconds_count{route="/a"} 4
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFuncExposition(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("things", "Things by kind.", func() ([]Sample, error) {
+		return []Sample{{Values: []string{"a"}, Value: 2}, {Values: []string{"b"}, Value: math.Inf(1)}}, nil
+	}, "kind")
+	r.NewHistogramFunc("sizes", "Sizes.", []float64{10}, func() ([]float64, error) {
+		return []float64{1, 20}, nil
+	})
+
+	want := `# HELP things Things by kind.
+# TYPE things gauge
+things{kind="a"} 2
+things{kind="b"} +Inf
+# HELP sizes Sizes.
+# TYPE sizes histogram
+sizes_bucket{le="10"} 1
+sizes_bucket{le="+Inf"} 2
+sizes_sum 21
+sizes_count 2
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     bool
+		wantCode int
+	}{
+		{"ok", false, http.StatusOK},
+		{"collector fails", true, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		r := NewRegistry()
+		r.NewCounter("ok_total", "OK.")
+		r.NewGaugeFunc("db", "From the database.", func() ([]Sample, error) {
+			if tt.fail {
+				return nil, errors.New("database is locked")
+			}
+			return []Sample{{Value: 1}}, nil
+		})
+		rec := httptest.NewRecorder()
+		r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: code %d, want %d", tt.name, rec.Code, tt.wantCode)
+		}
+		if tt.fail && strings.Contains(rec.Body.String(), "ok_total") {
+			t.Errorf("%s: partial scrape served: %s", tt.name, rec.Body)
+		}
+		if !tt.fail && rec.Header().Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+			t.Errorf("%s: content type %q", tt.name, rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestDuplicateAndLabelMismatchPanic(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("x_total", "X.", "a")
+	for name, f := range map[string]func(){
+		"duplicate":      func() { r.NewCounter("x_total", "X again.") },
+		"label mismatch": func() { c.Inc("1", "2") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
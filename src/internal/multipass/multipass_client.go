@@ -3,6 +3,7 @@ package multipass
 import (
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -70,7 +71,7 @@ func StartVM(vmName, sshKey string, duration time.Duration) error {
     }
 
     // 5) Report SSH access
-    fmt.Printf("✅ VM %q running; SSH with:\n    ssh -p 22 ubuntu@%s\n", vmName, ip)
+    slog.Info("VM running", "vm", vmName, "ssh", "ubuntu@"+ip)
 
     // 6) Schedule automatic deletion after duration
     go func() {
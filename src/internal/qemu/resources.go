@@ -18,15 +18,13 @@ func CheckResources() error {
 		return fmt.Errorf("failed to get disk usage info: %v", err)
 	}
 
-	fmt.Printf("Total Memory: %v bytes, Available: %v bytes\n", v.Total, v.Available)
-	fmt.Printf("Free Disk Space: %v bytes\n", d.Free)
-
 	// Define minimum thresholds (example: 2GB RAM and 10GB Disk)
 	const minRAM = 2 * 1024 * 1024 * 1024
 	const minDisk = 10 * 1024 * 1024 * 1024
 
 	if v.Available < minRAM || d.Free < minDisk {
-		return fmt.Errorf("insufficient resources")
+		return fmt.Errorf("insufficient resources: %d MB memory and %d MB disk available",
+			v.Available>>20, d.Free>>20)
 	}
 
 	return nil
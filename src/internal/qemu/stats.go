@@ -1,25 +1,29 @@
 package system
 
 import (
+	"log/slog"
+
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/mem"
-	"log"
 )
 
-// GetMemoryStats fetches total system memory.
+// GetMemoryStats fetches total and available system memory, or zeros if
+// they can't be read.
 func GetMemoryStats() (uint64, uint64) {
 	vmStats, err := mem.VirtualMemory()
 	if err != nil {
-		log.Fatalf("Failed to get memory stats: %v", err)
+		slog.Error("read memory stats", "err", err)
+		return 0, 0
 	}
 	return vmStats.Total, vmStats.Available
 }
 
-// GetDiskStats fetches available disk space.
+// GetDiskStats fetches available disk space, or zero if it can't be read.
 func GetDiskStats() uint64 {
 	diskStats, err := disk.Usage("/")
 	if err != nil {
-		log.Fatalf("Failed to get disk stats: %v", err)
+		slog.Error("read disk stats", "err", err)
+		return 0
 	}
 	return diskStats.Free
 }
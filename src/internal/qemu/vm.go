@@ -2,11 +2,14 @@ package system
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+	vmsys "github.com/smeetnagda/vmshare/internal/system"
 )
 
 // runCmd is a helper for exec.Command
@@ -51,8 +54,10 @@ users:
 	return isoPath, nil
 }
 
-// StartVM launches a QEMU ARM64 VM with SSH port forwarding.
-func StartVM(vmName, sshKey string, duration time.Duration) error {
+// StartVM launches a QEMU ARM64 VM with SSH port forwarding and blocks until
+// it exits. The VM is killed when its entry in sched fires, so extending the
+// rental is just sched.Reschedule(vmName, newDeadline).
+func StartVM(vmName, sshKey string, sched *expiry.Scheduler, expiresAt time.Time) error {
     imagePath := filepath.Join(os.Getenv("HOME"), "qemu-images", "ubuntu-24.04-server-arm64.img")
     if _, err := os.Stat(imagePath); err != nil {
         return fmt.Errorf("cloud image not found at %s", imagePath)
@@ -69,7 +74,7 @@ func StartVM(vmName, sshKey string, duration time.Duration) error {
     if err != nil {
         return err
     }
-    log.Printf("✅ Generated cloud-init ISO: %s", seedISO)
+    slog.Info("generated cloud-init ISO", "vm", vmName, "path", seedISO)
 
     // 2) qcow2 overlay...
     vmDisk := filepath.Join(workDir, vmName+".qcow2")
@@ -79,6 +84,7 @@ func StartVM(vmName, sshKey string, duration time.Duration) error {
 
     // 3) Launch QEMU with monitor & serial log
     serialLog := filepath.Join(workDir, "serial.log")
+    qmpSock := filepath.Join(workDir, "qmp.sock")
     qemuArgs := []string{
         "-machine", "virt,accel=hvf",
         "-cpu", "host",
@@ -86,6 +92,7 @@ func StartVM(vmName, sshKey string, duration time.Duration) error {
         "-m", "2048",
 		"-bios", filepath.Join(os.Getenv("HOMEBREW_PREFIX"), "share", "qemu", "edk2-aarch64-code.fd"),
         "-monitor", "tcp:127.0.0.1:4444,server,nowait",
+        "-qmp", "unix:" + qmpSock + ",server=on,wait=off", // graceful shutdown
         "-serial", "file:" + serialLog,       // will capture Linux serial console once it starts
 
         "-display", "curses",                 // show the VGA console (UEFI shell & kernel)
@@ -102,23 +109,29 @@ func StartVM(vmName, sshKey string, duration time.Duration) error {
     cmd.Stdout = os.Stdout
     cmd.Stderr = os.Stderr
 
-    log.Printf("🚀 Starting QEMU VM %s...", vmName)
+    slog.Info("starting QEMU", "vm", vmName)
     if err := cmd.Start(); err != nil {
         return fmt.Errorf("failed to launch QEMU: %v", err)
     }
 
-    // 4) auto‐shutdown after duration...
-    go func() {
-        time.Sleep(duration)
-        log.Printf("⏰ Time expired, stopping VM %s...", vmName)
-        cmd.Process.Kill()
-    }()
+    // 4) auto‐shutdown at expiry...
+    done := make(chan struct{})
+    sched.Schedule(vmName, expiresAt, func() {
+        slog.Info("rental expired; stopping VM", "vm", vmName)
+        stage, err := vmsys.StopProcess(cmd.Process, done, qmpSock, vmsys.DefaultShutdownGrace)
+        if err != nil {
+            slog.Error("stop VM", "vm", vmName, "err", err)
+        }
+        slog.Info("VM stopped", "vm", vmName, "stage", stage)
+    })
 
     // 5) let the VM run
     if err := cmd.Wait(); err != nil {
-        log.Printf("❗ QEMU exited: %v", err)
+        slog.Warn("QEMU exited", "vm", vmName, "err", err)
     }
-    log.Printf("✅ VM %s stopped; cleaning up %s", vmName, workDir)
+    close(done)
+    sched.Cancel(vmName)
+    slog.Info("VM exited", "vm", vmName, "dir", workDir)
     return nil
 }
 
@@ -126,6 +139,6 @@ func StartVM(vmName, sshKey string, duration time.Duration) error {
 // DeleteVM cleans up the temporary directory for a VM.
 func DeleteVM(vmName string) error {
 	workDir := filepath.Join(os.TempDir(), "vmrentals", vmName)
-	log.Printf("🗑️ Cleaning up %s...", workDir)
+	slog.Info("removing VM directory", "vm", vmName, "dir", workDir)
 	return os.RemoveAll(workDir)
 }
@@ -1,14 +1,16 @@
 package server
 
 import (
+    "crypto/subtle"
     "database/sql"
     "encoding/json"
     "fmt"
     "net/http"
-	"log"
+    "strings"
 
     "golang.org/x/crypto/bcrypt"
     "github.com/gorilla/sessions"
+    "github.com/smeetnagda/vmshare/internal/logging"
 )
 
 type SignupRequest struct {
@@ -27,21 +29,17 @@ var Store = sessions.NewCookieStore([]byte("Vn9gL5xE2qZ7TJk81rMfA0bYD6hW3uCpNeQs
 
 func HandleSignup(db *sql.DB) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        log.Printf("[SIGNUP] %s %s", r.Method, r.URL.Path)
+        logger := logging.FromContext(r.Context())
         var req SignupRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            log.Printf("[SIGNUP] decode error: %v", err)
+            logger.Warn("signup: bad request body", "err", err)
             http.Error(w, "invalid request", http.StatusBadRequest)
             return
         }
-        // log the payload (never log raw passwords in prod!)
-        log.Printf(`[SIGNUP] payload: email=%q, password=%q, sshKey=%q`,
-            req.Email, req.Password, req.SSHKey)
-
         // hash password
         hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
         if err != nil {
-            log.Printf("[SIGNUP] bcrypt error: %v", err)
+            logger.Error("signup: hash password", "err", err)
             http.Error(w, "server error", http.StatusInternalServerError)
             return
         }
@@ -49,11 +47,11 @@ func HandleSignup(db *sql.DB) http.HandlerFunc {
         // now insert
         id, err := CreateUser(db, req.Email, string(hashed), req.SSHKey)
         if err != nil {
-            log.Printf("[SIGNUP] CreateUser error: %v", err)
+            logger.Error("signup: create user", "email", req.Email, "err", err)
             http.Error(w, "could not create user", http.StatusInternalServerError)
             return
         }
-        log.Printf("[SIGNUP] user created: id=%d, email=%s", id, req.Email)
+        logger.Info("user created", "user_id", id, "email", req.Email)
 
         w.WriteHeader(http.StatusCreated)
         fmt.Fprint(w, id)
@@ -95,16 +93,15 @@ func HandleGetCurrentUser(db *sql.DB) http.HandlerFunc {
 // HandleLogin POST /login
 func HandleLogin(db *sql.DB) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        log.Println("[LOGIN] new request")                              // 1
+        logger := logging.FromContext(r.Context())
         if r.Method != http.MethodPost {
-            log.Println("[LOGIN] wrong method:", r.Method)             // 2
             http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
             return
         }
 
         var req LoginRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            log.Printf("[LOGIN] decode error: %v\n", err)               // 3
+            logger.Warn("login: bad request body", "err", err)
             http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
             return
         }
@@ -115,18 +112,16 @@ func HandleLogin(db *sql.DB) http.HandlerFunc {
             `SELECT id, password FROM users WHERE email = ?`, req.Email,
         ).Scan(&id, &hash)
         if err == sql.ErrNoRows {
-            log.Printf("[LOGIN] user not found: %q\n", req.Email)        // 5
+            logger.Info("login failed: unknown user", "email", req.Email)
             http.Error(w, "invalid credentials", http.StatusUnauthorized)
             return
         } else if err != nil {
-            log.Printf("[LOGIN] db error: %v\n", err)                   // 6
+            logger.Error("login: load user", "err", err)
             http.Error(w, fmt.Sprintf("db error: %v", err), http.StatusInternalServerError)
             return
         }
-        log.Printf("[LOGIN] fetched id=%d, hash=%q\n", id, hash)         // 7
-
         if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-            log.Printf("[LOGIN] bcrypt mismatch: %v\n", err)             // 8
+            logger.Info("login failed: wrong password", "user_id", id)
             http.Error(w, "invalid credentials", http.StatusUnauthorized)
             return
         }
@@ -146,11 +141,32 @@ func HandleLogin(db *sql.DB) http.HandlerFunc {
 		return
 		}
 
-        log.Printf("[LOGIN] success for user id=%d\n", id)               // 9
+        logger.Info("user logged in", "user_id", id)
         w.WriteHeader(http.StatusOK)
         w.Write([]byte("ok"))
     }
 }
+// sessionUserID returns the logged-in user, writing a 401 if there is none.
+func sessionUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+    sess, _ := Store.Get(r, "vmshare-session")
+    userID, ok := sess.Values["user_id"].(int)
+    if !ok {
+        http.Error(w, "not logged in", http.StatusUnauthorized)
+    }
+    return userID, ok
+}
+
+// AdminToken lets operators act on any rental by sending it as a Bearer
+// token, e.g. to migrate VMs off a host being drained. Empty turns admin
+// access off.
+var AdminToken string
+
+// isAdmin reports whether r carries AdminToken.
+func isAdmin(r *http.Request) bool {
+    given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return ok && AdminToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(AdminToken)) == 1
+}
+
 // LogoutHandler clears the session and returns 204 No Content.
 func LogoutHandler() http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
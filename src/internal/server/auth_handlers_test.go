@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// asUser adds a session cookie for userID to r. A zero userID leaves r
+// logged out.
+func asUser(t *testing.T, r *http.Request, userID int) *http.Request {
+	t.Helper()
+	if userID == 0 {
+		return r
+	}
+	sess, _ := Store.New(r, "vmshare-session")
+	sess.Values["user_id"] = userID
+	rec := httptest.NewRecorder()
+	if err := sess.Save(r, rec); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// serve runs h on a request for method and target as userID and returns
+// the response.
+func serve(t *testing.T, h http.Handler, method, target, body string, userID int) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, asUser(t, r, userID))
+	return rec
+}
+
+func TestSessionUserID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if _, ok := sessionUserID(rec, httptest.NewRequest(http.MethodGet, "/", nil)); ok || rec.Code != http.StatusUnauthorized {
+		t.Errorf("logged out: ok = %v, code %d; want false, 401", ok, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	r := asUser(t, httptest.NewRequest(http.MethodGet, "/", nil), 42)
+	if id, ok := sessionUserID(rec, r); !ok || id != 42 {
+		t.Errorf("logged in: %d, %v; want 42, true", id, ok)
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	tests := []struct {
+		token  string
+		header string
+		want   bool
+	}{
+		{"", "", false},
+		{"", "Bearer ", false},
+		{"secret", "", false},
+		{"secret", "Bearer secret", true},
+		{"secret", "Bearer wrong", false},
+		{"secret", "secret", false},
+	}
+	for _, tt := range tests {
+		AdminToken = tt.token
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := isAdmin(r); got != tt.want {
+			t.Errorf("AdminToken %q, Authorization %q: isAdmin = %v, want %v", tt.token, tt.header, got, tt.want)
+		}
+	}
+	AdminToken = ""
+}
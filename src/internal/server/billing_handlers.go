@@ -0,0 +1,30 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HandleGetBilling handles GET /billing: the logged-in user's rental time
+// and network traffic, per rental and in total.
+func HandleGetBilling(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		usage, err := GetUsage(db, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to query usage: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBillingUsesSessionUser(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	mustExec(t, db, `UPDATE rentals SET net_rx_bytes = 1000, net_tx_bytes = 500`)
+
+	billing := HandleGetBilling(db)
+	if rec := serve(t, billing, http.MethodGet, "/billing", "", 0); rec.Code != http.StatusUnauthorized {
+		t.Errorf("logged out: %d, want 401", rec.Code)
+	}
+	tests := []struct {
+		user    int
+		rentals int
+		rx      int64
+	}{
+		{alice, 1, 1000},
+		{bob, 0, 0},
+	}
+	for _, tt := range tests {
+		// ?user_id= is ignored
+		rec := serve(t, billing, http.MethodGet, fmt.Sprintf("/billing?user_id=%d", alice), "", tt.user)
+		var u Usage
+		json.NewDecoder(rec.Body).Decode(&u)
+		if rec.Code != http.StatusOK || u.UserID != tt.user || len(u.Rentals) != tt.rentals || u.NetRxBytes != tt.rx {
+			t.Errorf("as user %d: %d, %+v; want 200 with %d rentals, %d bytes in", tt.user, rec.Code, u, tt.rentals, tt.rx)
+		}
+	}
+}
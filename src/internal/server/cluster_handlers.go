@@ -0,0 +1,278 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+	"github.com/smeetnagda/vmshare/internal/system"
+)
+
+// CreateClusterRequest defines the payload for POST /clusters.
+type CreateClusterRequest struct {
+	Name     string `json:"name"` // hostname prefix; members are <name>-1 … <name>-N
+	Size     int    `json:"size"`
+	SSHKey   string `json:"ssh_key"`
+	Duration int    `json:"duration"` // in minutes
+	Image    string `json:"image"`    // optional, defaults to system.DefaultImage
+	Flavor   string `json:"flavor"`   // optional, defaults to system.DefaultFlavor
+}
+
+// ExtendClusterResponse reports the shared deadline after
+// PATCH /clusters/{id}/extend.
+type ExtendClusterResponse struct {
+	ClusterID          int64     `json:"cluster_id"`
+	VMNames            []string  `json:"vm_names"`
+	ExpiresAt          time.Time `json:"expires_at"`
+	RequestedExpiresAt time.Time `json:"requested_expires_at"`
+	MaxExpiresAt       time.Time `json:"max_expires_at"`
+	Capped             bool      `json:"capped"`
+	CappedBy           string    `json:"capped_by,omitempty"`
+}
+
+// ClustersHandler dispatches GET->List, POST->Create on /clusters.
+func ClustersHandler(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
+	list := HandleListClusters(db)
+	create := HandleCreateCluster(db, sched)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list(w, r)
+		case http.MethodPost:
+			create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HandleCreateCluster handles POST /clusters for the logged-in user. Either
+// every member is scheduled or the request fails with 409 and nothing is
+// created.
+func HandleCreateCluster(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		var req CreateClusterRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Size < 2 || req.Size > MaxClusterSize {
+			http.Error(w, fmt.Sprintf("size must be between 2 and %d", MaxClusterSize), http.StatusBadRequest)
+			return
+		}
+		if req.Duration <= 0 {
+			http.Error(w, "duration must be > 0", http.StatusBadRequest)
+			return
+		}
+		if time.Duration(req.Duration)*time.Minute > MaxRentalLifetime {
+			http.Error(w, fmt.Sprintf("duration exceeds maximum rental lifetime of %v", MaxRentalLifetime), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			req.Name = "node"
+		}
+		if req.Image == "" {
+			req.Image = system.DefaultImage
+		}
+		if req.Flavor == "" {
+			req.Flavor = system.DefaultFlavor
+		}
+		if !system.ValidImageName(req.Image) {
+			http.Error(w, fmt.Sprintf("invalid image %q", req.Image), http.StatusBadRequest)
+			return
+		}
+		if _, err := system.LookupFlavor(req.Flavor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c, err := CreateCluster(db, NewCluster{
+			UserID:    userID,
+			Name:      req.Name,
+			Size:      req.Size,
+			SSHKey:    req.SSHKey,
+			Image:     req.Image,
+			Flavor:    req.Flavor,
+			ExpiresAt: time.Now().Add(time.Duration(req.Duration) * time.Minute),
+		})
+		switch {
+		case errors.Is(err, ErrInvalidClusterName):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrClusterNoCapacity), errors.Is(err, ErrNoNetworkPort):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to create cluster: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, n := range c.Nodes {
+			ScheduleRentalExpiry(db, sched, n.VMName, c.ExpiresAt)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// HandleListClusters handles GET /clusters, the logged-in user's clusters.
+func HandleListClusters(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		list, err := ListClusters(db, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to query clusters: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// clusterID extracts {id} from /clusters/{id}[/...].
+func clusterID(r *http.Request) (int64, bool) {
+	rest := strings.TrimPrefix(r.URL.Path, "/clusters/")
+	id, err := strconv.ParseInt(strings.SplitN(rest, "/", 2)[0], 10, 64)
+	return id, err == nil
+}
+
+// requireClusterOwner reports whether the logged-in user owns cluster id,
+// writing an error response if not.
+func requireClusterOwner(db *sql.DB, w http.ResponseWriter, r *http.Request, id int64) bool {
+	userID, ok := sessionUserID(w, r)
+	if !ok {
+		return false
+	}
+	var owner int
+	err := db.QueryRow(`SELECT user_id FROM clusters WHERE id = ?`, id).Scan(&owner)
+	if err == sql.ErrNoRows || (err == nil && owner != userID) {
+		http.Error(w, ErrClusterNotFound.Error(), http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load cluster: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// HandleGetCluster handles GET /clusters/{id}: the cluster and its
+// inventory of hostnames and addresses, for its owner.
+func HandleGetCluster(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := clusterID(r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireClusterOwner(db, w, r, id) {
+			return
+		}
+		c, err := GetCluster(db, id)
+		switch {
+		case errors.Is(err, ErrClusterNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to load cluster: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// HandleExtendCluster handles PATCH /clusters/{id}/extend for the cluster's
+// owner, moving every member to the same new deadline.
+func HandleExtendCluster(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := clusterID(r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireClusterOwner(db, w, r, id) {
+			return
+		}
+		var req ExtendRentalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Duration <= 0 {
+			http.Error(w, "duration must be > 0", http.StatusBadRequest)
+			return
+		}
+
+		ext, members, err := ExtendCluster(db, id, req.Duration, MaxRentalLifetime)
+		switch {
+		case errors.Is(err, ErrClusterNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrRentalExpired), errors.Is(err, ErrRentalInactive),
+			errors.Is(err, ErrLifetimeExhausted):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to extend cluster: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, vmName := range members {
+			ScheduleRentalExpiry(db, sched, vmName, ext.ExpiresAt)
+		}
+
+		resp := ExtendClusterResponse{
+			ClusterID:          id,
+			VMNames:            members,
+			ExpiresAt:          ext.ExpiresAt,
+			RequestedExpiresAt: ext.RequestedExpiresAt,
+			MaxExpiresAt:       ext.MaxExpiresAt,
+			Capped:             ext.CappedBy != "",
+			CappedBy:           ext.CappedBy,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// HandleDeleteCluster handles DELETE /clusters/{id} for the cluster's owner,
+// stopping every member.
+func HandleDeleteCluster(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := clusterID(r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireClusterOwner(db, w, r, id) {
+			return
+		}
+		members, err := DeleteCluster(db, id)
+		switch {
+		case errors.Is(err, ErrClusterNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to delete cluster: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, vmName := range members {
+			CancelRentalExpiry(sched, vmName)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+)
+
+// seedCluster creates a two-node cluster for userID through the handler.
+func seedCluster(t *testing.T, db *sql.DB, sched *expiry.Scheduler, userID int) *Cluster {
+	t.Helper()
+	rec := serve(t, ClustersHandler(db, sched), http.MethodPost, "/clusters",
+		`{"name": "node", "size": 2, "ssh_key": "k", "duration": 60}`, userID)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create cluster: %d %s", rec.Code, rec.Body)
+	}
+	var c Cluster
+	json.NewDecoder(rec.Body).Decode(&c)
+	return &c
+}
+
+func TestClusterHandlersCheckOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 4, 0)
+	sched := expiry.New()
+	c := seedCluster(t, db, sched, alice)
+	if c.UserID != alice {
+		t.Errorf("cluster owned by %d, want %d", c.UserID, alice)
+	}
+	target := fmt.Sprintf("/clusters/%d", c.ID)
+
+	tests := []struct {
+		name   string
+		h      http.HandlerFunc
+		method string
+		target string
+		body   string
+		user   int
+		want   int
+	}{
+		{"get logged out", HandleGetCluster(db), http.MethodGet, target, "", 0, http.StatusUnauthorized},
+		{"get someone else's", HandleGetCluster(db), http.MethodGet, target, "", bob, http.StatusNotFound},
+		{"get own", HandleGetCluster(db), http.MethodGet, target, "", alice, http.StatusOK},
+		{"extend someone else's", HandleExtendCluster(db, sched), http.MethodPatch, target + "/extend", `{"duration": 10}`, bob, http.StatusNotFound},
+		{"extend own", HandleExtendCluster(db, sched), http.MethodPatch, target + "/extend", `{"duration": 10}`, alice, http.StatusOK},
+		{"delete logged out", HandleDeleteCluster(db, sched), http.MethodDelete, target, "", 0, http.StatusUnauthorized},
+		{"delete someone else's", HandleDeleteCluster(db, sched), http.MethodDelete, target, "", bob, http.StatusNotFound},
+		{"delete own", HandleDeleteCluster(db, sched), http.MethodDelete, target, "", alice, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, tt.h, tt.method, tt.target, tt.body, tt.user); rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	var clusterState, networkState string
+	var live int
+	db.QueryRow(`SELECT state FROM clusters WHERE id = ?`, c.ID).Scan(&clusterState)
+	db.QueryRow(`SELECT state FROM networks WHERE id = ?`, c.NetworkID).Scan(&networkState)
+	db.QueryRow(`SELECT COUNT(*) FROM rentals WHERE cluster_id = ? AND state NOT IN (?, ?)`,
+		c.ID, RentalStopped, RentalExpired).Scan(&live)
+	if clusterState != ClusterDeleted || networkState != NetworkDeleted || live != 0 {
+		t.Errorf("after delete: cluster %s, network %s, %d live members; want deleted, deleted, 0",
+			clusterState, networkState, live)
+	}
+}
+
+func TestExpiryFinishesCluster(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	seedAgent(t, db, 1, 4, 0)
+	sched := expiry.New()
+	c := seedCluster(t, db, sched, alice)
+	mustExec(t, db, `UPDATE rentals SET expires_at = ? WHERE cluster_id = ?`, time.Now().Add(-time.Second), c.ID)
+
+	state := func() (cluster, network string) {
+		db.QueryRow(`SELECT state FROM clusters WHERE id = ?`, c.ID).Scan(&cluster)
+		db.QueryRow(`SELECT state FROM networks WHERE id = ?`, c.NetworkID).Scan(&network)
+		return
+	}
+	expireRental(db, sched, c.Nodes[0].VMName)
+	if cluster, network := state(); cluster != ClusterActive || network != NetworkActive {
+		t.Errorf("one member left: cluster %s, network %s; want both active", cluster, network)
+	}
+	expireRental(db, sched, c.Nodes[1].VMName)
+	if cluster, network := state(); cluster != ClusterDeleted || network != NetworkDeleted {
+		t.Errorf("all members expired: cluster %s, network %s; want both deleted", cluster, network)
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/logging"
+	"github.com/smeetnagda/vmshare/internal/websocket"
+)
+
+// AllowedOrigins are the browser origins allowed to call the API, and so
+// to open WebSockets on it with the user's session.
+var AllowedOrigins = []string{"http://localhost:3000"}
+
+// HandleConsole handles GET /rentals/{vmName}/console/log, the guest's
+// serial output since boot, and GET /rentals/{vmName}/console, a WebSocket
+// to its interactive serial console. Both are proxied to the VM's agent
+// and only open to the rental's owner.
+func HandleConsole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// expect path like "/rentals/{vmName}/console[/log]"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 4 || len(parts) > 5 || parts[3] != "console" || (len(parts) == 5 && parts[4] != "log") {
+			http.NotFound(w, r)
+			return
+		}
+		vmName := parts[2]
+		if len(parts) == 4 && !websocket.IsUpgrade(r) {
+			http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		if websocket.IsUpgrade(r) && !allowedOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if !requireRentalOwner(db, w, r, vmName) {
+			return
+		}
+		proxyToAgent(db, w, r, vmName, "/vms/"+vmName+"/"+strings.Join(parts[3:], "/"))
+	}
+}
+
+// requireRentalOwner reports whether the logged-in user owns vmName,
+// writing an error response if not.
+func requireRentalOwner(db *sql.DB, w http.ResponseWriter, r *http.Request, vmName string) bool {
+	userID, ok := sessionUserID(w, r)
+	if !ok {
+		return false
+	}
+	st, err := GetRentalStatus(db, vmName)
+	if errors.Is(err, ErrRentalNotFound) || (err == nil && st.UserID != userID) {
+		http.Error(w, ErrRentalNotFound.Error(), http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load rental: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// allowedOrigin reports whether a browser request comes from the API's own
+// origin or one of AllowedOrigins. Browsers do not apply CORS to
+// WebSockets, so this is what keeps other sites from opening one with the
+// user's cookie.
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // not a browser
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, o := range AllowedOrigins {
+		if origin == o {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyToAgent forwards r to agentPath on the agent running vmName,
+// WebSocket upgrades included.
+func proxyToAgent(db *sql.DB, w http.ResponseWriter, r *http.Request, vmName, agentPath string) {
+	ep, err := RentalAgent(db, vmName)
+	switch {
+	case errors.Is(err, ErrRentalNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrRentalNotRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to find agent: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logger := logging.FromContext(r.Context())
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = ep.host()
+			pr.Out.URL.Path = agentPath
+			pr.Out.URL.RawPath = ""
+			pr.Out.URL.RawQuery = ""
+			pr.Out.Host = ep.host()
+			pr.Out.Header.Del("Cookie")
+			pr.Out.Header.Set("Authorization", "Bearer "+ep.Token)
+		},
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return dialAgentConn(ep)
+			},
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Error("proxy to agent", "vm", vmName, "agent_id", ep.ID, "err", err)
+			http.Error(w, "agent unreachable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// agentTunnelProtocol is the Upgrade token agents accept on
+// /vms/{vmName}/ssh for a raw stream to the VM's SSH port.
+const agentTunnelProtocol = "vmshare-tcp"
+
+// dialAgent opens a raw stream through the agent running vmName, by
+// upgrading a request for agentPath, with header added to it.
+func dialAgent(db *sql.DB, vmName, agentPath string, header http.Header) (net.Conn, error) {
+	ep, err := RentalAgent(db, vmName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialAgentConn(ep)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+ep.host()+agentPath, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+ep.Token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", agentTunnelProtocol)
+
+	// the agent may take a while to authorize a key in the guest
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("agent %d: %v", ep.ID, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("agent %d: %v", ep.ID, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		conn.Close()
+		return nil, fmt.Errorf("agent %d: %s: %s", ep.ID, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads drain a bufio.Reader first, so
+// nothing the peer sent along with its handshake response is lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -2,21 +2,140 @@ package server
 
 import (
     "database/sql"
-    "log"
+    "fmt"
+    "log/slog"
     "time"
+
+    "github.com/smeetnagda/vmshare/internal/expiry"
 )
 
-// StartExpiredRentalCleanup kicks off a goroutine that deletes expired rentals every minute.
-func StartExpiredRentalCleanup(db *sql.DB) {
-    go func() {
-        ticker := time.NewTicker(1 * time.Minute)
-        for range ticker.C {
-            n, err := DeleteExpiredRentals(db)
-            if err != nil {
-                log.Printf("Error deleting expired rentals: %v", err)
-            } else if n > 0 {
-                log.Printf("Cleaned up %d expired rentals", n)
-            }
+// StartExpiryScheduler loads every rental's deadline from the DB into a new
+// expiry scheduler and starts it. Rentals that expired while the coordinator
+// was down fire immediately.
+func StartExpiryScheduler(db *sql.DB) (*expiry.Scheduler, error) {
+    sched := expiry.New()
+
+    rows, err := db.Query(
+        `SELECT vm_name, expires_at FROM rentals
+          WHERE state IN (?, ?, ?, ?, ?, ?)
+            AND NOT (pause_clock = 1 AND suspended_at IS NOT NULL)`,
+        RentalPending, RentalRunning, RentalSuspending, RentalSuspended, RentalResuming, RentalMigrating,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("load rental deadlines: %v", err)
+    }
+    defer rows.Close()
+
+    n := 0
+    for rows.Next() {
+        var vmName string
+        var expiresAt time.Time
+        if err := rows.Scan(&vmName, &expiresAt); err != nil {
+            return nil, fmt.Errorf("scan rental deadline: %v", err)
         }
-    }()
+        ScheduleRentalExpiry(db, sched, vmName, expiresAt)
+        n++
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("iterate rental deadlines: %v", err)
+    }
+
+    sched.Start()
+    slog.Info("expiry scheduler started", "rentals", n)
+    return sched, nil
+}
+
+// ExpiryWarnings are the offsets before expiry at which the coordinator
+// notifies a rental's owner.
+var ExpiryWarnings = expiry.DefaultWarnings
+
+// ScheduleRentalExpiry (re)arms the expiry for vmName at expiresAt, along
+// with its pre-expiry warnings.
+func ScheduleRentalExpiry(db *sql.DB, sched *expiry.Scheduler, vmName string, expiresAt time.Time) {
+    sched.Schedule(vmName, expiresAt, func() {
+        expireRental(db, sched, vmName)
+    })
+    sched.ScheduleWarnings(vmName, expiresAt, ExpiryWarnings, func(time.Duration) {
+        notifyExpiryWarning(db, vmName)
+    })
+}
+
+// CancelRentalExpiry drops the expiry and any pending warnings for vmName.
+func CancelRentalExpiry(sched *expiry.Scheduler, vmName string) {
+    sched.Cancel(vmName)
+    sched.CancelWarnings(vmName, ExpiryWarnings)
+}
+
+// notifyExpiryWarning records an expiry_warning notification for the
+// rental's owner so clients can prompt them to extend.
+func notifyExpiryWarning(db *sql.DB, vmName string) {
+    var userID int
+    var expiresAt time.Time
+    err := db.QueryRow(
+        `SELECT user_id, expires_at FROM rentals
+          WHERE vm_name = ? AND state IN (?, ?, ?, ?, ?, ?)
+            AND NOT (pause_clock = 1 AND suspended_at IS NOT NULL)`,
+        vmName, RentalPending, RentalRunning, RentalSuspending, RentalSuspended, RentalResuming, RentalMigrating,
+    ).Scan(&userID, &expiresAt)
+    if err == sql.ErrNoRows {
+        return
+    } else if err != nil {
+        slog.Error("load rental for expiry warning", "vm", vmName, "err", err)
+        return
+    }
+
+    msg := fmt.Sprintf("Rental %s expires in %s (at %s). Extend it or save your work.",
+        vmName, expiry.FormatOffset(time.Until(expiresAt)), expiresAt.UTC().Format(time.RFC1123))
+    if _, err := CreateNotification(db, userID, vmName, "expiry_warning", msg, &expiresAt); err != nil {
+        slog.Error("record expiry warning", "vm", vmName, "err", err)
+        return
+    }
+    if err := recordRentalEvent(db, vmName, EventWarningSent, msg); err != nil {
+        slog.Error("record rental event", "vm", vmName, "err", err)
+    }
+    slog.Info("expiry warning sent", "vm", vmName, "user_id", userID, "expires_at", expiresAt)
+}
+
+// expireRental ends the rental once its deadline has passed: pending rentals
+// become expired, others are handed to their agent to stop, and a cluster
+// whose members have all ended is retired. If the row was extended after
+// the timer fired, it re-arms with the new deadline.
+func expireRental(db *sql.DB, sched *expiry.Scheduler, vmName string) {
+    var expiresAt time.Time
+    err := db.QueryRow(
+        `SELECT expires_at FROM rentals WHERE vm_name = ?`, vmName,
+    ).Scan(&expiresAt)
+    if err == sql.ErrNoRows {
+        return
+    } else if err != nil {
+        slog.Error("load rental for expiry", "vm", vmName, "err", err)
+        return
+    }
+    if expiresAt.After(time.Now()) {
+        ScheduleRentalExpiry(db, sched, vmName, expiresAt)
+        return
+    }
+    // a suspension with the clock stopped defers expiry until ResumeRental
+    // re-arms it with the shifted deadline
+    if paused, err := clockPaused(db, vmName); err != nil {
+        slog.Error("load rental for expiry", "vm", vmName, "err", err)
+        return
+    } else if paused {
+        return
+    }
+
+    if _, err := StopRental(db, vmName, "expired"); err != nil {
+        slog.Error("expire rental", "vm", vmName, "err", err)
+        expiryErrors.Inc()
+        return
+    }
+    rentalsExpired.Inc()
+    slog.Info("rental expired", "vm", vmName)
+
+    // the last member of a cluster to expire takes the cluster with it
+    if done, err := FinishCluster(db, vmName); err != nil {
+        slog.Error("finish cluster", "vm", vmName, "err", err)
+    } else if done {
+        slog.Info("cluster finished", "vm", vmName)
+    }
 }
@@ -6,16 +6,25 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// MigrationsDir holds schema.sql and the numbered migrations. It is read
+// when the database is opened and again by the readiness probe, so it
+// should be absolute: the default only works when the coordinator runs
+// from the source tree.
+var MigrationsDir = "migrations"
+
 // NewDB opens (or creates) the SQLite file at dbPath, runs migrations, and returns the *sql.DB.
 func NewDB(dbPath string) (*sql.DB, error) {
 	// Ensure the data directory exists
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create db directory %%s: %%v", dir, err)
+		return nil, fmt.Errorf("failed to create db directory %s: %v", dir, err)
 	}
 
 	// Open SQLite database
@@ -25,7 +34,7 @@ func NewDB(dbPath string) (*sql.DB, error) {
 	}
 
 	// Read and execute migrations
-	schemaPath := filepath.Join("migrations", "schema.sql")
+	schemaPath := filepath.Join(MigrationsDir, "schema.sql")
 	schema, err := ioutil.ReadFile(schemaPath)
 	if err != nil {
 		db.Close()
@@ -35,6 +44,109 @@ func NewDB(dbPath string) (*sql.DB, error) {
 		db.Close()
 		return nil, fmt.Errorf("exec migrations: %v", err)
 	}
+	if err := applyMigrations(db, MigrationsDir); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	return db, nil
 }
+
+// applyMigrations runs every migrations/NNN_*.sql file that has not been
+// recorded in schema_migrations yet, in version order. schema.sql is the
+// idempotent baseline; numbered files carry changes (ALTER TABLE etc.) that
+// must only run once.
+func applyMigrations(db *sql.DB, dir string) error {
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+		  version    INTEGER PRIMARY KEY,
+		  applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %v", err)
+	}
+
+	files, err := migrationFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, m := range files {
+		var n int
+		if err := db.QueryRow(
+			`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.version,
+		).Scan(&n); err != nil {
+			return fmt.Errorf("check migration %d: %v", m.version, err)
+		}
+		if n > 0 {
+			continue
+		}
+
+		body, err := ioutil.ReadFile(m.path)
+		if err != nil {
+			return fmt.Errorf("read %s: %v", m.path, err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin migration %d: %v", m.version, err)
+		}
+		if _, err := tx.Exec(string(body)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("exec %s: %v", filepath.Base(m.path), err)
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO schema_migrations(version) VALUES (?)`, m.version,
+		); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("record migration %d: %v", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("commit migration %d: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+type migrationFile struct {
+	version int
+	path    string
+}
+
+// migrationFiles lists dir/NNN_*.sql sorted by NNN.
+func migrationFiles(dir string) ([]migrationFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "[0-9]*_*.sql"))
+	if err != nil {
+		return nil, fmt.Errorf("list migrations: %v", err)
+	}
+	var files []migrationFile
+	for _, p := range paths {
+		prefix := strings.SplitN(filepath.Base(p), "_", 2)[0]
+		v, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("bad migration name %s: %v", p, err)
+		}
+		files = append(files, migrationFile{version: v, path: p})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].version < files[j].version })
+	return files, nil
+}
+
+// checkMigrations reports an error unless every migration in dir has been
+// applied, e.g. when a newer coordinator binary shares the DB with an old
+// migrations directory or the other way round.
+func checkMigrations(db *sql.DB, dir string) error {
+	files, err := migrationFiles(dir)
+	if err != nil {
+		return err
+	}
+	var applied sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&applied); err != nil {
+		return fmt.Errorf("read schema version: %v", err)
+	}
+	latest := 0
+	if len(files) > 0 {
+		latest = files[len(files)-1].version
+	}
+	if int(applied.Int64) != latest {
+		return fmt.Errorf("schema at version %d, migrations directory at %d", applied.Int64, latest)
+	}
+	return nil
+}
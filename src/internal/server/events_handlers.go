@@ -0,0 +1,232 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/logging"
+)
+
+// HandleListRentalEvents handles GET /rentals/{vmName}/events?after_id=N.
+// It returns the rental's timeline oldest first; after_id lets a client
+// fetch only what it has not seen yet. Only the rental's owner may read it.
+func HandleListRentalEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// expect path like "/rentals/{vmName}/events"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "events" {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireRentalOwner(db, w, r, parts[2]) {
+			return
+		}
+		var afterID int64
+		if v := r.URL.Query().Get("after_id"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid after_id", http.StatusBadRequest)
+				return
+			}
+			afterID = n
+		}
+
+		events, err := ListRentalEvents(db, parts[2], afterID)
+		if errors.Is(err, ErrRentalNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list events: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	}
+}
+
+// watchKeepalive is how often an idle watch stream gets a comment line, so
+// proxies do not time it out.
+const watchKeepalive = 15 * time.Second
+
+// HandleWatchRental handles GET /rentals/{vmName}/watch, a Server-Sent
+// Events stream of the rental's updates. It opens with a "snapshot" event
+// holding the rental's current status; a client that reconnects with
+// Last-Event-ID (or ?after_id=) is sent what it missed instead. Only the
+// rental's owner may watch it.
+func HandleWatchRental(db *sql.DB, hub *WatchHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// expect path like "/rentals/{vmName}/watch"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "watch" {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireRentalOwner(db, w, r, parts[2]) {
+			return
+		}
+		afterID, resume, err := watchAfterID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := GetRentalStatus(db, parts[2])
+		if errors.Is(err, ErrRentalNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to load rental: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		sub := hub.Subscribe(st.VMName, 0)
+		defer sub.Close()
+		if !resume {
+			// everything already recorded is reflected in the snapshot
+			if afterID, err = lastRentalEventID(db, st.VMName); err != nil {
+				http.Error(w, fmt.Sprintf("failed to load rental: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		startWatchStream(w)
+		if !resume {
+			writeWatchEvent(w, 0, "snapshot", st)
+		}
+		serveWatch(w, r, db, sub, afterID)
+	}
+}
+
+// HandleWatchUser handles GET /watch, a Server-Sent Events stream of
+// updates to all of the logged-in user's rentals. Only new updates are
+// sent unless the client reconnects with Last-Event-ID (or ?after_id=).
+func HandleWatchUser(db *sql.DB, hub *WatchHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sess, _ := Store.Get(r, "vmshare-session")
+		userID, ok := sess.Values["user_id"].(int)
+		if !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		afterID, resume, err := watchAfterID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sub := hub.Subscribe("", userID)
+		defer sub.Close()
+		if !resume {
+			if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM rental_events`).Scan(&afterID); err != nil {
+				http.Error(w, fmt.Sprintf("failed to query events: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		startWatchStream(w)
+		serveWatch(w, r, db, sub, afterID)
+	}
+}
+
+// watchAfterID reads where a reconnecting watcher left off, from the
+// Last-Event-ID header or the after_id parameter. resume is false for a
+// fresh watcher.
+func watchAfterID(r *http.Request) (afterID int64, resume bool, err error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("after_id")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+	afterID, err = strconv.ParseInt(v, 10, 64)
+	if err != nil || afterID < 0 {
+		return 0, false, errors.New("invalid Last-Event-ID")
+	}
+	return afterID, true, nil
+}
+
+// lastRentalEventID returns the ID of vmName's latest event, or 0.
+func lastRentalEventID(db *sql.DB, vmName string) (int64, error) {
+	var id int64
+	err := db.QueryRow(
+		`SELECT COALESCE(MAX(id), 0) FROM rental_events WHERE vm_name = ?`, vmName,
+	).Scan(&id)
+	return id, err
+}
+
+func startWatchStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+}
+
+// serveWatch sends sub's updates after afterID until the client goes away
+// or falls too far behind. Updates already in the database when sub was
+// opened are replayed from there first; the hub may deliver some of them
+// again, so anything at or before the last ID sent is skipped.
+func serveWatch(w http.ResponseWriter, r *http.Request, db *sql.DB, sub *Subscription, afterID int64) {
+	rc := http.NewResponseController(w)
+	for {
+		backlog, err := ListRentalUpdates(db, afterID, sub.vmName, sub.userID)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("replay rental events", "err", err)
+			return
+		}
+		for _, u := range backlog {
+			writeWatchEvent(w, u.ID, u.Kind, u)
+			afterID = u.ID
+		}
+		if len(backlog) < maxRentalUpdates {
+			break
+		}
+	}
+	rc.Flush()
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case u, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if u.ID <= afterID {
+				continue
+			}
+			writeWatchEvent(w, u.ID, u.Kind, u)
+			afterID = u.ID
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeWatchEvent writes one SSE event; id 0 is left out so it does not
+// reset the client's Last-Event-ID.
+func writeWatchEvent(w http.ResponseWriter, id int64, kind string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if id != 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data)
+}
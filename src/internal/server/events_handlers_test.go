@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRentalEventsCheckOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+
+	events := HandleListRentalEvents(db)
+	tests := []struct {
+		name   string
+		target string
+		user   int
+		want   int
+	}{
+		{"logged out", "/rentals/vm/events", 0, http.StatusUnauthorized},
+		{"someone else's", "/rentals/vm/events", bob, http.StatusNotFound},
+		{"unknown rental", "/rentals/missing/events", alice, http.StatusNotFound},
+		{"own", "/rentals/vm/events", alice, http.StatusOK},
+		{"own, bad after_id", "/rentals/vm/events?after_id=-1", alice, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, events, http.MethodGet, tt.target, "", tt.user); rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestWatchRentalChecksOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+
+	// not started: the stream ends with the request, so nothing needs the
+	// hub's polling loop
+	hub := &WatchHub{db: db, subs: make(map[*Subscription]struct{})}
+	watch := HandleWatchRental(db, hub)
+	tests := []struct {
+		name   string
+		target string
+		user   int
+		want   int
+	}{
+		{"logged out", "/rentals/vm/watch", 0, http.StatusUnauthorized},
+		{"someone else's", "/rentals/vm/watch", bob, http.StatusNotFound},
+		{"unknown rental", "/rentals/missing/watch", alice, http.StatusNotFound},
+		{"own", "/rentals/vm/watch", alice, http.StatusOK},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		watch.ServeHTTP(rec, asUser(t, r, tt.user))
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+		if snapshot := strings.Contains(rec.Body.String(), "event: snapshot"); snapshot != (tt.want == http.StatusOK) {
+			t.Errorf("%s: snapshot sent = %v: %s", tt.name, snapshot, rec.Body)
+		}
+	}
+}
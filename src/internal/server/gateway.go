@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// gatewayHandshakeTimeout bounds how long a client of the gateway or the
+// agent tunnel server may take to log in.
+const gatewayHandshakeTimeout = 30 * time.Second
+
+// gatewayMaxHandshakes caps the connections still logging in to each SSH
+// listener, so clients that connect and stall cannot tie up the
+// coordinator; connections over the cap are closed at once.
+const gatewayMaxHandshakes = 64
+
+// errGatewayDenied is what every failed gateway login sees, so it does not
+// reveal which rentals exist.
+var errGatewayDenied = errors.New("permission denied")
+
+// ServeSSHGateway runs the SSH gateway on addr: renters log in with
+// `ssh <vm_name>@gateway` using the key on their account, and their
+// session is carried through to the rental's guest.
+func ServeSSHGateway(db *sql.DB, addr string, hostKey ssh.Signer) error {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return authorizeGatewayKey(db, meta.User(), key)
+		},
+		ServerVersion: "SSH-2.0-vmshare-gateway",
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("SSH gateway listening", "addr", addr)
+	return serveGateway(db, ln, config)
+}
+
+// serveGateway accepts gateway clients on ln until it fails.
+func serveGateway(db *sql.DB, ln net.Listener, config *ssh.ServerConfig) error {
+	return acceptSSH(ln, "SSH gateway", func(conn net.Conn, loggedIn func()) {
+		handleGatewayConn(db, config, conn, loggedIn)
+	})
+}
+
+// acceptSSH accepts connections on ln until it fails and hands each to
+// handle, which calls loggedIn once its SSH handshake is over. Connections
+// beyond gatewayMaxHandshakes still logging in are dropped.
+func acceptSSH(ln net.Listener, name string, handle func(conn net.Conn, loggedIn func())) error {
+	handshakes := make(chan struct{}, gatewayMaxHandshakes)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		select {
+		case handshakes <- struct{}{}:
+			go handle(conn, func() { <-handshakes })
+		default:
+			slog.Warn(name+": too many logins in progress; dropping connection", "remote", conn.RemoteAddr().String())
+			conn.Close()
+		}
+	}
+}
+
+// authorizeGatewayKey lets key log in as vmName if it is one of the keys
+// on the account that owns the rental.
+func authorizeGatewayKey(db *sql.DB, vmName string, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var userID int
+	var keys sql.NullString
+	err := db.QueryRow(
+		`SELECT u.id, u.ssh_key FROM rentals r JOIN users u ON u.id = r.user_id WHERE r.vm_name = ?`,
+		vmName,
+	).Scan(&userID, &keys)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error("SSH gateway: load rental owner", "vm", vmName, "err", err)
+		}
+		return nil, errGatewayDenied
+	}
+	want := key.Marshal()
+	rest := []byte(keys.String)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var k ssh.PublicKey
+		k, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(k.Marshal(), want) {
+			return &ssh.Permissions{Extensions: map[string]string{"user_id": fmt.Sprint(userID)}}, nil
+		}
+	}
+	return nil, errGatewayDenied
+}
+
+// handleGatewayConn logs a client in and bridges its connection to the
+// guest: every channel and request it opens is opened on a connection to
+// the guest's sshd, and vice versa, so shells, exec, scp/sftp and port
+// forwarding all work as if the client had connected directly.
+// loggedIn is called once the login has succeeded or failed.
+func handleGatewayConn(db *sql.DB, config *ssh.ServerConfig, conn net.Conn, loggedIn func()) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(gatewayHandshakeTimeout))
+	client, chans, reqs, err := ssh.NewServerConn(conn, config)
+	loggedIn()
+	if err != nil {
+		slog.Debug("SSH gateway handshake", "remote", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer client.Close()
+	vmName := client.User()
+	logger := slog.With("vm", vmName, "user_id", client.Permissions.Extensions["user_id"],
+		"remote", conn.RemoteAddr().String())
+
+	guest, guestChans, guestReqs, err := dialGuestConn(db, vmName)
+	if err != nil {
+		logger.Warn("SSH gateway: connect to guest", "err", err)
+		msg := "could not reach the VM"
+		if errors.Is(err, ErrRentalNotRunning) {
+			msg = err.Error()
+		}
+		go ssh.DiscardRequests(reqs)
+		for nc := range chans {
+			nc.Reject(ssh.ConnectionFailed, msg)
+		}
+		return
+	}
+	defer guest.Close()
+	logger.Info("SSH gateway session opened")
+
+	go relayGlobalRequests(reqs, guest)
+	go relayGlobalRequests(guestReqs, client)
+	go func() {
+		for nc := range guestChans {
+			go bridgeChannel(nc, client)
+		}
+	}()
+	go func() {
+		guest.Wait()
+		client.Close()
+	}()
+	for nc := range chans {
+		go bridgeChannel(nc, guest)
+	}
+	logger.Info("SSH gateway session closed")
+}
+
+// relayGlobalRequests passes connection-level requests (keepalives, remote
+// port forwards) on to the other side and its replies back.
+func relayGlobalRequests(in <-chan *ssh.Request, out ssh.Conn) {
+	for req := range in {
+		ok, payload, err := out.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok, payload = false, nil
+		}
+		if req.WantReply {
+			req.Reply(ok, payload)
+		}
+	}
+}
+
+// bridgeChannel opens a channel like nc on out and copies data, stderr and
+// requests (pty, window size, exit status, ...) between the two until the
+// far side closes it.
+func bridgeChannel(nc ssh.NewChannel, out ssh.Conn) {
+	dst, dstReqs, err := out.OpenChannel(nc.ChannelType(), nc.ExtraData())
+	if err != nil {
+		var oce *ssh.OpenChannelError
+		if errors.As(err, &oce) {
+			nc.Reject(oce.Reason, oce.Message)
+		} else {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	src, srcReqs, err := nc.Accept()
+	if err != nil {
+		dst.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(dst, src)
+		dst.CloseWrite()
+	}()
+	go io.Copy(dst.Stderr(), src.Stderr())
+	go func() {
+		relayChannelRequests(srcReqs, dst)
+		dst.Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(src, dst)
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(src.Stderr(), dst.Stderr())
+		wg.Done()
+	}()
+	// the far side's exit status arrives as a request before it closes
+	relayChannelRequests(dstReqs, src)
+	wg.Wait()
+	src.CloseWrite()
+	src.Close()
+}
+
+func relayChannelRequests(in <-chan *ssh.Request, out ssh.Channel) {
+	for req := range in {
+		ok, err := out.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok = false
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// LoadHostKey reads the coordinator's SSH host key (used by the gateway and
+// the agent tunnels) from path, generating and saving a new ed25519 key if
+// there is none yet.
+func LoadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "vmshare coordinator")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, fmt.Errorf("save SSH host key: %v", err)
+	}
+	slog.Info("generated SSH host key", "path", path)
+	return ssh.NewSignerFromKey(priv)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newPublicKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestAuthorizeGatewayKey(t *testing.T) {
+	db := newTestDB(t)
+	laptop, laptopLine := newPublicKey(t)
+	desktop, desktopLine := newPublicKey(t)
+	bobKey, bobLine := newPublicKey(t)
+	stranger, _ := newPublicKey(t)
+
+	// several keys, with comments and blank lines between them
+	alice := seedUser(t, db, "alice@example.com",
+		"# work\n"+laptopLine+" alice@laptop\n\n"+desktopLine+" alice@desktop\n")
+	bob := seedUser(t, db, "bob@example.com", bobLine)
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "alice-vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+	seedRental(t, db, "bob-vm", bob, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		vm     string
+		key    ssh.PublicKey
+		wantID string // "" if denied
+	}{
+		{"first of several keys", "alice-vm", laptop, fmt.Sprint(alice)},
+		{"second of several keys", "alice-vm", desktop, fmt.Sprint(alice)},
+		{"another user's key", "alice-vm", bobKey, ""},
+		{"owner's key on their own VM", "bob-vm", bobKey, fmt.Sprint(bob)},
+		{"owner's key on someone else's VM", "bob-vm", laptop, ""},
+		{"unknown key", "alice-vm", stranger, ""},
+		{"unknown VM", "no-such-vm", laptop, ""},
+	}
+	for _, tt := range tests {
+		perms, err := authorizeGatewayKey(db, tt.vm, tt.key)
+		if tt.wantID == "" {
+			if err != errGatewayDenied {
+				t.Errorf("%s: %v, %v; want errGatewayDenied", tt.name, perms, err)
+			}
+			continue
+		}
+		if err != nil || perms.Extensions["user_id"] != tt.wantID {
+			t.Errorf("%s: %v, %v; want user %s", tt.name, perms, err, tt.wantID)
+		}
+	}
+}
+
+func TestGatewayCapsLogins(t *testing.T) {
+	db := newTestDB(t)
+	hostKey, err := LoadHostKey(t.TempDir() + "/host_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return authorizeGatewayKey(db, meta.User(), key)
+		},
+		ServerVersion: "SSH-2.0-vmshare-gateway",
+	}
+	config.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveGateway(db, ln, config)
+	testLoginCap(t, ln, "SSH-2.0-vmshare-gateway")
+}
+
+// testLoginCap checks that the SSH server on ln, which greets clients with
+// banner, turns connections away while gatewayMaxHandshakes others are
+// still logging in.
+func testLoginCap(t *testing.T, ln net.Listener, banner string) {
+	t.Helper()
+	// clients that connect and never log in hold every slot...
+	var stalled []net.Conn
+	defer func() {
+		for _, c := range stalled {
+			c.Close()
+		}
+	}()
+	greeting := func(c net.Conn) (string, error) {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return bufio.NewReader(c).ReadString('\n')
+	}
+	for i := 0; i < gatewayMaxHandshakes; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stalled = append(stalled, c)
+		if line, err := greeting(c); err != nil || !strings.HasPrefix(line, banner) {
+			t.Fatalf("connection %d: banner %q, %v", i+1, line, err)
+		}
+	}
+
+	// ...so the next is turned away
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if line, err := greeting(c); err == nil {
+		t.Fatalf("connection over the cap got %q", line)
+	}
+
+	// and a slot frees up when a stalled client goes away
+	stalled[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := greeting(c)
+		c.Close()
+		if err == nil && strings.HasPrefix(line, banner) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no slot freed after a client left")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -3,41 +3,71 @@ package server
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
-	"strconv"
-
-	"github.com/smeetnagda/vmshare/internal/multipass"
 
+	"github.com/smeetnagda/vmshare/internal/expiry"
+	"github.com/smeetnagda/vmshare/internal/logging"
+	"github.com/smeetnagda/vmshare/internal/system"
 )
 
-// CreateRentalRequest defines the payload for creating a rental.
+// CreateRentalRequest defines the payload for creating a rental. The
+// rental belongs to the session user.
 type CreateRentalRequest struct {
-	UserID   int    `json:"user_id"`
 	SSHKey   string `json:"ssh_key"`
 	Duration int    `json:"duration"` // in minutes
+	Image    string `json:"image"`    // optional, defaults to system.DefaultImage
+	Flavor   string `json:"flavor"`   // optional, defaults to system.DefaultFlavor
+	// VolumeIDs are attached for the rental's lifetime; the rental is
+	// pinned to the agent that holds them.
+	VolumeIDs []int64 `json:"volume_ids"`
+	// NetworkIDs are private networks the VM gets an extra NIC on; the
+	// rental is pinned to their agent.
+	NetworkIDs []int64 `json:"network_ids"`
+	// FromSnapshot boots the rental from one of the user's snapshots
+	// instead of a fresh image; image and flavor default to the snapshot's.
+	FromSnapshot int64 `json:"from_snapshot"`
+	// EgressPolicy limits what the VM may reach (see system.Egress*); the
+	// host's own policy applies if it is stricter. EgressAllow lists the
+	// hosts and subnets an allowlist policy permits.
+	EgressPolicy string   `json:"egress_policy"`
+	EgressAllow  []string `json:"egress_allow"`
 }
 
 // CreateRentalResponse returns the VM name and expiration.
 type CreateRentalResponse struct {
 	VMName    string    `json:"vm_name"`
+	Image     string    `json:"image"`
+	Flavor    string    `json:"flavor"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
 type ExtendRentalRequest struct {
 	    Duration int `json:"duration"` // minutes to add
 }
+// ExtendRentalResponse tells the renter the deadline that actually took
+// effect, which may be earlier than requested if a lifetime cap applied.
 type ExtendRentalResponse struct {
-    VMName    string    `json:"vm_name"`
-    ExpiresAt time.Time `json:"expires_at"`
+    VMName             string    `json:"vm_name"`
+    ExpiresAt          time.Time `json:"expires_at"`
+    RequestedExpiresAt time.Time `json:"requested_expires_at"`
+    MaxExpiresAt       time.Time `json:"max_expires_at"`
+    Capped             bool      `json:"capped"`
+    CappedBy           string    `json:"capped_by,omitempty"` // "max_lifetime" or "host_cap"
 }
 
+// MaxRentalLifetime bounds how long a rental may live in total, counted from
+// its creation, across the initial duration and all extensions.
+var MaxRentalLifetime = 24 * time.Hour
+
 
 // RentalsHandler dispatches GET->List, POST->Create
-func RentalsHandler(db *sql.DB) http.HandlerFunc {
+func RentalsHandler(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
     list := HandleListRentals(db)
-    create := HandleCreateRental(db)
+    create := HandleCreateRental(db, sched)
     return func(w http.ResponseWriter, r *http.Request) {
         switch r.Method {
         case http.MethodGet:
@@ -57,7 +87,11 @@ func HandleListRentals(db *sql.DB) http.HandlerFunc {
             return
         }
         rows, err := db.Query(`
-            SELECT id, vm_name, user_id, agent_id, ip_address, expires_at, created_at
+            SELECT id, vm_name, user_id, agent_id, ip_address, image, flavor, from_snapshot,
+                   state, suspended_at, pause_clock,
+                   egress_policy, egress_allow, egress_effective,
+                   net_rx_bytes, net_tx_bytes, net_limited,
+                   stop_reason, stop_stage, stopped_at, expires_at, created_at
             FROM rentals
         `)
         if err != nil {
@@ -65,6 +99,11 @@ func HandleListRentals(db *sql.DB) http.HandlerFunc {
             return
         }
         defer rows.Close()
+        ports, err := activePortForwards(db)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("failed to query port forwards: %v", err), http.StatusInternalServerError)
+            return
+        }
 
         var list []Rental
         for rows.Next() {
@@ -75,12 +114,31 @@ func HandleListRentals(db *sql.DB) http.HandlerFunc {
                 &rec.UserID,
                 &rec.AgentID,
                 &rec.IPAddress,
+                &rec.Image,
+                &rec.Flavor,
+                &rec.FromSnapshot,
+                &rec.State,
+                &rec.SuspendedAt,
+                &rec.PauseClock,
+                &rec.EgressPolicy,
+                &rec.EgressAllow,
+                &rec.EgressEffective,
+                &rec.NetRxBytes,
+                &rec.NetTxBytes,
+                &rec.NetLimited,
+                &rec.StopReason,
+                &rec.StopStage,
+                &rec.StoppedAt,
                 &rec.ExpiresAt,
                 &rec.CreatedAt,
             ); err != nil {
                 http.Error(w, fmt.Sprintf("failed to scan rental: %v", err), http.StatusInternalServerError)
                 return
             }
+            rec.Ports = ports[rec.VMName]
+            if rec.Ports == nil {
+                rec.Ports = []PortForward{}
+            }
             list = append(list, rec)
         }
         if err := rows.Err(); err != nil {
@@ -92,12 +150,16 @@ func HandleListRentals(db *sql.DB) http.HandlerFunc {
     }
 }
 // HandleCreateRental handles POST /rentals to create a new VM rental.
-func HandleCreateRental(db *sql.DB) http.HandlerFunc {
+func HandleCreateRental(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
 
 		var req CreateRentalRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -105,28 +167,160 @@ func HandleCreateRental(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if time.Duration(req.Duration)*time.Minute > MaxRentalLifetime {
+			http.Error(w, fmt.Sprintf("duration exceeds maximum rental lifetime of %v", MaxRentalLifetime), http.StatusBadRequest)
+			return
+		}
+
+		var snap *Snapshot
+		if req.FromSnapshot != 0 {
+			var err error
+			snap, err = GetSnapshot(db, req.FromSnapshot)
+			if err == nil && snap.UserID != userID {
+				err = ErrSnapshotNotFound
+			}
+			switch {
+			case errors.Is(err, ErrSnapshotNotFound):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			case err != nil:
+				http.Error(w, fmt.Sprintf("failed to load snapshot: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if snap.State != SnapshotAvailable {
+				http.Error(w, ErrSnapshotUnavailable.Error(), http.StatusConflict)
+				return
+			}
+			if req.Image != "" && req.Image != snap.Image {
+				http.Error(w, fmt.Sprintf("snapshot %d is of image %q", snap.ID, snap.Image), http.StatusBadRequest)
+				return
+			}
+			req.Image = snap.Image
+			if req.Flavor == "" {
+				req.Flavor = snap.Flavor
+			}
+		}
+
+		if req.Image == "" {
+			req.Image = system.DefaultImage
+		}
+		if req.Flavor == "" {
+			req.Flavor = system.DefaultFlavor
+		}
+		if !system.ValidImageName(req.Image) {
+			http.Error(w, fmt.Sprintf("invalid image %q", req.Image), http.StatusBadRequest)
+			return
+		}
+		if _, err := system.LookupFlavor(req.Flavor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.EgressPolicy == "" && len(req.EgressAllow) > 0 {
+			req.EgressPolicy = system.EgressAllowlist
+		}
+		if req.EgressPolicy != "" && !system.ValidEgressPolicy(req.EgressPolicy) {
+			http.Error(w, fmt.Sprintf("invalid egress_policy %q", req.EgressPolicy), http.StatusBadRequest)
+			return
+		}
+		for _, entry := range req.EgressAllow {
+			if !system.ValidEgressAllow(entry) {
+				http.Error(w, fmt.Sprintf("invalid egress_allow entry %q", entry), http.StatusBadRequest)
+				return
+			}
+		}
+
 		// Generate a unique VM name
-		vmName := fmt.Sprintf("rental-%d-%d", req.UserID, time.Now().Unix())
+		vmName := fmt.Sprintf("rental-%d-%d", userID, time.Now().Unix())
 		expiresAt := time.Now().Add(time.Duration(req.Duration) * time.Minute)
 
-		// Persist the rental
-		if _, err := db.Exec(
-			`INSERT INTO rentals(vm_name, user_id, ssh_key, agent_id, expires_at)
-			 VALUES (?, ?, ?, ?, ?)`,
-			vmName, req.UserID, req.SSHKey, 0, expiresAt,
+		// Persist the rental (and claim its volumes) atomically
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to create rental: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		agentID := 0
+		if len(req.VolumeIDs) > 0 {
+			agentID, err = attachVolumes(tx, vmName, userID, req.VolumeIDs)
+			switch {
+			case errors.Is(err, ErrVolumeNotFound):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			case errors.Is(err, ErrVolumeUnavailable), errors.Is(err, ErrVolumesSplit):
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case err != nil:
+				http.Error(w, fmt.Sprintf("failed to attach volumes: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		var fromSnapshot sql.NullInt64
+		if snap != nil {
+			// the snapshot file only exists on the agent that took it
+			if agentID != 0 && agentID != snap.AgentID {
+				http.Error(w, ErrSnapshotElsewhere.Error(), http.StatusConflict)
+				return
+			}
+			agentID = snap.AgentID
+			fromSnapshot = sql.NullInt64{Int64: snap.ID, Valid: true}
+		}
+		if len(req.NetworkIDs) > 0 {
+			netAgent, err := attachNetworks(tx, vmName, userID, req.NetworkIDs)
+			switch {
+			case errors.Is(err, ErrNetworkNotFound):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			case errors.Is(err, ErrNetworksSplit):
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case err != nil:
+				http.Error(w, fmt.Sprintf("failed to attach networks: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if agentID != 0 && agentID != netAgent {
+				http.Error(w, ErrNetworkElsewhere.Error(), http.StatusConflict)
+				return
+			}
+			agentID = netAgent
+		}
+
+		if _, err := tx.Exec(
+			`INSERT INTO rentals(vm_name, user_id, ssh_key, agent_id, image, flavor, from_snapshot,
+			                     egress_policy, egress_allow, expires_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?)`,
+			vmName, userID, req.SSHKey, agentID, req.Image, req.Flavor, fromSnapshot,
+			req.EgressPolicy, strings.Join(req.EgressAllow, ","), expiresAt,
 		); err != nil {
 			http.Error(w, fmt.Sprintf("failed to create rental: %v", err), http.StatusInternalServerError)
 			return
 		}
+		if err := recordRentalEvent(tx, vmName, EventCreated,
+			fmt.Sprintf("created (%s, %s) for %d minutes", req.Image, req.Flavor, req.Duration)); err != nil {
+			http.Error(w, fmt.Sprintf("failed to create rental: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to create rental: %v", err), http.StatusInternalServerError)
+			return
+		}
+		ScheduleRentalExpiry(db, sched, vmName, expiresAt)
+		logging.FromContext(r.Context()).Info("rental created",
+			"vm", vmName, "user_id", userID, "agent_id", agentID,
+			"image", req.Image, "flavor", req.Flavor, "expires_at", expiresAt)
 
-		resp := CreateRentalResponse{VMName: vmName, ExpiresAt: expiresAt}
+		resp := CreateRentalResponse{VMName: vmName, Image: req.Image, Flavor: req.Flavor, ExpiresAt: expiresAt}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
 }
 
-// HandleDeleteRental handles DELETE /rentals/{vmName} to tear down and remove a rental.
-func HandleDeleteRental(db *sql.DB) http.HandlerFunc {
+// HandleDeleteRental handles DELETE /rentals/{vmName} to tear down one of
+// the logged-in user's rentals. The owning agent notices the rental is
+// stopping and shuts the VM down. Cluster members are deleted with their
+// cluster.
+func HandleDeleteRental(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -139,23 +333,32 @@ func HandleDeleteRental(db *sql.DB) http.HandlerFunc {
 			http.NotFound(w, r)
 			return
 		}
-
-		// Attempt to delete the VM
-		if err := multipass.DeleteVM(vmName); err != nil {
-			http.Error(w, fmt.Sprintf("failed to delete VM: %v", err), http.StatusInternalServerError)
+		if !requireRentalOwner(db, w, r, vmName) {
 			return
 		}
 
-		// Remove from database
-		if _, err := db.Exec(`DELETE FROM rentals WHERE vm_name = ?`, vmName); err != nil {
-			http.Error(w, fmt.Sprintf("failed to remove rental: %v", err), http.StatusInternalServerError)
+		// Ask the owning agent to stop it; the row stays as history and
+		// records which stop stage worked.
+		found, err := DeleteRental(db, vmName)
+		switch {
+		case errors.Is(err, ErrClusterMember):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to stop rental: %v", err), http.StatusInternalServerError)
 			return
 		}
+		if !found {
+			http.Error(w, "rental not found", http.StatusNotFound)
+			return
+		}
+		CancelRentalExpiry(sched, vmName)
+		logging.FromContext(r.Context()).Info("rental deleted", "vm", vmName)
 
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
-func HandleExtendRental(db *sql.DB) http.HandlerFunc {
+func HandleExtendRental(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPatch {
             http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -168,6 +371,9 @@ func HandleExtendRental(db *sql.DB) http.HandlerFunc {
             return
         }
         vmName := parts[2]
+        if !requireRentalOwner(db, w, r, vmName) {
+            return
+        }
 
         var req ExtendRentalRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -179,34 +385,162 @@ func HandleExtendRental(db *sql.DB) http.HandlerFunc {
             return
         }
 
-        // bump expires_at
-        res, err := db.Exec(
-            `UPDATE rentals 
-             SET expires_at = datetime(expires_at, '+' || ? || ' minutes')
-             WHERE vm_name = ?`,
-            strconv.Itoa(req.Duration), vmName,
-        )
-        if err != nil {
-            http.Error(w, fmt.Sprintf("failed to extend rental: %v", err), http.StatusInternalServerError)
-            return
-        }
-        n, _ := res.RowsAffected()
-        if n == 0 {
+        ext, err := ExtendRental(db, vmName, req.Duration, MaxRentalLifetime)
+        switch {
+        case errors.Is(err, ErrRentalNotFound):
             http.Error(w, "rental not found", http.StatusNotFound)
             return
-        }
-
-        // fetch new expiration
-        var newExpiry time.Time
-        if err := db.QueryRow(
-            `SELECT expires_at FROM rentals WHERE vm_name = ?`, vmName,
-        ).Scan(&newExpiry); err != nil {
-            http.Error(w, fmt.Sprintf("could not fetch new expiry: %v", err), http.StatusInternalServerError)
+        case errors.Is(err, ErrRentalExpired), errors.Is(err, ErrRentalInactive),
+            errors.Is(err, ErrLifetimeExhausted), errors.Is(err, ErrClusterMember):
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        case err != nil:
+            http.Error(w, fmt.Sprintf("failed to extend rental: %v", err), http.StatusInternalServerError)
             return
         }
+        ScheduleRentalExpiry(db, sched, vmName, ext.ExpiresAt)
+        logging.FromContext(r.Context()).Info("rental extended",
+            "vm", vmName, "minutes", req.Duration, "expires_at", ext.ExpiresAt, "capped_by", ext.CappedBy)
 
-        resp := ExtendRentalResponse{VMName: vmName, ExpiresAt: newExpiry}
+        resp := ExtendRentalResponse{
+            VMName:             vmName,
+            ExpiresAt:          ext.ExpiresAt,
+            RequestedExpiresAt: ext.RequestedExpiresAt,
+            MaxExpiresAt:       ext.MaxExpiresAt,
+            Capped:             ext.CappedBy != "",
+            CappedBy:           ext.CappedBy,
+        }
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(resp)
     }
-}
\ No newline at end of file
+}
+
+// SuspendRentalRequest is the optional payload for
+// POST /rentals/{vmName}/suspend.
+type SuspendRentalRequest struct {
+	PauseClock bool `json:"pause_clock"` // don't count suspended time against the rental
+}
+
+// RentalStateResponse reports where a suspend or resume request left the
+// rental; the agent completes the transition in the background.
+type RentalStateResponse struct {
+	VMName    string    `json:"vm_name"`
+	State     string    `json:"state"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// HandleSuspendRental handles POST /rentals/{vmName}/suspend for the
+// rental's owner. The owning agent saves the VM's state to disk and stops
+// its QEMU process.
+func HandleSuspendRental(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// expect path like "/rentals/{vmName}/suspend"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "suspend" {
+			http.NotFound(w, r)
+			return
+		}
+		vmName := parts[2]
+		if !requireRentalOwner(db, w, r, vmName) {
+			return
+		}
+
+		var req SuspendRentalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		err := SuspendRental(db, vmName, req.PauseClock)
+		switch {
+		case errors.Is(err, ErrRentalNotFound):
+			http.Error(w, "rental not found", http.StatusNotFound)
+			return
+		case errors.Is(err, ErrRentalInactive):
+			http.Error(w, "rental is not running", http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to suspend rental: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(RentalStateResponse{VMName: vmName, State: RentalSuspending})
+	}
+}
+
+// HandleResumeRental handles POST /rentals/{vmName}/resume for the rental's
+// owner. The owning agent restores the VM; if its clock was paused the deadline moves out by the
+// time spent suspended.
+func HandleResumeRental(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// expect path like "/rentals/{vmName}/resume"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "resume" {
+			http.NotFound(w, r)
+			return
+		}
+		vmName := parts[2]
+		if !requireRentalOwner(db, w, r, vmName) {
+			return
+		}
+
+		expiresAt, err := ResumeRental(db, vmName)
+		switch {
+		case errors.Is(err, ErrRentalNotFound):
+			http.Error(w, "rental not found", http.StatusNotFound)
+			return
+		case errors.Is(err, ErrRentalNotSuspended):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to resume rental: %v", err), http.StatusInternalServerError)
+			return
+		}
+		ScheduleRentalExpiry(db, sched, vmName, expiresAt)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(RentalStateResponse{VMName: vmName, State: RentalResuming, ExpiresAt: expiresAt})
+	}
+}
+
+// HandleListNotifications handles GET /notifications, returning the logged-in
+// user's notifications. Pass ?after=<id> to fetch only newer ones.
+func HandleListNotifications(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sess, _ := Store.Get(r, "vmshare-session")
+		userID, ok := sess.Values["user_id"].(int)
+		if !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		var after int64
+		if v := r.URL.Query().Get("after"); v != "" {
+			if _, err := fmt.Sscan(v, &after); err != nil {
+				http.Error(w, "invalid after", http.StatusBadRequest)
+				return
+			}
+		}
+
+		list, err := ListNotifications(db, userID, after)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to query notifications: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
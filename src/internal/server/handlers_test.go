@@ -0,0 +1,149 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+)
+
+func TestSuspendResumeCheckOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+
+	suspend := HandleSuspendRental(db)
+	resume := HandleResumeRental(db, nil)
+	tests := []struct {
+		name   string
+		h      http.HandlerFunc
+		target string
+		user   int
+		want   int
+	}{
+		{"suspend logged out", suspend, "/rentals/vm/suspend", 0, http.StatusUnauthorized},
+		{"suspend someone else's", suspend, "/rentals/vm/suspend", bob, http.StatusNotFound},
+		{"suspend own", suspend, "/rentals/vm/suspend", alice, http.StatusAccepted},
+		{"resume logged out", resume, "/rentals/vm/resume", 0, http.StatusUnauthorized},
+		{"resume someone else's", resume, "/rentals/vm/resume", bob, http.StatusNotFound},
+		{"resume before the agent suspended it", resume, "/rentals/vm/resume", alice, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, tt.h, http.MethodPost, tt.target, "", tt.user); rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	var state string
+	db.QueryRow(`SELECT state FROM rentals WHERE vm_name = 'vm'`).Scan(&state)
+	if state != RentalSuspending {
+		t.Errorf("state = %q, want %q", state, RentalSuspending)
+	}
+}
+
+func TestCreateRentalUsesSessionUser(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	res := mustExec(t, db, `INSERT INTO volumes (name, user_id, agent_id, size_gb, state) VALUES ('data', ?, 1, 5, ?)`,
+		alice, VolumeAvailable)
+	vol, _ := res.LastInsertId()
+	create := HandleCreateRental(db, expiry.New())
+
+	tests := []struct {
+		name string
+		body string
+		user int
+		want int
+	}{
+		{"logged out", `{"duration": 30}`, 0, http.StatusUnauthorized},
+		{"someone else's volume", fmt.Sprintf(`{"duration": 30, "volume_ids": [%d]}`, vol), bob, http.StatusBadRequest},
+		{"someone else's volume as them", fmt.Sprintf(`{"user_id": %d, "duration": 30, "volume_ids": [%d]}`, alice, vol), bob, http.StatusBadRequest},
+		{"someone else's user_id", fmt.Sprintf(`{"user_id": %d, "duration": 30}`, alice), bob, http.StatusOK},
+		{"own volume", fmt.Sprintf(`{"duration": 30, "volume_ids": [%d]}`, vol), alice, http.StatusOK},
+	}
+	owners := map[string]int{}
+	for _, tt := range tests {
+		rec := serve(t, create, http.MethodPost, "/rentals", tt.body, tt.user)
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+			continue
+		}
+		if rec.Code == http.StatusOK {
+			var resp CreateRentalResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			owners[resp.VMName] = tt.user
+		}
+	}
+	for vm, want := range owners {
+		var owner int
+		db.QueryRow(`SELECT user_id FROM rentals WHERE vm_name = ?`, vm).Scan(&owner)
+		if owner != want || !strings.HasPrefix(vm, fmt.Sprintf("rental-%d-", want)) {
+			t.Errorf("rental %s owned by %d, want %d", vm, owner, want)
+		}
+	}
+
+	var attachedTo sql.NullString
+	db.QueryRow(`SELECT attached_to FROM volumes WHERE id = ?`, vol).Scan(&attachedTo)
+	if owners[attachedTo.String] != alice {
+		t.Errorf("volume attached to %q, want one of alice's rentals", attachedTo.String)
+	}
+}
+
+func TestDeleteExtendRentalCheckOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 4, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+	sched := expiry.New()
+	c := seedCluster(t, db, sched, alice)
+	var member string
+	db.QueryRow(`SELECT vm_name FROM rentals WHERE cluster_id = ? LIMIT 1`, c.ID).Scan(&member)
+
+	del := HandleDeleteRental(db, sched)
+	extend := HandleExtendRental(db, sched)
+	tests := []struct {
+		name   string
+		h      http.HandlerFunc
+		method string
+		target string
+		body   string
+		user   int
+		want   int
+	}{
+		{"extend logged out", extend, http.MethodPatch, "/rentals/vm/extend", `{"duration": 10}`, 0, http.StatusUnauthorized},
+		{"extend someone else's", extend, http.MethodPatch, "/rentals/vm/extend", `{"duration": 10}`, bob, http.StatusNotFound},
+		{"extend a cluster member", extend, http.MethodPatch, "/rentals/" + member + "/extend", `{"duration": 10}`, alice, http.StatusConflict},
+		{"extend own", extend, http.MethodPatch, "/rentals/vm/extend", `{"duration": 10}`, alice, http.StatusOK},
+		{"delete logged out", del, http.MethodDelete, "/rentals/vm", "", 0, http.StatusUnauthorized},
+		{"delete someone else's", del, http.MethodDelete, "/rentals/vm", "", bob, http.StatusNotFound},
+		{"delete a cluster member", del, http.MethodDelete, "/rentals/" + member, "", alice, http.StatusConflict},
+		{"delete own", del, http.MethodDelete, "/rentals/vm", "", alice, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		rec := serve(t, tt.h, tt.method, tt.target, tt.body, tt.user)
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+		if rec.Code == http.StatusConflict && !strings.Contains(rec.Body.String(), fmt.Sprintf("/clusters/%d", c.ID)) {
+			t.Errorf("%s: %q does not point at the cluster", tt.name, rec.Body)
+		}
+	}
+
+	var live int
+	db.QueryRow(`SELECT COUNT(*) FROM rentals WHERE cluster_id = ? AND state = ?`, c.ID, RentalPending).Scan(&live)
+	if live != 2 {
+		t.Errorf("%d cluster members still pending, want 2", live)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+	"github.com/smeetnagda/vmshare/internal/health"
+)
+
+// expiryLoopMaxAge is how long the expiry scheduler may go without waking
+// before the coordinator counts as unhealthy; it wakes every 30s.
+const expiryLoopMaxAge = 2 * time.Minute
+
+// HealthChecks returns the coordinator's probes. Liveness only fails if the
+// expiry scheduler, which nothing restarts, has died; readiness also needs
+// a reachable database with every migration applied.
+func HealthChecks(db *sql.DB, sched *expiry.Scheduler) (live, ready *health.Checks) {
+	expiryLoop := health.Recent(sched.LastLoop, expiryLoopMaxAge)
+
+	live = &health.Checks{}
+	live.Add("expiry_scheduler", expiryLoop)
+
+	ready = &health.Checks{}
+	ready.Add("database", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return db.PingContext(ctx)
+	})
+	ready.Add("migrations", func() error {
+		return checkMigrations(db, MigrationsDir)
+	})
+	ready.Add("expiry_scheduler", expiryLoop)
+	return live, ready
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+)
+
+func TestReadinessMigrations(t *testing.T) {
+	db := newTestDB(t)
+	current, err := filepath.Abs("../../migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ahead := t.TempDir()
+	if err := os.WriteFile(filepath.Join(ahead, "999_future.sql"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dir  string
+		want string
+	}{
+		{"applied, from another working directory", current, "ok"},
+		{"relative to the wrong directory", "migrations", "fail"},
+		{"newer migrations on disk", ahead, "fail"},
+	}
+	old := MigrationsDir
+	t.Cleanup(func() { MigrationsDir = old })
+	t.Chdir(t.TempDir())
+	for _, tt := range tests {
+		MigrationsDir = tt.dir
+		_, ready := HealthChecks(db, expiry.New())
+		if got := ready.Run().Checks["migrations"]; got.Status != tt.want {
+			t.Errorf("%s: migrations check %+v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
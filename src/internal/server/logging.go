@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/logging"
+)
+
+// RequestIDHeader carries a request's correlation ID. A caller-supplied ID
+// is kept so a client can tie its own logs to ours.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestLogger gives every request an ID, echoed in the response and
+// attached to the logger handlers get from logging.FromContext, and logs
+// each request once it has been served.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		logger := logging.FromContext(r.Context()).With("request_id", id)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(logging.WithLogger(r.Context(), logger)))
+		logger.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.code,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsResponse is the body of GET /rentals/{vmName}/metrics.
+type MetricsResponse struct {
+	VMName string        `json:"vm_name"`
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Step   int64         `json:"step"` // seconds
+	Points []MetricPoint `json:"points"`
+}
+
+// minMetricsStep is the agent's sampling interval; finer steps would be
+// mostly empty.
+const minMetricsStep = 15 * time.Second
+
+// HandleGetRentalMetrics handles GET /rentals/{vmName}/metrics?from=&to=&step=.
+// from and to are RFC 3339 times or Unix seconds and default to the last
+// hour; step is a duration ("5m") or seconds and defaults to about 60
+// points over the range. Only the rental's owner may read them.
+func HandleGetRentalMetrics(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// expect path like "/rentals/{vmName}/metrics"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireRentalOwner(db, w, r, parts[2]) {
+			return
+		}
+		q := r.URL.Query()
+		to, err := parseMetricsTime(q.Get("to"), time.Now())
+		if err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+		from, err := parseMetricsTime(q.Get("from"), to.Add(-time.Hour))
+		if err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+		step := (to.Sub(from) / 60).Truncate(time.Second)
+		if v := q.Get("step"); v != "" {
+			if step, err = parseMetricsStep(v); err != nil {
+				http.Error(w, "invalid step", http.StatusBadRequest)
+				return
+			}
+		}
+		if step < minMetricsStep {
+			step = minMetricsStep
+		}
+
+		points, err := GetRentalMetrics(db, parts[2], from, to, step)
+		switch {
+		case errors.Is(err, ErrRentalNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrInvalidMetricsRange):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to query metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MetricsResponse{
+			VMName: parts[2],
+			From:   from.UTC(),
+			To:     to.UTC(),
+			Step:   int64(step / time.Second),
+			Points: points,
+		})
+	}
+}
+
+// parseMetricsTime parses an RFC 3339 time or Unix seconds, or returns def
+// for "".
+func parseMetricsTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseMetricsStep parses a Go duration or a number of seconds.
+func parseMetricsStep(v string) (time.Duration, error) {
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
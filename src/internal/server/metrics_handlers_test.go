@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRentalMetricsCheckOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+
+	metrics := HandleGetRentalMetrics(db)
+	tests := []struct {
+		name   string
+		target string
+		user   int
+		want   int
+	}{
+		{"logged out", "/rentals/vm/metrics", 0, http.StatusUnauthorized},
+		{"someone else's", "/rentals/vm/metrics", bob, http.StatusNotFound},
+		{"unknown rental", "/rentals/missing/metrics", alice, http.StatusNotFound},
+		{"own", "/rentals/vm/metrics", alice, http.StatusOK},
+		{"own, bad range", "/rentals/vm/metrics?from=bogus", alice, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, metrics, http.MethodGet, tt.target, "", tt.user); rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestParseMetricsTimeAndStep(t *testing.T) {
+	def := time.Unix(100, 0)
+	times := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", def, false},
+		{"1700000000", time.Unix(1700000000, 0), false},
+		{"2026-01-02T03:04:05Z", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range times {
+		got, err := parseMetricsTime(tt.in, def)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !got.Equal(tt.want)) {
+			t.Errorf("parseMetricsTime(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	steps := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"60", time.Minute, false},
+		{"5m", 5 * time.Minute, false},
+		{"often", 0, true},
+	}
+	for _, tt := range steps {
+		got, err := parseMetricsStep(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseMetricsStep(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+)
+
+// MigrateRentalRequest is the optional payload for
+// POST /rentals/{vmName}/migrate.
+type MigrateRentalRequest struct {
+	AgentID int `json:"agent_id"` // destination; 0 lets the coordinator pick
+}
+
+// HandleMigrateRental handles POST /rentals/{vmName}/migrate, moving the
+// rental's VM to another agent. Only the rental's owner or an admin (see
+// AdminToken) may migrate it. Progress is reported by GET /migrations/{id}
+// and the rental's new endpoint appears once it is running again.
+func HandleMigrateRental(db *sql.DB, sched *expiry.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// expect path like "/rentals/{vmName}/migrate"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "migrate" {
+			http.NotFound(w, r)
+			return
+		}
+		vmName := parts[2]
+		if !isAdmin(r) && !requireRentalOwner(db, w, r, vmName) {
+			return
+		}
+
+		var req MigrateRentalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		m, expiresAt, err := StartMigration(db, vmName, req.AgentID)
+		switch {
+		case errors.Is(err, ErrRentalNotFound):
+			http.Error(w, "rental not found", http.StatusNotFound)
+			return
+		case errors.Is(err, ErrRentalInactive):
+			http.Error(w, "rental is not running or suspended", http.StatusConflict)
+			return
+		case errors.Is(err, ErrVolumesAttached), errors.Is(err, ErrNetworksAttached),
+			errors.Is(err, ErrNoMigrationTarget):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to start migration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		ScheduleRentalExpiry(db, sched, vmName, expiresAt)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(m)
+	}
+}
+
+// HandleGetMigration handles GET /migrations/{id} for the rental's owner or
+// an admin.
+func HandleGetMigration(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/migrations/"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		m, err := GetMigration(db, id)
+		switch {
+		case errors.Is(err, ErrMigrationNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to load migration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !isAdmin(r) && !requireRentalOwner(db, w, r, m.VMName) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+)
+
+func TestMigrationHandlersOwnerOrAdmin(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedAgent(t, db, 2, 2, 0)
+	mustExec(t, db, `UPDATE agents SET address = '127.0.0.1:7102' WHERE id = 2`)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+	AdminToken = "secret"
+	t.Cleanup(func() { AdminToken = "" })
+
+	migrate := HandleMigrateRental(db, expiry.New())
+	asAdmin := func(h http.Handler, method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer "+AdminToken)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for _, tt := range []struct {
+		name string
+		user int
+		want int
+	}{
+		{"logged out", 0, http.StatusUnauthorized},
+		{"someone else's", bob, http.StatusNotFound},
+	} {
+		if rec := serve(t, migrate, http.MethodPost, "/rentals/vm/migrate", "", tt.user); rec.Code != tt.want {
+			t.Errorf("migrate %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	rec := asAdmin(migrate, http.MethodPost, "/rentals/vm/migrate")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("migrate as admin: %d %s", rec.Code, rec.Body)
+	}
+	var m Migration
+	json.NewDecoder(rec.Body).Decode(&m)
+
+	get := HandleGetMigration(db)
+	target := fmt.Sprintf("/migrations/%d", m.ID)
+	for _, tt := range []struct {
+		name string
+		user int
+		want int
+	}{
+		{"logged out", 0, http.StatusUnauthorized},
+		{"someone else's", bob, http.StatusNotFound},
+		{"own", alice, http.StatusOK},
+	} {
+		if rec := serve(t, get, http.MethodGet, target, "", tt.user); rec.Code != tt.want {
+			t.Errorf("get %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if rec := asAdmin(get, http.MethodGet, target); rec.Code != http.StatusOK {
+		t.Errorf("get as admin: %d, want 200", rec.Code)
+	}
+
+	// the owner can move it back once it has landed
+	mustExec(t, db, `UPDATE rentals SET state = ?, agent_id = 2`, RentalRunning)
+	if rec := serve(t, migrate, http.MethodPost, "/rentals/vm/migrate", `{"agent_id": 1}`, alice); rec.Code != http.StatusConflict {
+		// agent 1 has no address, so there is nowhere to go
+		t.Errorf("migrate own: %d %s, want 409", rec.Code, rec.Body)
+	}
+}
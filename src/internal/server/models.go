@@ -1,7 +1,15 @@
 package server
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
 	"time"
 )
 
@@ -83,15 +91,54 @@ func UpsertAgent(db *sql.DB, name string, capacity, baseSSHPort int, lastSeen ti
 
 // --- Rental Model & Helpers ---
 
+// Rental lifecycle states. The agent moves pending rentals to running,
+// stopping ones to stopped, suspending ones to suspended and resuming ones
+// back to running; migrating ones become resuming on their new agent. The
+// coordinator does the rest.
+const (
+	RentalPending    = "pending"
+	RentalRunning    = "running"
+	RentalSuspending = "suspending"
+	RentalSuspended  = "suspended" // state saved to disk on the agent, no VM process
+	RentalResuming   = "resuming"
+	RentalMigrating  = "migrating" // being moved to another agent
+	RentalStopping   = "stopping"
+	RentalStopped    = "stopped"
+	RentalExpired    = "expired" // expired before any agent started it
+)
+
 // Rental represents a VM rental reservation.
 type Rental struct {
-	ID        int            `json:"id"`
-	VMName    string         `json:"vm_name"`
-	UserID    int            `json:"user_id"`
-	AgentID   int            `json:"agent_id"`
-	IPAddress sql.NullString `json:"ip_address"`
-	ExpiresAt time.Time      `json:"expires_at"`
-	CreatedAt time.Time      `json:"created_at"`
+	ID           int            `json:"id"`
+	VMName       string         `json:"vm_name"`
+	UserID       int            `json:"user_id"`
+	AgentID      int            `json:"agent_id"`
+	IPAddress    sql.NullString `json:"ip_address"`
+	Image        string         `json:"image"`
+	Flavor       string         `json:"flavor"`
+	FromSnapshot sql.NullInt64  `json:"from_snapshot"`
+	State        string         `json:"state"`
+	SuspendedAt  sql.NullTime   `json:"suspended_at"`
+	PauseClock   bool           `json:"pause_clock"` // expiry clock stopped while suspended
+	StopReason   sql.NullString `json:"stop_reason"`
+	StopStage    sql.NullString `json:"stop_stage"` // acpi, sigterm or sigkill
+	StoppedAt    sql.NullTime   `json:"stopped_at"`
+	ExpiresAt    time.Time      `json:"expires_at"`
+	CreatedAt    time.Time      `json:"created_at"`
+	Ports        []PortForward  `json:"ports"` // active forwards besides SSH
+
+	// EgressPolicy and EgressAllow are what the renter asked for;
+	// EgressEffective is what the agent enforces, once it has booted the VM.
+	EgressPolicy    sql.NullString `json:"egress_policy"`
+	EgressAllow     sql.NullString `json:"egress_allow"`
+	EgressEffective sql.NullString `json:"egress_effective"`
+
+	// NetRxBytes and NetTxBytes are the guest's network traffic over the
+	// rental; NetLimited is "rate" or "quota" while the agent has its
+	// network cut off for exceeding a host limit.
+	NetRxBytes int64          `json:"net_rx_bytes"`
+	NetTxBytes int64          `json:"net_tx_bytes"`
+	NetLimited sql.NullString `json:"net_limited"`
 }
 
 // CreateRental reserves a VM slot and returns the new row ID.
@@ -117,6 +164,94 @@ func UpdateRentalIP(db *sql.DB, vmName, ip string) error {
 	return err
 }
 
+// StopRental asks for an active rental to be torn down for reason. Pending
+// rentals end immediately; all others move to stopping for their agent to
+// shut down (or, if suspended, discard). It reports whether the rental exists.
+func StopRental(db *sql.DB, vmName, reason string) (bool, error) {
+	return stopRental(db, vmName, reason)
+}
+
+// DeleteRental is StopRental for a renter deleting vmName. Cluster members
+// only go together, with DeleteCluster, so deleting one alone fails with
+// ErrClusterMember.
+func DeleteRental(db *sql.DB, vmName string) (bool, error) {
+	var clusterID sql.NullInt64
+	err := db.QueryRow(`SELECT cluster_id FROM rentals WHERE vm_name = ?`, vmName).Scan(&clusterID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if clusterID.Valid {
+		return true, fmt.Errorf("%w; delete it with DELETE /clusters/%d", ErrClusterMember, clusterID.Int64)
+	}
+	return stopRental(db, vmName, "deleted")
+}
+
+// stopRental is StopRental on a *sql.DB or *sql.Tx.
+func stopRental(db querier, vmName, reason string) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE rentals
+		    SET state = CASE state WHEN ? THEN ? ELSE ? END,
+		        stopped_at = CASE state WHEN ? THEN ? ELSE stopped_at END,
+		        stop_reason = ?
+		  WHERE vm_name = ? AND state IN (?, ?, ?, ?, ?, ?)`,
+		RentalPending, pendingEndState(reason), RentalStopping,
+		RentalPending, time.Now(),
+		reason, vmName, RentalPending, RentalRunning, RentalSuspending, RentalSuspended, RentalResuming, RentalMigrating,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		if err := recordRentalEvent(db, vmName, EventStopRequested, "stop requested: "+reason); err != nil {
+			return true, err
+		}
+	}
+	var state string
+	err = db.QueryRow(`SELECT state FROM rentals WHERE vm_name = ?`, vmName).Scan(&state)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 && isTerminalRentalState(state) {
+		// never ran, so no agent will release its volumes or forwards
+		if err := DetachVolumes(db, vmName); err != nil {
+			return true, err
+		}
+		if err := closePortForwards(db, vmName); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// isLiveRentalState reports whether a rental in state still holds (or is
+// about to hold) a VM that can be extended.
+func isLiveRentalState(state string) bool {
+	switch state {
+	case RentalPending, RentalRunning, RentalSuspending, RentalSuspended, RentalResuming, RentalMigrating:
+		return true
+	}
+	return false
+}
+
+// isTerminalRentalState reports whether state is one a rental never leaves.
+func isTerminalRentalState(state string) bool {
+	return state == RentalStopped || state == RentalExpired
+}
+
+// pendingEndState is where a never-started rental goes when stopped.
+func pendingEndState(reason string) string {
+	if reason == "expired" {
+		return RentalExpired
+	}
+	return RentalStopped
+}
+
 // DeleteExpiredRentals removes any rentals past their expiration.
 // It returns the number of rows deleted.
 func DeleteExpiredRentals(db *sql.DB) (int64, error) {
@@ -126,3 +261,2011 @@ func DeleteExpiredRentals(db *sql.DB) (int64, error) {
 	}
 	return res.RowsAffected()
 }
+
+// --- Rental Extensions ---
+
+var (
+	ErrRentalNotFound    = errors.New("rental not found")
+	ErrRentalExpired     = errors.New("rental has already expired")
+	ErrRentalInactive    = errors.New("rental is no longer active")
+	ErrLifetimeExhausted = errors.New("rental is already at its maximum lifetime")
+)
+
+// Extension is an accepted extension and the deadline that took effect.
+type Extension struct {
+	VMName             string
+	RequestedExpiresAt time.Time
+	ExpiresAt          time.Time
+	MaxExpiresAt       time.Time
+	CappedBy           string // "", "max_lifetime" or "host_cap"
+}
+
+// ExtendRental pushes a rental's expiry out by minutes, clamped so the rental
+// never lives longer than maxLifetime or its host's max_lifetime_minutes
+// (both counted from created_at). The extension is recorded in
+// rental_extensions for the owning agent to apply to its kill timer.
+// Cluster members share a deadline and are extended with ExtendCluster.
+func ExtendRental(db *sql.DB, vmName string, minutes int, maxLifetime time.Duration) (*Extension, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var clusterID sql.NullInt64
+	err = tx.QueryRow(`SELECT cluster_id FROM rentals WHERE vm_name = ?`, vmName).Scan(&clusterID)
+	if err == sql.ErrNoRows {
+		return nil, ErrRentalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if clusterID.Valid {
+		return nil, fmt.Errorf("%w; extend it with PATCH /clusters/%d/extend", ErrClusterMember, clusterID.Int64)
+	}
+
+	ext, err := planExtension(tx, vmName, minutes, maxLifetime)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordExtension(tx, vmName, minutes, ext); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// planExtension works out where extending vmName by minutes would move its
+// deadline, without changing anything.
+func planExtension(tx *sql.Tx, vmName string, minutes int, maxLifetime time.Duration) (*Extension, error) {
+	var expiresAt, createdAt time.Time
+	var state string
+	var hostCap int
+	err := tx.QueryRow(
+		`SELECT r.expires_at, r.created_at, r.state, COALESCE(a.max_lifetime_minutes, 0)
+		   FROM rentals r LEFT JOIN agents a ON a.id = r.agent_id
+		  WHERE r.vm_name = ?`,
+		vmName,
+	).Scan(&expiresAt, &createdAt, &state, &hostCap)
+	if err == sql.ErrNoRows {
+		return nil, ErrRentalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isLiveRentalState(state) {
+		return nil, ErrRentalInactive
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, ErrRentalExpired
+	}
+
+	ext := &Extension{
+		VMName:             vmName,
+		RequestedExpiresAt: expiresAt.Add(time.Duration(minutes) * time.Minute),
+		MaxExpiresAt:       createdAt.Add(maxLifetime),
+	}
+	limitedBy := "max_lifetime"
+	if hostCap > 0 {
+		if hostMax := createdAt.Add(time.Duration(hostCap) * time.Minute); hostMax.Before(ext.MaxExpiresAt) {
+			ext.MaxExpiresAt = hostMax
+			limitedBy = "host_cap"
+		}
+	}
+	ext.ExpiresAt = ext.RequestedExpiresAt
+	if ext.ExpiresAt.After(ext.MaxExpiresAt) {
+		ext.ExpiresAt = ext.MaxExpiresAt
+		ext.CappedBy = limitedBy
+	}
+	if !ext.ExpiresAt.After(expiresAt) {
+		return nil, ErrLifetimeExhausted
+	}
+	return ext, nil
+}
+
+// recordExtension moves vmName's deadline to ext.ExpiresAt and logs it in
+// rental_extensions.
+func recordExtension(tx *sql.Tx, vmName string, minutes int, ext *Extension) error {
+	if _, err := tx.Exec(
+		`UPDATE rentals SET expires_at = ? WHERE vm_name = ?`,
+		ext.ExpiresAt, vmName,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO rental_extensions
+		   (vm_name, minutes, requested_expires_at, expires_at)
+		 VALUES (?, ?, ?, ?)`,
+		vmName, minutes, ext.RequestedExpiresAt, ext.ExpiresAt,
+	); err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("extended by %d minutes; expires at %s", minutes, ext.ExpiresAt.UTC().Format(time.RFC3339))
+	if ext.CappedBy != "" {
+		msg += " (capped by " + ext.CappedBy + ")"
+	}
+	return recordRentalEvent(tx, vmName, EventExtended, msg)
+}
+
+// --- Suspend & Resume ---
+
+// ErrRentalNotSuspended is returned when resuming a rental that is not
+// suspended.
+var ErrRentalNotSuspended = errors.New("rental is not suspended")
+
+// SuspendRental asks the agent running vmName to save it to disk and free
+// its resources. With pauseClock, time spent suspended does not count
+// against the rental.
+func SuspendRental(db *sql.DB, vmName string, pauseClock bool) error {
+	res, err := db.Exec(
+		`UPDATE rentals SET state = ?, suspended_at = ?, pause_clock = ?
+		  WHERE vm_name = ? AND state = ?`,
+		RentalSuspending, time.Now(), pauseClock, vmName, RentalRunning,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		msg := "suspend requested"
+		if pauseClock {
+			msg += "; expiry clock paused"
+		}
+		return recordRentalEvent(db, vmName, EventSuspendRequested, msg)
+	}
+	return rentalStateError(db, vmName, ErrRentalInactive)
+}
+
+// ResumeRental asks the agent holding a suspended rental to restore it. If
+// the clock was paused, the time spent suspended is added to the deadline,
+// which is returned.
+func ResumeRental(db *sql.DB, vmName string) (time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var state string
+	var expiresAt time.Time
+	var suspendedAt sql.NullTime
+	var pauseClock bool
+	err = tx.QueryRow(
+		`SELECT state, expires_at, suspended_at, pause_clock FROM rentals WHERE vm_name = ?`,
+		vmName,
+	).Scan(&state, &expiresAt, &suspendedAt, &pauseClock)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrRentalNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if state != RentalSuspended {
+		return time.Time{}, ErrRentalNotSuspended
+	}
+	if pauseClock && suspendedAt.Valid {
+		expiresAt = expiresAt.Add(time.Since(suspendedAt.Time))
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE rentals SET state = ?, expires_at = ?, suspended_at = NULL, pause_clock = 0
+		  WHERE vm_name = ?`,
+		RentalResuming, expiresAt, vmName,
+	); err != nil {
+		return time.Time{}, err
+	}
+	if err := recordRentalEvent(tx, vmName, EventResumeRequested,
+		"resume requested; expires at "+expiresAt.UTC().Format(time.RFC3339)); err != nil {
+		return time.Time{}, err
+	}
+	return expiresAt, tx.Commit()
+}
+
+// clockPaused reports whether vmName is suspended with its clock stopped.
+func clockPaused(db *sql.DB, vmName string) (bool, error) {
+	var paused bool
+	err := db.QueryRow(
+		`SELECT pause_clock = 1 AND suspended_at IS NOT NULL FROM rentals WHERE vm_name = ?`,
+		vmName,
+	).Scan(&paused)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return paused, err
+}
+
+// rentalStateError returns ErrRentalNotFound if vmName does not exist and
+// otherwise wrongState.
+func rentalStateError(db *sql.DB, vmName string, wrongState error) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM rentals WHERE vm_name = ?`, vmName).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRentalNotFound
+	}
+	return wrongState
+}
+
+// --- Migration Model & Helpers ---
+
+// Migration states.
+const (
+	MigrationPending   = "pending"
+	MigrationSending   = "sending"
+	MigrationCompleted = "completed"
+	MigrationFailed    = "failed"
+)
+
+// agentLiveWindow is how recently an agent must have sent a heartbeat to be
+// picked as a migration target.
+const agentLiveWindow = 30 * time.Second
+
+var (
+	ErrNoMigrationTarget = errors.New("no other agent can take this rental")
+	ErrVolumesAttached   = errors.New("rentals with volumes cannot be moved")
+	ErrNetworksAttached  = errors.New("rentals on private networks cannot be moved")
+	ErrMigrationNotFound = errors.New("migration not found")
+)
+
+// Migration is one move of a rental's VM between agents. The source agent
+// suspends the VM and streams it to the destination, which resumes it.
+type Migration struct {
+	ID            int64          `json:"id"`
+	VMName        string         `json:"vm_name"`
+	SourceAgentID int            `json:"source_agent_id"`
+	DestAgentID   int            `json:"dest_agent_id"`
+	State         string         `json:"state"`
+	Token         string         `json:"-"`
+	Error         sql.NullString `json:"error"`
+	CreatedAt     time.Time      `json:"created_at"`
+	CompletedAt   sql.NullTime   `json:"completed_at"`
+}
+
+// StartMigration moves vmName to destAgentID (or, if 0, to the most recently
+// seen other live agent with spare capacity). Running and suspended rentals
+// can be moved; either way the VM resumes on the destination. A paused
+// clock restarts, so the rental's deadline is returned for re-arming.
+func StartMigration(db *sql.DB, vmName string, destAgentID int) (*Migration, time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var sourceAgentID int
+	var state string
+	var expiresAt time.Time
+	var suspendedAt sql.NullTime
+	var pauseClock bool
+	err = tx.QueryRow(
+		`SELECT agent_id, state, expires_at, suspended_at, pause_clock FROM rentals WHERE vm_name = ?`,
+		vmName,
+	).Scan(&sourceAgentID, &state, &expiresAt, &suspendedAt, &pauseClock)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, ErrRentalNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if state != RentalRunning && state != RentalSuspended {
+		return nil, time.Time{}, ErrRentalInactive
+	}
+	var attached int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM volumes WHERE attached_to = ? AND state = ?`, vmName, VolumeAttached,
+	).Scan(&attached); err != nil {
+		return nil, time.Time{}, err
+	}
+	if attached > 0 {
+		return nil, time.Time{}, ErrVolumesAttached
+	}
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM network_attachments WHERE vm_name = ?`, vmName,
+	).Scan(&attached); err != nil {
+		return nil, time.Time{}, err
+	}
+	if attached > 0 {
+		return nil, time.Time{}, ErrNetworksAttached
+	}
+
+	err = tx.QueryRow(
+		`SELECT a.id FROM agents a
+		  WHERE a.id != ? AND (? = 0 OR a.id = ?)
+		    AND a.address IS NOT NULL AND a.last_seen > ?
+		    AND a.capacity > (SELECT COUNT(*) FROM rentals r
+		                       WHERE r.agent_id = a.id AND r.state IN (?, ?, ?))
+		  ORDER BY a.last_seen DESC
+		  LIMIT 1`,
+		sourceAgentID, destAgentID, destAgentID, time.Now().Add(-agentLiveWindow),
+		RentalRunning, RentalResuming, RentalMigrating,
+	).Scan(&destAgentID)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, ErrNoMigrationTarget
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, time.Time{}, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO migrations (vm_name, source_agent_id, dest_agent_id, state, token)
+		 VALUES (?, ?, ?, ?, ?)`,
+		vmName, sourceAgentID, destAgentID, MigrationPending, hex.EncodeToString(token),
+	)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if pauseClock && suspendedAt.Valid {
+		expiresAt = expiresAt.Add(time.Since(suspendedAt.Time))
+	}
+	if _, err := tx.Exec(
+		`UPDATE rentals SET state = ?, expires_at = ?, suspended_at = NULL, pause_clock = 0
+		  WHERE vm_name = ?`,
+		RentalMigrating, expiresAt, vmName,
+	); err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := recordRentalEvent(tx, vmName, EventMigrationRequested,
+		fmt.Sprintf("migration %d requested: agent %d to agent %d", id, sourceAgentID, destAgentID)); err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, time.Time{}, err
+	}
+	m, err := GetMigration(db, id)
+	return m, expiresAt, err
+}
+
+// GetMigration loads one migration.
+func GetMigration(db *sql.DB, id int64) (*Migration, error) {
+	var m Migration
+	err := db.QueryRow(
+		`SELECT id, vm_name, source_agent_id, dest_agent_id, state, token, error, created_at, completed_at
+		   FROM migrations WHERE id = ?`,
+		id,
+	).Scan(&m.ID, &m.VMName, &m.SourceAgentID, &m.DestAgentID, &m.State, &m.Token, &m.Error, &m.CreatedAt, &m.CompletedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrMigrationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// --- Network Model & Helpers ---
+
+// Network states.
+const (
+	NetworkActive  = "active"
+	NetworkDeleted = "deleted"
+)
+
+// DefaultNetworkCIDR is the subnet a network gets if none is asked for.
+// Networks are isolated from each other, so they may all share it.
+const DefaultNetworkCIDR = "10.10.0.0/24"
+
+var (
+	ErrNetworkNotFound  = errors.New("network not found")
+	ErrNetworkInUse     = errors.New("network has running rentals")
+	ErrNoNetworkHost    = errors.New("no agent available for this network")
+	ErrNetworksSplit    = errors.New("networks live on different agents")
+	ErrNetworkElsewhere = errors.New("networks and other rental resources live on different agents")
+	ErrInvalidCIDR      = errors.New("cidr must be an IPv4 subnet between /16 and /29")
+	ErrNoNetworkPort    = errors.New("no multicast port left for a new network")
+)
+
+// Networks are multicast segments, each on its own port in this range.
+// Networks of agents sharing a LAN may span hosts, so ports are unique
+// across all active networks rather than per agent.
+const (
+	networkPortMin = 40000
+	networkPortMax = 59999
+)
+
+// Network is a private L2 segment between a user's VMs on one agent. Each
+// attached rental gets a second NIC on it with an address the agent assigns.
+type Network struct {
+	ID          int64               `json:"id"`
+	Name        string              `json:"name"`
+	UserID      int                 `json:"user_id"`
+	AgentID     int                 `json:"agent_id"`
+	CIDR        string              `json:"cidr"`
+	State       string              `json:"state"`
+	CreatedAt   time.Time           `json:"created_at"`
+	Attachments []NetworkAttachment `json:"attachments"`
+}
+
+// NetworkAttachment is one live rental's NIC on a network. IPAddress is
+// empty until the agent boots the VM.
+type NetworkAttachment struct {
+	VMName    string         `json:"vm_name"`
+	IPAddress sql.NullString `json:"ip_address"`
+}
+
+// validNetworkCIDR reports whether cidr is a subnet the agent can assign
+// addresses from.
+func validNetworkCIDR(cidr string) bool {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil || !ip.Equal(ipnet.IP) {
+		return false
+	}
+	ones, _ := ipnet.Mask.Size()
+	return ones >= 16 && ones <= 29
+}
+
+// CreateNetwork creates a network for userID on agentID (or, if 0, on the
+// most recently seen live agent).
+func CreateNetwork(db *sql.DB, userID, agentID int, name, cidr string) (*Network, error) {
+	if cidr == "" {
+		cidr = DefaultNetworkCIDR
+	}
+	if !validNetworkCIDR(cidr) {
+		return nil, ErrInvalidCIDR
+	}
+	err := db.QueryRow(
+		`SELECT id FROM agents
+		  WHERE (? = 0 OR id = ?) AND last_seen > ?
+		  ORDER BY last_seen DESC
+		  LIMIT 1`,
+		agentID, agentID, time.Now().Add(-agentLiveWindow),
+	).Scan(&agentID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoNetworkHost
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	id, err := insertNetwork(tx, name, userID, agentID, cidr)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetNetwork(db, id)
+}
+
+// insertNetwork adds an active network inside tx, giving it the lowest
+// free multicast port.
+func insertNetwork(tx *sql.Tx, name string, userID, agentID int, cidr string) (int64, error) {
+	rows, err := tx.Query(
+		`SELECT mcast_port FROM networks WHERE state = ? AND mcast_port IS NOT NULL ORDER BY mcast_port`,
+		NetworkActive,
+	)
+	if err != nil {
+		return 0, err
+	}
+	port := networkPortMin
+	for rows.Next() {
+		var used int
+		if err := rows.Scan(&used); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if used == port {
+			port++
+		} else if used > port {
+			break
+		}
+	}
+	rows.Close()
+	if port > networkPortMax {
+		return 0, ErrNoNetworkPort
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO networks (name, user_id, agent_id, cidr, state, mcast_port) VALUES (?, ?, ?, ?, ?, ?)`,
+		name, userID, agentID, cidr, NetworkActive, port,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// GetNetwork loads one network with the rentals currently on it.
+func GetNetwork(db *sql.DB, id int64) (*Network, error) {
+	var n Network
+	err := db.QueryRow(
+		`SELECT id, name, user_id, agent_id, cidr, state, created_at FROM networks WHERE id = ?`,
+		id,
+	).Scan(&n.ID, &n.Name, &n.UserID, &n.AgentID, &n.CIDR, &n.State, &n.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNetworkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n.Attachments, err = networkAttachments(db, id); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// ListNetworks returns userID's active networks.
+func ListNetworks(db *sql.DB, userID int) ([]Network, error) {
+	rows, err := db.Query(
+		`SELECT id FROM networks WHERE user_id = ? AND state = ? ORDER BY id`,
+		userID, NetworkActive,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	list := []Network{}
+	for _, id := range ids {
+		n, err := GetNetwork(db, id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *n)
+	}
+	return list, nil
+}
+
+// networkAttachments lists the live rentals attached to network id.
+func networkAttachments(db *sql.DB, id int64) ([]NetworkAttachment, error) {
+	rows, err := db.Query(
+		`SELECT na.vm_name, na.ip_address
+		   FROM network_attachments na JOIN rentals r ON r.vm_name = na.vm_name
+		  WHERE na.network_id = ? AND r.state NOT IN (?, ?)
+		  ORDER BY na.vm_name`,
+		id, RentalStopped, RentalExpired,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []NetworkAttachment{}
+	for rows.Next() {
+		var a NetworkAttachment
+		if err := rows.Scan(&a.VMName, &a.IPAddress); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// DeleteNetwork removes userID's network id once no live rental is
+// attached to it. Other users' networks are reported as not found.
+func DeleteNetwork(db *sql.DB, id int64, userID int) error {
+	n, err := GetNetwork(db, id)
+	if err != nil {
+		return err
+	}
+	if n.UserID != userID {
+		return ErrNetworkNotFound
+	}
+	if len(n.Attachments) > 0 {
+		return ErrNetworkInUse
+	}
+	_, err = db.Exec(`UPDATE networks SET state = ? WHERE id = ?`, NetworkDeleted, id)
+	return err
+}
+
+// attachNetworks attaches vmName to networkIDs inside tx. They must belong
+// to userID, be active and share one agent, whose ID is returned so the
+// rental can be pinned there.
+func attachNetworks(tx *sql.Tx, vmName string, userID int, networkIDs []int64) (int, error) {
+	agentID := 0
+	for _, id := range networkIDs {
+		var owner, onAgent int
+		var state string
+		err := tx.QueryRow(
+			`SELECT user_id, agent_id, state FROM networks WHERE id = ?`, id,
+		).Scan(&owner, &onAgent, &state)
+		if err == sql.ErrNoRows || (err == nil && (owner != userID || state != NetworkActive)) {
+			return 0, ErrNetworkNotFound
+		}
+		if err != nil {
+			return 0, err
+		}
+		if agentID != 0 && onAgent != agentID {
+			return 0, ErrNetworksSplit
+		}
+		agentID = onAgent
+
+		if _, err := tx.Exec(
+			`INSERT INTO network_attachments (network_id, vm_name) VALUES (?, ?)`, id, vmName,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return agentID, nil
+}
+
+// --- Cluster Model & Helpers ---
+
+// Cluster states.
+const (
+	ClusterActive  = "active"
+	ClusterDeleted = "deleted"
+)
+
+// MaxClusterSize bounds how many VMs one cluster may have.
+var MaxClusterSize = 16
+
+var (
+	ErrClusterNotFound    = errors.New("cluster not found")
+	ErrClusterNoCapacity  = errors.New("not enough agent capacity for the whole cluster")
+	ErrClusterMember      = errors.New("rental belongs to a cluster")
+	ErrInvalidClusterName = errors.New("cluster name must be a lowercase hostname label")
+)
+
+// clusterNamePattern keeps "<name>-<n>" a valid hostname.
+var clusterNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,39}$`)
+
+// Cluster is a group of rentals launched, extended and deleted as one unit.
+// Its members share a private network and know each other by hostname.
+type Cluster struct {
+	ID        int64         `json:"id"`
+	Name      string        `json:"name"`
+	UserID    int           `json:"user_id"`
+	NetworkID int64         `json:"network_id"`
+	CIDR      string        `json:"cidr"`
+	Size      int           `json:"size"`
+	Image     string        `json:"image"`
+	Flavor    string        `json:"flavor"`
+	State     string        `json:"state"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	CreatedAt time.Time     `json:"created_at"`
+	Nodes     []ClusterNode `json:"nodes"`
+}
+
+// ClusterNode is one member of a cluster's inventory. PrivateIP is its
+// address on the cluster network; IPAddress is where its agent forwards
+// SSH once it runs.
+type ClusterNode struct {
+	Hostname  string         `json:"hostname"`
+	VMName    string         `json:"vm_name"`
+	AgentID   int            `json:"agent_id"`
+	PrivateIP string         `json:"private_ip"`
+	IPAddress sql.NullString `json:"ip_address"`
+	State     string         `json:"state"`
+}
+
+// NewCluster describes the cluster CreateCluster should launch.
+type NewCluster struct {
+	UserID    int
+	Name      string
+	Size      int
+	SSHKey    string
+	Image     string
+	Flavor    string
+	ExpiresAt time.Time
+}
+
+// CreateCluster schedules all of a cluster's rentals at once, or none. The
+// members go on one agent if any has room; otherwise they are spread over
+// agents whose private networks reach each other (see placeCluster). The
+// cluster's network and each member's hostname and address are set up here
+// so the inventory is known before any VM boots.
+func CreateCluster(db *sql.DB, nc NewCluster) (*Cluster, error) {
+	if !clusterNamePattern.MatchString(nc.Name) {
+		return nil, ErrInvalidClusterName
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	placement, err := placeCluster(tx, nc.Size)
+	if err != nil {
+		return nil, err
+	}
+	_, subnet, err := net.ParseCIDR(DefaultNetworkCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	networkID, err := insertNetwork(tx, nc.Name, nc.UserID, placement[0], DefaultNetworkCIDR)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO clusters (name, user_id, network_id, size, image, flavor, state, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		nc.Name, nc.UserID, networkID, nc.Size, nc.Image, nc.Flavor, ClusterActive, nc.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	for i, agentID := range placement {
+		vmName := fmt.Sprintf("cluster-%d-%d", id, i+1)
+		hostname := fmt.Sprintf("%s-%d", nc.Name, i+1)
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32(i)+2) // .1 is left unused, as on other networks
+
+		if _, err := tx.Exec(
+			`INSERT INTO rentals(vm_name, user_id, ssh_key, agent_id, image, flavor, cluster_id, hostname, expires_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			vmName, nc.UserID, nc.SSHKey, agentID, nc.Image, nc.Flavor, id, hostname, nc.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		if err := recordRentalEvent(tx, vmName, EventCreated,
+			fmt.Sprintf("created as %s in cluster %q (%s, %s)", hostname, nc.Name, nc.Image, nc.Flavor)); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO network_attachments (network_id, vm_name, ip_address) VALUES (?, ?, ?)`,
+			networkID, vmName, ip.String(),
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetCluster(db, id)
+}
+
+// placeCluster picks an agent for each of size new rentals. It prefers the
+// live agent with the most free slots; if none fits them all, it spreads
+// them over agents whose network_addr is not loopback, since only those
+// can carry a private network between hosts.
+func placeCluster(tx *sql.Tx, size int) ([]int, error) {
+	rows, err := tx.Query(
+		`SELECT a.id, COALESCE(a.network_addr, ''),
+		        a.capacity - (SELECT COUNT(*) FROM rentals r
+		                       WHERE r.agent_id = a.id AND r.state IN (?, ?, ?, ?)) AS free
+		   FROM agents a
+		  WHERE a.last_seen > ?
+		  ORDER BY free DESC, a.last_seen DESC`,
+		RentalPending, RentalRunning, RentalResuming, RentalMigrating,
+		time.Now().Add(-agentLiveWindow),
+	)
+	if err != nil {
+		return nil, err
+	}
+	type agent struct {
+		id, free    int
+		networkAddr string
+	}
+	var agents []agent
+	for rows.Next() {
+		var a agent
+		if err := rows.Scan(&a.id, &a.networkAddr, &a.free); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if a.free > 0 {
+			agents = append(agents, a)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var placement []int
+	if len(agents) > 0 && agents[0].free >= size {
+		for len(placement) < size {
+			placement = append(placement, agents[0].id)
+		}
+		return placement, nil
+	}
+	for _, a := range agents {
+		if ip := net.ParseIP(a.networkAddr); ip == nil || ip.IsLoopback() {
+			continue
+		}
+		for n := 0; n < a.free && len(placement) < size; n++ {
+			placement = append(placement, a.id)
+		}
+	}
+	if len(placement) < size {
+		return nil, ErrClusterNoCapacity
+	}
+	return placement, nil
+}
+
+// GetCluster loads one cluster with its inventory.
+func GetCluster(db *sql.DB, id int64) (*Cluster, error) {
+	var c Cluster
+	err := db.QueryRow(
+		`SELECT c.id, c.name, c.user_id, c.network_id, n.cidr, c.size, c.image, c.flavor,
+		        c.state, c.expires_at, c.created_at
+		   FROM clusters c JOIN networks n ON n.id = c.network_id
+		  WHERE c.id = ?`,
+		id,
+	).Scan(&c.ID, &c.Name, &c.UserID, &c.NetworkID, &c.CIDR, &c.Size, &c.Image, &c.Flavor,
+		&c.State, &c.ExpiresAt, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrClusterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		`SELECT r.hostname, r.vm_name, r.agent_id, COALESCE(na.ip_address, ''), r.ip_address, r.state
+		   FROM rentals r
+		   LEFT JOIN network_attachments na ON na.vm_name = r.vm_name AND na.network_id = ?
+		  WHERE r.cluster_id = ?
+		  ORDER BY r.id`,
+		c.NetworkID, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c.Nodes = []ClusterNode{}
+	for rows.Next() {
+		var n ClusterNode
+		if err := rows.Scan(&n.Hostname, &n.VMName, &n.AgentID, &n.PrivateIP, &n.IPAddress, &n.State); err != nil {
+			return nil, err
+		}
+		c.Nodes = append(c.Nodes, n)
+	}
+	return &c, rows.Err()
+}
+
+// ListClusters returns userID's active clusters.
+func ListClusters(db *sql.DB, userID int) ([]Cluster, error) {
+	rows, err := db.Query(
+		`SELECT id FROM clusters WHERE user_id = ? AND state = ? ORDER BY id`,
+		userID, ClusterActive,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	list := []Cluster{}
+	for _, id := range ids {
+		c, err := GetCluster(db, id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *c)
+	}
+	return list, nil
+}
+
+// clusterMembers lists the VM names of cluster id's live rentals.
+func clusterMembers(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, id int64) ([]string, error) {
+	rows, err := q.Query(
+		`SELECT vm_name FROM rentals
+		  WHERE cluster_id = ? AND state IN (?, ?, ?, ?, ?, ?)
+		  ORDER BY id`,
+		id, RentalPending, RentalRunning, RentalSuspending, RentalSuspended, RentalResuming, RentalMigrating,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// ExtendCluster extends every live member of cluster id by minutes. The
+// members keep a shared deadline, so the tightest cap among them applies
+// to all. It returns the combined extension and the members extended.
+func ExtendCluster(db *sql.DB, id int64, minutes int, maxLifetime time.Duration) (*Extension, []string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var state string
+	err = tx.QueryRow(`SELECT state FROM clusters WHERE id = ?`, id).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrClusterNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := clusterMembers(tx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state != ClusterActive || len(members) == 0 {
+		return nil, nil, ErrRentalInactive
+	}
+
+	var ext *Extension
+	for _, vmName := range members {
+		e, err := planExtension(tx, vmName, minutes, maxLifetime)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", vmName, err)
+		}
+		if ext == nil || e.ExpiresAt.Before(ext.ExpiresAt) {
+			ext = e
+		}
+	}
+	ext.VMName = ""
+	for _, vmName := range members {
+		if err := recordExtension(tx, vmName, minutes, ext); err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, err := tx.Exec(
+		`UPDATE clusters SET expires_at = ? WHERE id = ?`, ext.ExpiresAt, id,
+	); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return ext, members, nil
+}
+
+// DeleteCluster stops all of cluster id's live members and retires its
+// network. It returns the members it stopped.
+func DeleteCluster(db *sql.DB, id int64) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var networkID int64
+	err = tx.QueryRow(`SELECT network_id FROM clusters WHERE id = ?`, id).Scan(&networkID)
+	if err == sql.ErrNoRows {
+		return nil, ErrClusterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	members, err := clusterMembers(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, vmName := range members {
+		if _, err := stopRental(tx, vmName, "deleted"); err != nil {
+			return nil, err
+		}
+	}
+	if err := retireCluster(tx, id, networkID); err != nil {
+		return nil, err
+	}
+	return members, tx.Commit()
+}
+
+// retireCluster marks cluster id deleted and retires its network.
+func retireCluster(q execer, id, networkID int64) error {
+	if _, err := q.Exec(`UPDATE clusters SET state = ? WHERE id = ?`, ClusterDeleted, id); err != nil {
+		return err
+	}
+	_, err := q.Exec(`UPDATE networks SET state = ? WHERE id = ?`, NetworkDeleted, networkID)
+	return err
+}
+
+// FinishCluster retires the cluster vmName belongs to once none of its
+// members is live any more, e.g. after the last one expired. It reports
+// whether it did.
+func FinishCluster(db *sql.DB, vmName string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id, networkID int64
+	err = tx.QueryRow(
+		`SELECT c.id, c.network_id FROM rentals r JOIN clusters c ON c.id = r.cluster_id
+		  WHERE r.vm_name = ? AND c.state = ?`,
+		vmName, ClusterActive,
+	).Scan(&id, &networkID)
+	if err == sql.ErrNoRows {
+		return false, nil // not in a cluster, or it is already finished
+	}
+	if err != nil {
+		return false, err
+	}
+	members, err := clusterMembers(tx, id)
+	if err != nil || len(members) > 0 {
+		return false, err
+	}
+	if err := retireCluster(tx, id, networkID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// --- Port Forward Model & Helpers ---
+
+// Port forward states. The agent applies pending forwards to the running VM
+// and tears down removing ones.
+const (
+	PortForwardPending  = "pending"
+	PortForwardActive   = "active"
+	PortForwardRemoving = "removing"
+	PortForwardRemoved  = "removed"
+	PortForwardError    = "error"
+)
+
+// MaxPortForwards bounds how many extra ports one rental may expose.
+var MaxPortForwards = 10
+
+var (
+	ErrPortForwardNotFound = errors.New("port forward not found")
+	ErrPortForwardExists   = errors.New("guest port is already forwarded")
+	ErrTooManyPortForwards = errors.New("too many port forwards for this rental")
+	ErrInvalidPortForward  = errors.New("protocol must be tcp or udp and guest_port 1-65535")
+)
+
+// PortForward exposes a guest port on the rental's agent. HostPort is set
+// once the agent has picked and applied it.
+type PortForward struct {
+	ID        int64          `json:"id"`
+	VMName    string         `json:"vm_name"`
+	Protocol  string         `json:"protocol"`
+	GuestPort int            `json:"guest_port"`
+	HostPort  sql.NullInt64  `json:"host_port"`
+	State     string         `json:"state"`
+	Error     sql.NullString `json:"error"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+const portForwardColumns = `id, vm_name, protocol, guest_port, host_port, state, error, created_at`
+
+func scanPortForward(row interface{ Scan(...any) error }) (*PortForward, error) {
+	var f PortForward
+	err := row.Scan(&f.ID, &f.VMName, &f.Protocol, &f.GuestPort, &f.HostPort, &f.State, &f.Error, &f.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrPortForwardNotFound
+	}
+	return &f, err
+}
+
+// CreatePortForward asks vmName's agent to expose guestPort. The SSH port
+// is always forwarded, so guest tcp/22 counts as taken.
+func CreatePortForward(db *sql.DB, vmName, protocol string, guestPort int) (*PortForward, error) {
+	if (protocol != "tcp" && protocol != "udp") || guestPort < 1 || guestPort > 65535 {
+		return nil, ErrInvalidPortForward
+	}
+	if protocol == "tcp" && guestPort == 22 {
+		return nil, ErrPortForwardExists
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var state string
+	err = tx.QueryRow(`SELECT state FROM rentals WHERE vm_name = ?`, vmName).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, ErrRentalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isLiveRentalState(state) {
+		return nil, ErrRentalInactive
+	}
+
+	var total, dup int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(protocol = ? AND guest_port = ?), 0)
+		   FROM port_forwards WHERE vm_name = ? AND state IN (?, ?)`,
+		protocol, guestPort, vmName, PortForwardPending, PortForwardActive,
+	).Scan(&total, &dup); err != nil {
+		return nil, err
+	}
+	if dup > 0 {
+		return nil, ErrPortForwardExists
+	}
+	if total >= MaxPortForwards {
+		return nil, ErrTooManyPortForwards
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO port_forwards (vm_name, protocol, guest_port, state) VALUES (?, ?, ?, ?)`,
+		vmName, protocol, guestPort, PortForwardPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return scanPortForward(db.QueryRow(
+		`SELECT `+portForwardColumns+` FROM port_forwards WHERE id = ?`, id,
+	))
+}
+
+// ListPortForwards returns vmName's forwards that have not been removed.
+func ListPortForwards(db *sql.DB, vmName string) ([]PortForward, error) {
+	rows, err := db.Query(
+		`SELECT `+portForwardColumns+` FROM port_forwards
+		  WHERE vm_name = ? AND state != ?
+		  ORDER BY id`,
+		vmName, PortForwardRemoved,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []PortForward{}
+	for rows.Next() {
+		f, err := scanPortForward(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *f)
+	}
+	return list, rows.Err()
+}
+
+// activePortForwards returns every active forward, keyed by rental.
+func activePortForwards(db *sql.DB) (map[string][]PortForward, error) {
+	rows, err := db.Query(
+		`SELECT `+portForwardColumns+` FROM port_forwards WHERE state = ? ORDER BY id`,
+		PortForwardActive,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byVM := map[string][]PortForward{}
+	for rows.Next() {
+		f, err := scanPortForward(rows)
+		if err != nil {
+			return nil, err
+		}
+		byVM[f.VMName] = append(byVM[f.VMName], *f)
+	}
+	return byVM, rows.Err()
+}
+
+// RemovePortForward asks the agent to take forward id of vmName down.
+// Failed forwards were never applied and are dropped at once.
+func RemovePortForward(db *sql.DB, vmName string, id int64) error {
+	res, err := db.Exec(
+		`UPDATE port_forwards
+		    SET state = CASE state WHEN ? THEN ? ELSE ? END
+		  WHERE id = ? AND vm_name = ? AND state IN (?, ?, ?)`,
+		PortForwardError, PortForwardRemoved, PortForwardRemoving,
+		id, vmName, PortForwardPending, PortForwardActive, PortForwardError,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPortForwardNotFound
+	}
+	return nil
+}
+
+// closePortForwards marks all of vmName's forwards removed once no VM
+// holds them any more.
+func closePortForwards(db execer, vmName string) error {
+	_, err := db.Exec(
+		`UPDATE port_forwards SET state = ? WHERE vm_name = ? AND state != ?`,
+		PortForwardRemoved, vmName, PortForwardRemoved,
+	)
+	return err
+}
+
+// --- Notification Model & Helpers ---
+
+// Notification is a user-facing notice about one of their rentals.
+type Notification struct {
+	ID        int64      `json:"id"`
+	UserID    int        `json:"user_id"`
+	VMName    string     `json:"vm_name"`
+	Kind      string     `json:"kind"`
+	Message   string     `json:"message"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// CreateNotification stores a notification and returns its ID.
+func CreateNotification(db *sql.DB, userID int, vmName, kind, message string, expiresAt *time.Time) (int64, error) {
+	res, err := db.Exec(
+		`INSERT INTO notifications (user_id, vm_name, kind, message, expires_at)
+		 VALUES (?, ?, ?, ?, ?)`,
+		userID, vmName, kind, message, expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListNotifications returns userID's notifications with id > afterID, oldest first.
+func ListNotifications(db *sql.DB, userID int, afterID int64) ([]Notification, error) {
+	rows, err := db.Query(
+		`SELECT id, user_id, vm_name, kind, message, expires_at, created_at
+		   FROM notifications
+		  WHERE user_id = ? AND id > ?
+		  ORDER BY id`,
+		userID, afterID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.UserID, &n.VMName, &n.Kind, &n.Message, &expiresAt, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			n.ExpiresAt = &expiresAt.Time
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// --- Volume Model & Helpers ---
+
+// Volume states.
+const (
+	VolumeCreating  = "creating"
+	VolumeAvailable = "available"
+	VolumeAttached  = "attached"
+	VolumeDeleting  = "deleting"
+	VolumeDeleted   = "deleted"
+	VolumeError     = "error"
+)
+
+var (
+	ErrVolumeNotFound    = errors.New("volume not found")
+	ErrVolumeQuota       = errors.New("volume quota exceeded")
+	ErrNoVolumeHost      = errors.New("no agent has room for this volume")
+	ErrVolumeUnavailable = errors.New("volume is not available")
+	ErrVolumesSplit      = errors.New("volumes live on different agents")
+)
+
+// Volume is a standalone qcow2 data disk stored on one agent. It can be
+// attached to one rental at a time on that agent and survives its teardown.
+type Volume struct {
+	ID         int64          `json:"id"`
+	Name       string         `json:"name"`
+	UserID     int            `json:"user_id"`
+	AgentID    int            `json:"agent_id"`
+	SizeGB     int            `json:"size_gb"`
+	State      string         `json:"state"`
+	AttachedTo sql.NullString `json:"attached_to"`
+	Error      sql.NullString `json:"error"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+// CreateVolume reserves a volume for userID on agentID (or, if agentID is 0,
+// on the most recently seen agent with room). The user's total must stay
+// within userQuotaGB and the agent's within its volume_quota_gb. The agent
+// creates the backing file and marks it available.
+func CreateVolume(db *sql.DB, userID, agentID int, name string, sizeGB, userQuotaGB int) (*Volume, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var used int
+	if err := tx.QueryRow(
+		`SELECT COALESCE(SUM(size_gb), 0) FROM volumes
+		  WHERE user_id = ? AND state NOT IN (?, ?)`,
+		userID, VolumeDeleted, VolumeError,
+	).Scan(&used); err != nil {
+		return nil, err
+	}
+	if used+sizeGB > userQuotaGB {
+		return nil, ErrVolumeQuota
+	}
+
+	// free space per agent = quota - live volumes
+	err = tx.QueryRow(
+		`SELECT a.id FROM agents a
+		  WHERE (? = 0 OR a.id = ?)
+		    AND a.volume_quota_gb - COALESCE((
+		          SELECT SUM(v.size_gb) FROM volumes v
+		           WHERE v.agent_id = a.id AND v.state NOT IN (?, ?)), 0) >= ?
+		  ORDER BY a.last_seen DESC
+		  LIMIT 1`,
+		agentID, agentID, VolumeDeleted, VolumeError, sizeGB,
+	).Scan(&agentID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoVolumeHost
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO volumes (name, user_id, agent_id, size_gb, state)
+		 VALUES (?, ?, ?, ?, ?)`,
+		name, userID, agentID, sizeGB, VolumeCreating,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetVolume(db, id)
+}
+
+// GetVolume loads one volume.
+func GetVolume(db *sql.DB, id int64) (*Volume, error) {
+	var v Volume
+	err := db.QueryRow(
+		`SELECT id, name, user_id, agent_id, size_gb, state, attached_to, error, created_at
+		   FROM volumes WHERE id = ?`,
+		id,
+	).Scan(&v.ID, &v.Name, &v.UserID, &v.AgentID, &v.SizeGB, &v.State, &v.AttachedTo, &v.Error, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrVolumeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ListVolumes returns userID's volumes that have not been deleted.
+func ListVolumes(db *sql.DB, userID int) ([]Volume, error) {
+	rows, err := db.Query(
+		`SELECT id, name, user_id, agent_id, size_gb, state, attached_to, error, created_at
+		   FROM volumes
+		  WHERE user_id = ? AND state != ?
+		  ORDER BY id`,
+		userID, VolumeDeleted,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Volume{}
+	for rows.Next() {
+		var v Volume
+		if err := rows.Scan(&v.ID, &v.Name, &v.UserID, &v.AgentID, &v.SizeGB, &v.State, &v.AttachedTo, &v.Error, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// DeleteVolume asks the owning agent to remove userID's unattached volume
+// id. Other users' volumes are reported as not found.
+func DeleteVolume(db *sql.DB, id int64, userID int) error {
+	res, err := db.Exec(
+		`UPDATE volumes SET state = ? WHERE id = ? AND user_id = ? AND state IN (?, ?)`,
+		VolumeDeleting, id, userID, VolumeAvailable, VolumeError,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	v, err := GetVolume(db, id)
+	if err != nil {
+		return err
+	}
+	if v.UserID != userID {
+		return ErrVolumeNotFound
+	}
+	return ErrVolumeUnavailable
+}
+
+// attachVolumes marks volumeIDs as attached to vmName inside tx. They must
+// belong to userID, be available and share one agent, whose ID is returned
+// so the rental can be pinned there.
+func attachVolumes(tx *sql.Tx, vmName string, userID int, volumeIDs []int64) (int, error) {
+	agentID := 0
+	for _, id := range volumeIDs {
+		var owner, onAgent int
+		var state string
+		err := tx.QueryRow(
+			`SELECT user_id, agent_id, state FROM volumes WHERE id = ?`, id,
+		).Scan(&owner, &onAgent, &state)
+		if err == sql.ErrNoRows || (err == nil && owner != userID) {
+			return 0, ErrVolumeNotFound
+		}
+		if err != nil {
+			return 0, err
+		}
+		if state != VolumeAvailable {
+			return 0, ErrVolumeUnavailable
+		}
+		if agentID != 0 && onAgent != agentID {
+			return 0, ErrVolumesSplit
+		}
+		agentID = onAgent
+
+		if _, err := tx.Exec(
+			`UPDATE volumes SET state = ?, attached_to = ? WHERE id = ?`,
+			VolumeAttached, vmName, id,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return agentID, nil
+}
+
+// DetachVolumes releases every volume attached to vmName.
+func DetachVolumes(db execer, vmName string) error {
+	_, err := db.Exec(
+		`UPDATE volumes SET state = ?, attached_to = NULL
+		  WHERE attached_to = ? AND state = ?`,
+		VolumeAvailable, vmName, VolumeAttached,
+	)
+	return err
+}
+
+// --- Snapshot Model & Helpers ---
+
+// Snapshot states.
+const (
+	SnapshotPending   = "pending"
+	SnapshotCreating  = "creating"
+	SnapshotAvailable = "available"
+	SnapshotError     = "error"
+)
+
+var (
+	ErrSnapshotNotFound    = errors.New("snapshot not found")
+	ErrSnapshotUnavailable = errors.New("snapshot is not available")
+	ErrSnapshotElsewhere   = errors.New("snapshot and volumes live on different agents")
+)
+
+// Snapshot is a copy of a rental's disk taken while the VM was paused. It is
+// stored on the agent that ran the rental, so rentals restored from it are
+// pinned there.
+type Snapshot struct {
+	ID          int64          `json:"id"`
+	Name        string         `json:"name"`
+	UserID      int            `json:"user_id"`
+	AgentID     int            `json:"agent_id"`
+	VMName      string         `json:"vm_name"`
+	Image       string         `json:"image"`
+	Flavor      string         `json:"flavor"`
+	State       string         `json:"state"`
+	SizeBytes   sql.NullInt64  `json:"size_bytes"`
+	Error       sql.NullString `json:"error"`
+	CreatedAt   time.Time      `json:"created_at"`
+	CompletedAt sql.NullTime   `json:"completed_at"`
+}
+
+const snapshotColumns = `id, name, user_id, agent_id, vm_name, image, flavor, state,
+	size_bytes, error, created_at, completed_at`
+
+func scanSnapshot(row interface{ Scan(...any) error }) (*Snapshot, error) {
+	var s Snapshot
+	err := row.Scan(&s.ID, &s.Name, &s.UserID, &s.AgentID, &s.VMName, &s.Image, &s.Flavor,
+		&s.State, &s.SizeBytes, &s.Error, &s.CreatedAt, &s.CompletedAt)
+	return &s, err
+}
+
+// CreateSnapshot asks the agent running vmName to snapshot its disk. Only
+// running rentals can be snapshotted.
+func CreateSnapshot(db *sql.DB, vmName, name string) (*Snapshot, error) {
+	var userID, agentID int
+	var image, flavor, state string
+	err := db.QueryRow(
+		`SELECT user_id, agent_id, image, flavor, state FROM rentals WHERE vm_name = ?`,
+		vmName,
+	).Scan(&userID, &agentID, &image, &flavor, &state)
+	if err == sql.ErrNoRows {
+		return nil, ErrRentalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state != RentalRunning {
+		return nil, ErrRentalInactive
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", vmName, time.Now().Unix())
+	}
+
+	res, err := db.Exec(
+		`INSERT INTO snapshots (name, user_id, agent_id, vm_name, image, flavor, state)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		name, userID, agentID, vmName, image, flavor, SnapshotPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return GetSnapshot(db, id)
+}
+
+// GetSnapshot loads one snapshot.
+func GetSnapshot(db *sql.DB, id int64) (*Snapshot, error) {
+	s, err := scanSnapshot(db.QueryRow(`SELECT `+snapshotColumns+` FROM snapshots WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListSnapshots returns userID's snapshots, oldest first.
+func ListSnapshots(db *sql.DB, userID int) ([]Snapshot, error) {
+	rows, err := db.Query(
+		`SELECT `+snapshotColumns+` FROM snapshots WHERE user_id = ? ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Snapshot{}
+	for rows.Next() {
+		s, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *s)
+	}
+	return list, rows.Err()
+}
+
+// --- Billing Model & Helpers ---
+
+// RentalUsage is what one rental has used: time held and network traffic.
+type RentalUsage struct {
+	VMName     string       `json:"vm_name"`
+	State      string       `json:"state"`
+	Image      string       `json:"image"`
+	Flavor     string       `json:"flavor"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StoppedAt  sql.NullTime `json:"stopped_at"`
+	Minutes    int64        `json:"minutes"`
+	NetRxBytes int64        `json:"net_rx_bytes"`
+	NetTxBytes int64        `json:"net_tx_bytes"`
+}
+
+// Usage is a user's billable usage across all their rentals.
+type Usage struct {
+	UserID     int           `json:"user_id"`
+	Rentals    []RentalUsage `json:"rentals"`
+	Minutes    int64         `json:"minutes"`
+	NetRxBytes int64         `json:"net_rx_bytes"`
+	NetTxBytes int64         `json:"net_tx_bytes"`
+}
+
+// GetUsage totals userID's rentals. A rental is billed from creation until
+// it stopped, or until now while it is still live, but never past its
+// expiry.
+func GetUsage(db *sql.DB, userID int) (*Usage, error) {
+	rows, err := db.Query(
+		`SELECT vm_name, state, image, flavor, created_at, stopped_at, expires_at,
+		        net_rx_bytes, net_tx_bytes
+		   FROM rentals WHERE user_id = ? ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	u := &Usage{UserID: userID, Rentals: []RentalUsage{}}
+	now := time.Now()
+	for rows.Next() {
+		var r RentalUsage
+		var expiresAt time.Time
+		if err := rows.Scan(&r.VMName, &r.State, &r.Image, &r.Flavor, &r.CreatedAt,
+			&r.StoppedAt, &expiresAt, &r.NetRxBytes, &r.NetTxBytes); err != nil {
+			return nil, err
+		}
+		end := now
+		if r.StoppedAt.Valid {
+			end = r.StoppedAt.Time
+		}
+		if end.After(expiresAt) {
+			end = expiresAt
+		}
+		if end.After(r.CreatedAt) {
+			r.Minutes = int64(math.Ceil(end.Sub(r.CreatedAt).Minutes()))
+		}
+		u.Rentals = append(u.Rentals, r)
+		u.Minutes += r.Minutes
+		u.NetRxBytes += r.NetRxBytes
+		u.NetTxBytes += r.NetTxBytes
+	}
+	return u, rows.Err()
+}
+
+// --- VM Metrics Model & Helpers ---
+
+// MaxMetricPoints bounds how many points one metrics query may return.
+const MaxMetricPoints = 1000
+
+// ErrInvalidMetricsRange is returned for an empty range or one that needs
+// too many points at the requested step.
+var ErrInvalidMetricsRange = errors.New("metrics range must be non-empty and at most 1000 steps")
+
+// MetricPoint is one step of a rental's resource usage. Rates are averages
+// over the step; CPUPercent is of one host core, so a busy 2-CPU guest
+// shows up to 200.
+type MetricPoint struct {
+	At            time.Time `json:"at"`
+	CPUPercent    float64   `json:"cpu_percent"`
+	RSSBytes      int64     `json:"rss_bytes"` // peak within the step
+	DiskReadBps   float64   `json:"disk_read_bps"`
+	DiskWriteBps  float64   `json:"disk_write_bps"`
+	DiskReadIOPS  float64   `json:"disk_read_iops"`
+	DiskWriteIOPS float64   `json:"disk_write_iops"`
+	NetRxBps      float64   `json:"net_rx_bps"`
+	NetTxBps      float64   `json:"net_tx_bps"`
+}
+
+// metricSample is one vm_metrics row.
+type metricSample struct {
+	at               time.Time
+	cpu              float64
+	rss              int64
+	rdBytes, wrBytes int64
+	rdOps, wrOps     int64
+	rxBytes, txBytes int64
+}
+
+// counterDelta is how far a counter moved between two samples; a smaller
+// value means the QEMU process restarted and counted up from zero.
+func counterDelta(prev, cur float64) float64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// GetRentalMetrics returns vmName's usage between from and to, one point per
+// step that has samples. Each point covers [At, At+step).
+func GetRentalMetrics(db *sql.DB, vmName string, from, to time.Time, step time.Duration) ([]MetricPoint, error) {
+	if step <= 0 || !to.After(from) || to.Sub(from)/step > MaxMetricPoints {
+		return nil, ErrInvalidMetricsRange
+	}
+	var exists int
+	if err := db.QueryRow(`SELECT 1 FROM rentals WHERE vm_name = ?`, vmName).Scan(&exists); err == sql.ErrNoRows {
+		return nil, ErrRentalNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// one sample before from, so the first step has a baseline for its rates
+	rows, err := db.Query(
+		`SELECT at, cpu_seconds, rss_bytes, disk_rd_bytes, disk_wr_bytes, disk_rd_ops, disk_wr_ops,
+		        net_rx_bytes, net_tx_bytes
+		   FROM vm_metrics
+		  WHERE vm_name = ? AND at < ?
+		    AND at >= COALESCE((SELECT MAX(at) FROM vm_metrics WHERE vm_name = ? AND at < ?), ?)
+		  ORDER BY at`,
+		vmName, to.UTC(), vmName, from.UTC(), from.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type bucket struct {
+		secs, cpu, rd, wr, rdOps, wrOps, rx, tx float64
+		rss                                     int64
+	}
+	buckets := map[int64]*bucket{}
+	var prev *metricSample
+	for rows.Next() {
+		var s metricSample
+		if err := rows.Scan(&s.at, &s.cpu, &s.rss, &s.rdBytes, &s.wrBytes, &s.rdOps, &s.wrOps,
+			&s.rxBytes, &s.txBytes); err != nil {
+			return nil, err
+		}
+		if s.at.Before(from) {
+			prev = &s
+			continue
+		}
+		i := int64(s.at.Sub(from) / step)
+		b := buckets[i]
+		if b == nil {
+			b = &bucket{}
+			buckets[i] = b
+		}
+		if s.rss > b.rss {
+			b.rss = s.rss
+		}
+		if prev != nil {
+			b.secs += s.at.Sub(prev.at).Seconds()
+			b.cpu += counterDelta(prev.cpu, s.cpu)
+			b.rd += counterDelta(float64(prev.rdBytes), float64(s.rdBytes))
+			b.wr += counterDelta(float64(prev.wrBytes), float64(s.wrBytes))
+			b.rdOps += counterDelta(float64(prev.rdOps), float64(s.rdOps))
+			b.wrOps += counterDelta(float64(prev.wrOps), float64(s.wrOps))
+			b.rx += counterDelta(float64(prev.rxBytes), float64(s.rxBytes))
+			b.tx += counterDelta(float64(prev.txBytes), float64(s.txBytes))
+		}
+		prev = &s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	points := []MetricPoint{}
+	for i := int64(0); i <= int64(to.Sub(from)/step); i++ {
+		b := buckets[i]
+		if b == nil {
+			continue
+		}
+		p := MetricPoint{At: from.Add(time.Duration(i) * step).UTC(), RSSBytes: b.rss}
+		if b.secs > 0 {
+			p.CPUPercent = b.cpu / b.secs * 100
+			p.DiskReadBps = b.rd / b.secs
+			p.DiskWriteBps = b.wr / b.secs
+			p.DiskReadIOPS = b.rdOps / b.secs
+			p.DiskWriteIOPS = b.wrOps / b.secs
+			p.NetRxBps = b.rx / b.secs
+			p.NetTxBps = b.tx / b.secs
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// --- Rental Event Model & Helpers ---
+
+// Rental event kinds the coordinator records. Agents add the boot, stop and
+// error events: scheduled, seed_built, qemu_started, warm_handover,
+// ssh_ready, running, guest_warned, suspended, resumed, migrated_out,
+// migrated_in, stopped, destroyed and error.
+const (
+	EventCreated            = "created"
+	EventExtended           = "extended"
+	EventWarningSent        = "warning_sent"
+	EventStopRequested      = "stop_requested"
+	EventSuspendRequested   = "suspend_requested"
+	EventResumeRequested    = "resume_requested"
+	EventMigrationRequested = "migration_requested"
+)
+
+// RentalEvent is one entry in a rental's timeline.
+type RentalEvent struct {
+	ID        int64          `json:"id"`
+	VMName    string         `json:"vm_name"`
+	Kind      string         `json:"kind"`
+	Message   string         `json:"message"`
+	Detail    sql.NullString `json:"detail"`
+	AgentID   sql.NullInt64  `json:"agent_id"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// querier is a *sql.DB or *sql.Tx.
+type querier interface {
+	execer
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// recordRentalEvent appends an event to vmName's timeline, tagged with the
+// agent the rental is on.
+func recordRentalEvent(q execer, vmName, kind, message string) error {
+	_, err := q.Exec(
+		`INSERT INTO rental_events (vm_name, kind, message, agent_id)
+		 VALUES (?, ?, ?, (SELECT NULLIF(agent_id, 0) FROM rentals WHERE vm_name = ?))`,
+		vmName, kind, message, vmName,
+	)
+	return err
+}
+
+// ListRentalEvents returns vmName's events after afterID, oldest first.
+func ListRentalEvents(db *sql.DB, vmName string, afterID int64) ([]RentalEvent, error) {
+	var exists int
+	err := db.QueryRow(`SELECT 1 FROM rentals WHERE vm_name = ?`, vmName).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, ErrRentalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		`SELECT id, vm_name, kind, message, detail, agent_id, created_at
+		   FROM rental_events WHERE vm_name = ? AND id > ? ORDER BY id`,
+		vmName, afterID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []RentalEvent{}
+	for rows.Next() {
+		var e RentalEvent
+		if err := rows.Scan(&e.ID, &e.VMName, &e.Kind, &e.Message, &e.Detail, &e.AgentID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// RentalUpdate is a rental event together with the rental's state as of
+// when it was read, which is what watchers are sent.
+type RentalUpdate struct {
+	RentalEvent
+	UserID    int            `json:"user_id"`
+	State     string         `json:"state"`
+	IPAddress sql.NullString `json:"ip_address"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// RentalStatus is where a rental stands right now.
+type RentalStatus struct {
+	VMName    string         `json:"vm_name"`
+	UserID    int            `json:"user_id"`
+	State     string         `json:"state"`
+	IPAddress sql.NullString `json:"ip_address"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// GetRentalStatus loads vmName's current state and endpoint.
+func GetRentalStatus(db *sql.DB, vmName string) (*RentalStatus, error) {
+	st := RentalStatus{VMName: vmName}
+	err := db.QueryRow(
+		`SELECT user_id, state, ip_address, expires_at FROM rentals WHERE vm_name = ?`, vmName,
+	).Scan(&st.UserID, &st.State, &st.IPAddress, &st.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRentalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// ErrRentalNotRunning is returned when a rental's VM is not on an agent.
+var ErrRentalNotRunning = errors.New("rental is not running")
+
+// AgentEndpoint is how the coordinator reaches an agent's HTTP API.
+type AgentEndpoint struct {
+	ID    int
+	Addr  string // used when the agent has no reverse tunnel up; empty for tunneled agents
+	Token string
+}
+
+// RentalAgent returns the endpoint of the agent running (or booting)
+// vmName's VM, for proxying requests about the VM to it.
+func RentalAgent(db *sql.DB, vmName string) (AgentEndpoint, error) {
+	var ep AgentEndpoint
+	var state string
+	var agentID sql.NullInt64
+	var address, tok, tunnelKey sql.NullString
+	err := db.QueryRow(
+		`SELECT r.state, a.id, a.address, a.token, a.tunnel_key
+		   FROM rentals r LEFT JOIN agents a ON a.id = r.agent_id
+		  WHERE r.vm_name = ?`, vmName,
+	).Scan(&state, &agentID, &address, &tok, &tunnelKey)
+	if err == sql.ErrNoRows {
+		return ep, ErrRentalNotFound
+	}
+	if err != nil {
+		return ep, err
+	}
+	// a booting VM already has a console, which is when it is most useful
+	if (state != RentalRunning && state != RentalPending) || !agentID.Valid || !tok.Valid {
+		return ep, ErrRentalNotRunning
+	}
+	// an agent that uses a tunnel is only reached through it: nothing
+	// vouches for the address it reports
+	if tunnelKey.Valid {
+		address.String = ""
+	}
+	return AgentEndpoint{ID: int(agentID.Int64), Addr: address.String, Token: tok.String}, nil
+}
+
+// maxRentalUpdates caps how many updates one ListRentalUpdates call returns.
+const maxRentalUpdates = 500
+
+// ListRentalUpdates returns up to maxRentalUpdates events after afterID,
+// oldest first, optionally narrowed to one rental or one user's rentals.
+func ListRentalUpdates(db *sql.DB, afterID int64, vmName string, userID int) ([]RentalUpdate, error) {
+	query := `SELECT e.id, e.vm_name, e.kind, e.message, e.detail, e.agent_id, e.created_at,
+	                 r.user_id, r.state, r.ip_address, r.expires_at
+	            FROM rental_events e JOIN rentals r ON r.vm_name = e.vm_name
+	           WHERE e.id > ?`
+	args := []any{afterID}
+	if vmName != "" {
+		query += ` AND e.vm_name = ?`
+		args = append(args, vmName)
+	}
+	if userID != 0 {
+		query += ` AND r.user_id = ?`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY e.id LIMIT ?`
+	args = append(args, maxRentalUpdates)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []RentalUpdate
+	for rows.Next() {
+		var u RentalUpdate
+		if err := rows.Scan(&u.ID, &u.VMName, &u.Kind, &u.Message, &u.Detail, &u.AgentID, &u.CreatedAt,
+			&u.UserID, &u.State, &u.IPAddress, &u.ExpiresAt); err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
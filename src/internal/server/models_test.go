@@ -0,0 +1,222 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDB returns a fresh database with every migration applied.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema, err := os.ReadFile("../../migrations/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMigrations(db, "../../migrations"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// mustExec runs query, failing the test on error.
+func mustExec(t *testing.T, db *sql.DB, query string, args ...any) sql.Result {
+	t.Helper()
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return res
+}
+
+// seedUser adds a user and returns its id.
+func seedUser(t *testing.T, db *sql.DB, email, sshKey string) int {
+	t.Helper()
+	res := mustExec(t, db, `INSERT INTO users (email, password, ssh_key) VALUES (?, 'x', ?)`, email, sshKey)
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+// seedAgent adds an agent with room for capacity VMs.
+func seedAgent(t *testing.T, db *sql.DB, id, capacity, maxLifetimeMinutes int) {
+	t.Helper()
+	mustExec(t, db,
+		`INSERT INTO agents (id, name, last_seen, capacity, max_lifetime_minutes) VALUES (?, ?, ?, ?, ?)`,
+		id, "agent-"+time.Now().Format("150405.000000000"), time.Now(), capacity, maxLifetimeMinutes)
+}
+
+// seedRental adds a rental of userID on agentID.
+func seedRental(t *testing.T, db *sql.DB, vmName string, userID, agentID int, state string, createdAt, expiresAt time.Time) {
+	t.Helper()
+	mustExec(t, db,
+		`INSERT INTO rentals (vm_name, user_id, agent_id, ssh_key, state, created_at, expires_at)
+		 VALUES (?, ?, ?, 'k', ?, ?, ?)`,
+		vmName, userID, agentID, state, createdAt, expiresAt)
+}
+
+func TestExtendRentalClamping(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name        string
+		createdAgo  time.Duration
+		expiresIn   time.Duration
+		state       string
+		hostCap     int // minutes, 0 = none
+		maxLifetime time.Duration
+		minutes     int
+
+		wantExpiresIn time.Duration
+		wantCappedBy  string
+		wantErr       error
+	}{
+		{
+			name: "within limits", createdAgo: time.Hour, expiresIn: time.Hour, state: RentalRunning,
+			maxLifetime: 24 * time.Hour, minutes: 30,
+			wantExpiresIn: 90 * time.Minute,
+		},
+		{
+			name: "capped by max lifetime", createdAgo: time.Hour, expiresIn: time.Hour, state: RentalRunning,
+			maxLifetime: 3 * time.Hour, minutes: 240,
+			wantExpiresIn: 2 * time.Hour, wantCappedBy: "max_lifetime",
+		},
+		{
+			name: "capped by host", createdAgo: time.Hour, expiresIn: time.Hour, state: RentalRunning,
+			hostCap: 150, maxLifetime: 24 * time.Hour, minutes: 240,
+			wantExpiresIn: 90 * time.Minute, wantCappedBy: "host_cap",
+		},
+		{
+			name: "host cap looser than max lifetime", createdAgo: time.Hour, expiresIn: time.Hour, state: RentalRunning,
+			hostCap: 600, maxLifetime: 3 * time.Hour, minutes: 240,
+			wantExpiresIn: 2 * time.Hour, wantCappedBy: "max_lifetime",
+		},
+		{
+			name: "suspended rentals can be extended", createdAgo: time.Hour, expiresIn: time.Hour, state: RentalSuspended,
+			maxLifetime: 24 * time.Hour, minutes: 10,
+			wantExpiresIn: 70 * time.Minute,
+		},
+		{
+			name: "already at the cap", createdAgo: time.Hour, expiresIn: time.Hour, state: RentalRunning,
+			maxLifetime: 2 * time.Hour, minutes: 30,
+			wantErr: ErrLifetimeExhausted,
+		},
+		{
+			name: "already expired", createdAgo: time.Hour, expiresIn: -time.Minute, state: RentalRunning,
+			maxLifetime: 24 * time.Hour, minutes: 30,
+			wantErr: ErrRentalExpired,
+		},
+		{
+			name: "stopped", createdAgo: time.Hour, expiresIn: time.Hour, state: RentalStopped,
+			maxLifetime: 24 * time.Hour, minutes: 30,
+			wantErr: ErrRentalInactive,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			user := seedUser(t, db, "u@example.com", "k")
+			seedAgent(t, db, 1, 2, tt.hostCap)
+			seedRental(t, db, "vm", user, 1, tt.state, now.Add(-tt.createdAgo), now.Add(tt.expiresIn))
+
+			ext, err := ExtendRental(db, "vm", tt.minutes, tt.maxLifetime)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := now.Add(tt.wantExpiresIn); !ext.ExpiresAt.Equal(want) {
+				t.Errorf("ExpiresAt = %v, want %v", ext.ExpiresAt, want)
+			}
+			if ext.CappedBy != tt.wantCappedBy {
+				t.Errorf("CappedBy = %q, want %q", ext.CappedBy, tt.wantCappedBy)
+			}
+
+			var stored time.Time
+			var logged int
+			db.QueryRow(`SELECT expires_at FROM rentals WHERE vm_name = 'vm'`).Scan(&stored)
+			db.QueryRow(`SELECT COUNT(*) FROM rental_extensions WHERE vm_name = 'vm'`).Scan(&logged)
+			if !stored.Equal(ext.ExpiresAt) {
+				t.Errorf("stored expires_at = %v, want %v", stored, ext.ExpiresAt)
+			}
+			if logged != 1 {
+				t.Errorf("%d rental_extensions rows, want 1", logged)
+			}
+		})
+	}
+}
+
+func TestExtendRentalUnknown(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := ExtendRental(db, "missing", 10, time.Hour); !errors.Is(err, ErrRentalNotFound) {
+		t.Fatalf("err = %v, want ErrRentalNotFound", err)
+	}
+}
+
+func TestCreateNetworkPorts(t *testing.T) {
+	db := newTestDB(t)
+	user := seedUser(t, db, "u@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	port := func(id int64) int {
+		var p int
+		db.QueryRow(`SELECT mcast_port FROM networks WHERE id = ?`, id).Scan(&p)
+		return p
+	}
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		n, err := CreateNetwork(db, user, 0, "n", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID)
+		if got, want := port(n.ID), networkPortMin+i; got != want {
+			t.Errorf("network %d: port %d, want %d", n.ID, got, want)
+		}
+	}
+
+	// a deleted network's port is reused
+	if err := DeleteNetwork(db, ids[1], user); err != nil {
+		t.Fatal(err)
+	}
+	n, err := CreateNetwork(db, user, 0, "n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := port(n.ID); got != networkPortMin+1 {
+		t.Errorf("after delete: port %d, want %d", got, networkPortMin+1)
+	}
+
+	// ids past the old 20000-port window no longer wrap onto used ports
+	mustExec(t, db, `UPDATE sqlite_sequence SET seq = 20000 WHERE name = 'networks'`)
+	n, err = CreateNetwork(db, user, 0, "n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := port(n.ID); got != networkPortMin+3 {
+		t.Errorf("network %d: port %d, want %d", n.ID, got, networkPortMin+3)
+	}
+
+	// with every port taken, creation fails instead of sharing one
+	mustExec(t, db,
+		`WITH RECURSIVE p(port) AS (SELECT ? UNION ALL SELECT port + 1 FROM p WHERE port < ?)
+		 INSERT INTO networks (name, user_id, agent_id, cidr, state, mcast_port)
+		 SELECT 'fill', ?, 1, ?, ?, port FROM p`,
+		networkPortMin+4, networkPortMax, user, DefaultNetworkCIDR, NetworkActive)
+	if _, err := CreateNetwork(db, user, 0, "n", ""); !errors.Is(err, ErrNoNetworkPort) {
+		t.Errorf("err = %v, want ErrNoNetworkPort", err)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CreateNetworkRequest defines the payload for POST /networks.
+type CreateNetworkRequest struct {
+	Name    string `json:"name"`
+	CIDR    string `json:"cidr"`     // optional, defaults to DefaultNetworkCIDR
+	AgentID int    `json:"agent_id"` // optional; 0 lets the coordinator pick a host
+}
+
+// NetworksHandler dispatches GET->List, POST->Create on /networks.
+func NetworksHandler(db *sql.DB) http.HandlerFunc {
+	list := HandleListNetworks(db)
+	create := HandleCreateNetwork(db)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list(w, r)
+		case http.MethodPost:
+			create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HandleCreateNetwork handles POST /networks, creating a network for the
+// logged-in user.
+func HandleCreateNetwork(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		var req CreateNetworkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			req.Name = fmt.Sprintf("network-%d", userID)
+		}
+
+		n, err := CreateNetwork(db, userID, req.AgentID, req.Name, req.CIDR)
+		switch {
+		case errors.Is(err, ErrInvalidCIDR):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrNoNetworkHost), errors.Is(err, ErrNoNetworkPort):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to create network: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(n)
+	}
+}
+
+// HandleListNetworks handles GET /networks, the logged-in user's networks
+// including the rentals on each and their addresses.
+func HandleListNetworks(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		list, err := ListNetworks(db, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to query networks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// HandleDeleteNetwork handles DELETE /networks/{id} for the network's owner.
+func HandleDeleteNetwork(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/networks/"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+
+		err = DeleteNetwork(db, id, userID)
+		switch {
+		case errors.Is(err, ErrNetworkNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrNetworkInUse):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to delete network: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
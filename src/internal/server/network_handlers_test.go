@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+)
+
+func TestNetworkHandlersUseSessionUser(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	networks := NetworksHandler(db)
+
+	// the body's user_id no longer picks the owner
+	rec := serve(t, networks, http.MethodPost, "/networks", fmt.Sprintf(`{"user_id": %d, "name": "lan"}`, bob), alice)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	var n Network
+	json.NewDecoder(rec.Body).Decode(&n)
+	if n.UserID != alice {
+		t.Errorf("created network owned by %d, want %d", n.UserID, alice)
+	}
+	if rec := serve(t, networks, http.MethodPost, "/networks", `{}`, 0); rec.Code != http.StatusUnauthorized {
+		t.Errorf("create logged out: %d, want 401", rec.Code)
+	}
+
+	if rec := serve(t, networks, http.MethodGet, "/networks", "", 0); rec.Code != http.StatusUnauthorized {
+		t.Errorf("list logged out: %d, want 401", rec.Code)
+	}
+	for _, tt := range []struct {
+		user int
+		want int
+	}{{alice, 1}, {bob, 0}} {
+		rec := serve(t, networks, http.MethodGet, fmt.Sprintf("/networks?user_id=%d", alice), "", tt.user)
+		var list []Network
+		json.NewDecoder(rec.Body).Decode(&list)
+		if rec.Code != http.StatusOK || len(list) != tt.want {
+			t.Errorf("list as user %d: %d, %d networks; want 200, %d", tt.user, rec.Code, len(list), tt.want)
+		}
+	}
+
+	del := HandleDeleteNetwork(db)
+	target := fmt.Sprintf("/networks/%d", n.ID)
+	tests := []struct {
+		name string
+		user int
+		want int
+	}{
+		{"logged out", 0, http.StatusUnauthorized},
+		{"someone else's", bob, http.StatusNotFound},
+		{"own", alice, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, del, http.MethodDelete, target, "", tt.user); rec.Code != tt.want {
+			t.Errorf("delete %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestCreateRentalOnNetworkChecksOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	res := mustExec(t, db,
+		`INSERT INTO networks (name, user_id, agent_id, cidr, state, mcast_port) VALUES ('lan', ?, 1, ?, ?, ?)`,
+		alice, DefaultNetworkCIDR, NetworkActive, networkPortMin)
+	network, _ := res.LastInsertId()
+	create := HandleCreateRental(db, expiry.New())
+
+	tests := []struct {
+		name string
+		body string
+		user int
+		want int
+	}{
+		{"someone else's network", fmt.Sprintf(`{"duration": 30, "network_ids": [%d]}`, network), bob, http.StatusBadRequest},
+		{"someone else's network as them", fmt.Sprintf(`{"user_id": %d, "duration": 30, "network_ids": [%d]}`, alice, network), bob, http.StatusBadRequest},
+		{"own network", fmt.Sprintf(`{"duration": 30, "network_ids": [%d]}`, network), alice, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, create, http.MethodPost, "/rentals", tt.body, tt.user); rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+	var n int
+	db.QueryRow(
+		`SELECT COUNT(*) FROM network_attachments na JOIN rentals r ON r.vm_name = na.vm_name
+		  WHERE na.network_id = ? AND r.user_id != ?`, network, alice,
+	).Scan(&n)
+	if n != 0 {
+		t.Errorf("%d of someone else's VMs on alice's network", n)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CreatePortForwardRequest defines the payload for
+// POST /rentals/{vmName}/ports.
+type CreatePortForwardRequest struct {
+	Protocol  string `json:"protocol"` // tcp (default) or udp
+	GuestPort int    `json:"guest_port"`
+}
+
+// HandleCreatePortForward handles POST /rentals/{vmName}/ports for the
+// rental's owner. The owning agent picks a host port and applies the forward to the running VM; poll
+// GET /rentals/{vmName}/ports for the host port.
+func HandleCreatePortForward(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// expect path like "/rentals/{vmName}/ports"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "ports" {
+			http.NotFound(w, r)
+			return
+		}
+		vmName := parts[2]
+		if !requireRentalOwner(db, w, r, vmName) {
+			return
+		}
+
+		var req CreatePortForwardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Protocol == "" {
+			req.Protocol = "tcp"
+		}
+
+		f, err := CreatePortForward(db, vmName, req.Protocol, req.GuestPort)
+		switch {
+		case errors.Is(err, ErrInvalidPortForward):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrRentalNotFound):
+			http.Error(w, "rental not found", http.StatusNotFound)
+			return
+		case errors.Is(err, ErrRentalInactive), errors.Is(err, ErrPortForwardExists),
+			errors.Is(err, ErrTooManyPortForwards):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to create port forward: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(f)
+	}
+}
+
+// HandleListPortForwards handles GET /rentals/{vmName}/ports for the
+// rental's owner.
+func HandleListPortForwards(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "ports" {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireRentalOwner(db, w, r, parts[2]) {
+			return
+		}
+		list, err := ListPortForwards(db, parts[2])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to query port forwards: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// HandleDeletePortForward handles DELETE /rentals/{vmName}/ports/{id} for
+// the rental's owner.
+func HandleDeletePortForward(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// expect path like "/rentals/{vmName}/ports/{id}"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 5 || parts[3] != "ports" {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireRentalOwner(db, w, r, parts[2]) {
+			return
+		}
+
+		err = RemovePortForward(db, parts[2], id)
+		switch {
+		case errors.Is(err, ErrPortForwardNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to remove port forward: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPortForwardHandlersCheckOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+
+	create := HandleCreatePortForward(db)
+	body := `{"guest_port": 8080}`
+	for _, tt := range []struct {
+		name string
+		user int
+		want int
+	}{
+		{"logged out", 0, http.StatusUnauthorized},
+		{"someone else's rental", bob, http.StatusNotFound},
+	} {
+		if rec := serve(t, create, http.MethodPost, "/rentals/vm/ports", body, tt.user); rec.Code != tt.want {
+			t.Errorf("create %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	rec := serve(t, create, http.MethodPost, "/rentals/vm/ports", body, alice)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("create own: %d %s", rec.Code, rec.Body)
+	}
+	var f PortForward
+	json.NewDecoder(rec.Body).Decode(&f)
+
+	list := HandleListPortForwards(db)
+	if rec := serve(t, list, http.MethodGet, "/rentals/vm/ports", "", bob); rec.Code != http.StatusNotFound {
+		t.Errorf("list someone else's: %d, want 404", rec.Code)
+	}
+	if rec := serve(t, list, http.MethodGet, "/rentals/vm/ports", "", alice); rec.Code != http.StatusOK {
+		t.Errorf("list own: %d, want 200", rec.Code)
+	}
+
+	del := HandleDeletePortForward(db)
+	target := fmt.Sprintf("/rentals/vm/ports/%d", f.ID)
+	for _, tt := range []struct {
+		name string
+		user int
+		want int
+	}{
+		{"logged out", 0, http.StatusUnauthorized},
+		{"someone else's rental", bob, http.StatusNotFound},
+		{"own", alice, http.StatusAccepted},
+	} {
+		if rec := serve(t, del, http.MethodDelete, target, "", tt.user); rec.Code != tt.want {
+			t.Errorf("delete %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/metrics"
+)
+
+// Metrics is the coordinator's Prometheus registry, served on /metrics.
+var Metrics = metrics.NewRegistry()
+
+var (
+	httpRequests = Metrics.NewCounter("vmshare_http_requests_total",
+		"HTTP requests served, by route, method and status code.", "route", "method", "code")
+	httpDuration = Metrics.NewHistogram("vmshare_http_request_duration_seconds",
+		"HTTP request latency by route.", metrics.DefaultBuckets, "route")
+	rentalsExpired = Metrics.NewCounter("vmshare_rentals_expired_total",
+		"Rentals ended by the expiry scheduler.")
+	expiryErrors = Metrics.NewCounter("vmshare_expiry_errors_total",
+		"Expiry runs that failed to end a rental and will be retried on restart.")
+)
+
+// provisioningBuckets are bounds, in seconds, for the time from a rental
+// being created to its VM answering SSH: seconds for a warm VM, minutes for
+// a cold boot that installs packages.
+var provisioningBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200}
+
+// RegisterDBMetrics adds the metrics read from the database on each scrape.
+func RegisterDBMetrics(db *sql.DB) {
+	Metrics.NewGaugeFunc("vmshare_rentals", "Rentals by state.", func() ([]metrics.Sample, error) {
+		return countBy(db, `SELECT state, COUNT(*) FROM rentals GROUP BY state`)
+	}, "state")
+	Metrics.NewGaugeFunc("vmshare_agents", "Agents by status: online if heard from in the last 30s.", func() ([]metrics.Sample, error) {
+		return countBy(db,
+			`SELECT CASE WHEN last_seen > ? THEN 'online' ELSE 'offline' END, COUNT(*)
+			   FROM agents GROUP BY 1`,
+			time.Now().Add(-agentLiveWindow))
+	}, "status")
+	Metrics.NewHistogramFunc("vmshare_rental_provisioning_seconds",
+		"Time from a rental being created to its VM being reachable, for rentals started in the last 24h.", provisioningBuckets,
+		func() ([]float64, error) { return provisioningTimes(db) })
+}
+
+// countBy runs a "SELECT label, COUNT(*)" query as gauge samples.
+func countBy(db *sql.DB, query string, args ...any) ([]metrics.Sample, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var samples []metrics.Sample
+	for rows.Next() {
+		var label string
+		var n int
+		if err := rows.Scan(&label, &n); err != nil {
+			return nil, err
+		}
+		samples = append(samples, metrics.Sample{Values: []string{label}, Value: float64(n)})
+	}
+	return samples, rows.Err()
+}
+
+// provisioningWindow bounds the rentals the provisioning histogram is
+// built from, so a scrape reads a day of rentals rather than all of them.
+const provisioningWindow = 24 * time.Hour
+
+// provisioningTimes returns the provisioning latency of every rental
+// started within the last provisioningWindow.
+func provisioningTimes(db *sql.DB) ([]float64, error) {
+	rows, err := db.Query(
+		`SELECT created_at, started_at FROM rentals WHERE started_at > ?`,
+		time.Now().Add(-provisioningWindow))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var obs []float64
+	for rows.Next() {
+		var created, started time.Time
+		if err := rows.Scan(&created, &started); err != nil {
+			return nil, err
+		}
+		obs = append(obs, started.Sub(created).Seconds())
+	}
+	return obs, rows.Err()
+}
+
+// InstrumentHandler counts and times every request next serves.
+func InstrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := routeLabel(r.URL.Path)
+		httpRequests.Inc(route, r.Method, strconv.Itoa(rec.code))
+		httpDuration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// routes are the coordinator's routes, with IDs and VM names as {id}. A
+// request for anything else is labelled "other", so scanners probing
+// random paths can't grow the series without bound.
+var routes = []string{
+	"/rentals", "/rentals/{id}", "/rentals/{id}/ports/{id}", "/rentals/{id}/console/log",
+	"/rentals/{id}/extend", "/rentals/{id}/snapshots", "/rentals/{id}/suspend",
+	"/rentals/{id}/resume", "/rentals/{id}/migrate", "/rentals/{id}/ports",
+	"/rentals/{id}/metrics", "/rentals/{id}/events", "/rentals/{id}/console",
+	"/rentals/{id}/terminal", "/rentals/{id}/watch",
+	"/volumes", "/volumes/{id}",
+	"/networks", "/networks/{id}",
+	"/clusters", "/clusters/{id}", "/clusters/{id}/extend",
+	"/snapshots", "/migrations/{id}",
+	"/signup", "/login", "/logout", "/me", "/notifications", "/watch", "/billing",
+	"/livez", "/readyz", "/metrics",
+}
+
+// routeLabel maps a request path to its route, so the label stays
+// low-cardinality: /rentals/rental-1-2/ports/3 becomes
+// /rentals/{id}/ports/{id}, and paths that match no route become "other".
+func routeLabel(p string) string {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for _, route := range routes {
+		if matchRoute(strings.Split(route[1:], "/"), parts) {
+			return route
+		}
+	}
+	return "other"
+}
+
+// matchRoute reports whether the path segments fit the route's, where
+// {id} matches any one non-empty segment.
+func matchRoute(route, parts []string) bool {
+	if len(route) != len(parts) {
+		return false
+	}
+	for i, seg := range route {
+		if seg == "{id}" && parts[i] == "" || seg != "{id}" && seg != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush and Hijack pass through, for streaming and upgraded connections.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	r.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
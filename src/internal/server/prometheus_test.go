@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteLabel(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/rentals", "/rentals"},
+		{"/rentals/", "/rentals"},
+		{"/rentals/rental-1-2", "/rentals/{id}"},
+		{"/rentals/rental-1-2/ports/3", "/rentals/{id}/ports/{id}"},
+		{"/rentals/rental-1-2/console/log", "/rentals/{id}/console/log"},
+		{"/rentals/rental-1-2/terminal", "/rentals/{id}/terminal"},
+		{"/clusters/7/extend", "/clusters/{id}/extend"},
+		{"/metrics", "/metrics"},
+		{"/wp-admin/setup.php", "other"},
+		{"/.env", "other"},
+		{"/rentals/x/anything", "other"},
+		{"/rentals/x/ports/3/more", "other"},
+	}
+	for _, tt := range tests {
+		if got := routeLabel(tt.path); got != tt.want {
+			t.Errorf("routeLabel(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestProvisioningTimesWindow(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	seedAgent(t, db, 1, 3, 0)
+	now := time.Now()
+	for _, r := range []struct {
+		vm      string
+		created time.Time
+		started any
+	}{
+		{"recent", now.Add(-time.Hour), now.Add(-time.Hour + 30*time.Second)},
+		{"old", now.Add(-72 * time.Hour), now.Add(-72*time.Hour + 90*time.Second)},
+		{"pending", now, nil},
+	} {
+		seedRental(t, db, r.vm, alice, 1, RentalRunning, r.created, now.Add(time.Hour))
+		mustExec(t, db, `UPDATE rentals SET started_at = ? WHERE vm_name = ?`, r.started, r.vm)
+	}
+
+	obs, err := provisioningTimes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obs) != 1 || obs[0] != 30 {
+		t.Errorf("provisioningTimes = %v, want only the recent rental's 30s", obs)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// CreateSnapshotRequest defines the optional payload for
+// POST /rentals/{vmName}/snapshots.
+type CreateSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// HandleCreateSnapshot handles POST /rentals/{vmName}/snapshots for the
+// rental's owner. The owning agent pauses the VM, copies its disk and marks
+// the snapshot available.
+func HandleCreateSnapshot(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// expect path like "/rentals/{vmName}/snapshots"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "snapshots" {
+			http.NotFound(w, r)
+			return
+		}
+		vmName := parts[2]
+		if !requireRentalOwner(db, w, r, vmName) {
+			return
+		}
+
+		var req CreateSnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		snap, err := CreateSnapshot(db, vmName, req.Name)
+		switch {
+		case errors.Is(err, ErrRentalNotFound):
+			http.Error(w, "rental not found", http.StatusNotFound)
+			return
+		case errors.Is(err, ErrRentalInactive):
+			http.Error(w, "rental is not running", http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to create snapshot: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(snap)
+	}
+}
+
+// HandleListSnapshots handles GET /snapshots, the logged-in user's snapshots.
+func HandleListSnapshots(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		list, err := ListSnapshots(db, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to query snapshots: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
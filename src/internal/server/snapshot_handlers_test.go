@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/smeetnagda/vmshare/internal/expiry"
+)
+
+func TestSnapshotHandlersCheckOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	seedRental(t, db, "vm", alice, 1, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+
+	create := HandleCreateSnapshot(db)
+	tests := []struct {
+		name string
+		user int
+		want int
+	}{
+		{"logged out", 0, http.StatusUnauthorized},
+		{"someone else's rental", bob, http.StatusNotFound},
+		{"own rental", alice, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, create, http.MethodPost, "/rentals/vm/snapshots", "", tt.user); rec.Code != tt.want {
+			t.Errorf("create %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	list := HandleListSnapshots(db)
+	if rec := serve(t, list, http.MethodGet, "/snapshots", "", 0); rec.Code != http.StatusUnauthorized {
+		t.Errorf("list logged out: %d, want 401", rec.Code)
+	}
+	for _, tt := range []struct {
+		user int
+		want int
+	}{{alice, 1}, {bob, 0}} {
+		rec := serve(t, list, http.MethodGet, "/snapshots?user_id=1", "", tt.user)
+		var snaps []Snapshot
+		json.NewDecoder(rec.Body).Decode(&snaps)
+		if rec.Code != http.StatusOK || len(snaps) != tt.want {
+			t.Errorf("list as user %d: %d, %d snapshots; want 200, %d", tt.user, rec.Code, len(snaps), tt.want)
+		}
+	}
+}
+
+func TestCreateRentalFromSnapshotChecksOwner(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	res := mustExec(t, db,
+		`INSERT INTO snapshots (name, user_id, agent_id, vm_name, image, flavor, state) VALUES ('s', ?, 1, 'vm', 'ubuntu', 'small', ?)`,
+		alice, SnapshotAvailable)
+	snap, _ := res.LastInsertId()
+	create := HandleCreateRental(db, expiry.New())
+
+	tests := []struct {
+		name string
+		body string
+		user int
+		want int
+	}{
+		{"someone else's snapshot", fmt.Sprintf(`{"duration": 30, "from_snapshot": %d}`, snap), bob, http.StatusBadRequest},
+		{"someone else's snapshot as them", fmt.Sprintf(`{"user_id": %d, "duration": 30, "from_snapshot": %d}`, alice, snap), bob, http.StatusBadRequest},
+		{"own snapshot", fmt.Sprintf(`{"duration": 30, "from_snapshot": %d}`, snap), alice, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, create, http.MethodPost, "/rentals", tt.body, tt.user); rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM rentals WHERE from_snapshot = ? AND user_id != ?`, snap, alice).Scan(&n)
+	if n != 0 {
+		t.Errorf("%d rentals restored from alice's snapshot for someone else", n)
+	}
+}
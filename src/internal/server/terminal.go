@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/smeetnagda/vmshare/internal/logging"
+	"github.com/smeetnagda/vmshare/internal/websocket"
+)
+
+// guestUser is the guest account the coordinator's own SSH sessions (the
+// browser terminal and the SSH gateway) log in as.
+const guestUser = "ubuntu"
+
+// terminalIdleTimeout ends a terminal session after this long without
+// input from the client.
+const terminalIdleTimeout = 30 * time.Minute
+
+// maxTerminalsPerUser caps each user's concurrent terminal sessions; every
+// one holds an SSH connection to a guest.
+const maxTerminalsPerUser = 4
+
+// terminalSessions counts the open terminal sessions of each user.
+var terminalSessions = struct {
+	mu     sync.Mutex
+	byUser map[int]int
+}{byUser: make(map[int]int)}
+
+// acquireTerminal takes one of userID's terminal slots, reporting false if
+// all are in use.
+func acquireTerminal(userID int) bool {
+	terminalSessions.mu.Lock()
+	defer terminalSessions.mu.Unlock()
+	if terminalSessions.byUser[userID] >= maxTerminalsPerUser {
+		return false
+	}
+	terminalSessions.byUser[userID]++
+	return true
+}
+
+// releaseTerminal gives back a slot taken by acquireTerminal.
+func releaseTerminal(userID int) {
+	terminalSessions.mu.Lock()
+	defer terminalSessions.mu.Unlock()
+	if terminalSessions.byUser[userID]--; terminalSessions.byUser[userID] <= 0 {
+		delete(terminalSessions.byUser, userID)
+	}
+}
+
+// terminalResize is the control message a terminal client sends when its
+// window changes size.
+type terminalResize struct {
+	Type string `json:"type"` // "resize"
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// HandleTerminal handles GET /rentals/{vmName}/terminal?cols=&rows=, a
+// WebSocket carrying an interactive SSH session to the rental, for renters
+// who cannot reach the agent's SSH port themselves. The coordinator logs
+// in with a one-off key the agent authorizes in the guest for the session.
+//
+// Messages from the client are keyboard input, except a text message
+// holding a JSON object with "type": "resize", which resizes the PTY.
+// Messages to the client are terminal output, as binary messages.
+//
+// A user may hold maxTerminalsPerUser sessions at once. A session ends
+// after terminalIdleTimeout without input, or when the client stops
+// reading its output.
+func HandleTerminal(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// expect path like "/rentals/{vmName}/terminal"
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 4 || parts[3] != "terminal" {
+			http.NotFound(w, r)
+			return
+		}
+		vmName := parts[2]
+		if !websocket.IsUpgrade(r) {
+			http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		if !allowedOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if !requireRentalOwner(db, w, r, vmName) {
+			return
+		}
+		userID, _ := sessionUserID(w, r)
+		if !acquireTerminal(userID) {
+			http.Error(w, "too many open terminal sessions", http.StatusTooManyRequests)
+			return
+		}
+		defer releaseTerminal(userID)
+		cols, rows := 80, 24
+		if v, err := strconv.Atoi(r.URL.Query().Get("cols")); err == nil && v > 0 {
+			cols = v
+		}
+		if v, err := strconv.Atoi(r.URL.Query().Get("rows")); err == nil && v > 0 {
+			rows = v
+		}
+		logger := logging.FromContext(r.Context()).With("vm", vmName)
+
+		client, err := dialGuestSSH(db, vmName)
+		switch {
+		case errors.Is(err, ErrRentalNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrRentalNotRunning):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			logger.Error("terminal: connect to guest", "err", err)
+			http.Error(w, "could not connect to the VM", http.StatusBadGateway)
+			return
+		}
+		defer client.Close()
+		sess, err := client.NewSession()
+		if err != nil {
+			logger.Error("terminal: open session", "err", err)
+			http.Error(w, "could not open a session", http.StatusBadGateway)
+			return
+		}
+		defer sess.Close()
+		stdin, err := sess.StdinPipe()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ws, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		out := ws.Writer(websocket.BinaryMessage)
+		sess.Stdout = out
+		sess.Stderr = out
+		modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 38400, ssh.TTY_OP_OSPEED: 38400}
+		if err := sess.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+			ws.WriteMessage(websocket.TextMessage, []byte("could not allocate a terminal: "+err.Error()))
+			return
+		}
+		if err := sess.Shell(); err != nil {
+			ws.WriteMessage(websocket.TextMessage, []byte("could not start a shell: "+err.Error()))
+			return
+		}
+		logger.Info("terminal opened")
+
+		go func() {
+			sess.Wait()
+			ws.Close()
+		}()
+		idle := time.AfterFunc(terminalIdleTimeout, func() {
+			logger.Info("terminal idle; closing")
+			ws.WriteMessage(websocket.TextMessage, []byte("\r\nsession closed after "+terminalIdleTimeout.String()+" without input\r\n"))
+			ws.Close()
+		})
+		defer idle.Stop()
+		for {
+			typ, msg, err := ws.ReadMessage()
+			if err != nil {
+				break
+			}
+			idle.Reset(terminalIdleTimeout)
+			if typ == websocket.TextMessage && bytes.HasPrefix(msg, []byte("{")) {
+				var rs terminalResize
+				if json.Unmarshal(msg, &rs) == nil && rs.Type == "resize" {
+					if rs.Cols > 0 && rs.Rows > 0 {
+						sess.WindowChange(rs.Rows, rs.Cols)
+					}
+					continue
+				}
+			}
+			if _, err := stdin.Write(msg); err != nil {
+				break
+			}
+		}
+		logger.Info("terminal closed")
+	}
+}
+
+// dialGuestSSH logs in to vmName's guest over a tunnel through its agent,
+// with a fresh key the agent authorizes for the length of the tunnel.
+func dialGuestSSH(db *sql.DB, vmName string) (*ssh.Client, error) {
+	c, chans, reqs, err := dialGuestConn(db, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialGuestConn is dialGuestSSH for callers that handle the connection's
+// channels and requests themselves.
+func dialGuestConn(db *sql.DB, vmName string) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pub := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	conn, err := dialAgent(db, vmName, "/vms/"+vmName+"/ssh", http.Header{"X-Vmshare-Key": {pub}})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	config := &ssh.ClientConfig{
+		User: guestUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// the guest's host key is generated on first boot and never
+		// published; the tunnel comes from the agent we authenticated to
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	c, chans, reqs, err := ssh.NewClientConn(conn, vmName, config)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("ssh: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return c, chans, reqs, nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTerminalSessionCap(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	// pending: the handler gets as far as dialing the guest, which fails
+	seedRental(t, db, "vm", alice, 1, RentalPending, time.Now(), time.Now().Add(time.Hour))
+
+	for i := 0; i < maxTerminalsPerUser; i++ {
+		if !acquireTerminal(alice) {
+			t.Fatalf("slot %d refused", i+1)
+		}
+	}
+	if acquireTerminal(alice) {
+		t.Fatal("slot over the cap granted")
+	}
+	if !acquireTerminal(bob) {
+		t.Fatal("another user's cap applied")
+	}
+	releaseTerminal(bob)
+
+	terminal := HandleTerminal(db)
+	open := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/rentals/vm/terminal", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		rec := httptest.NewRecorder()
+		terminal.ServeHTTP(rec, asUser(t, r, alice))
+		return rec.Code
+	}
+	if code := open(); code != http.StatusTooManyRequests {
+		t.Errorf("at the cap: %d, want 429", code)
+	}
+	releaseTerminal(alice)
+	if code := open(); code != http.StatusConflict {
+		t.Errorf("below the cap: %d, want 409 for a rental that is not running", code)
+	}
+	for i := 1; i < maxTerminalsPerUser; i++ {
+		releaseTerminal(alice)
+	}
+	terminalSessions.mu.Lock()
+	defer terminalSessions.mu.Unlock()
+	if n := len(terminalSessions.byUser); n != 0 {
+		t.Errorf("%d users still hold slots: %v", n, terminalSessions.byUser)
+	}
+}
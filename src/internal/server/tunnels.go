@@ -0,0 +1,236 @@
+package server
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/smeetnagda/vmshare/internal/metrics"
+	"github.com/smeetnagda/vmshare/internal/tunnel"
+)
+
+// agentTunnels holds the reverse tunnel each connected agent keeps open.
+var agentTunnels = struct {
+	mu    sync.Mutex
+	conns map[int]ssh.Conn
+}{conns: make(map[int]ssh.Conn)}
+
+// ServeAgentTunnels accepts the reverse tunnels agents behind NAT dial out
+// to the coordinator. An agent logs in as tunnel.User(id) with the tunnel
+// key it publishes in its heartbeat; from then on the coordinator reaches
+// its HTTP API through the tunnel instead of dialing its address. Only
+// that API goes through the tunnel: agents still need the database.
+func ServeAgentTunnels(db *sql.DB, addr string, hostKey ssh.Signer) error {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return authorizeAgent(db, meta.User(), key)
+		},
+		ServerVersion: "SSH-2.0-vmshare-tunnel",
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	Metrics.NewGaugeFunc("vmshare_agent_tunnels", "Agents connected over a reverse tunnel.", func() ([]metrics.Sample, error) {
+		agentTunnels.mu.Lock()
+		defer agentTunnels.mu.Unlock()
+		return []metrics.Sample{{Value: float64(len(agentTunnels.conns))}}, nil
+	})
+	// agents pin this as VMSHARE_TUNNEL_HOST_KEY
+	slog.Info("agent tunnels listening", "addr", addr,
+		"host_key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))))
+	return serveAgentTunnels(db, ln, config)
+}
+
+// serveAgentTunnels accepts agent tunnels on ln until it fails.
+func serveAgentTunnels(db *sql.DB, ln net.Listener, config *ssh.ServerConfig) error {
+	return acceptSSH(ln, "agent tunnels", func(conn net.Conn, loggedIn func()) {
+		handleAgentTunnel(db, config, conn, loggedIn)
+	})
+}
+
+// authorizeAgent checks an agent's tunnel login against its published
+// tunnel key.
+func authorizeAgent(db *sql.DB, user string, key ssh.PublicKey) (*ssh.Permissions, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(user, "agent-"))
+	if err != nil || tunnel.User(id) != user {
+		return nil, errGatewayDenied
+	}
+	var published sql.NullString
+	if err := db.QueryRow(`SELECT tunnel_key FROM agents WHERE id = ?`, id).Scan(&published); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error("agent tunnel: load key", "agent_id", id, "err", err)
+		}
+		return nil, errGatewayDenied
+	}
+	if !published.Valid {
+		return nil, errGatewayDenied
+	}
+	want, _, _, _, err := ssh.ParseAuthorizedKey([]byte(published.String))
+	if err != nil || subtle.ConstantTimeCompare(want.Marshal(), key.Marshal()) != 1 {
+		return nil, errGatewayDenied
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"agent_id": strconv.Itoa(id)}}, nil
+}
+
+func handleAgentTunnel(db *sql.DB, config *ssh.ServerConfig, conn net.Conn, loggedIn func()) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(gatewayHandshakeTimeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	loggedIn()
+	if err != nil {
+		slog.Debug("agent tunnel handshake", "remote", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sconn.Close()
+	agentID, _ := strconv.Atoi(sconn.Permissions.Extensions["agent_id"])
+	logger := slog.With("agent_id", agentID, "remote", conn.RemoteAddr().String())
+
+	agentTunnels.mu.Lock()
+	if old := agentTunnels.conns[agentID]; old != nil {
+		old.Close() // the agent reconnected before we noticed it left
+	}
+	agentTunnels.conns[agentID] = sconn
+	agentTunnels.mu.Unlock()
+	logger.Info("agent tunnel connected")
+	defer func() {
+		agentTunnels.mu.Lock()
+		if agentTunnels.conns[agentID] == sconn {
+			delete(agentTunnels.conns, agentID)
+		}
+		agentTunnels.mu.Unlock()
+		logger.Info("agent tunnel disconnected")
+	}()
+
+	go ssh.DiscardRequests(reqs)
+	go keepTunnelAlive(sconn)
+	for nc := range chans {
+		if nc.ChannelType() != tunnel.HTTPChannel {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		go relayAgentChannel(db, agentID, nc)
+	}
+}
+
+// keepTunnelAlive closes conn once the agent stops answering, so a dead
+// tunnel is not used for requests.
+func keepTunnelAlive(conn ssh.Conn) {
+	t := time.NewTicker(tunnel.KeepaliveInterval)
+	defer t.Stop()
+	for range t.C {
+		if _, _, err := conn.SendRequest("keepalive@vmshare", true, nil); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// relayAgentChannel connects a channel agent sourceID opened to the HTTP
+// API of the agent it targets. The only thing agents send each other is a
+// migrating VM, so the relay is refused unless sourceID is sending one to
+// the target, and it only goes down the target's own tunnel.
+func relayAgentChannel(db *sql.DB, sourceID int, nc ssh.NewChannel) {
+	target, err := tunnel.ParseTarget(nc)
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	if err := authorizeRelay(db, sourceID, int(target.AgentID)); err != nil {
+		nc.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+	dst, err := dialAgentConn(AgentEndpoint{ID: int(target.AgentID)})
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer dst.Close()
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(dst, ch)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(ch, dst)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// errRelayDenied is returned for a relay no migration calls for.
+var errRelayDenied = errors.New("no migration to that agent in progress")
+
+// authorizeRelay checks that agent sourceID is sending a VM to agent
+// targetID.
+func authorizeRelay(db *sql.DB, sourceID, targetID int) error {
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM migrations
+		  WHERE source_agent_id = ? AND dest_agent_id = ? AND state = 'sending'`,
+		sourceID, targetID,
+	).Scan(&n)
+	if err != nil {
+		slog.Error("agent tunnel: check relay", "agent_id", sourceID, "target", targetID, "err", err)
+		return errRelayDenied
+	}
+	if n == 0 {
+		return errRelayDenied
+	}
+	return nil
+}
+
+// dialAgentConn opens a connection to an agent's HTTP API: through its
+// reverse tunnel if it has one up, otherwise straight to its address.
+func dialAgentConn(ep AgentEndpoint) (net.Conn, error) {
+	agentTunnels.mu.Lock()
+	conn := agentTunnels.conns[ep.ID]
+	agentTunnels.mu.Unlock()
+	if conn != nil {
+		c, err := tunnel.Open(conn, nil)
+		if err != nil {
+			return nil, fmt.Errorf("agent %d tunnel: %v", ep.ID, err)
+		}
+		return c, nil
+	}
+	if ep.Addr == "" {
+		return nil, fmt.Errorf("agent %d: %w", ep.ID, errAgentUnreachable)
+	}
+	c, err := net.DialTimeout("tcp", ep.Addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("dial agent %d at %s: %v", ep.ID, ep.Addr, err)
+	}
+	return c, nil
+}
+
+// errAgentUnreachable is returned for an agent with neither a tunnel nor
+// an address.
+var errAgentUnreachable = errors.New("no tunnel and no address")
+
+// host is the Host header for requests to ep.
+func (ep AgentEndpoint) host() string {
+	if ep.Addr != "" {
+		return ep.Addr
+	}
+	return tunnel.User(ep.ID)
+}
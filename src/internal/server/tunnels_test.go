@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizeAgent(t *testing.T) {
+	db := newTestDB(t)
+	key, line := newPublicKey(t)
+	other, otherLine := newPublicKey(t)
+	seedAgent(t, db, 1, 2, 0)
+	seedAgent(t, db, 2, 2, 0)
+	seedAgent(t, db, 3, 2, 0)
+	mustExec(t, db, `UPDATE agents SET tunnel_key = ?, token = 'secret' WHERE id = 1`, line)
+	mustExec(t, db, `UPDATE agents SET tunnel_key = ? WHERE id = 2`, otherLine)
+
+	tests := []struct {
+		name   string
+		user   string
+		key    ssh.PublicKey
+		wantID string // "" if denied
+	}{
+		{"published key", "agent-1", key, "1"},
+		{"another agent's key", "agent-1", other, ""},
+		{"own key as another agent", "agent-2", key, ""},
+		{"no key published", "agent-3", key, ""},
+		{"unknown agent", "agent-9", key, ""},
+		{"not an agent", "root", key, ""},
+		{"padded id", "agent-01", key, ""},
+	}
+	for _, tt := range tests {
+		perms, err := authorizeAgent(db, tt.user, tt.key)
+		if tt.wantID == "" {
+			if err != errGatewayDenied {
+				t.Errorf("%s: %v, %v; want errGatewayDenied", tt.name, perms, err)
+			}
+			continue
+		}
+		if err != nil || perms.Extensions["agent_id"] != tt.wantID {
+			t.Errorf("%s: %v, %v; want agent %s", tt.name, perms, err, tt.wantID)
+		}
+	}
+}
+
+func TestAuthorizeRelay(t *testing.T) {
+	db := newTestDB(t)
+	for id := 1; id <= 3; id++ {
+		seedAgent(t, db, id, 2, 0)
+	}
+	for _, m := range []struct {
+		vm        string
+		src, dest int
+		state     string
+	}{
+		{"sending-vm", 1, 2, "sending"},
+		{"pending-vm", 1, 3, "pending"},
+		{"done-vm", 2, 3, "completed"},
+	} {
+		mustExec(t, db,
+			`INSERT INTO migrations (vm_name, source_agent_id, dest_agent_id, state, token) VALUES (?, ?, ?, ?, 't')`,
+			m.vm, m.src, m.dest, m.state)
+	}
+
+	tests := []struct {
+		source, target int
+		ok             bool
+	}{
+		{1, 2, true},
+		{2, 1, false}, // the destination cannot relay back
+		{3, 2, false}, // nor can a bystander
+		{1, 3, false}, // not sending yet
+		{2, 3, false}, // already done
+		{1, 1, false},
+	}
+	for _, tt := range tests {
+		err := authorizeRelay(db, tt.source, tt.target)
+		if tt.ok != (err == nil) {
+			t.Errorf("authorizeRelay(%d, %d) = %v; want ok %v", tt.source, tt.target, err, tt.ok)
+		}
+	}
+}
+
+func TestRentalAgentIgnoresTunneledAddress(t *testing.T) {
+	db := newTestDB(t)
+	_, line := newPublicKey(t)
+	alice := seedUser(t, db, "alice@example.com", "")
+	for id := 1; id <= 2; id++ {
+		seedAgent(t, db, id, 2, 0)
+		mustExec(t, db, `UPDATE agents SET address = ?, token = 't' WHERE id = ?`, fmt.Sprintf("10.0.0.%d:7100", id), id)
+		seedRental(t, db, fmt.Sprintf("vm-%d", id), alice, id, RentalRunning, time.Now(), time.Now().Add(time.Hour))
+	}
+	mustExec(t, db, `UPDATE agents SET tunnel_key = ? WHERE id = 2`, line)
+
+	for vm, want := range map[string]string{"vm-1": "10.0.0.1:7100", "vm-2": ""} {
+		ep, err := RentalAgent(db, vm)
+		if err != nil || ep.Addr != want {
+			t.Errorf("RentalAgent(%s) = %+v, %v; want address %q", vm, ep, err, want)
+		}
+	}
+	if _, err := dialAgentConn(AgentEndpoint{ID: 2}); err == nil {
+		t.Error("dialAgentConn to a tunneled agent without its tunnel up succeeded")
+	}
+}
+
+func TestAgentTunnelCapsLogins(t *testing.T) {
+	db := newTestDB(t)
+	hostKey, err := LoadHostKey(t.TempDir() + "/host_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return authorizeAgent(db, meta.User(), key)
+		},
+		ServerVersion: "SSH-2.0-vmshare-tunnel",
+	}
+	config.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAgentTunnels(db, ln, config)
+	testLoginCap(t, ln, "SSH-2.0-vmshare-tunnel")
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CreateVolumeRequest defines the payload for POST /volumes.
+type CreateVolumeRequest struct {
+	Name    string `json:"name"`
+	SizeGB  int    `json:"size_gb"`
+	AgentID int    `json:"agent_id"` // optional; 0 lets the coordinator pick a host
+}
+
+// VolumeQuotaGB caps the total size of a user's live volumes.
+var VolumeQuotaGB = 50
+
+// VolumesHandler dispatches GET->List, POST->Create on /volumes.
+func VolumesHandler(db *sql.DB) http.HandlerFunc {
+	list := HandleListVolumes(db)
+	create := HandleCreateVolume(db)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list(w, r)
+		case http.MethodPost:
+			create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HandleCreateVolume handles POST /volumes for the logged-in user. The
+// volume starts out "creating" until its agent has made the disk.
+func HandleCreateVolume(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		var req CreateVolumeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.SizeGB <= 0 {
+			http.Error(w, "size_gb must be > 0", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			req.Name = fmt.Sprintf("volume-%d", userID)
+		}
+
+		vol, err := CreateVolume(db, userID, req.AgentID, req.Name, req.SizeGB, VolumeQuotaGB)
+		switch {
+		case errors.Is(err, ErrVolumeQuota), errors.Is(err, ErrNoVolumeHost):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to create volume: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(vol)
+	}
+}
+
+// HandleListVolumes handles GET /volumes, listing the logged-in user's
+// volumes.
+func HandleListVolumes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+		list, err := ListVolumes(db, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to query volumes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// HandleDeleteVolume handles DELETE /volumes/{id} for the volume's owner.
+// Attached volumes must be released (by ending their rental) first.
+func HandleDeleteVolume(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/volumes/"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		userID, ok := sessionUserID(w, r)
+		if !ok {
+			return
+		}
+
+		err = DeleteVolume(db, id, userID)
+		switch {
+		case errors.Is(err, ErrVolumeNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrVolumeUnavailable):
+			http.Error(w, "volume is attached or busy", http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to delete volume: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
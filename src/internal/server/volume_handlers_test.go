@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestVolumeHandlersUseSessionUser(t *testing.T) {
+	db := newTestDB(t)
+	alice := seedUser(t, db, "alice@example.com", "k")
+	bob := seedUser(t, db, "bob@example.com", "k")
+	seedAgent(t, db, 1, 2, 0)
+	mustExec(t, db, `UPDATE agents SET volume_quota_gb = 100`)
+	volumes := VolumesHandler(db)
+
+	// the body's user_id no longer picks the owner
+	rec := serve(t, volumes, http.MethodPost, "/volumes", `{"user_id": 999, "name": "data", "size_gb": 5}`, alice)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	var vol Volume
+	json.NewDecoder(rec.Body).Decode(&vol)
+	if vol.UserID != alice {
+		t.Errorf("created volume owned by %d, want %d", vol.UserID, alice)
+	}
+	mustExec(t, db, `UPDATE volumes SET state = ?`, VolumeAvailable)
+
+	if rec := serve(t, volumes, http.MethodPost, "/volumes", `{"size_gb": 5}`, 0); rec.Code != http.StatusUnauthorized {
+		t.Errorf("create logged out: %d, want 401", rec.Code)
+	}
+
+	for _, tt := range []struct {
+		user int
+		want int
+	}{{alice, 1}, {bob, 0}} {
+		rec := serve(t, volumes, http.MethodGet, fmt.Sprintf("/volumes?user_id=%d", alice), "", tt.user)
+		var list []Volume
+		json.NewDecoder(rec.Body).Decode(&list)
+		if rec.Code != http.StatusOK || len(list) != tt.want {
+			t.Errorf("list as user %d: %d, %d volumes; want 200, %d", tt.user, rec.Code, len(list), tt.want)
+		}
+	}
+
+	del := HandleDeleteVolume(db)
+	target := fmt.Sprintf("/volumes/%d", vol.ID)
+	tests := []struct {
+		name string
+		user int
+		want int
+	}{
+		{"logged out", 0, http.StatusUnauthorized},
+		{"someone else's", bob, http.StatusNotFound},
+		{"own", alice, http.StatusAccepted},
+		{"own, already deleting", alice, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, del, http.MethodDelete, target, "", tt.user); rec.Code != tt.want {
+			t.Errorf("delete %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// watchPollInterval is how often the hub tails rental_events. Agents write
+// events straight to the database, so polling is how the coordinator hears
+// about them.
+const watchPollInterval = 500 * time.Millisecond
+
+// watchBuffer is how many updates a subscriber may fall behind by before
+// it is dropped. A dropped watcher reconnects and catches up from the
+// database with Last-Event-ID.
+const watchBuffer = 64
+
+// WatchHub fans rental events out to the clients watching them. It tails
+// the rental_events table, so it sees events from agents as well as from
+// this coordinator.
+type WatchHub struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	lastID int64
+}
+
+// Subscription receives the updates that match its filter on C. C is
+// closed if the subscriber falls too far behind or the subscription is
+// closed.
+type Subscription struct {
+	C <-chan RentalUpdate
+
+	c      chan RentalUpdate
+	hub    *WatchHub
+	vmName string
+	userID int
+}
+
+// StartWatchHub starts tailing rental_events from the current end of the
+// table.
+func StartWatchHub(db *sql.DB) (*WatchHub, error) {
+	h := &WatchHub{db: db, subs: make(map[*Subscription]struct{})}
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM rental_events`).Scan(&h.lastID); err != nil {
+		return nil, err
+	}
+	go h.run()
+	return h, nil
+}
+
+// Subscribe returns a subscription to vmName's updates or, if vmName is
+// "", to all of userID's.
+func (h *WatchHub) Subscribe(vmName string, userID int) *Subscription {
+	c := make(chan RentalUpdate, watchBuffer)
+	s := &Subscription{C: c, c: c, hub: h, vmName: vmName, userID: userID}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s)
+}
+
+// drop removes s and closes its channel; h.mu must be held.
+func (h *WatchHub) drop(s *Subscription) {
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+func (s *Subscription) matches(u RentalUpdate) bool {
+	if s.vmName != "" {
+		return u.VMName == s.vmName
+	}
+	return u.UserID == s.userID
+}
+
+func (h *WatchHub) run() {
+	for {
+		h.poll()
+		time.Sleep(watchPollInterval)
+	}
+}
+
+// poll publishes every event written since the last poll.
+func (h *WatchHub) poll() {
+	for {
+		updates, err := ListRentalUpdates(h.db, h.lastID, "", 0)
+		if err != nil {
+			slog.Error("tail rental events", "err", err)
+			return
+		}
+		if len(updates) == 0 {
+			return
+		}
+		h.mu.Lock()
+		for _, u := range updates {
+			for s := range h.subs {
+				if !s.matches(u) {
+					continue
+				}
+				select {
+				case s.c <- u:
+				default:
+					slog.Warn("dropping slow rental watcher", "vm", s.vmName, "user_id", s.userID)
+					h.drop(s)
+				}
+			}
+		}
+		h.lastID = updates[len(updates)-1].ID
+		h.mu.Unlock()
+		if len(updates) < maxRentalUpdates {
+			return
+		}
+	}
+}
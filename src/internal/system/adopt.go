@@ -0,0 +1,124 @@
+package system
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// runningVM is the manifest kept in a VM's work area while QEMU runs, so a
+// restarted agent can take the VM back (see AdoptVM).
+type runningVM struct {
+    savedVM
+    Pid    int    `json:"pid"`
+    Cgroup string `json:"cgroup,omitempty"`
+}
+
+func runningPath(dir string) string { return filepath.Join(dir, "qemu.json") }
+
+// WorkRoot holds the work areas of the VMs on this host.
+func WorkRoot() string { return filepath.Join(os.TempDir(), "vmrentals") }
+
+// writeRunning records vm in its work area. It is called whenever the VM's
+// process or name changes.
+func (vm *VM) writeRunning() {
+    data, err := json.Marshal(runningVM{
+        savedVM: savedVM{
+            Name: vm.Name, Dir: vm.Dir, Disk: vm.Disk, HostPort: vm.HostPort,
+            Image: vm.Image, Flavor: vm.Flavor, Args: vm.args,
+        },
+        Pid:    vm.proc.Pid,
+        Cgroup: vm.cgroup,
+    })
+    if err == nil {
+        err = os.WriteFile(runningPath(vm.Dir), data, 0644)
+    }
+    if err != nil {
+        slog.Warn("record running VM", "vm", vm.Name, "err", err)
+    }
+}
+
+// exited cleans up after the QEMU process has ended and closes vm.done.
+func (vm *VM) exited() {
+    os.Remove(runningPath(vm.Dir))
+    vm.release()
+    close(vm.done)
+}
+
+// RunningManifests lists the manifests of the QEMU processes recorded on
+// this host, whichever agent started them. Some may have exited since.
+func RunningManifests() ([]string, error) {
+    return filepath.Glob(filepath.Join(WorkRoot(), "*", "qemu.json"))
+}
+
+// AdoptVM takes over the QEMU process still running from the work area
+// holding manifest (see RunningManifests), e.g. after the agent restarted. The
+// process is not our child, so its exit is noticed by polling, and what it
+// wrote to stderr before the restart is lost.
+func AdoptVM(manifest string) (*VM, error) {
+    data, err := os.ReadFile(manifest)
+    if err != nil {
+        return nil, err
+    }
+    var r runningVM
+    if err := json.Unmarshal(data, &r); err != nil {
+        return nil, fmt.Errorf("parse %s: %v", manifest, err)
+    }
+    proc, err := os.FindProcess(r.Pid)
+    if err != nil {
+        return nil, err
+    }
+    if !processAlive(proc) {
+        return nil, fmt.Errorf("VM %s: QEMU (pid %d) is not running", r.Name, r.Pid)
+    }
+    vm := &VM{
+        Name:     r.Name,
+        Dir:      r.Dir,
+        Disk:     r.Disk,
+        HostPort: r.HostPort,
+        Image:    r.Image,
+        Flavor:   r.Flavor,
+        args:     r.Args,
+        proc:     proc,
+        done:     make(chan struct{}),
+        cgroup:   r.Cgroup,
+        stderr:   &tailBuffer{},
+    }
+    // the pid may have been reused since; a QEMU still answering on the
+    // VM's own QMP socket is the one we started
+    if err := vm.QMP("query-status", nil, nil); err != nil {
+        return nil, fmt.Errorf("VM %s: QMP: %v", r.Name, err)
+    }
+    vm.startRelay()
+    go func() {
+        for processAlive(proc) {
+            time.Sleep(time.Second)
+        }
+        vm.exited()
+    }()
+    return vm, nil
+}
+
+// Rename hands a running VM over to a new name, e.g. a warm VM to the rental
+// it now serves. Its work area moves along, so anything that finds a VM's
+// files by name keeps working; QEMU keeps its open files and sockets.
+func (vm *VM) Rename(name string) error {
+    dir := filepath.Join(WorkRoot(), name)
+    if _, err := os.Stat(dir); err == nil {
+        return fmt.Errorf("work area %s already exists", dir)
+    }
+    if err := os.Rename(vm.Dir, dir); err != nil {
+        return err
+    }
+    for i, a := range vm.args {
+        vm.args[i] = strings.ReplaceAll(a, vm.Dir, dir)
+    }
+    vm.Disk = filepath.Join(dir, filepath.Base(vm.Disk))
+    vm.Name, vm.Dir = name, dir
+    vm.writeRunning()
+    return nil
+}
@@ -0,0 +1,173 @@
+package system
+
+import (
+    "encoding/json"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// fakeQMP answers every command on sock with an empty return, like an idle
+// QEMU would.
+func fakeQMP(t *testing.T, sock string) {
+    t.Helper()
+    ln, err := net.Listen("unix", sock)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+                enc.Encode(map[string]any{"QMP": map[string]any{}})
+                for {
+                    var cmd map[string]any
+                    if dec.Decode(&cmd) != nil {
+                        return
+                    }
+                    enc.Encode(map[string]any{"return": map[string]any{}})
+                }
+            }()
+        }
+    }()
+}
+
+// startSleeper stands in for a QEMU process left by a previous agent.
+func startSleeper(t *testing.T) *exec.Cmd {
+    t.Helper()
+    cmd := exec.Command("sleep", "60")
+    if err := cmd.Start(); err != nil {
+        t.Skipf("cannot start sleep: %v", err)
+    }
+    t.Cleanup(func() { cmd.Process.Kill() })
+    go cmd.Wait()
+    return cmd
+}
+
+func writeManifest(t *testing.T, dir string, r runningVM) string {
+    t.Helper()
+    data, err := json.Marshal(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := runningPath(dir)
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestAdoptVM(t *testing.T) {
+    dir := t.TempDir()
+    fakeQMP(t, filepath.Join(dir, "qmp.sock"))
+    proc := startSleeper(t)
+    manifest := writeManifest(t, dir, runningVM{
+        savedVM: savedVM{Name: "rental-1", Dir: dir, Disk: filepath.Join(dir, "rental-1.qcow2"),
+            HostPort: 22222, Image: "ubuntu", Flavor: "small", Args: []string{"-m", "1024"}},
+        Pid: proc.Process.Pid,
+    })
+
+    vm, err := AdoptVM(manifest)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if vm.Name != "rental-1" || vm.HostPort != 22222 || vm.Dir != dir || len(vm.args) != 2 {
+        t.Errorf("adopted %+v, want the manifest's VM", vm)
+    }
+    select {
+    case <-vm.Done():
+        t.Fatal("Done closed while the process runs")
+    default:
+    }
+
+    proc.Process.Kill()
+    select {
+    case <-vm.Done():
+    case <-time.After(5 * time.Second):
+        t.Fatal("Done not closed after the process exited")
+    }
+    if _, err := os.Stat(manifest); !os.IsNotExist(err) {
+        t.Errorf("manifest still there after exit: %v", err)
+    }
+}
+
+func TestAdoptVMRefusesStaleManifests(t *testing.T) {
+    t.Run("process gone", func(t *testing.T) {
+        dir := t.TempDir()
+        fakeQMP(t, filepath.Join(dir, "qmp.sock"))
+        proc := startSleeper(t)
+        proc.Process.Kill()
+        time.Sleep(100 * time.Millisecond)
+        manifest := writeManifest(t, dir, runningVM{savedVM: savedVM{Name: "vm", Dir: dir}, Pid: proc.Process.Pid})
+        if _, err := AdoptVM(manifest); err == nil {
+            t.Fatal("adopted a VM whose process has exited")
+        }
+    })
+    t.Run("pid reused", func(t *testing.T) {
+        // a live process but no QEMU behind the VM's QMP socket
+        dir := t.TempDir()
+        proc := startSleeper(t)
+        manifest := writeManifest(t, dir, runningVM{savedVM: savedVM{Name: "vm", Dir: dir}, Pid: proc.Process.Pid})
+        if _, err := AdoptVM(manifest); err == nil {
+            t.Fatal("adopted a process that does not answer QMP")
+        }
+    })
+}
+
+func TestRenameMovesWorkArea(t *testing.T) {
+    t.Setenv("TMPDIR", t.TempDir())
+    old := filepath.Join(WorkRoot(), "warm-1-1-1")
+    if err := os.MkdirAll(old, 0755); err != nil {
+        t.Fatal(err)
+    }
+    disk := filepath.Join(old, "warm-1-1-1.qcow2")
+    os.WriteFile(disk, nil, 0644)
+    proc := startSleeper(t)
+    vm := &VM{
+        Name: "warm-1-1-1", Dir: old, Disk: disk,
+        args: []string{"-drive", "file=" + disk + ",if=virtio", "-qmp", "unix:" + filepath.Join(old, "qmp.sock")},
+        proc: proc.Process,
+    }
+
+    if err := vm.Rename("rental-7"); err != nil {
+        t.Fatal(err)
+    }
+    dir := filepath.Join(WorkRoot(), "rental-7")
+    if vm.Name != "rental-7" || vm.Dir != dir || vm.Disk != filepath.Join(dir, "warm-1-1-1.qcow2") {
+        t.Errorf("after Rename: name %q dir %q disk %q", vm.Name, vm.Dir, vm.Disk)
+    }
+    if _, err := os.Stat(vm.Disk); err != nil {
+        t.Errorf("disk not moved: %v", err)
+    }
+    if _, err := os.Stat(old); !os.IsNotExist(err) {
+        t.Errorf("old work area still there: %v", err)
+    }
+    if want := "unix:" + filepath.Join(dir, "qmp.sock"); vm.args[3] != want {
+        t.Errorf("args[3] = %q, want %q", vm.args[3], want)
+    }
+
+    data, err := os.ReadFile(runningPath(dir))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var r runningVM
+    json.Unmarshal(data, &r)
+    if r.Name != "rental-7" || r.Dir != dir || r.Pid != proc.Process.Pid {
+        t.Errorf("manifest = %+v, want the renamed VM", r)
+    }
+
+    // a second VM may not take over an existing work area
+    other := &VM{Name: "warm-1-1-2", Dir: t.TempDir(), proc: proc.Process}
+    if err := other.Rename("rental-7"); err == nil {
+        t.Error("Rename onto an existing work area succeeded")
+    }
+}
@@ -0,0 +1,88 @@
+package system
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strconv"
+)
+
+// CgroupRoot is the cgroup v2 directory VM processes are confined under,
+// one child cgroup per QEMU process. The agent needs write access to it,
+// e.g. through systemd delegation.
+var CgroupRoot = "/sys/fs/cgroup/vmshare.slice"
+
+// memoryOverheadMB is what QEMU itself may use on top of guest RAM.
+const memoryOverheadMB = 512
+
+// cpuPeriod is the cpu.max period, in microseconds.
+const cpuPeriod = 100000
+
+// confine moves the QEMU process into its own cgroup with cpu.max and
+// memory.max derived from flavor, so a busy guest cannot take more of the
+// host than it rented. Failing to do so is logged but not fatal: the VM
+// runs unconfined, as on hosts without cgroup v2.
+func (vm *VM) confine(flavor Flavor) {
+    if err := vm.setCgroup(flavor); err != nil {
+        slog.Warn("cgroup limits not applied", "vm", vm.Name, "err", err)
+    }
+}
+
+func (vm *VM) setCgroup(flavor Flavor) error {
+    if err := os.MkdirAll(CgroupRoot, 0755); err != nil {
+        return err
+    }
+    if err := writeCgroupFile(CgroupRoot, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+        return err
+    }
+    dir := filepath.Join(CgroupRoot, fmt.Sprintf("%s-%d", vm.Name, vm.proc.Pid))
+    if err := os.Mkdir(dir, 0755); err != nil {
+        return err
+    }
+    limits := []struct{ file, value string }{
+        {"cpu.max", cpuMax(flavor)},
+        {"memory.max", memoryMax(flavor)},
+        {"cgroup.procs", strconv.Itoa(vm.proc.Pid)},
+    }
+    for _, l := range limits {
+        if err := writeCgroupFile(dir, l.file, l.value); err != nil {
+            os.Remove(dir)
+            return err
+        }
+    }
+    vm.cgroup = dir
+    return nil
+}
+
+// cpuMax is the cpu.max value for flavor: its CPUs as whole cores, or no
+// limit if it sets none.
+func cpuMax(flavor Flavor) string {
+    if flavor.CPUs <= 0 {
+        return fmt.Sprintf("max %d", cpuPeriod)
+    }
+    return fmt.Sprintf("%d %d", flavor.CPUs*cpuPeriod, cpuPeriod)
+}
+
+// memoryMax is the memory.max value for flavor: guest RAM plus QEMU's own
+// overhead in bytes, or no limit if it sets none.
+func memoryMax(flavor Flavor) string {
+    if flavor.MemoryMB <= 0 {
+        return "max"
+    }
+    return strconv.Itoa((flavor.MemoryMB + memoryOverheadMB) << 20)
+}
+
+// release removes the VM's cgroup once its process has exited.
+func (vm *VM) release() {
+    if vm.cgroup != "" {
+        os.Remove(vm.cgroup)
+    }
+}
+
+func writeCgroupFile(dir, name, value string) error {
+    if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+        return fmt.Errorf("write %s: %v", name, err)
+    }
+    return nil
+}
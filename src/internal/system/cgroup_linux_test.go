@@ -0,0 +1,28 @@
+package system
+
+import "testing"
+
+func TestCgroupLimits(t *testing.T) {
+    tests := []struct {
+        name    string
+        flavor  Flavor
+        wantCPU string
+        wantMem string
+    }{
+        {"small", Flavors["small"], "100000 100000", "1610612736"},
+        {"medium", Flavors["medium"], "200000 100000", "2684354560"},
+        {"large", Flavors["large"], "400000 100000", "4831838208"},
+        {"unlimited", Flavor{}, "max 100000", "max"},
+        {"negative", Flavor{CPUs: -1, MemoryMB: -1}, "max 100000", "max"},
+        {"no RAM limit", Flavor{CPUs: 1}, "100000 100000", "max"},
+        {"no CPU limit", Flavor{MemoryMB: 512}, "max 100000", "1073741824"},
+    }
+    for _, tt := range tests {
+        if got := cpuMax(tt.flavor); got != tt.wantCPU {
+            t.Errorf("%s: cpu.max %q, want %q", tt.name, got, tt.wantCPU)
+        }
+        if got := memoryMax(tt.flavor); got != tt.wantMem {
+            t.Errorf("%s: memory.max %q, want %q", tt.name, got, tt.wantMem)
+        }
+    }
+}
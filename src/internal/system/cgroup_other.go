@@ -0,0 +1,9 @@
+//go:build !linux
+
+package system
+
+// confine is a no-op where cgroup v2 is not available; QEMU runs with
+// only its disk throttling.
+func (vm *VM) confine(flavor Flavor) {}
+
+func (vm *VM) release() {}
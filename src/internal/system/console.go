@@ -0,0 +1,24 @@
+package system
+
+import (
+    "net"
+    "path/filepath"
+    "time"
+)
+
+// ConsoleLog is the file the guest's serial console output is captured in,
+// from the first boot message on.
+func (vm *VM) ConsoleLog() string {
+    return filepath.Join(vm.Dir, "serial.log")
+}
+
+// ConsoleSocket is the path of the VM's serial console socket.
+func (vm *VM) ConsoleSocket() string {
+    return filepath.Join(vm.Dir, "console.sock")
+}
+
+// DialConsole connects to the VM's serial console. QEMU serves one client
+// at a time; output keeps going to ConsoleLog either way.
+func (vm *VM) DialConsole() (net.Conn, error) {
+    return net.DialTimeout("unix", vm.ConsoleSocket(), 5*time.Second)
+}
@@ -0,0 +1,123 @@
+package system
+
+import (
+    "fmt"
+    "net"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// Egress policies, from least to most strict.
+//
+// QEMU's user-mode NIC has no per-destination filtering: a guest either
+// reaches everything the host can (open) or nothing at all (restrict=on).
+// The two filtered policies therefore run the NIC restricted and give the
+// guest one way out, a guestfwd to an HTTP proxy the agent runs for that VM
+// (see Egress.Pipe), which applies the filter.
+const (
+    EgressOpen        = "open"         // anything the host can reach
+    EgressDenyPrivate = "deny-private" // through the proxy, except RFC1918, loopback, link-local and the host
+    EgressAllowlist   = "allowlist"    // through the proxy, only to allow-listed hosts and subnets
+    EgressIsolated    = "isolated"     // nothing but the forwarded ports
+)
+
+var egressRank = map[string]int{
+    EgressOpen:        0,
+    EgressDenyPrivate: 1,
+    EgressAllowlist:   2,
+    EgressIsolated:    3,
+}
+
+// Where a filtered guest finds its egress proxy.
+const (
+    EgressProxyIP   = "10.0.2.100"
+    EgressProxyPort = 3128
+)
+
+// ValidEgressPolicy reports whether p names an egress policy.
+func ValidEgressPolicy(p string) bool {
+    _, ok := egressRank[p]
+    return ok
+}
+
+// StricterEgress returns whichever of policies a and b allows less. An
+// empty policy defers to the other.
+func StricterEgress(a, b string) string {
+    if a == "" || egressRank[b] > egressRank[a] {
+        return b
+    }
+    return a
+}
+
+// EgressProxied reports whether guests under policy p reach the network
+// only through the egress proxy.
+func EgressProxied(p string) bool {
+    return p == EgressDenyPrivate || p == EgressAllowlist
+}
+
+var hostPattern = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// ValidEgressAllow reports whether entry can go on an allow-list: an IP
+// address, a CIDR subnet, a hostname or a "*.domain" wildcard.
+func ValidEgressAllow(entry string) bool {
+    if net.ParseIP(entry) != nil {
+        return true
+    }
+    if _, _, err := net.ParseCIDR(entry); err == nil {
+        return true
+    }
+    return len(entry) <= 253 && hostPattern.MatchString(strings.ToLower(entry))
+}
+
+// Egress is how a VM's user-mode NIC is set up.
+type Egress struct {
+    Policy string
+    // Pipe is the command QEMU runs for each connection a proxied guest
+    // makes to its proxy, with the VM's egress socket (see
+    // VM.EgressSocket) appended as the last argument. It must relay
+    // stdin/stdout to that socket.
+    Pipe []string
+}
+
+// EgressSocket is the host-side path of the socket the VM's egress proxy
+// listens on.
+func (vm *VM) EgressSocket() string {
+    return filepath.Join(vm.Dir, "egress.sock")
+}
+
+// nicArg builds the -nic option for a VM in workDir with SSH on hostPort.
+func nicArg(workDir string, hostPort int, e Egress) string {
+    nic := fmt.Sprintf("user,id=%s,hostfwd=tcp::%d-:22", primaryNIC, hostPort)
+    if e.Policy == "" || e.Policy == EgressOpen {
+        return nic
+    }
+    nic += ",restrict=on"
+    if EgressProxied(e.Policy) {
+        var words []string
+        for _, a := range append(append([]string{}, e.Pipe...), filepath.Join(workDir, "egress.sock")) {
+            words = append(words, shellQuote(a))
+        }
+        cmd := strings.Join(words, " ")
+        // commas separate -nic options, so those in the command are doubled
+        nic += fmt.Sprintf(",guestfwd=tcp:%s:%d-cmd:%s",
+            EgressProxyIP, EgressProxyPort, strings.ReplaceAll(cmd, ",", ",,"))
+    }
+    return nic
+}
+
+// egressCloudConfig points a proxied guest's tools at its egress proxy.
+func egressCloudConfig(policy string) (string, []cloudFile) {
+    if !EgressProxied(policy) {
+        return "", nil
+    }
+    proxy := fmt.Sprintf("http://%s:%d", EgressProxyIP, EgressProxyPort)
+    apt := fmt.Sprintf("apt:\n  http_proxy: %s\n  https_proxy: %s\n", proxy, proxy)
+    env := cloudFile{
+        Path:   "/etc/environment",
+        Append: true,
+        Content: fmt.Sprintf("http_proxy=%s\nhttps_proxy=%s\nHTTP_PROXY=%s\nHTTPS_PROXY=%s\nno_proxy=localhost,127.0.0.1\n",
+            proxy, proxy, proxy, proxy),
+    }
+    return apt, []cloudFile{env}
+}
@@ -0,0 +1,73 @@
+package system
+
+import "testing"
+
+func TestNicArg(t *testing.T) {
+    pipe := []string{"/usr/bin/agent", "egress-pipe"}
+    const base = "user,id=net0,hostfwd=tcp::2222-:22"
+    tests := []struct {
+        name string
+        e    Egress
+        want string
+    }{
+        {"no policy", Egress{}, base},
+        {"open", Egress{Policy: EgressOpen, Pipe: pipe}, base},
+        {"isolated", Egress{Policy: EgressIsolated, Pipe: pipe}, base + ",restrict=on"},
+        {"deny-private", Egress{Policy: EgressDenyPrivate, Pipe: pipe},
+            base + ",restrict=on,guestfwd=tcp:10.0.2.100:3128-cmd:'/usr/bin/agent' 'egress-pipe' '/vm/egress.sock'"},
+        {"allowlist", Egress{Policy: EgressAllowlist, Pipe: pipe},
+            base + ",restrict=on,guestfwd=tcp:10.0.2.100:3128-cmd:'/usr/bin/agent' 'egress-pipe' '/vm/egress.sock'"},
+        // a comma would end the option, and a quote the shell word
+        {"awkward pipe path", Egress{Policy: EgressAllowlist, Pipe: []string{"/opt/a,b/it's", "egress-pipe"}},
+            base + `,restrict=on,guestfwd=tcp:10.0.2.100:3128-cmd:'/opt/a,,b/it'\''s' 'egress-pipe' '/vm/egress.sock'`},
+    }
+    for _, tt := range tests {
+        if got := nicArg("/vm", 2222, tt.e); got != tt.want {
+            t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestStricterEgress(t *testing.T) {
+    tests := []struct {
+        a, b, want string
+    }{
+        {"", EgressOpen, EgressOpen},
+        {EgressAllowlist, "", EgressAllowlist},
+        {EgressOpen, EgressDenyPrivate, EgressDenyPrivate},
+        {EgressAllowlist, EgressDenyPrivate, EgressAllowlist},
+        {EgressIsolated, EgressAllowlist, EgressIsolated},
+        {EgressOpen, EgressOpen, EgressOpen},
+    }
+    for _, tt := range tests {
+        if got := StricterEgress(tt.a, tt.b); got != tt.want {
+            t.Errorf("StricterEgress(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+        }
+    }
+}
+
+func TestValidEgressAllow(t *testing.T) {
+    tests := []struct {
+        entry string
+        want  bool
+    }{
+        {"example.com", true},
+        {"*.example.com", true},
+        {"Example.COM", true},
+        {"10.0.0.1", true},
+        {"2001:db8::1", true},
+        {"10.0.0.0/8", true},
+        {"", false},
+        {"*", false},
+        {"*.", false},
+        {"ex*ample.com", false},
+        {"-example.com", false},
+        {"example.com,evil.com", false},
+        {"10.0.0.0/33", false},
+    }
+    for _, tt := range tests {
+        if got := ValidEgressAllow(tt.entry); got != tt.want {
+            t.Errorf("ValidEgressAllow(%q) = %v, want %v", tt.entry, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,76 @@
+package system
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Flavor is a named VM size renters pick from. CPUs and MemoryMB are also
+// enforced on the QEMU process (see confine), and DiskIOPS and DiskMBps
+// throttle all of the VM's disks together.
+type Flavor struct {
+    Name     string `json:"name"`
+    CPUs     int    `json:"cpus"`
+    MemoryMB int    `json:"memory_mb"`
+    DiskIOPS int    `json:"disk_iops"`
+    DiskMBps int    `json:"disk_mbps"`
+}
+
+// Flavors are the sizes every agent offers.
+var Flavors = map[string]Flavor{
+    "small":  {Name: "small", CPUs: 1, MemoryMB: 1024, DiskIOPS: 500, DiskMBps: 50},
+    "medium": {Name: "medium", CPUs: 2, MemoryMB: 2048, DiskIOPS: 1000, DiskMBps: 100},
+    "large":  {Name: "large", CPUs: 4, MemoryMB: 4096, DiskIOPS: 2000, DiskMBps: 200},
+}
+
+// throttleGroup is the QEMU block throttle group all of a VM's disks share,
+// so attaching more volumes does not raise its I/O limits.
+const throttleGroup = "disks"
+
+// throttleOpts returns the -drive options that put a disk in the VM's
+// throttle group. QEMU takes the limits from the first drive that names
+// the group. A zero limit is left out, and a flavor with neither limit
+// has no group at all.
+func (f Flavor) throttleOpts() string {
+    var opts string
+    if f.DiskIOPS > 0 {
+        opts += fmt.Sprintf(",throttling.iops-total=%d", f.DiskIOPS)
+    }
+    if f.DiskMBps > 0 {
+        opts += fmt.Sprintf(",throttling.bps-total=%d", f.DiskMBps<<20)
+    }
+    if opts == "" {
+        return ""
+    }
+    return ",throttling.group=" + throttleGroup + opts
+}
+
+const (
+    DefaultFlavor = "medium"
+    DefaultImage  = "ubuntu-24.04-server-arm64"
+)
+
+// ImageDir holds the raw base images, one <image>.img per image name.
+var ImageDir = filepath.Join(os.Getenv("HOME"), "qemu-images")
+
+// LookupFlavor returns the named flavor.
+func LookupFlavor(name string) (Flavor, error) {
+    f, ok := Flavors[name]
+    if !ok {
+        return Flavor{}, fmt.Errorf("unknown flavor %q", name)
+    }
+    return f, nil
+}
+
+// ValidImageName reports whether name is usable as an image name (a bare
+// file stem, never a path).
+func ValidImageName(name string) bool {
+    return name != "" && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+// ImagePath is where the base image for name lives on this host.
+func ImagePath(name string) string {
+    return filepath.Join(ImageDir, name+".img")
+}
@@ -0,0 +1,23 @@
+package system
+
+import "testing"
+
+func TestThrottleOpts(t *testing.T) {
+    tests := []struct {
+        name   string
+        flavor Flavor
+        want   string
+    }{
+        {"small", Flavors["small"], ",throttling.group=disks,throttling.iops-total=500,throttling.bps-total=52428800"},
+        {"medium", Flavors["medium"], ",throttling.group=disks,throttling.iops-total=1000,throttling.bps-total=104857600"},
+        {"large", Flavors["large"], ",throttling.group=disks,throttling.iops-total=2000,throttling.bps-total=209715200"},
+        {"unlimited", Flavor{}, ""},
+        {"IOPS only", Flavor{DiskIOPS: 100}, ",throttling.group=disks,throttling.iops-total=100"},
+        {"bandwidth only", Flavor{DiskMBps: 1}, ",throttling.group=disks,throttling.bps-total=1048576"},
+    }
+    for _, tt := range tests {
+        if got := tt.flavor.throttleOpts(); got != tt.want {
+            t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
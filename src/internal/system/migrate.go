@@ -0,0 +1,167 @@
+package system
+
+import (
+    "archive/tar"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math/rand"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+)
+
+// Entries of a migration stream, in the order they are sent.
+const (
+    migrateManifest = "vm.json"
+    migrateState    = "state"
+    migrateDisk     = "disk.qcow2"
+    migrateSeed     = "seed.iso"
+)
+
+// ExportSuspended writes a VM suspended into dir to w as a tar stream that
+// ImportSuspended can unpack on another host. The disk is sent as a qcow2
+// holding only what differs from the base image, which the receiving host
+// must also have.
+func ExportSuspended(dir string, w io.Writer) error {
+    saved, err := readManifest(dir)
+    if err != nil {
+        return err
+    }
+
+    disk := filepath.Join(dir, migrateDisk)
+    defer os.Remove(disk)
+    cmd := exec.Command("qemu-img", "convert",
+        "-O", "qcow2",
+        "-B", ImagePath(saved.Image),
+        "-F", "raw",
+        saved.Disk, disk)
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("qemu-img convert: %v, output: %s", err, out)
+    }
+
+    tw := tar.NewWriter(w)
+    files := []struct{ name, path string }{
+        {migrateManifest, manifestPath(dir)},
+        {migrateState, statePath(dir)},
+        {migrateDisk, disk},
+        {migrateSeed, filepath.Join(saved.Dir, "seed.iso")},
+    }
+    for _, f := range files {
+        if err := addTarFile(tw, f.name, f.path); err != nil {
+            return err
+        }
+    }
+    return tw.Close()
+}
+
+func addTarFile(tw *tar.Writer, name, path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size()}); err != nil {
+        return err
+    }
+    if _, err := io.Copy(tw, f); err != nil {
+        return fmt.Errorf("send %s: %v", name, err)
+    }
+    return nil
+}
+
+// ImportSuspended unpacks a stream written by ExportSuspended so that
+// ResumeVM(dir) restores the VM here. Its disk and seed go into workDir, the
+// disk is re-pointed at this host's copy of the base image and the VM gets a
+// fresh SSH port.
+func ImportSuspended(r io.Reader, dir, workDir string) error {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return fmt.Errorf("mkdir suspend dir: %v", err)
+    }
+    if err := os.MkdirAll(workDir, 0755); err != nil {
+        return fmt.Errorf("mkdir workspace: %v", err)
+    }
+
+    var saved *savedVM
+    tr := tar.NewReader(r)
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("read stream: %v", err)
+        }
+        var dest string
+        switch hdr.Name {
+        case migrateManifest:
+            dest = manifestPath(dir)
+        case migrateState:
+            dest = statePath(dir)
+        case migrateDisk, migrateSeed:
+            if saved == nil {
+                return fmt.Errorf("stream sends %s before %s", hdr.Name, migrateManifest)
+            }
+            dest = filepath.Join(workDir, hdr.Name)
+        default:
+            return fmt.Errorf("unexpected entry %q in stream", hdr.Name)
+        }
+        if err := writeFile(dest, tr); err != nil {
+            return err
+        }
+        if hdr.Name == migrateManifest {
+            if saved, err = readManifest(dir); err != nil {
+                return err
+            }
+        }
+    }
+    if saved == nil {
+        return fmt.Errorf("stream has no %s", migrateManifest)
+    }
+
+    baseImg := ImagePath(saved.Image)
+    if _, err := os.Stat(baseImg); err != nil {
+        return fmt.Errorf("base image %s: %v", saved.Image, err)
+    }
+    disk := filepath.Join(workDir, filepath.Base(saved.Disk))
+    if err := os.Rename(filepath.Join(workDir, migrateDisk), disk); err != nil {
+        return err
+    }
+    cmd := exec.Command("qemu-img", "rebase", "-u", "-b", baseImg, "-F", "raw", disk)
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("qemu-img rebase: %v, output: %s", err, out)
+    }
+
+    // same command line, relocated to workDir and on a new host port
+    hostPort := 20000 + rand.Intn(10000)
+    oldFwd := fmt.Sprintf("hostfwd=tcp::%d-:22", saved.HostPort)
+    newFwd := fmt.Sprintf("hostfwd=tcp::%d-:22", hostPort)
+    for i, a := range saved.Args {
+        a = strings.ReplaceAll(a, saved.Dir, workDir)
+        saved.Args[i] = strings.ReplaceAll(a, oldFwd, newFwd)
+    }
+    saved.Dir, saved.Disk, saved.HostPort = workDir, disk, hostPort
+
+    manifest, err := json.Marshal(saved)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(manifestPath(dir), manifest, 0644)
+}
+
+func writeFile(path string, r io.Reader) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(f, r); err != nil {
+        f.Close()
+        return fmt.Errorf("receive %s: %v", filepath.Base(path), err)
+    }
+    return f.Close()
+}
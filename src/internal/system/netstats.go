@@ -0,0 +1,273 @@
+package system
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// primaryNIC is the netdev id of the VM's user-mode NIC, the one carrying
+// SSH and internet traffic.
+const primaryNIC = "net0"
+
+// The primary NIC's packets pass through the agent between the guest and
+// QEMU's user-mode stack, so the host meters and throttles them where the
+// renter can't interfere. For each direction a filter-redirector sends the
+// packets out on one socket in the VM's work area and takes them back on
+// another, framed as a 4-byte big-endian length followed by the packet.
+const (
+    relayQueue       = 256       // packets held back per direction before dropping
+    relayMaxPacket   = 69632     // QEMU's NET_BUFSIZE
+    relayDialTimeout = 30 * time.Second
+)
+
+// relayDirs are the filter-redirectors on the primary NIC: tx carries what
+// the guest sends (the netdev's receive queue), rx what it receives.
+var relayDirs = []struct{ name, queue string }{
+    {"tx", "rx"},
+    {"rx", "tx"},
+}
+
+func relaySocket(dir, name, end string) string {
+    return filepath.Join(dir, "net-"+name+"-"+end+".sock")
+}
+
+// relayArgs returns the QEMU flags routing the primary NIC of a VM in
+// workDir through the agent.
+func relayArgs(workDir string) []string {
+    var args []string
+    for _, d := range relayDirs {
+        out, in := "net"+d.name+"-out", "net"+d.name+"-in"
+        args = append(args,
+            "-chardev", fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off", out, relaySocket(workDir, d.name, "out")),
+            "-chardev", fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off", in, relaySocket(workDir, d.name, "in")),
+            "-object", fmt.Sprintf("filter-redirector,id=net%s,netdev=%s,queue=%s,outdev=%s,indev=%s",
+                d.name, primaryNIC, d.queue, out, in))
+    }
+    return args
+}
+
+// NetStats are byte counters of the VM's primary NIC, counted on the host
+// as packets pass the relay: Rx is traffic into the VM, Tx out of it, and
+// Dropped the packets the relay discarded because the VM was over its
+// rate limit or blocked. They start at zero with each QEMU process and
+// each agent run.
+type NetStats struct {
+    RxBytes uint64
+    TxBytes uint64
+    Dropped uint64
+}
+
+// errNoRelay is returned for VMs whose primary NIC is not routed through
+// the agent, e.g. ones suspended before the relay existed.
+var errNoRelay = errors.New("VM network is not relayed through the agent")
+
+// netRelay moves a VM's primary NIC traffic between QEMU's redirector
+// sockets, counting it and enforcing a token-bucket rate limit shared by
+// both directions.
+type netRelay struct {
+    connected atomic.Bool
+    rx, tx    atomic.Uint64
+    dropped   atomic.Uint64
+
+    mu      sync.Mutex
+    rate    float64 // bytes per second; 0 means unlimited
+    burst   float64
+    tokens  float64
+    at      time.Time
+    blocked bool
+}
+
+// startRelay connects to the redirector sockets of the VM's QEMU process
+// and relays its traffic until the process exits.
+func (vm *VM) startRelay() {
+    vm.net = &netRelay{}
+    go vm.net.run(vm.Name, vm.Dir, vm.done)
+}
+
+// run dials the redirector sockets, retrying while QEMU creates them, and
+// pumps both directions.
+func (r *netRelay) run(vmName, dir string, done <-chan struct{}) {
+    conns := map[string]net.Conn{}
+    defer func() {
+        for _, c := range conns {
+            c.Close()
+        }
+    }()
+    deadline := time.Now().Add(relayDialTimeout)
+    for _, d := range relayDirs {
+        for _, end := range []string{"out", "in"} {
+            path := relaySocket(dir, d.name, end)
+            for {
+                c, err := net.Dial("unix", path)
+                if err == nil {
+                    conns[d.name+end] = c
+                    break
+                }
+                if time.Now().After(deadline) {
+                    slog.Warn("VM network not relayed; traffic is not metered", "vm", vmName, "err", err)
+                    return
+                }
+                select {
+                case <-done:
+                    return
+                case <-time.After(100 * time.Millisecond):
+                }
+            }
+        }
+    }
+    r.connected.Store(true)
+    defer r.connected.Store(false)
+
+    var wg sync.WaitGroup
+    for _, d := range relayDirs {
+        count := &r.tx
+        if d.name == "rx" {
+            count = &r.rx
+        }
+        wg.Add(1)
+        go func(out, in net.Conn) {
+            defer wg.Done()
+            r.pump(out, in, count)
+            out.Close()
+            in.Close()
+        }(conns[d.name+"out"], conns[d.name+"in"])
+    }
+    go func() {
+        <-done
+        for _, c := range conns {
+            c.Close()
+        }
+    }()
+    wg.Wait()
+}
+
+// pump relays the packets QEMU writes to out back in through in. A reader
+// keeps draining out so QEMU never blocks on it; packets that arrive while
+// the queue is full, or while the VM is blocked, are dropped.
+func (r *netRelay) pump(out, in net.Conn, count *atomic.Uint64) {
+    queue := make(chan []byte, relayQueue)
+    go func() {
+        defer close(queue)
+        for {
+            pkt, err := readFrame(out)
+            if err != nil {
+                return
+            }
+            select {
+            case queue <- pkt:
+            default:
+                r.dropped.Add(1)
+            }
+        }
+    }()
+    for pkt := range queue {
+        if !r.admit(len(pkt)) {
+            r.dropped.Add(1)
+            continue
+        }
+        if err := writeFrame(in, pkt); err != nil {
+            return
+        }
+        count.Add(uint64(len(pkt)))
+    }
+}
+
+// admit waits until n bytes fit the rate limit and reports whether the
+// packet may pass.
+func (r *netRelay) admit(n int) bool {
+    for {
+        r.mu.Lock()
+        if r.blocked {
+            r.mu.Unlock()
+            return false
+        }
+        if r.rate <= 0 {
+            r.mu.Unlock()
+            return true
+        }
+        now := time.Now()
+        r.tokens = min(r.tokens+r.rate*now.Sub(r.at).Seconds(), r.burst)
+        r.at = now
+        if r.tokens >= float64(n) {
+            r.tokens -= float64(n)
+            r.mu.Unlock()
+            return true
+        }
+        wait := time.Duration((float64(n) - r.tokens) / r.rate * float64(time.Second))
+        r.mu.Unlock()
+        time.Sleep(wait)
+    }
+}
+
+// readFrame reads one length-prefixed packet.
+func readFrame(rd io.Reader) ([]byte, error) {
+    var hdr [4]byte
+    if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+        return nil, err
+    }
+    n := binary.BigEndian.Uint32(hdr[:])
+    if n > relayMaxPacket {
+        return nil, fmt.Errorf("packet of %d bytes", n)
+    }
+    pkt := make([]byte, n)
+    if _, err := io.ReadFull(rd, pkt); err != nil {
+        return nil, err
+    }
+    return pkt, nil
+}
+
+// writeFrame writes one length-prefixed packet.
+func writeFrame(w io.Writer, pkt []byte) error {
+    buf := make([]byte, 4+len(pkt))
+    binary.BigEndian.PutUint32(buf, uint32(len(pkt)))
+    copy(buf[4:], pkt)
+    _, err := w.Write(buf)
+    return err
+}
+
+// NetworkStats returns the primary NIC's counters.
+func (vm *VM) NetworkStats() (NetStats, error) {
+    if vm.net == nil || !vm.net.connected.Load() {
+        return NetStats{}, errNoRelay
+    }
+    return NetStats{
+        RxBytes: vm.net.rx.Load(),
+        TxBytes: vm.net.tx.Load(),
+        Dropped: vm.net.dropped.Load(),
+    }, nil
+}
+
+// LimitNetwork caps the primary NIC's combined throughput at bytesPerSec,
+// letting up to burst bytes through at once. Traffic over the limit is
+// queued briefly, then dropped. Zero removes the limit.
+func (vm *VM) LimitNetwork(bytesPerSec, burst float64) {
+    if vm.net == nil {
+        return
+    }
+    r := vm.net
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.rate != bytesPerSec || r.burst != burst {
+        r.rate, r.burst = bytesPerSec, burst
+        r.tokens, r.at = burst, time.Now()
+    }
+}
+
+// BlockNetwork drops all of the primary NIC's traffic, SSH included, while
+// blocked is set.
+func (vm *VM) BlockNetwork(blocked bool) {
+    if vm.net == nil {
+        return
+    }
+    vm.net.mu.Lock()
+    vm.net.blocked = blocked
+    vm.net.mu.Unlock()
+}
@@ -0,0 +1,187 @@
+package system
+
+import (
+    "bytes"
+    "net"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+// fakeRedirectors stands in for the filter-redirector sockets of a QEMU
+// process in dir, returning the QEMU end of each, keyed like "txout".
+func fakeRedirectors(t *testing.T, dir string) map[string]net.Conn {
+    t.Helper()
+    conns := map[string]net.Conn{}
+    type accepted struct {
+        key  string
+        conn net.Conn
+    }
+    ch := make(chan accepted, 4)
+    for _, d := range relayDirs {
+        for _, end := range []string{"out", "in"} {
+            ln, err := net.Listen("unix", relaySocket(dir, d.name, end))
+            if err != nil {
+                t.Fatal(err)
+            }
+            t.Cleanup(func() { ln.Close() })
+            key := d.name + end
+            go func() {
+                c, err := ln.Accept()
+                if err == nil {
+                    ch <- accepted{key, c}
+                }
+            }()
+        }
+    }
+    for len(conns) < 4 {
+        select {
+        case a := <-ch:
+            conns[a.key] = a.conn
+            t.Cleanup(func() { a.conn.Close() })
+        case <-time.After(5 * time.Second):
+            t.Fatalf("relay connected %d of 4 sockets", len(conns))
+        }
+    }
+    return conns
+}
+
+// relayedVM returns a VM with a relay attached to fake redirectors.
+func relayedVM(t *testing.T) (*VM, map[string]net.Conn) {
+    t.Helper()
+    dir, err := os.MkdirTemp("", "relay")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+    vm := &VM{Name: "vm", Dir: dir, done: make(chan struct{})}
+    t.Cleanup(func() { close(vm.done) })
+    vm.startRelay()
+    conns := fakeRedirectors(t, dir)
+    deadline := time.Now().Add(5 * time.Second)
+    for !vm.net.connected.Load() {
+        if time.Now().After(deadline) {
+            t.Fatal("relay never connected")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return vm, conns
+}
+
+func TestRelayArgs(t *testing.T) {
+    args := strings.Join(relayArgs("/w"), " ")
+    for _, want := range []string{
+        "socket,id=nettx-out,path=/w/net-tx-out.sock,server=on,wait=off",
+        "filter-redirector,id=nettx,netdev=net0,queue=rx,outdev=nettx-out,indev=nettx-in",
+        "filter-redirector,id=netrx,netdev=net0,queue=tx,outdev=netrx-out,indev=netrx-in",
+    } {
+        if !strings.Contains(args, want) {
+            t.Errorf("relay args %q lack %q", args, want)
+        }
+    }
+}
+
+func TestFrames(t *testing.T) {
+    var buf bytes.Buffer
+    for _, pkt := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{1}, 1500)} {
+        if err := writeFrame(&buf, pkt); err != nil {
+            t.Fatal(err)
+        }
+        got, err := readFrame(&buf)
+        if err != nil || !bytes.Equal(got, pkt) {
+            t.Errorf("round trip of %d bytes: %d bytes, %v", len(pkt), len(got), err)
+        }
+    }
+    if _, err := readFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); err == nil {
+        t.Error("oversized frame accepted")
+    }
+}
+
+func TestRelayCountsBothDirections(t *testing.T) {
+    vm, conns := relayedVM(t)
+    for _, tt := range []struct {
+        dir  string
+        size int
+    }{{"tx", 100}, {"rx", 300}, {"rx", 200}} {
+        pkt := bytes.Repeat([]byte{'x'}, tt.size)
+        if err := writeFrame(conns[tt.dir+"out"], pkt); err != nil {
+            t.Fatal(err)
+        }
+        conns[tt.dir+"in"].SetReadDeadline(time.Now().Add(2 * time.Second))
+        got, err := readFrame(conns[tt.dir+"in"])
+        if err != nil || !bytes.Equal(got, pkt) {
+            t.Fatalf("%s packet came back as %d bytes, %v", tt.dir, len(got), err)
+        }
+    }
+    stats, err := vm.NetworkStats()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stats.TxBytes != 100 || stats.RxBytes != 500 || stats.Dropped != 0 {
+        t.Errorf("stats = %+v, want tx 100, rx 500, none dropped", stats)
+    }
+}
+
+func TestRelayRateLimit(t *testing.T) {
+    vm, conns := relayedVM(t)
+    vm.LimitNetwork(10000, 1000) // 10 kB/s after a 1 kB burst
+
+    pkt := bytes.Repeat([]byte{'x'}, 1000)
+    start := time.Now()
+    for i := 0; i < 3; i++ {
+        if err := writeFrame(conns["txout"], pkt); err != nil {
+            t.Fatal(err)
+        }
+    }
+    conns["txin"].SetReadDeadline(time.Now().Add(2 * time.Second))
+    for i := 0; i < 3; i++ {
+        if _, err := readFrame(conns["txin"]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // the burst covers the first packet; the other two wait 100ms each
+    if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+        t.Errorf("3 kB passed a 10 kB/s limit in %v", elapsed)
+    }
+}
+
+func TestRelayBlock(t *testing.T) {
+    vm, conns := relayedVM(t)
+    vm.BlockNetwork(true)
+    if err := writeFrame(conns["rxout"], []byte("blocked")); err != nil {
+        t.Fatal(err)
+    }
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        if stats, _ := vm.NetworkStats(); stats.Dropped == 1 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("blocked packet was not dropped")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    vm.BlockNetwork(false)
+    if err := writeFrame(conns["rxout"], []byte("open")); err != nil {
+        t.Fatal(err)
+    }
+    conns["rxin"].SetReadDeadline(time.Now().Add(2 * time.Second))
+    got, err := readFrame(conns["rxin"])
+    if err != nil || string(got) != "open" {
+        t.Fatalf("after unblocking got %q, %v", got, err)
+    }
+    if stats, _ := vm.NetworkStats(); stats.RxBytes != 4 {
+        t.Errorf("RxBytes = %d, want only the unblocked packet's 4", stats.RxBytes)
+    }
+}
+
+func TestNetworkStatsWithoutRelay(t *testing.T) {
+    vm := &VM{Name: "vm"}
+    if _, err := vm.NetworkStats(); err != errNoRelay {
+        t.Errorf("err = %v, want errNoRelay", err)
+    }
+    vm.LimitNetwork(1, 1) // no relay: nothing to do, but no panic
+    vm.BlockNetwork(true)
+}
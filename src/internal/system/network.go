@@ -0,0 +1,86 @@
+package system
+
+import (
+    "fmt"
+    "net"
+    "strings"
+)
+
+// primaryMAC is the address QEMU gives the first NIC (the user-mode one
+// carrying SSH) when none is set.
+const primaryMAC = "52:54:00:12:34:56"
+
+// privateNetGroup is the multicast group private networks use. Each network
+// gets its own port. Traffic is sent from the NIC's LocalAddr: on loopback
+// only VMs on this host share the segment.
+const privateNetGroup = "230.0.0.1"
+
+// NetworkNIC is a VM's NIC on a private network. Port is the segment's
+// multicast port, which the coordinator keeps unique per network. Address
+// is the static address in CIDR form, e.g. "10.10.0.2/24"; LocalAddr is
+// the host address the segment's multicast uses (default 127.0.0.1).
+type NetworkNIC struct {
+    NetworkID int64
+    Port      int
+    Address   string
+    LocalAddr string
+}
+
+// HostEntry is a line added to the guest's /etc/hosts.
+type HostEntry struct {
+    IP   string
+    Name string
+}
+
+// MAC derives a stable MAC for the NIC from its network and address.
+func (n NetworkNIC) MAC() string {
+    ip, _, _ := net.ParseCIDR(n.Address)
+    ip4 := ip.To4()
+    if ip4 == nil {
+        ip4 = net.IPv4zero.To4()
+    }
+    return fmt.Sprintf("52:54:01:%02x:%02x:%02x", byte(n.NetworkID), ip4[2], ip4[3])
+}
+
+// networkArgs returns the -netdev/-device flags for nics.
+func networkArgs(nics []NetworkNIC) []string {
+    var args []string
+    for i, n := range nics {
+        local := n.LocalAddr
+        if local == "" {
+            local = "127.0.0.1"
+        }
+        args = append(args,
+            "-netdev", fmt.Sprintf("socket,id=priv%d,mcast=%s:%d,localaddr=%s",
+                i, privateNetGroup, n.Port, local),
+            "-device", fmt.Sprintf("virtio-net-pci,netdev=priv%d,mac=%s", i, n.MAC()))
+    }
+    return args
+}
+
+// networkConfig renders the cloud-init network-config giving each private
+// NIC its static address. The primary NIC is listed too, since supplying a
+// network-config replaces cloud-init's default DHCP setup.
+func networkConfig(nics []NetworkNIC) string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "version: 2\nethernets:\n")
+    fmt.Fprintf(&b, "  primary:\n    match:\n      macaddress: %q\n    dhcp4: true\n", primaryMAC)
+    for i, n := range nics {
+        fmt.Fprintf(&b, "  priv%d:\n    match:\n      macaddress: %q\n    set-name: priv%d\n    addresses: [%s]\n",
+            i, n.MAC(), i, n.Address)
+    }
+    return b.String()
+}
+
+// hostsFile is the cloud-init file entry appending hosts to the guest's
+// /etc/hosts.
+func hostsFile(hosts []HostEntry) []cloudFile {
+    if len(hosts) == 0 {
+        return nil
+    }
+    var b strings.Builder
+    for _, h := range hosts {
+        fmt.Fprintf(&b, "%s %s\n", h.IP, h.Name)
+    }
+    return []cloudFile{{Path: "/etc/hosts", Append: true, Content: b.String()}}
+}
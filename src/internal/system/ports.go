@@ -0,0 +1,93 @@
+package system
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// HostFwdAdd forwards proto ("tcp" or "udp") port hostPort on the host to
+// guestPort in the guest through the VM's user-mode NIC, while it runs.
+// Forwards added this way are not part of the command line, so they are
+// gone once the QEMU process is.
+func (vm *VM) HostFwdAdd(proto string, hostPort, guestPort int) error {
+    out, err := vm.hmp(fmt.Sprintf("hostfwd_add %s::%d-:%d", proto, hostPort, guestPort))
+    if err != nil {
+        return err
+    }
+    if out != "" {
+        return fmt.Errorf("hostfwd_add: %s", out)
+    }
+    return nil
+}
+
+// HostFwdRemove removes a forward added with HostFwdAdd.
+func (vm *VM) HostFwdRemove(proto string, hostPort int) error {
+    out, err := vm.hmp(fmt.Sprintf("hostfwd_remove %s::%d", proto, hostPort))
+    if err != nil {
+        return err
+    }
+    if !strings.HasSuffix(out, "removed") {
+        return fmt.Errorf("hostfwd_remove: %s", out)
+    }
+    return nil
+}
+
+// HostFwd is a forward on a VM's user-mode NIC.
+type HostFwd struct {
+    Proto    string // "tcp" or "udp"
+    HostPort int
+}
+
+// HostFwds lists the forwards the running QEMU process has, including the
+// SSH forward from its command line. An agent that adopts a VM uses it to
+// learn which forwards survived.
+func (vm *VM) HostFwds() ([]HostFwd, error) {
+    out, err := vm.hmp("info usernet")
+    if err != nil {
+        return nil, err
+    }
+    return parseHostFwds(out), nil
+}
+
+// parseHostFwds reads the HOST_FORWARD lines of "info usernet", e.g.
+//
+//    TCP[HOST_FORWARD]  13               *  2222       10.0.2.15    22     0     0
+//
+// where the fields after the protocol are the socket, the host address
+// (left out when unset) and the host port.
+func parseHostFwds(out string) []HostFwd {
+    var fwds []HostFwd
+    for _, line := range strings.Split(out, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 3 {
+            continue
+        }
+        proto, state, ok := strings.Cut(fields[0], "[")
+        if !ok || state != "HOST_FORWARD]" {
+            continue
+        }
+        port := fields[2]
+        if (port == "*" || net.ParseIP(port) != nil) && len(fields) > 3 {
+            port = fields[3]
+        }
+        n, err := strconv.Atoi(port)
+        if err != nil {
+            continue
+        }
+        fwds = append(fwds, HostFwd{Proto: strings.ToLower(proto), HostPort: n})
+    }
+    return fwds
+}
+
+// hmp runs a human monitor command over QMP. HMP reports most failures as
+// output text rather than as QMP errors, so the trimmed output is returned
+// for the caller to judge.
+func (vm *VM) hmp(cmdline string) (string, error) {
+    var out string
+    if err := vm.QMP("human-monitor-command", map[string]any{"command-line": cmdline}, &out); err != nil {
+        return "", err
+    }
+    return strings.TrimSpace(out), nil
+}
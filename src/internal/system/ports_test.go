@@ -0,0 +1,27 @@
+package system
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseHostFwds(t *testing.T) {
+    out := `Hub -1 (net0):
+  Protocol[State]    FD  Source Address  Port   Dest. Address  Port RecvQ SendQ
+  TCP[HOST_FORWARD]  13               *  2222       10.0.2.15    22     0     0
+  TCP[HOST_FORWARD]  14       127.0.0.1 31000       10.0.2.15  8080     0     0
+  UDP[HOST_FORWARD]  15                 31001       10.0.2.15    53     0     0
+  TCP[ESTABLISHED]   20       10.0.2.2 40000       10.0.2.15    22     0     0
+  TCP[HOST_FORWARD]  16               *  bogus      10.0.2.15    80     0     0`
+    want := []HostFwd{
+        {Proto: "tcp", HostPort: 2222},
+        {Proto: "tcp", HostPort: 31000},
+        {Proto: "udp", HostPort: 31001},
+    }
+    if got := parseHostFwds(out); !reflect.DeepEqual(got, want) {
+        t.Errorf("parseHostFwds = %+v, want %+v", got, want)
+    }
+    if got := parseHostFwds(""); got != nil {
+        t.Errorf("parseHostFwds(\"\") = %+v, want nil", got)
+    }
+}
@@ -2,39 +2,165 @@ package system
 
 import (
     "fmt"
+    "io"
     "io/ioutil"
     "math/rand"
     "os"
     "os/exec"
     "path/filepath"
     "runtime"
+    "strings"
     "time"
 )
 
+// VM is a QEMU guest launched by StartVM. It runs until Stop is called;
+// the caller decides when that is (see internal/expiry).
+type VM struct {
+    Name     string
+    Dir      string // per-VM work area holding disks and control sockets
+    Disk     string // the VM's writable qcow2 overlay
+    HostPort int
+    Image    string
+    Flavor   string
+
+    args   []string // QEMU command line, reused to restore a suspended VM
+    proc   *os.Process
+    done   chan struct{}
+    cgroup string // cgroup the QEMU process was confined to, if any
+    stderr *tailBuffer
+    net    *netRelay // carries the primary NIC's traffic; see startRelay
+}
+
+// Stop shuts the VM down, escalating from ACPI power-off to SIGTERM to
+// SIGKILL (see StopProcess), and returns the stage that worked. It returns
+// "" if the VM had already exited.
+func (vm *VM) Stop(grace time.Duration) (string, error) {
+    return StopProcess(vm.proc, vm.done, vm.QMPSocket(), grace)
+}
+
+// Done is closed once the QEMU process has exited.
+func (vm *VM) Done() <-chan struct{} {
+    return vm.done
+}
+
+// VMSpec describes the VM StartVM should boot.
+type VMSpec struct {
+    Name   string
+    SSHKey string // empty for warm-pool VMs; see AuthorizeKey
+    Image  string // base image name, see ImagePath
+    Flavor string // key into Flavors
+    // Volumes are persistent data disks attached for the VM's lifetime.
+    Volumes []VolumeDisk
+    // Networks are private networks the VM gets a second NIC on.
+    Networks []NetworkNIC
+    // Hostname, if set, is the guest's hostname, and Hosts are extra
+    // /etc/hosts entries, e.g. the other members of its cluster.
+    Hostname string
+    Hosts    []HostEntry
+    // Egress sets what the guest may reach on the network (default open).
+    Egress Egress
+    // Snapshot, if set, is a qcow2 snapshot (see VM.Snapshot) of Image to
+    // boot from instead of the pristine base image.
+    Snapshot string
+    // Progress, if set, is told as boot stages complete: "seed_built" and
+    // "qemu_started".
+    Progress func(stage string)
+}
+
+// cloudFile is a file cloud-init writes into the guest.
+type cloudFile struct {
+    Path    string
+    Content string
+    Append  bool
+}
+
+// writeFilesConfig renders files as a cloud-config write_files section.
+func writeFilesConfig(files []cloudFile) string {
+    if len(files) == 0 {
+        return ""
+    }
+    var b strings.Builder
+    b.WriteString("write_files:\n")
+    for _, f := range files {
+        fmt.Fprintf(&b, "  - path: %s\n", f.Path)
+        if f.Append {
+            b.WriteString("    append: true\n")
+        }
+        b.WriteString("    content: |\n")
+        for _, line := range strings.Split(strings.TrimSuffix(f.Content, "\n"), "\n") {
+            fmt.Fprintf(&b, "      %s\n", line)
+        }
+    }
+    return b.String()
+}
+
+func progress(spec VMSpec, stage string) {
+    if spec.Progress != nil {
+        spec.Progress(stage)
+    }
+}
+
 // StartVM launches a QEMU VM with cloud-init, user SSH key injected,
-// forwards guest:22 → random host port, and returns that host port.
-func StartVM(vmName, sshKey string, duration time.Duration) (int, error) {
+// forwards guest:22 → random host port, and returns a handle to it.
+func StartVM(spec VMSpec) (*VM, error) {
+    vmName := spec.Name
+    if spec.Image == "" {
+        spec.Image = DefaultImage
+    }
+    if spec.Flavor == "" {
+        spec.Flavor = DefaultFlavor
+    }
+    flavor, err := LookupFlavor(spec.Flavor)
+    if err != nil {
+        return nil, err
+    }
+    if !ValidImageName(spec.Image) {
+        return nil, fmt.Errorf("invalid image name %q", spec.Image)
+    }
+    baseImg := ImagePath(spec.Image)
+    if _, err := os.Stat(baseImg); err != nil {
+        return nil, fmt.Errorf("base image %s: %v", spec.Image, err)
+    }
+
     workDir := filepath.Join(os.TempDir(), "vmrentals", vmName)
     os.RemoveAll(workDir)
     if err := os.MkdirAll(workDir, 0755); err != nil {
-        return 0, fmt.Errorf("mkdir workspace: %v", err)
+        return nil, fmt.Errorf("mkdir workspace: %v", err)
     }
 
     // --- write user-data + meta-data ---
+    keys := ""
+    if spec.SSHKey != "" {
+        keys = fmt.Sprintf("ssh_authorized_keys:\n  - %s\n", spec.SSHKey)
+    }
+    egressApt, files := egressCloudConfig(spec.Egress.Policy)
+    files = append(files, hostsFile(spec.Hosts)...)
     userData := fmt.Sprintf(`#cloud-config
-ssh_authorized_keys:
-  - %s
-users:
+%susers:
   - name: ubuntu
     sudo: ALL=(ALL) NOPASSWD:ALL
     shell: /bin/bash
-`, sshKey)
+packages:
+  - qemu-guest-agent
+runcmd:
+  - systemctl start qemu-guest-agent
+%s%s`, keys, egressApt, writeFilesConfig(files))
     if err := ioutil.WriteFile(filepath.Join(workDir, "user-data"), []byte(userData), 0644); err != nil {
-        return 0, fmt.Errorf("write user-data: %v", err)
+        return nil, fmt.Errorf("write user-data: %v", err)
     }
     metaData := fmt.Sprintf("instance-id: %s\n", vmName)
+    if spec.Hostname != "" {
+        metaData += fmt.Sprintf("local-hostname: %s\n", spec.Hostname)
+    }
     if err := ioutil.WriteFile(filepath.Join(workDir, "meta-data"), []byte(metaData), 0644); err != nil {
-        return 0, fmt.Errorf("write meta-data: %v", err)
+        return nil, fmt.Errorf("write meta-data: %v", err)
+    }
+    seedFiles := []string{"user-data", "meta-data"}
+    if len(spec.Networks) > 0 {
+        if err := ioutil.WriteFile(filepath.Join(workDir, "network-config"), []byte(networkConfig(spec.Networks)), 0644); err != nil {
+            return nil, fmt.Errorf("write network-config: %v", err)
+        }
+        seedFiles = append(seedFiles, "network-config")
     }
 
     // --- build seed ISO ---
@@ -48,40 +174,41 @@ users:
             "-udf", "-joliet", "-iso")
     } else {
         // Linux fallback: genisoimage or mkisofs
+        isoArgs := []string{
+            "-output", isoPath,
+            "-volid", "cidata",
+            "-joliet", "-rock",
+            "-graft-points",
+        }
+        for _, f := range seedFiles {
+            isoArgs = append(isoArgs, f+"="+filepath.Join(workDir, f))
+        }
         if _, err := exec.LookPath("genisoimage"); err == nil {
-            isoCmd = exec.Command("genisoimage",
-                "-output", isoPath,
-                "-volid", "cidata",
-                "-joliet", "-rock",
-                "-graft-points",
-                "user-data="+filepath.Join(workDir, "user-data"),
-                "meta-data="+filepath.Join(workDir, "meta-data"))
+            isoCmd = exec.Command("genisoimage", isoArgs...)
         } else {
-            isoCmd = exec.Command("mkisofs",
-                "-output", isoPath,
-                "-volid", "cidata",
-                "-joliet", "-rock",
-                "-graft-points",
-                "user-data="+filepath.Join(workDir, "user-data"),
-                "meta-data="+filepath.Join(workDir, "meta-data"))
+            isoCmd = exec.Command("mkisofs", isoArgs...)
         }
     }
     isoCmd.Stdout = os.Stdout
     isoCmd.Stderr = os.Stderr
     if err := isoCmd.Run(); err != nil {
-        return 0, fmt.Errorf("build seed ISO: %v", err)
+        return nil, fmt.Errorf("build seed ISO: %v", err)
     }
+    progress(spec, "seed_built")
 
     // --- backing disk ---
-    baseImg := "/Users/smeetnagda/qemu-images/ubuntu-24.04-server-arm64.img" // adjust path
+    backing, backingFmt := baseImg, "raw"
+    if spec.Snapshot != "" {
+        backing, backingFmt = spec.Snapshot, "qcow2"
+    }
     qcow := filepath.Join(workDir, vmName+".qcow2")
     imgCmd := exec.Command("qemu-img", "create",
         "-f", "qcow2",
-        "-b", baseImg,
-        "-F", "raw",
+        "-b", backing,
+        "-F", backingFmt,
         qcow)
     if out, err := imgCmd.CombinedOutput(); err != nil {
-        return 0, fmt.Errorf("qemu-img create: %v, output: %s", err, out)
+        return nil, fmt.Errorf("qemu-img create: %v, output: %s", err, out)
     }
 
     // --- pick a host port and launch QEMU ---
@@ -91,25 +218,53 @@ users:
     qemuArgs := []string{
         "-machine", "virt,accel=hvf",
         "-cpu", "cortex-a72",
-        "-m", "2048",
-        "-smp", "2",
-        "-drive", "file=" + qcow + ",if=virtio,format=qcow2",
+        "-m", fmt.Sprint(flavor.MemoryMB),
+        "-smp", fmt.Sprint(flavor.CPUs),
+        "-drive", "file=" + qcow + ",if=virtio,format=qcow2" + flavor.throttleOpts(),
         "-drive", "file=" + isoPath + ",if=virtio,media=cdrom,readonly=on",
-        "-nic", fmt.Sprintf("user,hostfwd=tcp::%d-:22", hostPort),
+        "-nic", nicArg(workDir, hostPort, spec.Egress),
+        "-qmp", "unix:" + filepath.Join(workDir, "qmp.sock") + ",server=on,wait=off",
+        // qemu-guest-agent channel, used for in-guest notices
+        "-chardev", "socket,path=" + filepath.Join(workDir, "qga.sock") + ",server=on,wait=off,id=qga0",
+        "-device", "virtio-serial",
+        "-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+        // serial console: logged to serial.log, interactive over console.sock
+        "-chardev", "socket,path=" + filepath.Join(workDir, "console.sock") + ",server=on,wait=off,id=serial0" +
+            ",logfile=" + filepath.Join(workDir, "serial.log") + ",logappend=on",
+        "-serial", "chardev:serial0",
         "-nographic",
     }
+    qemuArgs = append(qemuArgs, relayArgs(workDir)...)
+    qemuArgs = append(qemuArgs, volumeArgs(spec.Volumes, flavor)...)
+    qemuArgs = append(qemuArgs, networkArgs(spec.Networks)...)
+    stderr := &tailBuffer{}
     cmd := exec.Command("qemu-system-aarch64", qemuArgs...)
     cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
+    cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
     if err := cmd.Start(); err != nil {
-        return 0, fmt.Errorf("start QEMU: %v", err)
+        return nil, fmt.Errorf("start QEMU: %v", err)
     }
+    progress(spec, "qemu_started")
 
-    // cleanup after duration
+    vm := &VM{
+        Name:     vmName,
+        Dir:      workDir,
+        Disk:     qcow,
+        HostPort: hostPort,
+        Image:    spec.Image,
+        Flavor:   spec.Flavor,
+        args:     qemuArgs,
+        proc:     cmd.Process,
+        done:     make(chan struct{}),
+        stderr:   stderr,
+    }
+    vm.confine(flavor)
+    vm.writeRunning()
+    vm.startRelay()
     go func() {
-        time.Sleep(duration)
-        cmd.Process.Kill()
+        cmd.Wait()
+        vm.exited()
     }()
 
-    return hostPort, nil
+    return vm, nil
 }
@@ -0,0 +1,250 @@
+package system
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "net"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// qgaTimeout bounds every round trip to the guest agent. A guest that has
+// not finished booting simply never answers.
+const qgaTimeout = 10 * time.Second
+
+// qgaConn speaks the qemu-guest-agent JSON protocol over the virtio-serial
+// socket QEMU exposes on the host.
+type qgaConn struct {
+    conn net.Conn
+    dec  *json.Decoder
+}
+
+type qgaResponse struct {
+    Return json.RawMessage `json:"return"`
+    Error  *struct {
+        Class string `json:"class"`
+        Desc  string `json:"desc"`
+    } `json:"error"`
+}
+
+// dialQGA connects to the guest agent socket and syncs the stream, dropping
+// any stale replies a previous client left behind.
+func dialQGA(sockPath string) (*qgaConn, error) {
+    conn, err := net.DialTimeout("unix", sockPath, qgaTimeout)
+    if err != nil {
+        return nil, fmt.Errorf("dial guest agent: %v", err)
+    }
+    c := &qgaConn{conn: conn, dec: json.NewDecoder(conn)}
+
+    id := rand.Int63n(1 << 31)
+    if err := c.send("guest-sync", map[string]int64{"id": id}); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    for {
+        var resp qgaResponse
+        if err := c.dec.Decode(&resp); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("guest-sync: %v", err)
+        }
+        var got int64
+        if json.Unmarshal(resp.Return, &got) == nil && got == id {
+            return c, nil
+        }
+    }
+}
+
+func (c *qgaConn) Close() error {
+    return c.conn.Close()
+}
+
+func (c *qgaConn) send(cmd string, args any) error {
+    c.conn.SetDeadline(time.Now().Add(qgaTimeout))
+    msg := map[string]any{"execute": cmd}
+    if args != nil {
+        msg["arguments"] = args
+    }
+    if err := json.NewEncoder(c.conn).Encode(msg); err != nil {
+        return fmt.Errorf("%s: %v", cmd, err)
+    }
+    return nil
+}
+
+// call runs one guest agent command and decodes its "return" into out.
+func (c *qgaConn) call(cmd string, args, out any) error {
+    if err := c.send(cmd, args); err != nil {
+        return err
+    }
+    var resp qgaResponse
+    if err := c.dec.Decode(&resp); err != nil {
+        return fmt.Errorf("%s: %v", cmd, err)
+    }
+    if resp.Error != nil {
+        return fmt.Errorf("%s: %s: %s", cmd, resp.Error.Class, resp.Error.Desc)
+    }
+    if out != nil {
+        return json.Unmarshal(resp.Return, out)
+    }
+    return nil
+}
+
+// QGASocket is the host-side path of the VM's guest agent channel.
+func (vm *VM) QGASocket() string {
+    return filepath.Join(vm.Dir, "qga.sock")
+}
+
+// GuestExec runs path with args inside the guest via qemu-guest-agent,
+// feeding it stdin, and waits for it to exit. It returns the exit code and
+// combined stdout/stderr.
+func (vm *VM) GuestExec(path string, args []string, stdin []byte) (int, []byte, error) {
+    c, err := dialQGA(vm.QGASocket())
+    if err != nil {
+        return 0, nil, err
+    }
+    defer c.Close()
+
+    execArgs := map[string]any{
+        "path":           path,
+        "arg":            args,
+        "capture-output": true,
+    }
+    if len(stdin) > 0 {
+        execArgs["input-data"] = base64.StdEncoding.EncodeToString(stdin)
+    }
+    var started struct {
+        PID int `json:"pid"`
+    }
+    if err := c.call("guest-exec", execArgs, &started); err != nil {
+        return 0, nil, err
+    }
+
+    deadline := time.Now().Add(qgaTimeout)
+    for time.Now().Before(deadline) {
+        var st struct {
+            Exited   bool   `json:"exited"`
+            ExitCode int    `json:"exitcode"`
+            OutData  string `json:"out-data"`
+            ErrData  string `json:"err-data"`
+        }
+        if err := c.call("guest-exec-status", map[string]int{"pid": started.PID}, &st); err != nil {
+            return 0, nil, err
+        }
+        if st.Exited {
+            out, _ := base64.StdEncoding.DecodeString(st.OutData)
+            errOut, _ := base64.StdEncoding.DecodeString(st.ErrData)
+            return st.ExitCode, append(out, errOut...), nil
+        }
+        time.Sleep(200 * time.Millisecond)
+    }
+    return 0, nil, fmt.Errorf("guest-exec %s: timed out", path)
+}
+
+// Broadcast shows msg to everyone logged into the guest (wall) and leaves it
+// in the login banner so the next SSH session sees it too.
+func (vm *VM) Broadcast(msg string) error {
+    const script = `mkdir -p /run/motd.d && cat > /run/motd.d/90-vmshare && wall < /run/motd.d/90-vmshare`
+    code, out, err := vm.GuestExec("/bin/sh", []string{"-c", script}, []byte(msg+"\n"))
+    if err != nil {
+        return err
+    }
+    if code != 0 {
+        return fmt.Errorf("broadcast exited %d: %s", code, out)
+    }
+    return nil
+}
+
+// WaitGuestAgent blocks until the guest agent answers or timeout passes. A
+// responsive guest agent means the guest finished booting.
+func (vm *VM) WaitGuestAgent(timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for {
+        c, err := dialQGA(vm.QGASocket())
+        if err == nil {
+            c.Close()
+            return nil
+        }
+        select {
+        case <-vm.done:
+            return fmt.Errorf("VM %s exited while booting", vm.Name)
+        default:
+        }
+        if time.Now().After(deadline) {
+            return fmt.Errorf("guest agent not ready after %v: %v", timeout, err)
+        }
+        time.Sleep(2 * time.Second)
+    }
+}
+
+// guestUser and guestHome are the guest account keys are authorized for;
+// variables so tests can point them at a local account.
+var (
+    guestUser = "ubuntu"
+    guestHome = "/home/ubuntu"
+)
+
+// appendKeyScript appends stdin to the authorized_keys of user $1, whose
+// home is $2. It runs as root in the guest.
+const appendKeyScript = `set -e
+install -d -m 700 "$2/.ssh"
+chown "$1:" "$2/.ssh"
+cat >> "$2/.ssh/authorized_keys"
+chown "$1:" "$2/.ssh/authorized_keys"
+chmod 600 "$2/.ssh/authorized_keys"`
+
+// AddTemporaryKey authorizes sshKey for the guest user for the next ttl,
+// tagged with tag so RemoveKey can take it out again. sshd stops accepting
+// it after ttl even if it is never removed. The expiry is written in the
+// guest's local time, without the "Z" suffix older sshd rejects, and is
+// computed from the guest's clock.
+func (vm *VM) AddTemporaryKey(sshKey, tag string, ttl time.Duration) error {
+    script := `set -e
+exp=$(date -d "+$3 seconds" +%Y%m%d%H%M%S)
+key=$(cat)
+printf 'expiry-time="%s" %s %s\n' "$exp" "$key" "$4" | {
+` + appendKeyScript + `
+}`
+    args := []string{"-c", script, "sh", guestUser, guestHome, strconv.Itoa(int(ttl.Seconds())), tag}
+    code, out, err := vm.GuestExec("/bin/sh", args, []byte(strings.TrimSpace(sshKey)))
+    if err != nil {
+        return err
+    }
+    if code != 0 {
+        return fmt.Errorf("add key exited %d: %s", code, out)
+    }
+    return nil
+}
+
+// RemoveKey drops the authorized_keys entries added with tag.
+func (vm *VM) RemoveKey(tag string) error {
+    const script = `f="$2/.ssh/authorized_keys"
+[ -f "$f" ] || exit 0
+grep -vF -- " $3" "$f" > "$f.tmp" || true
+chown "$1:" "$f.tmp" && chmod 600 "$f.tmp" && mv "$f.tmp" "$f"`
+    code, out, err := vm.GuestExec("/bin/sh", []string{"-c", script, "sh", guestUser, guestHome, tag}, nil)
+    if err != nil {
+        return err
+    }
+    if code != 0 {
+        return fmt.Errorf("remove key exited %d: %s", code, out)
+    }
+    return nil
+}
+
+// AuthorizeKey appends sshKey to the guest user's authorized_keys inside the
+// running guest and sets its hostname, handing a warm VM over to a renter.
+func (vm *VM) AuthorizeKey(sshKey, hostname string) error {
+    script := appendKeyScript + `
+hostnamectl set-hostname "$3"`
+    code, out, err := vm.GuestExec("/bin/sh", []string{"-c", script, "sh", guestUser, guestHome, hostname}, []byte(sshKey+"\n"))
+    if err != nil {
+        return err
+    }
+    if code != 0 {
+        return fmt.Errorf("authorize key exited %d: %s", code, out)
+    }
+    return nil
+}
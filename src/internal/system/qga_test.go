@@ -0,0 +1,183 @@
+package system
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "net"
+    "os"
+    "os/exec"
+    "os/user"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+)
+
+// fakeGuestAgent answers guest agent commands on vm's socket, running
+// guest-exec commands on this host.
+func fakeGuestAgent(t *testing.T, vm *VM) {
+    t.Helper()
+    ln, err := net.Listen("unix", vm.QGASocket())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go serveGuestAgent(conn)
+        }
+    }()
+}
+
+func serveGuestAgent(conn net.Conn) {
+    defer conn.Close()
+    dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+    var out []byte
+    var code int
+    for {
+        var req struct {
+            Execute   string          `json:"execute"`
+            Arguments json.RawMessage `json:"arguments"`
+        }
+        if err := dec.Decode(&req); err != nil {
+            return
+        }
+        var ret any
+        switch req.Execute {
+        case "guest-sync":
+            var args struct{ ID int64 }
+            json.Unmarshal(req.Arguments, &args)
+            ret = args.ID
+        case "guest-exec":
+            var args struct {
+                Path  string   `json:"path"`
+                Arg   []string `json:"arg"`
+                Input string   `json:"input-data"`
+            }
+            json.Unmarshal(req.Arguments, &args)
+            stdin, _ := base64.StdEncoding.DecodeString(args.Input)
+            cmd := exec.Command(args.Path, args.Arg...)
+            cmd.Stdin = bytes.NewReader(stdin)
+            out, _ = cmd.CombinedOutput()
+            code = cmd.ProcessState.ExitCode()
+            ret = map[string]int{"pid": 1}
+        case "guest-exec-status":
+            ret = map[string]any{"exited": true, "exitcode": code, "out-data": base64.StdEncoding.EncodeToString(out)}
+        }
+        enc.Encode(map[string]any{"return": ret})
+    }
+}
+
+// localGuest returns a VM whose guest agent runs commands here, with the
+// guest account pointed at the current user and a scratch home.
+func localGuest(t *testing.T) (*VM, string) {
+    t.Helper()
+    // a short directory: unix socket paths are limited to ~100 bytes
+    dir, err := os.MkdirTemp("", "qga")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+    me, err := user.Current()
+    if err != nil {
+        t.Fatal(err)
+    }
+    oldUser, oldHome := guestUser, guestHome
+    guestUser, guestHome = me.Username, filepath.Join(dir, "home")
+    t.Cleanup(func() { guestUser, guestHome = oldUser, oldHome })
+
+    vm := &VM{Name: "vm", Dir: dir, done: make(chan struct{})}
+    fakeGuestAgent(t, vm)
+    return vm, filepath.Join(guestHome, ".ssh", "authorized_keys")
+}
+
+func readKeys(t *testing.T, path string) []string {
+    t.Helper()
+    b, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestAddTemporaryKey(t *testing.T) {
+    if exec.Command("date", "-d", "+1 seconds").Run() != nil {
+        t.Skip("needs GNU date(1), as in the guest")
+    }
+    vm, keys := localGuest(t)
+    const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIK0 coordinator"
+
+    before := time.Now()
+    if err := vm.AddTemporaryKey(key+"\n", "vmshare-tag1", time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    lines := readKeys(t, keys)
+    if len(lines) != 1 {
+        t.Fatalf("authorized_keys = %q, want one line", lines)
+    }
+    m := regexp.MustCompile(`^expiry-time="(\d{14})" (.*) vmshare-tag1$`).FindStringSubmatch(lines[0])
+    if m == nil {
+        t.Fatalf("line %q is not expiry-time=\"YYYYMMDDHHMMSS\" <key> <tag>", lines[0])
+    }
+    if m[2] != key {
+        t.Errorf("key = %q, want %q", m[2], key)
+    }
+    // sshd reads the time without a "Z" as the guest's local time
+    exp, err := time.ParseInLocation("20060102150405", m[1], time.Local)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := before.Add(time.Hour); exp.Before(want.Add(-2*time.Second)) || exp.After(want.Add(5*time.Second)) {
+        t.Errorf("expiry %v, want about %v", exp, want)
+    }
+
+    for path, want := range map[string]os.FileMode{filepath.Dir(keys): 0700, keys: 0600} {
+        if fi, err := os.Stat(path); err != nil {
+            t.Error(err)
+        } else if fi.Mode().Perm() != want {
+            t.Errorf("%s: mode %v, want %v", path, fi.Mode().Perm(), want)
+        }
+    }
+}
+
+func TestRemoveKey(t *testing.T) {
+    vm, keys := localGuest(t)
+    if err := vm.RemoveKey("vmshare-tag1"); err != nil {
+        t.Fatalf("no authorized_keys yet: %v", err)
+    }
+
+    os.MkdirAll(filepath.Dir(keys), 0700)
+    os.WriteFile(keys, []byte(strings.Join([]string{
+        "ssh-ed25519 AAAAowner renter@laptop",
+        `expiry-time="20300101000000" ssh-ed25519 AAAAone vmshare-tag1`,
+        `expiry-time="20300101000000" ssh-ed25519 AAAAtwo vmshare-tag2`,
+    }, "\n")+"\n"), 0600)
+
+    tests := []struct {
+        tag  string
+        want []string
+    }{
+        {"vmshare-tag1", []string{"ssh-ed25519 AAAAowner renter@laptop", `expiry-time="20300101000000" ssh-ed25519 AAAAtwo vmshare-tag2`}},
+        {"vmshare-unknown", []string{"ssh-ed25519 AAAAowner renter@laptop", `expiry-time="20300101000000" ssh-ed25519 AAAAtwo vmshare-tag2`}},
+        {"vmshare-tag2", []string{"ssh-ed25519 AAAAowner renter@laptop"}},
+    }
+    for _, tt := range tests {
+        if err := vm.RemoveKey(tt.tag); err != nil {
+            t.Fatalf("remove %s: %v", tt.tag, err)
+        }
+        if got := readKeys(t, keys); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+            t.Errorf("after removing %s: %q, want %q", tt.tag, got, tt.want)
+        }
+    }
+    if fi, err := os.Stat(keys); err != nil {
+        t.Error(err)
+    } else if fi.Mode().Perm() != 0600 {
+        t.Errorf("authorized_keys mode %v, want 0600", fi.Mode().Perm())
+    }
+}
@@ -0,0 +1,102 @@
+package system
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "path/filepath"
+    "time"
+)
+
+// qmpTimeout bounds every QMP round trip.
+const qmpTimeout = 10 * time.Second
+
+// qmpConn is a QEMU Machine Protocol session on the VM's control socket.
+type qmpConn struct {
+    conn net.Conn
+    dec  *json.Decoder
+}
+
+type qmpMessage struct {
+    Return json.RawMessage `json:"return"`
+    Event  string          `json:"event"`
+    Error  *struct {
+        Class string `json:"class"`
+        Desc  string `json:"desc"`
+    } `json:"error"`
+}
+
+// dialQMP connects to a QMP socket, consumes the greeting and leaves
+// capabilities negotiation mode so commands can be issued.
+func dialQMP(sockPath string) (*qmpConn, error) {
+    conn, err := net.DialTimeout("unix", sockPath, qmpTimeout)
+    if err != nil {
+        return nil, fmt.Errorf("dial qmp: %v", err)
+    }
+    c := &qmpConn{conn: conn, dec: json.NewDecoder(conn)}
+
+    conn.SetDeadline(time.Now().Add(qmpTimeout))
+    var greeting map[string]json.RawMessage
+    if err := c.dec.Decode(&greeting); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("qmp greeting: %v", err)
+    }
+    if err := c.execute("qmp_capabilities", nil, nil); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return c, nil
+}
+
+func (c *qmpConn) Close() error {
+    return c.conn.Close()
+}
+
+// execute runs one QMP command and decodes its "return" into out, skipping
+// any asynchronous events QEMU interleaves with the reply.
+func (c *qmpConn) execute(cmd string, args, out any) error {
+    c.conn.SetDeadline(time.Now().Add(qmpTimeout))
+    msg := map[string]any{"execute": cmd}
+    if args != nil {
+        msg["arguments"] = args
+    }
+    if err := json.NewEncoder(c.conn).Encode(msg); err != nil {
+        return fmt.Errorf("%s: %v", cmd, err)
+    }
+    for {
+        var resp qmpMessage
+        if err := c.dec.Decode(&resp); err != nil {
+            return fmt.Errorf("%s: %v", cmd, err)
+        }
+        if resp.Event != "" {
+            continue
+        }
+        if resp.Error != nil {
+            return fmt.Errorf("%s: %s: %s", cmd, resp.Error.Class, resp.Error.Desc)
+        }
+        if out != nil {
+            return json.Unmarshal(resp.Return, out)
+        }
+        return nil
+    }
+}
+
+// qmpExecute opens a session on sockPath, runs a single command and closes it.
+func qmpExecute(sockPath, cmd string, args, out any) error {
+    c, err := dialQMP(sockPath)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    return c.execute(cmd, args, out)
+}
+
+// QMPSocket is the host-side path of the VM's QMP control socket.
+func (vm *VM) QMPSocket() string {
+    return filepath.Join(vm.Dir, "qmp.sock")
+}
+
+// QMP runs a single QMP command against the VM.
+func (vm *VM) QMP(cmd string, args, out any) error {
+    return qmpExecute(vm.QMPSocket(), cmd, args, out)
+}
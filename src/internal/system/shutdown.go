@@ -0,0 +1,64 @@
+package system
+
+import (
+    "log/slog"
+    "os"
+    "syscall"
+    "time"
+)
+
+// Stop stages, in escalation order. The stage that actually ended the VM is
+// recorded on the rental so hosts can spot guests that ignore shutdown.
+const (
+    StopACPI    = "acpi"    // guest halted after system_powerdown
+    StopSIGTERM = "sigterm" // QEMU exited on SIGTERM
+    StopSIGKILL = "sigkill" // QEMU had to be killed
+)
+
+// DefaultShutdownGrace is how long a guest gets to halt after an ACPI
+// power-button press before QEMU is signalled.
+const DefaultShutdownGrace = 30 * time.Second
+
+// termGrace is how long QEMU gets to exit after SIGTERM before SIGKILL.
+const termGrace = 10 * time.Second
+
+// StopProcess runs the stop sequence for a QEMU process: ACPI
+// system_powerdown via QMP, wait up to grace for the guest to halt, then
+// SIGTERM, then SIGKILL. done must close when the process has exited. It
+// returns the stage that succeeded, or "" if the process was already gone.
+func StopProcess(proc *os.Process, done <-chan struct{}, qmpSock string, grace time.Duration) (string, error) {
+    select {
+    case <-done:
+        return "", nil
+    default:
+    }
+
+    if err := qmpExecute(qmpSock, "system_powerdown", nil, nil); err != nil {
+        slog.Warn("system_powerdown failed", "qmp", qmpSock, "err", err)
+    } else {
+        select {
+        case <-done:
+            return StopACPI, nil
+        case <-time.After(grace):
+        }
+    }
+
+    if err := proc.Signal(syscall.SIGTERM); err == nil {
+        select {
+        case <-done:
+            return StopSIGTERM, nil
+        case <-time.After(termGrace):
+        }
+    }
+
+    if err := proc.Kill(); err != nil {
+        return StopSIGKILL, err
+    }
+    <-done
+    return StopSIGKILL, nil
+}
+
+// processAlive reports whether proc has not exited yet.
+func processAlive(proc *os.Process) bool {
+    return proc.Signal(syscall.Signal(0)) == nil
+}
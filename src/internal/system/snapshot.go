@@ -0,0 +1,54 @@
+package system
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+)
+
+// SnapshotPath is where snapshot id lives under dir.
+func SnapshotPath(dir string, id int64) string {
+    return filepath.Join(dir, fmt.Sprintf("snap-%d.qcow2", id))
+}
+
+// Snapshot pauses the VM, copies its disk to dest and resumes it. QEMU
+// flushes the disk when the VM stops, so the copy is crash-consistent. dest
+// holds only what differs from the base image and is backed by it, so it
+// stays valid however the VM's own disk chain looks. It returns the size of
+// dest in bytes.
+func (vm *VM) Snapshot(dest string) (int64, error) {
+    if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+        return 0, fmt.Errorf("mkdir snapshot dir: %v", err)
+    }
+    if err := vm.QMP("stop", nil, nil); err != nil {
+        return 0, fmt.Errorf("pause VM: %v", err)
+    }
+    defer func() {
+        if err := vm.QMP("cont", nil, nil); err != nil {
+            slog.Error("resume VM after snapshot", "vm", vm.Name, "err", err)
+        }
+    }()
+
+    // -U: QEMU still holds the write lock on the overlay
+    tmp := dest + ".tmp"
+    cmd := exec.Command("qemu-img", "convert", "-U",
+        "-O", "qcow2",
+        "-B", ImagePath(vm.Image),
+        "-F", "raw",
+        vm.Disk, tmp)
+    if out, err := cmd.CombinedOutput(); err != nil {
+        os.Remove(tmp)
+        return 0, fmt.Errorf("qemu-img convert: %v, output: %s", err, out)
+    }
+    if err := os.Rename(tmp, dest); err != nil {
+        os.Remove(tmp)
+        return 0, err
+    }
+    fi, err := os.Stat(dest)
+    if err != nil {
+        return 0, err
+    }
+    return fi.Size(), nil
+}
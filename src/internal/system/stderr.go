@@ -0,0 +1,35 @@
+package system
+
+import "sync"
+
+// stderrTailSize is how much of QEMU's most recent stderr output a VM keeps
+// for error reports.
+const stderrTailSize = 4096
+
+// tailBuffer keeps the last stderrTailSize bytes written to it.
+type tailBuffer struct {
+    mu  sync.Mutex
+    buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.buf = append(t.buf, p...)
+    if over := len(t.buf) - stderrTailSize; over > 0 {
+        t.buf = append(t.buf[:0], t.buf[over:]...)
+    }
+    return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return string(t.buf)
+}
+
+// StderrTail returns the end of what QEMU has written to stderr, e.g. why
+// it exited.
+func (vm *VM) StderrTail() string {
+    return vm.stderr.String()
+}
@@ -0,0 +1,201 @@
+package system
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// resumeTimeout bounds how long a restored VM may take to load its state.
+const resumeTimeout = 5 * time.Minute
+
+// savedVM is the manifest written next to a suspended VM's state so it can
+// be restored later, even by a restarted agent.
+type savedVM struct {
+    Name     string   `json:"name"`
+    Dir      string   `json:"dir"`
+    Disk     string   `json:"disk"`
+    HostPort int      `json:"host_port"`
+    Image    string   `json:"image"`
+    Flavor   string   `json:"flavor"`
+    Args     []string `json:"args"`
+}
+
+func manifestPath(dir string) string { return filepath.Join(dir, "vm.json") }
+func statePath(dir string) string    { return filepath.Join(dir, "state") }
+
+// readManifest loads the manifest of the VM suspended into dir.
+func readManifest(dir string) (*savedVM, error) {
+    data, err := os.ReadFile(manifestPath(dir))
+    if err != nil {
+        return nil, fmt.Errorf("read manifest: %v", err)
+    }
+    var saved savedVM
+    if err := json.Unmarshal(data, &saved); err != nil {
+        return nil, fmt.Errorf("parse manifest: %v", err)
+    }
+    return &saved, nil
+}
+
+// shellQuote quotes s for use in the exec: migration URIs, which QEMU runs
+// through /bin/sh.
+func shellQuote(s string) string {
+    return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Suspend saves the VM's full state (RAM and devices) to dir with a QMP
+// migration to a file, then ends the QEMU process so its memory goes back to
+// the host. The VM's disk stays where it is; ResumeVM picks it all up again.
+// On failure the VM keeps running.
+func (vm *VM) Suspend(dir string) error {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return fmt.Errorf("mkdir suspend dir: %v", err)
+    }
+    manifest, err := json.Marshal(savedVM{
+        Name: vm.Name, Dir: vm.Dir, Disk: vm.Disk, HostPort: vm.HostPort,
+        Image: vm.Image, Flavor: vm.Flavor, Args: vm.args,
+    })
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(manifestPath(dir), manifest, 0644); err != nil {
+        return fmt.Errorf("write manifest: %v", err)
+    }
+
+    c, err := dialQMP(vm.QMPSocket())
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    if err := c.execute("stop", nil, nil); err != nil {
+        return fmt.Errorf("pause VM: %v", err)
+    }
+    if err := migrateAndWait(c, "exec:cat > "+shellQuote(statePath(dir))); err != nil {
+        c.execute("cont", nil, nil)
+        return err
+    }
+    if err := c.execute("quit", nil, nil); err != nil {
+        // QEMU may drop the connection before replying
+        select {
+        case <-vm.done:
+        case <-time.After(qmpTimeout):
+            return fmt.Errorf("quit after save: %v", err)
+        }
+    }
+    <-vm.done
+    return nil
+}
+
+// migrateAndWait starts an outgoing migration to uri and polls until it
+// finishes.
+func migrateAndWait(c *qmpConn, uri string) error {
+    if err := c.execute("migrate", map[string]any{"uri": uri}, nil); err != nil {
+        return err
+    }
+    for {
+        var st struct {
+            Status    string `json:"status"`
+            ErrorDesc string `json:"error-desc"`
+        }
+        if err := c.execute("query-migrate", nil, &st); err != nil {
+            return err
+        }
+        switch st.Status {
+        case "completed":
+            return nil
+        case "failed", "cancelled":
+            return fmt.Errorf("migration %s: %s", st.Status, st.ErrorDesc)
+        }
+        time.Sleep(200 * time.Millisecond)
+    }
+}
+
+// ResumeVM restores a VM suspended into dir: QEMU is started with the same
+// command line plus -incoming and loads the saved state. The saved state is
+// removed once the guest is running again.
+func ResumeVM(dir string) (*VM, error) {
+    saved, err := readManifest(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    args := append(append([]string{}, saved.Args...),
+        "-incoming", "exec:cat < "+shellQuote(statePath(dir)))
+    stderr := &tailBuffer{}
+    cmd := exec.Command("qemu-system-aarch64", args...)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+    if err := cmd.Start(); err != nil {
+        return nil, fmt.Errorf("start QEMU: %v", err)
+    }
+    vm := &VM{
+        Name:     saved.Name,
+        Dir:      saved.Dir,
+        Disk:     saved.Disk,
+        HostPort: saved.HostPort,
+        Image:    saved.Image,
+        Flavor:   saved.Flavor,
+        args:     saved.Args,
+        proc:     cmd.Process,
+        done:     make(chan struct{}),
+        stderr:   stderr,
+    }
+    if flavor, err := LookupFlavor(vm.Flavor); err == nil {
+        vm.confine(flavor)
+    }
+    vm.startRelay()
+    go func() {
+        cmd.Wait()
+        vm.exited()
+    }()
+
+    if err := vm.waitRunning(resumeTimeout); err != nil {
+        vm.proc.Kill()
+        <-vm.done
+        return nil, err
+    }
+    vm.writeRunning()
+    os.RemoveAll(dir)
+    return vm, nil
+}
+
+// waitRunning polls QMP until the guest is running again after an incoming
+// migration. The state was saved with the guest paused, and QEMU restores
+// that run state, so the guest is continued once loading is done.
+func (vm *VM) waitRunning(timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for {
+        var st struct {
+            Status string `json:"status"`
+        }
+        err := vm.QMP("query-status", nil, &st)
+        if err == nil && st.Status == "running" {
+            return nil
+        }
+        if err == nil && st.Status == "paused" {
+            err = vm.QMP("cont", nil, nil)
+        }
+        select {
+        case <-vm.done:
+            return fmt.Errorf("VM %s exited while restoring", vm.Name)
+        default:
+        }
+        if time.Now().After(deadline) {
+            return fmt.Errorf("VM %s not running after %v (status %q, %v)", vm.Name, timeout, st.Status, err)
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+}
+
+// DiscardSuspended deletes a suspended VM's saved state and disk.
+func DiscardSuspended(dir string) error {
+    if saved, err := readManifest(dir); err == nil && saved.Dir != "" {
+        os.RemoveAll(saved.Dir)
+    }
+    return os.RemoveAll(dir)
+}
@@ -0,0 +1,62 @@
+package system
+
+import (
+    "github.com/shirou/gopsutil/process"
+)
+
+// ProcessStats is the host-side cost of the QEMU process: CPU time spent
+// (user and system, across all vCPU threads) and resident memory.
+type ProcessStats struct {
+    CPUSeconds float64
+    RSSBytes   uint64
+}
+
+// ProcessStats samples the QEMU process. CPU time restarts at zero when the
+// process does, e.g. on resume or migration.
+func (vm *VM) ProcessStats() (ProcessStats, error) {
+    p, err := process.NewProcess(int32(vm.proc.Pid))
+    if err != nil {
+        return ProcessStats{}, err
+    }
+    t, err := p.Times()
+    if err != nil {
+        return ProcessStats{}, err
+    }
+    m, err := p.MemoryInfo()
+    if err != nil {
+        return ProcessStats{}, err
+    }
+    return ProcessStats{CPUSeconds: t.User + t.System, RSSBytes: m.RSS}, nil
+}
+
+// BlockStats are I/O counters summed over all of the VM's disks since QEMU
+// started.
+type BlockStats struct {
+    RdBytes uint64
+    WrBytes uint64
+    RdOps   uint64
+    WrOps   uint64
+}
+
+// BlockStats reads the disk counters through QMP query-blockstats.
+func (vm *VM) BlockStats() (BlockStats, error) {
+    var devs []struct {
+        Stats struct {
+            RdBytes uint64 `json:"rd_bytes"`
+            WrBytes uint64 `json:"wr_bytes"`
+            RdOps   uint64 `json:"rd_operations"`
+            WrOps   uint64 `json:"wr_operations"`
+        } `json:"stats"`
+    }
+    if err := vm.QMP("query-blockstats", nil, &devs); err != nil {
+        return BlockStats{}, err
+    }
+    var s BlockStats
+    for _, d := range devs {
+        s.RdBytes += d.Stats.RdBytes
+        s.WrBytes += d.Stats.WrBytes
+        s.RdOps += d.Stats.RdOps
+        s.WrOps += d.Stats.WrOps
+    }
+    return s, nil
+}
@@ -0,0 +1,43 @@
+package system
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+)
+
+// VolumeDisk is a persistent data disk attached to a VM. It shows up in the
+// guest as /dev/disk/by-id/virtio-vol-<ID>.
+type VolumeDisk struct {
+    ID   int64
+    Path string
+}
+
+// VolumePath is where volume id lives under dir.
+func VolumePath(dir string, id int64) string {
+    return filepath.Join(dir, fmt.Sprintf("vol-%d.qcow2", id))
+}
+
+// CreateDisk creates an empty qcow2 disk of sizeGB at path.
+func CreateDisk(path string, sizeGB int) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("mkdir volume dir: %v", err)
+    }
+    cmd := exec.Command("qemu-img", "create", "-f", "qcow2", path, fmt.Sprintf("%dG", sizeGB))
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("qemu-img create: %v, output: %s", err, out)
+    }
+    return nil
+}
+
+// volumeArgs returns the -drive flags for vols, throttled with the root
+// disk under flavor's limits.
+func volumeArgs(vols []VolumeDisk, flavor Flavor) []string {
+    var args []string
+    for _, v := range vols {
+        args = append(args, "-drive",
+            fmt.Sprintf("file=%s,if=virtio,format=qcow2,serial=vol-%d", v.Path, v.ID)+flavor.throttleOpts())
+    }
+    return args
+}
@@ -0,0 +1,239 @@
+// Package tunnel carries the agent HTTP API over an SSH connection that the
+// agent dials out to the coordinator, so agents behind NAT stay reachable.
+// It carries nothing else: agents still read and write the coordinator's
+// database directly.
+// Each HTTP connection is one SSH channel of type HTTPChannel; this package
+// adapts those channels to net.Conn and net.Listener so ordinary HTTP
+// clients and servers can use them.
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HTTPChannel is the channel type for one connection to an agent's HTTP
+// API. Opened by the coordinator, it reaches the agent at the other end of
+// the tunnel; opened by an agent, it asks the coordinator to connect it to
+// the agent named in its Target.
+const HTTPChannel = "vmshare-http"
+
+// KeepaliveInterval is how often each side checks the tunnel is still up.
+const KeepaliveInterval = 30 * time.Second
+
+// Target is the extra data of an HTTPChannel an agent opens.
+type Target struct {
+	AgentID uint32
+}
+
+// User is the SSH user name agentID logs in to the tunnel server as.
+func User(agentID int) string {
+	return "agent-" + strconv.Itoa(agentID)
+}
+
+// readChunk is the most a Conn reads from its channel at once.
+const readChunk = 32 << 10
+
+// Conn is an SSH channel as a net.Conn. SSH channels have no deadlines, so
+// a pump goroutine reads the channel and Read waits on it or the read
+// deadline, whichever comes first: a read deadline that passes returns a
+// timeout and leaves the connection usable, as net/http expects when it
+// hijacks one. A write deadline that passes closes the channel, since a
+// blocked channel write cannot be interrupted otherwise.
+type Conn struct {
+	ssh.Channel
+	local, remote net.Addr
+
+	startPump sync.Once
+	chunks    chan []byte // from the pump
+	readErr   error       // set once the pump has stopped
+	pumpDone  chan struct{}
+	pending   []byte // the unread rest of the last chunk
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	deadlineMoved chan struct{} // closed when the read deadline changes
+	writeTimer    *time.Timer
+}
+
+// NewConn wraps ch, reporting the SSH connection's addresses as its own.
+func NewConn(ch ssh.Channel, conn ssh.Conn) *Conn {
+	return &Conn{
+		Channel:       ch,
+		local:         conn.LocalAddr(),
+		remote:        conn.RemoteAddr(),
+		chunks:        make(chan []byte),
+		pumpDone:      make(chan struct{}),
+		closed:        make(chan struct{}),
+		deadlineMoved: make(chan struct{}),
+	}
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// pump reads the channel until it fails or the Conn is closed.
+func (c *Conn) pump() {
+	defer close(c.pumpDone)
+	for {
+		buf := make([]byte, readChunk)
+		n, err := c.Channel.Read(buf)
+		if n > 0 {
+			select {
+			case c.chunks <- buf[:n]:
+			case <-c.closed:
+				c.readErr = net.ErrClosed
+				return
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	c.startPump.Do(func() { go c.pump() })
+	for {
+		c.mu.Lock()
+		deadline, moved := c.readDeadline, c.deadlineMoved
+		c.mu.Unlock()
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case b := <-c.chunks:
+			n := copy(p, b)
+			c.pending = b[n:]
+			return n, nil
+		case <-c.pumpDone:
+			return 0, c.readErr
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-moved:
+			// the deadline changed; wait again with the new one
+		}
+	}
+}
+
+// Close closes the channel and stops the pump.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Channel.Close()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineMoved)
+	c.deadlineMoved = make(chan struct{})
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeTimer != nil {
+		c.writeTimer.Stop()
+		c.writeTimer = nil
+	}
+	if !t.IsZero() {
+		c.writeTimer = time.AfterFunc(time.Until(t), func() { c.Close() })
+	}
+	return nil
+}
+
+// Open opens an HTTPChannel on conn, with target as its extra data if set.
+func Open(conn ssh.Conn, target *Target) (*Conn, error) {
+	var extra []byte
+	if target != nil {
+		extra = ssh.Marshal(target)
+	}
+	ch, reqs, err := conn.OpenChannel(HTTPChannel, extra)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return NewConn(ch, conn), nil
+}
+
+// Listener is a net.Listener whose connections are channels accepted from
+// an SSH connection.
+type Listener struct {
+	addr  net.Addr
+	conns chan net.Conn
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+// NewListener returns a Listener reporting addr as its address. Feed it
+// with Push.
+func NewListener(addr net.Addr) *Listener {
+	return &Listener{addr: addr, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Push hands c to Accept. It closes c if the listener is closed.
+func (l *Listener) Push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr { return l.addr }
+
+// ErrNoTarget is returned for an HTTPChannel whose extra data is not a
+// Target.
+var ErrNoTarget = errors.New("tunnel: channel has no target")
+
+// ParseTarget decodes the Target of a channel an agent opened.
+func ParseTarget(nc ssh.NewChannel) (Target, error) {
+	var t Target
+	if err := ssh.Unmarshal(nc.ExtraData(), &t); err != nil {
+		return t, ErrNoTarget
+	}
+	return t, nil
+}
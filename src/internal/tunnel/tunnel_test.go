@@ -0,0 +1,248 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshPair returns the two ends of an SSH connection over loopback, with
+// the server's incoming channels.
+func sshPair(t *testing.T) (client, server ssh.Conn, serverChans <-chan ssh.NewChannel) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	// over TCP: both ends send their version first, which an unbuffered
+	// net.Pipe would deadlock on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		conn  ssh.Conn
+		chans <-chan ssh.NewChannel
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(c2, config)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		done <- result{conn, chans, err}
+	}()
+	client, clientChans, clientReqs, err := ssh.NewClientConn(c1, "pipe", &ssh.ClientConfig{
+		User:            User(1),
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(clientReqs)
+	go func() {
+		for nc := range clientChans {
+			nc.Reject(ssh.UnknownChannelType, "client")
+		}
+	}()
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	t.Cleanup(func() { client.Close(); res.conn.Close() })
+	return client, res.conn, res.chans
+}
+
+// connPair opens an HTTPChannel and returns both ends as Conns.
+func connPair(t *testing.T) (local, remote *Conn) {
+	t.Helper()
+	client, server, chans := sshPair(t)
+	accepted := make(chan *Conn, 1)
+	go func() {
+		nc := <-chans
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		accepted <- NewConn(ch, server)
+	}()
+	local, err := Open(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote = <-accepted
+	if remote == nil {
+		t.Fatal("channel not accepted")
+	}
+	return local, remote
+}
+
+func TestReadDeadline(t *testing.T) {
+	local, remote := connPair(t)
+
+	// a deadline in the past times out without closing anything
+	remote.SetReadDeadline(time.Now().Add(-time.Second))
+	buf := make([]byte, 16)
+	if _, err := remote.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline error", err)
+	}
+	var ne net.Error
+	if _, err := remote.Read(buf); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("err = %v, want a net.Error timeout", err)
+	}
+
+	// a blocked read returns when a deadline arrives
+	remote.SetReadDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := remote.Read(buf)
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	remote.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("err = %v, want a deadline error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read ignored the new deadline")
+	}
+
+	// data sent meanwhile is still there once the deadline is cleared
+	remote.SetReadDeadline(time.Time{})
+	if _, err := local.Write([]byte("still open")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("still open"))
+	if _, err := io.ReadFull(remote, got); err != nil || string(got) != "still open" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	local, remote := connPair(t)
+	local.Write([]byte("bye"))
+	local.Close()
+	got, err := io.ReadAll(remote)
+	if err != nil || string(got) != "bye" {
+		t.Errorf("read %q, %v; want the data, then EOF", got, err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after EOF: %v", err)
+	}
+}
+
+func TestWriteDeadlineCloses(t *testing.T) {
+	_, remote := connPair(t)
+	remote.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+	if _, err := remote.Write([]byte("late")); err == nil {
+		t.Error("write after the write deadline succeeded")
+	}
+}
+
+// TestUpgradeThroughTunnel serves HTTP on tunnel channels and switches a
+// connection to another protocol. net/http aborts its background read by
+// setting a read deadline in the past when a handler hijacks, which must
+// not close the channel.
+func TestUpgradeThroughTunnel(t *testing.T) {
+	client, server, chans := sshPair(t)
+	ln := NewListener(server.LocalAddr())
+	defer ln.Close()
+	go func() {
+		for nc := range chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			ln.Push(NewConn(ch, server))
+		}
+	}()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			fmt.Fprint(w, "plain")
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Time{})
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		line, err := brw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("echo: " + line))
+	}))
+
+	// an ordinary request first
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) { return Open(client, nil) },
+	}}
+	resp, err := httpClient.Get("http://" + User(1) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "plain" {
+		t.Fatalf("plain request: %q", body)
+	}
+
+	conn, err := Open(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /vms/vm/ssh HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", User(1))
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade answered %s", resp.Status)
+	}
+	fmt.Fprint(conn, "hello\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := br.ReadString('\n')
+	if err != nil || line != "echo: hello\n" {
+		t.Fatalf("after the upgrade read %q, %v", line, err)
+	}
+}
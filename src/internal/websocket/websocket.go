@@ -0,0 +1,320 @@
+// Package websocket is a minimal server-side WebSocket (RFC 6455)
+// implementation: enough to carry a console or terminal session to a
+// browser. It handles the opening handshake, masking, fragmentation and
+// control frames; it does not do extensions or subprotocols.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types, as frame opcodes.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// MaxMessageSize is the largest message ReadMessage accepts.
+const MaxMessageSize = 1 << 20
+
+// writeTimeout bounds each frame write, so a peer that stops reading
+// cannot block writers forever; a write that times out closes the
+// connection. closeTimeout is how long Close waits for the peer to answer
+// its close frame. Variables so tests can shorten them.
+var (
+	writeTimeout = 10 * time.Second
+	closeTimeout = 5 * time.Second
+)
+
+// acceptGUID is appended to the client's key to prove the server speaks
+// WebSocket (RFC 6455 section 1.3).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrMessageTooLarge is returned for messages over MaxMessageSize.
+var ErrMessageTooLarge = errors.New("websocket: message too large")
+
+// Conn is a server-side WebSocket connection. One goroutine may read while
+// others write.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	rmu  sync.Mutex // held while reading frames
+
+	wmu     sync.Mutex
+	closing bool // our close frame has been sent; no more frames may follow
+	closed  bool
+
+	peerClosed chan struct{} // closed once the peer's close frame is read
+	closeOnce  sync.Once
+}
+
+func newConn(conn net.Conn, br *bufio.Reader) *Conn {
+	return &Conn{conn: conn, br: br, peerClosed: make(chan struct{})}
+}
+
+// IsUpgrade reports whether r asks to switch to the WebSocket protocol.
+func IsUpgrade(r *http.Request) bool {
+	return headerHas(r.Header, "Connection", "upgrade") && headerHas(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade completes the opening handshake for r and takes over its
+// connection. On failure it has already written an error response.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsUpgrade(r) {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket upgrade unsupported", http.StatusInternalServerError)
+		return nil, err
+	}
+	h := sha1.Sum([]byte(key + acceptGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h[:]))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newConn(conn, brw.Reader), nil
+}
+
+// headerHas reports whether the comma-separated header name lists token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// as they arrive. A close from the peer is answered and reported as io.EOF.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var msgType int
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case opPing:
+			// a failed pong has closed the connection, which the next
+			// read reports; after our close frame none is due
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.peerClose(payload)
+			return 0, nil, io.EOF
+		case TextMessage, BinaryMessage:
+			if msgType != 0 {
+				return 0, nil, errors.New("websocket: new message inside a fragmented one")
+			}
+			msgType = op
+		case opContinuation:
+			if msgType == 0 {
+				return 0, nil, errors.New("websocket: continuation without a message")
+			}
+		default:
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+		if len(msg)+len(payload) > MaxMessageSize {
+			return 0, nil, ErrMessageTooLarge
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msgType, msg, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload. Clients must mask
+// every frame they send.
+func (c *Conn) readFrame() (fin bool, op int, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = int(hdr[0] & 0x0f)
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("websocket: reserved bits set")
+	}
+	if hdr[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("websocket: unmasked client frame")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= opClose && (n > 125 || !fin) {
+		return false, 0, nil, errors.New("websocket: invalid control frame")
+	}
+	if n > MaxMessageSize {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// WriteMessage sends data as one unfragmented message of msgType.
+func (c *Conn) WriteMessage(msgType int, data []byte) error {
+	return c.writeFrame(msgType, data)
+}
+
+func (c *Conn) writeFrame(op int, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed || c.closing {
+		return net.ErrClosed
+	}
+	if op == opClose {
+		c.closing = true
+	}
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | byte(op)
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		// a partial frame leaves the stream unusable
+		c.closed = true
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// peerClose handles the peer's close frame: it is echoed, with its status
+// code, unless it answers ours, and the connection is closed.
+func (c *Conn) peerClose(payload []byte) {
+	if len(payload) > 2 {
+		payload = payload[:2]
+	}
+	c.writeFrame(opClose, payload)
+	c.shutdown()
+	close(c.peerClosed)
+}
+
+// shutdown closes the underlying connection.
+func (c *Conn) shutdown() {
+	c.wmu.Lock()
+	c.closed = true
+	c.wmu.Unlock()
+	c.conn.Close()
+}
+
+// Close runs the closing handshake: it sends a normal-closure frame, waits
+// up to closeTimeout for the peer's close frame, and closes the connection.
+// Close may be called more than once and while another goroutine is
+// reading, which then still receives messages the peer sent before its
+// answer; otherwise they are discarded.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		if err := c.writeFrame(opClose, []byte{0x03, 0xe8}); err != nil { // 1000
+			c.shutdown()
+			return
+		}
+		if c.rmu.TryLock() {
+			// nobody is reading; look for the peer's answer ourselves
+			c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+			for {
+				_, op, _, err := c.readFrame()
+				if err != nil || op == opClose {
+					break
+				}
+			}
+			c.rmu.Unlock()
+		} else {
+			// the reader sees the peer's answer
+			select {
+			case <-c.peerClosed:
+			case <-time.After(closeTimeout):
+			}
+		}
+		c.shutdown()
+	})
+	return nil
+}
+
+// Writer returns an io.Writer that sends each Write as one message of
+// msgType, for copying a stream into the connection.
+func (c *Conn) Writer(msgType int) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		if err := c.WriteMessage(msgType, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
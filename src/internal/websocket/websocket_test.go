@@ -0,0 +1,424 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a frame as a client sends it, masked unless unmasked
+// is set.
+func clientFrame(fin bool, op int, payload []byte, unmasked bool) []byte {
+	b := []byte{byte(op), 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b[1] = byte(n)
+	case n <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if unmasked {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+type frame struct {
+	fin     bool
+	op      int
+	payload []byte
+}
+
+// readServerFrame reads one frame the server sent; they are never masked.
+func readServerFrame(r io.Reader) (frame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	if hdr[1]&0x80 != 0 {
+		return frame{}, errors.New("server frame is masked")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	f := frame{fin: hdr[0]&0x80 != 0, op: int(hdr[0] & 0x0f), payload: make([]byte, n)}
+	_, err := io.ReadFull(r, f.payload)
+	return f, err
+}
+
+// pipe returns a server Conn and the client end of its connection.
+func pipe(t *testing.T) (*Conn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+	return newConn(server, bufio.NewReader(server)), client
+}
+
+// serverFrames collects what the server sends to client until it closes.
+func serverFrames(client net.Conn) <-chan frame {
+	ch := make(chan frame, 16)
+	go func() {
+		defer close(ch)
+		for {
+			f, err := readServerFrame(client)
+			if err != nil {
+				return
+			}
+			ch <- f
+		}
+	}()
+	return ch
+}
+
+func shortTimeouts(t *testing.T) {
+	oldWrite, oldClose := writeTimeout, closeTimeout
+	writeTimeout, closeTimeout = 100*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() { writeTimeout, closeTimeout = oldWrite, oldClose })
+}
+
+func TestUpgrade(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		ws, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		typ, msg, err := ws.ReadMessage()
+		if err == nil {
+			ws.WriteMessage(typ, msg)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the sample handshake from RFC 6455 section 1.3
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake answered %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	c.Write(clientFrame(true, TextMessage, []byte("hi"), false))
+	if f, err := readServerFrame(br); err != nil || f.op != TextMessage || string(f.payload) != "hi" {
+		t.Errorf("echo = %+v, %v", f, err)
+	}
+	if f, err := readServerFrame(br); err != nil || f.op != opClose {
+		t.Errorf("after the echo: %+v, %v; want a close", f, err)
+	}
+	c.Write(clientFrame(true, opClose, []byte{0x03, 0xe8}, false))
+	<-done
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"not an upgrade", map[string]string{}, http.StatusUpgradeRequired},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "k"}, http.StatusBadRequest},
+		{"no key", map[string]string{"Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(tt.header) > 0 {
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+		}
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		if _, err := Upgrade(rec, r); err == nil || rec.Code != tt.want {
+			t.Errorf("%s: code %d, err %v; want %d", tt.name, rec.Code, err, tt.want)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	big := bytes.Repeat([]byte{'b'}, 70000)
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		wantType int
+		wantMsg  []byte
+		wantErr  bool
+		wantPong bool
+	}{
+		{
+			name:     "short text",
+			frames:   [][]byte{clientFrame(true, TextMessage, []byte("hello"), false)},
+			wantType: TextMessage, wantMsg: []byte("hello"),
+		},
+		{
+			name:     "16-bit length",
+			frames:   [][]byte{clientFrame(true, BinaryMessage, big[:300], false)},
+			wantType: BinaryMessage, wantMsg: big[:300],
+		},
+		{
+			name:     "64-bit length",
+			frames:   [][]byte{clientFrame(true, BinaryMessage, big, false)},
+			wantType: BinaryMessage, wantMsg: big,
+		},
+		{
+			name: "fragmented, with a ping between fragments",
+			frames: [][]byte{
+				clientFrame(false, TextMessage, []byte("hel"), false),
+				clientFrame(true, opPing, []byte("p"), false),
+				clientFrame(false, opContinuation, []byte("l"), false),
+				clientFrame(true, opContinuation, []byte("o"), false),
+			},
+			wantType: TextMessage, wantMsg: []byte("hello"), wantPong: true,
+		},
+		{
+			name:    "unmasked",
+			frames:  [][]byte{clientFrame(true, TextMessage, []byte("x"), true)},
+			wantErr: true,
+		},
+		{
+			name:    "reserved bits",
+			frames:  [][]byte{func() []byte { f := clientFrame(true, TextMessage, []byte("x"), false); f[0] |= 0x40; return f }()},
+			wantErr: true,
+		},
+		{
+			name:    "continuation without a message",
+			frames:  [][]byte{clientFrame(true, opContinuation, []byte("x"), false)},
+			wantErr: true,
+		},
+		{
+			name: "new message inside a fragmented one",
+			frames: [][]byte{
+				clientFrame(false, TextMessage, []byte("a"), false),
+				clientFrame(true, TextMessage, []byte("b"), false),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "fragmented control frame",
+			frames:  [][]byte{clientFrame(false, opPing, []byte("p"), false)},
+			wantErr: true,
+		},
+		{
+			name:    "oversized control frame",
+			frames:  [][]byte{clientFrame(true, opPing, big[:126], false)},
+			wantErr: true,
+		},
+		{
+			name:    "unknown opcode",
+			frames:  [][]byte{clientFrame(true, 3, nil, false)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, client := pipe(t)
+			sent := serverFrames(client)
+			go func() {
+				for _, f := range tt.frames {
+					if _, err := client.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+			typ, msg, err := ws.ReadMessage()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("read %d %q, want an error", typ, msg)
+				}
+				return
+			}
+			if err != nil || typ != tt.wantType || !bytes.Equal(msg, tt.wantMsg) {
+				t.Fatalf("read %d, %d bytes, %v; want %d, %d bytes", typ, len(msg), err, tt.wantType, len(tt.wantMsg))
+			}
+			if tt.wantPong {
+				if f := <-sent; f.op != opPong || string(f.payload) != "p" {
+					t.Errorf("ping answered with %+v", f)
+				}
+			}
+		})
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	ws, client := pipe(t)
+	// just the header: the size is rejected before the payload is read
+	hdr := []byte{0x82, 0x80 | 127}
+	hdr = binary.BigEndian.AppendUint64(hdr, MaxMessageSize+1)
+	go client.Write(hdr)
+	if _, _, err := ws.ReadMessage(); err != ErrMessageTooLarge {
+		t.Errorf("err = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		ws, client := pipe(t)
+		sent := serverFrames(client)
+		payload := bytes.Repeat([]byte{'w'}, size)
+		if err := ws.WriteMessage(BinaryMessage, payload); err != nil {
+			t.Fatal(err)
+		}
+		if f := <-sent; !f.fin || f.op != BinaryMessage || !bytes.Equal(f.payload, payload) {
+			t.Errorf("%d bytes: sent fin %v, op %d, %d bytes", size, f.fin, f.op, len(f.payload))
+		}
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	shortTimeouts(t)
+	ws, _ := pipe(t) // the client never reads
+
+	start := time.Now()
+	err := ws.WriteMessage(TextMessage, []byte("stuck"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("write took %v", elapsed)
+	}
+	if err := ws.WriteMessage(TextMessage, []byte("again")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after a timeout: %v, want net.ErrClosed", err)
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	ws, client := pipe(t)
+	sent := serverFrames(client)
+	go client.Write(clientFrame(true, opClose, []byte{0x03, 0xe9, 'b', 'y', 'e'}, false)) // 1001
+	if _, _, err := ws.ReadMessage(); err != io.EOF {
+		t.Fatalf("err = %v, want io.EOF", err)
+	}
+	if f := <-sent; f.op != opClose || !bytes.Equal(f.payload, []byte{0x03, 0xe9}) {
+		t.Errorf("close echoed as %+v, want op 8 with code 1001", f)
+	}
+	if _, ok := <-sent; ok {
+		t.Error("connection still open after the close handshake")
+	}
+	if err := ws.WriteMessage(TextMessage, []byte("late")); err == nil {
+		t.Error("wrote after the close handshake")
+	}
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name      string
+		reading   bool // another goroutine is in ReadMessage
+		answer    bool // the client answers the close frame
+		minWait   time.Duration
+		wantFrame int
+	}{
+		{"answered, nobody reading", false, true, 0, opClose},
+		{"answered, while reading", true, true, 0, opClose},
+		{"unanswered", false, false, 200 * time.Millisecond, opClose},
+		{"unanswered, while reading", true, false, 200 * time.Millisecond, opClose},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shortTimeouts(t)
+			ws, client := pipe(t)
+			readDone := make(chan error, 1)
+			if tt.reading {
+				go func() {
+					for {
+						if _, _, err := ws.ReadMessage(); err != nil {
+							readDone <- err
+							return
+						}
+					}
+				}()
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			start := time.Now()
+			closed := make(chan struct{})
+			go func() {
+				ws.Close()
+				close(closed)
+			}()
+			f, err := readServerFrame(client)
+			if err != nil || f.op != opClose || !bytes.Equal(f.payload, []byte{0x03, 0xe8}) {
+				t.Fatalf("server sent %+v, %v; want a 1000 close", f, err)
+			}
+			if err := ws.WriteMessage(TextMessage, []byte("after close")); err == nil {
+				t.Error("data frame sent after the close frame")
+			}
+			select {
+			case <-closed:
+				if tt.answer {
+					t.Fatal("Close returned before the peer answered")
+				}
+			case <-time.After(50 * time.Millisecond):
+			}
+			if tt.answer {
+				// data still in flight is discarded, then the answer ends it
+				client.Write(clientFrame(true, TextMessage, []byte("in flight"), false))
+				client.Write(clientFrame(true, opClose, []byte{0x03, 0xe8}, false))
+			}
+			select {
+			case <-closed:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Close did not return")
+			}
+			if elapsed := time.Since(start); elapsed < tt.minWait {
+				t.Errorf("Close returned after %v, want at least %v", elapsed, tt.minWait)
+			}
+			if tt.reading {
+				if err := <-readDone; tt.answer && err != io.EOF {
+					t.Errorf("reader ended with %v, want io.EOF from the answer", err)
+				}
+			}
+			if _, err := readServerFrame(client); err == nil {
+				t.Error("server sent more after its close frame")
+			}
+			ws.Close() // a second Close is a no-op
+		})
+	}
+}
+
+func TestHeaderHas(t *testing.T) {
+	h := http.Header{}
+	h.Add("Connection", "keep-alive, Upgrade")
+	if !headerHas(h, "Connection", "upgrade") || headerHas(h, "Connection", "close") {
+		t.Error("headerHas misread a token list")
+	}
+	if headerHas(h, "Upgrade", "websocket") {
+		t.Error("headerHas found a missing header")
+	}
+}
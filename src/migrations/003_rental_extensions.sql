@@ -0,0 +1,16 @@
+-- hosts may cap how long rentals on their machine can live (0 = no cap)
+ALTER TABLE agents ADD COLUMN max_lifetime_minutes INTEGER NOT NULL DEFAULT 0;
+
+-- every accepted extension; the owning agent applies it to its kill timer
+-- and stamps applied_at
+CREATE TABLE IF NOT EXISTS rental_extensions (
+  id                    INTEGER PRIMARY KEY AUTOINCREMENT,
+  vm_name               TEXT     NOT NULL,
+  minutes               INTEGER  NOT NULL,
+  requested_expires_at  DATETIME NOT NULL,
+  expires_at            DATETIME NOT NULL,
+  created_at            DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  applied_at            DATETIME
+);
+CREATE INDEX IF NOT EXISTS idx_rental_extensions_pending
+  ON rental_extensions(vm_name, applied_at);
@@ -0,0 +1,13 @@
+-- user-facing notices emitted by the coordinator (e.g. expiry warnings)
+CREATE TABLE IF NOT EXISTS notifications (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id     INTEGER  NOT NULL,
+  vm_name     TEXT     NOT NULL,
+  kind        TEXT     NOT NULL,
+  message     TEXT     NOT NULL,
+  expires_at  DATETIME,
+  created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_user
+  ON notifications(user_id, id);
@@ -0,0 +1,14 @@
+-- explicit lifecycle so rentals outlive their VM as history:
+--   pending -> running -> stopping -> stopped
+--   pending -> expired            (never started)
+ALTER TABLE rentals ADD COLUMN state TEXT NOT NULL DEFAULT 'pending';
+-- why the VM was stopped: expired, deleted, guest_shutdown
+ALTER TABLE rentals ADD COLUMN stop_reason TEXT;
+-- which stop stage ended the VM: acpi, sigterm, sigkill
+ALTER TABLE rentals ADD COLUMN stop_stage TEXT;
+ALTER TABLE rentals ADD COLUMN stopped_at DATETIME;
+
+UPDATE rentals SET state = 'running' WHERE ip_address IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_rentals_state
+  ON rentals(state);
@@ -0,0 +1,3 @@
+-- which base image and size a rental asked for
+ALTER TABLE rentals ADD COLUMN image TEXT NOT NULL DEFAULT 'ubuntu-24.04-server-arm64';
+ALTER TABLE rentals ADD COLUMN flavor TEXT NOT NULL DEFAULT 'medium';
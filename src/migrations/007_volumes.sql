@@ -0,0 +1,23 @@
+-- standalone data disks that live on one agent and outlive rentals
+--   creating -> available <-> attached
+--   available -> deleting -> deleted
+CREATE TABLE IF NOT EXISTS volumes (
+  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+  name         TEXT     NOT NULL,
+  user_id      INTEGER  NOT NULL,
+  agent_id     INTEGER  NOT NULL,
+  size_gb      INTEGER  NOT NULL,
+  state        TEXT     NOT NULL DEFAULT 'creating',
+  attached_to  TEXT,                 -- rentals.vm_name while attached
+  error        TEXT,
+  created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY(user_id) REFERENCES users(id),
+  FOREIGN KEY(agent_id) REFERENCES agents(id)
+);
+CREATE INDEX IF NOT EXISTS idx_volumes_agent_state
+  ON volumes(agent_id, state);
+CREATE INDEX IF NOT EXISTS idx_volumes_attached_to
+  ON volumes(attached_to);
+
+-- how much volume storage each host offers (0 = none)
+ALTER TABLE agents ADD COLUMN volume_quota_gb INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,25 @@
+-- point-in-time copies of a rental's disk, stored on the agent that ran it
+--   pending -> creating -> available | error
+CREATE TABLE IF NOT EXISTS snapshots (
+  id            INTEGER PRIMARY KEY AUTOINCREMENT,
+  name          TEXT     NOT NULL,
+  user_id       INTEGER  NOT NULL,
+  agent_id      INTEGER  NOT NULL,
+  vm_name       TEXT     NOT NULL,   -- rental it was taken from
+  image         TEXT     NOT NULL,   -- base image the disk is layered on
+  flavor        TEXT     NOT NULL,
+  state         TEXT     NOT NULL DEFAULT 'pending',
+  size_bytes    INTEGER,
+  error         TEXT,
+  created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  completed_at  DATETIME,
+  FOREIGN KEY(user_id) REFERENCES users(id),
+  FOREIGN KEY(agent_id) REFERENCES agents(id)
+);
+CREATE INDEX IF NOT EXISTS idx_snapshots_agent_state
+  ON snapshots(agent_id, state);
+CREATE INDEX IF NOT EXISTS idx_snapshots_user
+  ON snapshots(user_id);
+
+-- snapshot a rental was restored from, if any
+ALTER TABLE rentals ADD COLUMN from_snapshot INTEGER REFERENCES snapshots(id);
@@ -0,0 +1,5 @@
+-- suspend-to-disk: running -> suspending -> suspended -> resuming -> running
+-- suspended_at is set while a suspension is in effect; with pause_clock the
+-- time spent suspended is added back to expires_at on resume
+ALTER TABLE rentals ADD COLUMN suspended_at DATETIME;
+ALTER TABLE rentals ADD COLUMN pause_clock INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,21 @@
+-- where each agent serves the agent-to-agent protocol (host:port)
+ALTER TABLE agents ADD COLUMN address TEXT;
+
+-- moves of a rental's VM from one agent to another
+--   pending -> sending -> completed | failed
+-- the source agent authenticates to the destination with token
+CREATE TABLE IF NOT EXISTS migrations (
+  id              INTEGER PRIMARY KEY AUTOINCREMENT,
+  vm_name         TEXT     NOT NULL,
+  source_agent_id INTEGER  NOT NULL,
+  dest_agent_id   INTEGER  NOT NULL,
+  state           TEXT     NOT NULL DEFAULT 'pending',
+  token           TEXT     NOT NULL,
+  error           TEXT,
+  created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  completed_at    DATETIME,
+  FOREIGN KEY(source_agent_id) REFERENCES agents(id),
+  FOREIGN KEY(dest_agent_id) REFERENCES agents(id)
+);
+CREATE INDEX IF NOT EXISTS idx_migrations_vm
+  ON migrations(vm_name);
@@ -0,0 +1,27 @@
+-- private L2 segments between a user's VMs on one agent; each network is a
+-- QEMU socket netdev on its own loopback multicast port
+CREATE TABLE IF NOT EXISTS networks (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  name        TEXT     NOT NULL,
+  user_id     INTEGER  NOT NULL,
+  agent_id    INTEGER  NOT NULL,
+  cidr        TEXT     NOT NULL,   -- IPv4 subnet the agent assigns from
+  state       TEXT     NOT NULL DEFAULT 'active',   -- active | deleted
+  created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY(user_id) REFERENCES users(id),
+  FOREIGN KEY(agent_id) REFERENCES agents(id)
+);
+CREATE INDEX IF NOT EXISTS idx_networks_user
+  ON networks(user_id);
+
+-- a rental's NIC on a network; ip is assigned by the agent at boot
+CREATE TABLE IF NOT EXISTS network_attachments (
+  network_id  INTEGER  NOT NULL,
+  vm_name     TEXT     NOT NULL,
+  ip_address  TEXT,
+  created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY(network_id, vm_name),
+  FOREIGN KEY(network_id) REFERENCES networks(id)
+);
+CREATE INDEX IF NOT EXISTS idx_network_attachments_vm
+  ON network_attachments(vm_name);
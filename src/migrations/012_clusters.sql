@@ -0,0 +1,26 @@
+-- the local address an agent's private networks send multicast from;
+-- loopback keeps them on the host, a LAN address lets a network span agents
+ALTER TABLE agents ADD COLUMN network_addr TEXT;
+
+-- groups of rentals launched, extended and deleted as one unit, sharing a
+-- private network
+CREATE TABLE IF NOT EXISTS clusters (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  name        TEXT     NOT NULL,
+  user_id     INTEGER  NOT NULL,
+  network_id  INTEGER  NOT NULL,
+  size        INTEGER  NOT NULL,
+  image       TEXT     NOT NULL,
+  flavor      TEXT     NOT NULL,
+  state       TEXT     NOT NULL DEFAULT 'active',   -- active | deleted
+  expires_at  DATETIME NOT NULL,
+  created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY(user_id) REFERENCES users(id),
+  FOREIGN KEY(network_id) REFERENCES networks(id)
+);
+CREATE INDEX IF NOT EXISTS idx_clusters_user
+  ON clusters(user_id);
+
+-- membership and the guest hostname each member boots with
+ALTER TABLE rentals ADD COLUMN cluster_id INTEGER REFERENCES clusters(id);
+ALTER TABLE rentals ADD COLUMN hostname TEXT;
@@ -0,0 +1,17 @@
+-- extra guest ports a renter exposes on the agent's host, applied live
+--   pending -> active -> removing -> removed
+--   pending -> error
+CREATE TABLE IF NOT EXISTS port_forwards (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  vm_name     TEXT     NOT NULL,
+  protocol    TEXT     NOT NULL,   -- tcp | udp
+  guest_port  INTEGER  NOT NULL,
+  host_port   INTEGER,             -- picked by the agent
+  state       TEXT     NOT NULL DEFAULT 'pending',
+  error       TEXT,
+  created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_port_forwards_vm
+  ON port_forwards(vm_name);
+CREATE INDEX IF NOT EXISTS idx_port_forwards_state
+  ON port_forwards(state);
@@ -0,0 +1,8 @@
+-- what renter VMs may reach on the network (see system.Egress*)
+--   agents.egress_policy: the host's floor, reported by the agent
+--   rentals.egress_policy / egress_allow: what the renter asked for
+--   rentals.egress_effective: the stricter of the two, set at boot
+ALTER TABLE agents ADD COLUMN egress_policy TEXT NOT NULL DEFAULT 'open';
+ALTER TABLE rentals ADD COLUMN egress_policy TEXT;
+ALTER TABLE rentals ADD COLUMN egress_allow TEXT;      -- comma-separated hosts/subnets
+ALTER TABLE rentals ADD COLUMN egress_effective TEXT;
@@ -0,0 +1,10 @@
+-- per-rental network transfer on the VM's internet-facing NIC, sampled by
+-- the agent from the guest's counters
+--   net_*_bytes: totals for the rental's lifetime
+--   net_*_seen:  the guest counters at the last sample (they reset on reboot)
+--   net_limited: why the agent has the link down: rate | quota
+ALTER TABLE rentals ADD COLUMN net_rx_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rentals ADD COLUMN net_tx_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rentals ADD COLUMN net_rx_seen INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rentals ADD COLUMN net_tx_seen INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rentals ADD COLUMN net_limited TEXT;
@@ -0,0 +1,21 @@
+-- per-VM resource samples written by the agent every few seconds
+--   cpu_seconds, disk_*: counters of the QEMU process; they restart at zero
+--                        with it (resume, migration)
+--   net_*_bytes:         the rental's running totals (see 015)
+CREATE TABLE IF NOT EXISTS vm_metrics (
+  id             INTEGER PRIMARY KEY AUTOINCREMENT,
+  vm_name        TEXT     NOT NULL,
+  at             DATETIME NOT NULL,
+  cpu_seconds    REAL     NOT NULL,
+  rss_bytes      INTEGER  NOT NULL,
+  disk_rd_bytes  INTEGER  NOT NULL,
+  disk_wr_bytes  INTEGER  NOT NULL,
+  disk_rd_ops    INTEGER  NOT NULL,
+  disk_wr_ops    INTEGER  NOT NULL,
+  net_rx_bytes   INTEGER  NOT NULL,
+  net_tx_bytes   INTEGER  NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_vm_metrics_vm_at
+  ON vm_metrics(vm_name, at);
+CREATE INDEX IF NOT EXISTS idx_vm_metrics_at
+  ON vm_metrics(at);
@@ -0,0 +1,3 @@
+-- when the agent first reported the rental running; with created_at it
+-- gives the provisioning latency
+ALTER TABLE rentals ADD COLUMN started_at DATETIME;
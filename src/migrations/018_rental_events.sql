@@ -0,0 +1,13 @@
+-- timeline of everything that happened to a rental, written by the
+-- coordinator (requests) and the agent running it (boot, stop, errors)
+CREATE TABLE IF NOT EXISTS rental_events (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  vm_name     TEXT     NOT NULL,
+  kind        TEXT     NOT NULL,
+  message     TEXT     NOT NULL,
+  detail      TEXT,               -- e.g. the tail of QEMU's stderr
+  agent_id    INTEGER,            -- the rental's agent at the time, if any
+  created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_rental_events_vm
+  ON rental_events(vm_name, id);
@@ -0,0 +1,3 @@
+-- bearer token the coordinator presents to an agent's HTTP API, e.g. to
+-- proxy a VM's console; agents pick a new one each time they start
+ALTER TABLE agents ADD COLUMN token TEXT;
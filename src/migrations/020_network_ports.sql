@@ -0,0 +1,4 @@
+-- the multicast port a network's segment uses, unique among active
+-- networks; existing networks keep the port derived from their id
+ALTER TABLE networks ADD COLUMN mcast_port INTEGER;
+UPDATE networks SET mcast_port = 40000 + id % 20000;
@@ -0,0 +1,3 @@
+-- the provisioning histogram reads only recently started rentals
+CREATE INDEX IF NOT EXISTS idx_rentals_started_at
+  ON rentals(started_at);
@@ -0,0 +1,3 @@
+-- public key (authorized_keys format) an agent logs in to the tunnel
+-- server with; agents generate a new one each time they start
+ALTER TABLE agents ADD COLUMN tunnel_key TEXT;